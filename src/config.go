@@ -0,0 +1,161 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Keys of the configuration file that stand in for the positional arguments
+const configTargetSocketKey string = "target-socket"
+const configExposedAddressKey string = "exposed-address"
+const configAccessRulesKey string = "access-rules"
+
+// positionalArguments : The socket addresses and access rules list that the
+// veil is launched with
+type positionalArguments struct {
+	targetSocketPath    string
+	exposedAddress      string
+	accessRulesFilepath string
+}
+
+// Environment variables that supply options not passed on the command line
+const targetSocketEnvVar string = "VEIL_TARGET_SOCKET"
+const exposedSocketEnvVar string = "VEIL_EXPOSED_SOCKET"
+const rulesFileEnvVar string = "VEIL_RULES_FILE"
+const timeoutEnvVar string = "VEIL_TIMEOUT"
+
+// explicitlySetFlags : Returns the names of the flags set on the command line
+func explicitlySetFlags(flagSet *flag.FlagSet) map[string]bool {
+	var explicitFlags map[string]bool = map[string]bool{}
+	flagSet.Visit(func(explicitFlag *flag.Flag) {
+		explicitFlags[explicitFlag.Name] = true
+	})
+
+	return explicitFlags
+}
+
+// applyConfigFile : Reads a JSON configuration file whose keys are the names of
+// command-line flags, or one of the keys standing in for the positional
+// arguments, and applies its values to the flag set. Flags set explicitly on
+// the command line take precedence over the file and are left untouched.
+func applyConfigFile(flagSet *flag.FlagSet, explicitFlags map[string]bool, configPath string) (positionalArguments, error) {
+	var arguments positionalArguments
+
+	configContents, errRead := os.ReadFile(configPath)
+	if errRead != nil {
+		return arguments, errRead
+	}
+
+	var configValues map[string]interface{}
+	if err := json.Unmarshal(configContents, &configValues); err != nil {
+		return arguments, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	for configKey, configValue := range configValues {
+		value, errValue := configValueString(configValue)
+		if errValue != nil {
+			return arguments, fmt.Errorf("invalid value for %q: %v", configKey, errValue)
+		}
+
+		switch configKey {
+		case configTargetSocketKey:
+			arguments.targetSocketPath = value
+			continue
+		case configExposedAddressKey:
+			arguments.exposedAddress = value
+			continue
+		case configAccessRulesKey:
+			arguments.accessRulesFilepath = value
+			continue
+		}
+
+		if flagSet.Lookup(configKey) == nil || configKey == "config" {
+			return arguments, fmt.Errorf("unknown option %q", configKey)
+		}
+
+		if explicitFlags[configKey] {
+			continue
+		}
+
+		if err := flagSet.Set(configKey, value); err != nil {
+			return arguments, fmt.Errorf("invalid value for %q: %v", configKey, err)
+		}
+	}
+
+	return arguments, nil
+}
+
+// configValueString : Converts a value decoded from the configuration file to
+// the textual form that its flag accepts. Lists are joined with commas.
+func configValueString(configValue interface{}) (string, error) {
+	switch typedValue := configValue.(type) {
+	case string:
+		return typedValue, nil
+	case bool:
+		return strconv.FormatBool(typedValue), nil
+	case float64:
+		return strconv.FormatFloat(typedValue, 'f', -1, 64), nil
+	case []interface{}:
+		var elements []string = []string{}
+		for _, element := range typedValue {
+			elementString, isString := element.(string)
+			if !isString {
+				return "", errors.New("lists may only contain strings")
+			}
+
+			elements = append(elements, elementString)
+		}
+
+		return strings.Join(elements, ","), nil
+	default:
+		return "", errors.New("must be a string, number, boolean or list of strings")
+	}
+}
+
+// applyEnvironment : Fills in the positional arguments and timeout from the
+// environment variables that are set, taking precedence over the configuration
+// file but not over flags set on the command line
+func applyEnvironment(flagSet *flag.FlagSet, explicitFlags map[string]bool, arguments *positionalArguments) error {
+	if targetSocketPath := os.Getenv(targetSocketEnvVar); len(targetSocketPath) > 0 {
+		arguments.targetSocketPath = targetSocketPath
+	}
+
+	if exposedAddress := os.Getenv(exposedSocketEnvVar); len(exposedAddress) > 0 {
+		arguments.exposedAddress = exposedAddress
+	}
+
+	if accessRulesFilepath := os.Getenv(rulesFileEnvVar); len(accessRulesFilepath) > 0 {
+		arguments.accessRulesFilepath = accessRulesFilepath
+	}
+
+	if timeout := os.Getenv(timeoutEnvVar); len(timeout) > 0 && !explicitFlags["timeout"] {
+		if err := flagSet.Set("timeout", timeout); err != nil {
+			return fmt.Errorf("invalid %s: %v", timeoutEnvVar, err)
+		}
+	}
+
+	return nil
+}
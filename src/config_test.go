@@ -0,0 +1,281 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestFlagSet : Returns a flag set registering a representative selection
+// of the veil's flags, one of each kind of value
+func newTestFlagSet() *flag.FlagSet {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("veil", flag.ContinueOnError)
+	flagSet.SetOutput(io.Discard)
+	flagSet.String("config", "", "")
+	flagSet.Duration("timeout", 30*time.Second, "")
+	flagSet.String("log-format", "text", "")
+	flagSet.Bool("lenient", false, "")
+	flagSet.Int("max-concurrent", 0, "")
+	flagSet.Float64("rate", 0, "")
+	flagSet.String("strip-headers", "", "")
+	var allowedCIDRs repeatedFlag
+	flagSet.Var(&allowedCIDRs, "allow-cidr", "")
+
+	return flagSet
+}
+
+// writeTestConfigFile : Writes the contents of a configuration file to a
+// temporary file, returning its path
+func writeTestConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+
+	var configPath string = filepath.Join(t.TempDir(), "veil.json")
+	if err := os.WriteFile(configPath, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return configPath
+}
+
+// flagValues : Returns the textual value of every flag in the flag set
+func flagValues(flagSet *flag.FlagSet) map[string]string {
+	var values map[string]string = map[string]string{}
+	flagSet.VisitAll(func(visitedFlag *flag.Flag) {
+		values[visitedFlag.Name] = visitedFlag.Value.String()
+	})
+
+	return values
+}
+
+func TestConfigFileEquivalentToFlags(t *testing.T) {
+	testCases := []struct {
+		name           string
+		commandLine    []string
+		configContents string
+	}{
+		{
+			name:           "positional arguments",
+			commandLine:    []string{"/run/target.sock", "/run/veil.sock", "rules.txt"},
+			configContents: `{"target-socket": "/run/target.sock", "exposed-address": "/run/veil.sock", "access-rules": "rules.txt"}`,
+		},
+		{
+			name:           "string and duration",
+			commandLine:    []string{"-timeout", "5s", "-log-format", "json"},
+			configContents: `{"timeout": "5s", "log-format": "json"}`,
+		},
+		{
+			name:           "boolean",
+			commandLine:    []string{"-lenient"},
+			configContents: `{"lenient": true}`,
+		},
+		{
+			name:           "numbers",
+			commandLine:    []string{"-max-concurrent", "8", "-rate", "2.5"},
+			configContents: `{"max-concurrent": 8, "rate": 2.5}`,
+		},
+		{
+			name:           "list",
+			commandLine:    []string{"-strip-headers", "Cookie,Authorization"},
+			configContents: `{"strip-headers": ["Cookie", "Authorization"]}`,
+		},
+		{
+			name:           "repeated flag",
+			commandLine:    []string{"-allow-cidr", "10.0.0.0/8", "-allow-cidr", "192.168.0.0/16"},
+			configContents: `{"allow-cidr": ["10.0.0.0/8", "192.168.0.0/16"]}`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var commandLineFlags *flag.FlagSet = newTestFlagSet()
+			if err := commandLineFlags.Parse(testCase.commandLine); err != nil {
+				t.Fatal(err)
+			}
+
+			var configFlags *flag.FlagSet = newTestFlagSet()
+			configArguments, err := applyConfigFile(configFlags, map[string]bool{}, writeTestConfigFile(t, testCase.configContents))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var expectedValues, configValues map[string]string = flagValues(commandLineFlags), flagValues(configFlags)
+			for name, expectedValue := range expectedValues {
+				if configValues[name] != expectedValue {
+					t.Errorf("expected -%s to be %q, got %q", name, expectedValue, configValues[name])
+				}
+			}
+
+			var expectedArguments positionalArguments
+			if len(commandLineFlags.Args()) == 3 {
+				expectedArguments = positionalArguments{
+					targetSocketPath:    commandLineFlags.Arg(0),
+					exposedAddress:      commandLineFlags.Arg(1),
+					accessRulesFilepath: commandLineFlags.Arg(2),
+				}
+			}
+
+			if configArguments != expectedArguments {
+				t.Errorf("expected positional arguments %+v, got %+v", expectedArguments, configArguments)
+			}
+		})
+	}
+}
+
+func TestConfigFileExplicitFlagsTakePrecedence(t *testing.T) {
+	var flagSet *flag.FlagSet = newTestFlagSet()
+	if err := flagSet.Parse([]string{"-timeout", "1s"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var configPath string = writeTestConfigFile(t, `{"timeout": "5s", "log-format": "json"}`)
+	if _, err := applyConfigFile(flagSet, explicitlySetFlags(flagSet), configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if timeout := flagSet.Lookup("timeout").Value.String(); timeout != "1s" {
+		t.Errorf("expected the explicit -timeout to be kept, got %s", timeout)
+	}
+
+	if logFormat := flagSet.Lookup("log-format").Value.String(); logFormat != "json" {
+		t.Errorf("expected -log-format to be set from the file, got %s", logFormat)
+	}
+}
+
+func TestConfigFileRejected(t *testing.T) {
+	testCases := []struct {
+		name           string
+		configContents string
+		expectedError  string
+	}{
+		{name: "invalid JSON", configContents: `{"timeout": `, expectedError: "invalid JSON"},
+		{name: "not an object", configContents: `["timeout"]`, expectedError: "invalid JSON"},
+		{name: "unknown option", configContents: `{"no-such-flag": true}`, expectedError: `unknown option "no-such-flag"`},
+		{name: "nested configuration file", configContents: `{"config": "other.json"}`, expectedError: `unknown option "config"`},
+		{name: "invalid flag value", configContents: `{"timeout": "soon"}`, expectedError: `invalid value for "timeout"`},
+		{name: "unsupported value type", configContents: `{"timeout": {"seconds": 5}}`, expectedError: `invalid value for "timeout"`},
+		{name: "list of non-strings", configContents: `{"strip-headers": [1, 2]}`, expectedError: "lists may only contain strings"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := applyConfigFile(newTestFlagSet(), map[string]bool{}, writeTestConfigFile(t, testCase.configContents))
+			if err == nil || !strings.Contains(err.Error(), testCase.expectedError) {
+				t.Errorf("expected an error containing %q, got %v", testCase.expectedError, err)
+			}
+		})
+	}
+
+	if _, err := applyConfigFile(newTestFlagSet(), map[string]bool{}, filepath.Join(t.TempDir(), "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("expected a missing configuration file to be reported, got %v", err)
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	testCases := []struct {
+		name              string
+		commandLine       []string
+		configContents    string
+		environment       map[string]string
+		expectedArguments positionalArguments
+		expectedTimeout   string
+	}{
+		{
+			name:              "unset",
+			expectedArguments: positionalArguments{},
+			expectedTimeout:   "30s",
+		},
+		{
+			name: "positional arguments and timeout",
+			environment: map[string]string{
+				targetSocketEnvVar:  "/run/target.sock",
+				exposedSocketEnvVar: "/run/veil.sock",
+				rulesFileEnvVar:     "rules.txt",
+				timeoutEnvVar:       "5s",
+			},
+			expectedArguments: positionalArguments{"/run/target.sock", "/run/veil.sock", "rules.txt"},
+			expectedTimeout:   "5s",
+		},
+		{
+			name:              "explicit timeout flag takes precedence",
+			commandLine:       []string{"-timeout", "1s"},
+			environment:       map[string]string{timeoutEnvVar: "5s"},
+			expectedArguments: positionalArguments{},
+			expectedTimeout:   "1s",
+		},
+		{
+			name:           "takes precedence over the configuration file",
+			configContents: `{"target-socket": "/run/file.sock", "access-rules": "file-rules.txt", "timeout": "10s"}`,
+			environment: map[string]string{
+				targetSocketEnvVar: "/run/target.sock",
+				timeoutEnvVar:      "5s",
+			},
+			expectedArguments: positionalArguments{targetSocketPath: "/run/target.sock", accessRulesFilepath: "file-rules.txt"},
+			expectedTimeout:   "5s",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for _, environmentVariable := range []string{targetSocketEnvVar, exposedSocketEnvVar, rulesFileEnvVar, timeoutEnvVar} {
+				t.Setenv(environmentVariable, testCase.environment[environmentVariable])
+			}
+
+			var flagSet *flag.FlagSet = newTestFlagSet()
+			if err := flagSet.Parse(testCase.commandLine); err != nil {
+				t.Fatal(err)
+			}
+
+			var explicitFlags map[string]bool = explicitlySetFlags(flagSet)
+			var arguments positionalArguments
+			if len(testCase.configContents) > 0 {
+				var err error
+				if arguments, err = applyConfigFile(flagSet, explicitFlags, writeTestConfigFile(t, testCase.configContents)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := applyEnvironment(flagSet, explicitFlags, &arguments); err != nil {
+				t.Fatal(err)
+			}
+
+			if arguments != testCase.expectedArguments {
+				t.Errorf("expected positional arguments %+v, got %+v", testCase.expectedArguments, arguments)
+			}
+
+			if timeout := flagSet.Lookup("timeout").Value.String(); timeout != testCase.expectedTimeout {
+				t.Errorf("expected -timeout to be %s, got %s", testCase.expectedTimeout, timeout)
+			}
+		})
+	}
+}
+
+func TestEnvironmentInvalidTimeout(t *testing.T) {
+	t.Setenv(timeoutEnvVar, "soon")
+
+	var arguments positionalArguments
+	if err := applyEnvironment(newTestFlagSet(), map[string]bool{}, &arguments); err == nil || !strings.Contains(err.Error(), timeoutEnvVar) {
+		t.Errorf("expected an invalid %s to be reported, got %v", timeoutEnvVar, err)
+	}
+}
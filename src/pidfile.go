@@ -0,0 +1,119 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// pidFileMode : Permissions of the PID file, which any user may read
+const pidFileMode os.FileMode = 0644
+
+// isProcessRunning : Reports whether a process with the PID exists
+func isProcessRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	// A process owned by another user exists even though it cannot be
+	// signalled
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, os.ErrPermission)
+}
+
+// writePIDFile : Writes the PID of the veil to the file, replacing it
+// atomically so that it is never seen partially written. A file left behind by
+// a veil that is still running is not replaced, to prevent two veils from
+// being started in its place.
+func writePIDFile(pidFilePath string) error {
+	if existingContents, err := os.ReadFile(pidFilePath); err == nil {
+		existingPID, errPID := strconv.Atoi(strings.TrimSpace(string(existingContents)))
+		if errPID == nil && existingPID > 0 && existingPID != os.Getpid() && isProcessRunning(existingPID) {
+			return fmt.Errorf("already running with PID %d", existingPID)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	temporaryFile, err := os.CreateTemp(filepath.Dir(pidFilePath), "."+filepath.Base(pidFilePath)+".")
+	if err != nil {
+		return err
+	}
+
+	var temporaryPath string = temporaryFile.Name()
+	_, errWrite := fmt.Fprintln(temporaryFile, os.Getpid())
+	errClose := temporaryFile.Close()
+	if errWrite == nil {
+		errWrite = errClose
+	}
+
+	if errWrite == nil {
+		errWrite = os.Chmod(temporaryPath, pidFileMode)
+	}
+
+	if errWrite == nil {
+		errWrite = os.Rename(temporaryPath, pidFilePath)
+	}
+
+	if errWrite != nil {
+		os.Remove(temporaryPath)
+		return errWrite
+	}
+
+	return nil
+}
+
+// cleanUpPIDFile : Removes the PID file if one was requested, logging any
+// failure to do so
+func cleanUpPIDFile(pidFilePath string) {
+	if len(pidFilePath) == 0 {
+		return
+	}
+
+	if err := removePIDFile(pidFilePath); err != nil {
+		log.Println("Unable to remove PID file", pidFilePath+":", err)
+	}
+}
+
+// removePIDFile : Removes the PID file, provided that it still holds the PID
+// of the veil rather than that of a veil started since
+func removePIDFile(pidFilePath string) error {
+	pidFileContents, err := os.ReadFile(pidFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if strings.TrimSpace(string(pidFileContents)) != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+
+	return os.Remove(pidFilePath)
+}
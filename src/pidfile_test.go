@@ -0,0 +1,158 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// exitedPID : Returns the PID of a process that has already exited, as left
+// behind in a stale PID file
+func exitedPID(t *testing.T) int {
+	t.Helper()
+
+	var command *exec.Cmd = exec.Command(os.Args[0], "-test.run=^$")
+	if err := command.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	return command.Process.Pid
+}
+
+func TestWritePIDFile(t *testing.T) {
+	testCases := []struct {
+		name             string
+		existing         bool
+		existingContents string
+	}{
+		{name: "no existing file", existing: false},
+		{name: "stale PID", existing: true, existingContents: strconv.Itoa(exitedPID(t)) + "\n"},
+		{name: "own PID", existing: true, existingContents: strconv.Itoa(os.Getpid()) + "\n"},
+		{name: "unparseable contents", existing: true, existingContents: "not a PID\n"},
+		{name: "empty file", existing: true, existingContents: ""},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var pidFileDirectory string = t.TempDir()
+			var pidFilePath string = filepath.Join(pidFileDirectory, "veil.pid")
+			if testCase.existing {
+				if err := os.WriteFile(pidFilePath, []byte(testCase.existingContents), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := writePIDFile(pidFilePath); err != nil {
+				t.Fatal(err)
+			}
+
+			pidFileContents, err := os.ReadFile(pidFilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected := strconv.Itoa(os.Getpid()) + "\n"; string(pidFileContents) != expected {
+				t.Errorf("expected the PID file to hold %q, got %q", expected, pidFileContents)
+			}
+
+			pidFileInfo, err := os.Stat(pidFilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if pidFileInfo.Mode().Perm() != pidFileMode {
+				t.Errorf("expected the PID file to have mode %v, got %v", pidFileMode, pidFileInfo.Mode().Perm())
+			}
+
+			// Nothing is left behind from writing the file atomically
+			directoryEntries, err := os.ReadDir(pidFileDirectory)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(directoryEntries) != 1 {
+				t.Errorf("expected only the PID file to be left, got %d files", len(directoryEntries))
+			}
+		})
+	}
+}
+
+func TestWritePIDFileAlreadyRunning(t *testing.T) {
+	var pidFilePath string = filepath.Join(t.TempDir(), "veil.pid")
+	var runningPIDContents string = strconv.Itoa(os.Getppid()) + "\n"
+	if err := os.WriteFile(pidFilePath, []byte(runningPIDContents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writePIDFile(pidFilePath); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Errorf("expected a refusal to replace the PID of a running process, got %v", err)
+	}
+
+	pidFileContents, err := os.ReadFile(pidFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(pidFileContents) != runningPIDContents {
+		t.Errorf("expected the PID file to be left holding %q, got %q", runningPIDContents, pidFileContents)
+	}
+
+	// The veil refuses to start in the place of the running process
+	var socketDirectory string = t.TempDir()
+	_, stderr, exitCode := runMain(t, "-pidfile", pidFilePath, filepath.Join(socketDirectory, "target.sock"), filepath.Join(socketDirectory, "veil.sock"), filepath.Join(socketDirectory, "rules.txt"))
+	if exitCode == 0 || !strings.Contains(stderr, "already running") {
+		t.Errorf("expected the veil to refuse to start, got exit code %d: %s", exitCode, stderr)
+	}
+}
+
+func TestRemovePIDFile(t *testing.T) {
+	testCases := []struct {
+		name             string
+		existingContents string
+		expectedRemoved  bool
+	}{
+		{name: "own PID", existingContents: strconv.Itoa(os.Getpid()) + "\n", expectedRemoved: true},
+		{name: "PID of a later veil", existingContents: strconv.Itoa(os.Getppid()) + "\n", expectedRemoved: false},
+		{name: "missing file", expectedRemoved: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var pidFilePath string = filepath.Join(t.TempDir(), "veil.pid")
+			if len(testCase.existingContents) > 0 {
+				if err := os.WriteFile(pidFilePath, []byte(testCase.existingContents), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := removePIDFile(pidFilePath); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := os.Stat(pidFilePath); os.IsNotExist(err) != testCase.expectedRemoved {
+				t.Errorf("expected the PID file removed to be %t, got error %v", testCase.expectedRemoved, err)
+			}
+		})
+	}
+}
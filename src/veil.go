@@ -19,214 +19,345 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net"
-	"net/http"
 	"os"
-	"path/filepath"
-	"sort"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/mux"
-	"github.com/thoas/go-funk"
+	"github.com/pdulapalli/unix-socket-http-veil/veil"
 )
 
-const accessRuleStringDelimiter string = "~"
-const unauthorizedMsgString string = "{\"type\":\"error\",\"status-code\":401,\"status\":\"Unauthorized\",\"result\":{\"message\":\"access denied\"}}"
-const unknownMsgString string = "{\"type\":\"error\",\"status-code\":404,\"status\":\"Not Found\",\"result\":{\"message\":\"not found\"}}"
-const badRequestString string = "{\"type\":\"error\",\"status-code\":400,\"status\":\"Invalid Request\",\"result\":{\"message\":\"bad request\"}}"
-const requestTimeoutString string = "{\"type\":\"error\",\"status-code\":408,\"status\":\"Request Timeout\",\"result\":{\"message\":\"request timed out\"}}"
-const internalErrorString string = "{\"type\":\"error\",\"status-code\":500,\"status\":\"Internal Server Error\",\"result\":{\"message\":\"internal server error\"}}"
-
-// createUnixSocketHTTPClient : Returns a handle to a function that can field and
-// filter incoming requests
-func createUnixSocketHTTPClient(unixSocketPath string) *http.Client {
-	return &http.Client{
-		Transport: &http.Transport{
-			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-				return net.Dial("unix", unixSocketPath)
-			},
-		},
-	}
-}
+const defaultShutdownTimeout time.Duration = 10 * time.Second
 
-// obtainSocketRequestHandler : Returns a handle to a function that can field and
-// filter incoming requests
-func obtainSocketRequestHandler(targetSocketPath string) func(w http.ResponseWriter, r *http.Request) {
-	var socketHTTPClientPtr *http.Client = createUnixSocketHTTPClient(targetSocketPath)
-
-	// Fields and filters incoming requests, then relays those as
-	// appopriate to the encapsulated UNIX Domain Socket
-	return func(w http.ResponseWriter, r *http.Request) {
-		var requestPath string = "http://unix" + r.URL.Path
-		requestContext, _ := context.WithTimeout(context.Background(), 5*time.Second)
-
-		switch r.Method {
-		case http.MethodGet:
-			fallthrough
-		case http.MethodPost:
-			fallthrough
-		case http.MethodDelete:
-			fallthrough
-		case http.MethodPatch:
-			fallthrough
-		case http.MethodPut:
-			httpRequest, errReqCreate := http.NewRequest(r.Method, requestPath, r.Body)
-			if errReqCreate != nil {
-				io.WriteString(w, internalErrorString)
-				return
-			}
+// unixAddressScheme : Prefix designating the exposed socket argument as a UNIX
+// Domain Socket path, whatever the path itself looks like
+const unixAddressScheme string = "unix://"
 
-			httpRequest = httpRequest.WithContext(requestContext)
-			response, errReqPeform := (*socketHTTPClientPtr).Do(httpRequest)
+// Build metadata, injected at build time through -ldflags, e.g.
+// -ldflags "-X main.version=1.2.0 -X main.gitCommit=$(git rev-parse HEAD)"
+var version string = "dev"
+var gitCommit string = "unknown"
+var buildDate string = "unknown"
 
-			if errReqPeform != nil {
-				io.WriteString(w, requestTimeoutString)
-				return
-			}
+// reloadOnSignal : Reloads the access rules whenever the process receives
+// SIGHUP
+func reloadOnSignal(exposedVeil *veil.Veil) {
+	var reloadSignals chan os.Signal = make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
 
-			io.Copy(w, response.Body)
-			break
-		default:
-			io.WriteString(w, badRequestString)
+	go func() {
+		for range reloadSignals {
+			exposedVeil.Reload()
 		}
-	}
+	}()
 }
 
-func unknownRequestHandler(w http.ResponseWriter, r *http.Request) {
-	io.WriteString(w, unknownMsgString)
+// serveUntilShutdown : Serves requests through the veil until the process
+// receives SIGINT or SIGTERM, at which point no new connections are accepted
+// and outstanding requests are given up to gracePeriod to complete
+func serveUntilShutdown(exposedVeil *veil.Veil, gracePeriod time.Duration) error {
+	var shutdownSignals chan os.Signal = make(chan os.Signal, 1)
+	signal.Notify(shutdownSignals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(shutdownSignals)
+
+	var serveErrors chan error = make(chan error, 1)
+	go func() {
+		serveErrors <- exposedVeil.Serve()
+	}()
+
+	select {
+	case err := <-serveErrors:
+		exposedVeil.Shutdown(context.Background())
+		return err
+	case receivedSignal := <-shutdownSignals:
+		log.Println("Received", receivedSignal, "signal, shutting down...")
+	}
+
+	shutdownContext, cancelShutdown := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancelShutdown()
+
+	return exposedVeil.Shutdown(shutdownContext)
 }
 
-func forbiddenRequestHandler(w http.ResponseWriter, r *http.Request) {
-	io.WriteString(w, unauthorizedMsgString)
+// repeatedFlag : Value of a flag that may be given more than once, each time
+// with one or more comma-separated elements, accumulating every element
+type repeatedFlag []string
+
+// String : Formats the elements of the flag as a comma-separated list
+func (value *repeatedFlag) String() string {
+	return strings.Join(*value, ",")
 }
 
-func createUnixSocketListener(socketPath string) net.Listener {
-	os.RemoveAll(socketPath)
+// Set : Adds the comma-separated elements of an occurrence of the flag
+func (value *repeatedFlag) Set(element string) error {
+	*value = append(*value, veil.SplitCommaSeparated(element)...)
+	return nil
+}
 
-	socketParentDirPath := filepath.Dir(socketPath)
-	_, err := os.Stat(socketParentDirPath)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			panic(err)
+// parseMethodAliases : Parses a comma-separated list of method aliases, each of
+// the form NAME=METHOD+METHOD, into the HTTP methods granted by each name
+func parseMethodAliases(value string) (map[string][]string, error) {
+	var aliases map[string][]string = map[string][]string{}
+	for _, alias := range veil.SplitCommaSeparated(value) {
+		var aliasParts []string = strings.SplitN(alias, "=", 2)
+		if len(aliasParts) != 2 || len(strings.TrimSpace(aliasParts[0])) == 0 {
+			return nil, fmt.Errorf("expected NAME=METHOD+METHOD but found %q", alias)
 		}
 
-		if err := os.MkdirAll(socketParentDirPath, 0755); err != nil {
-			panic(err)
+		var aliasName string = strings.TrimSpace(aliasParts[0])
+		for _, method := range strings.Split(aliasParts[1], "+") {
+			if method = strings.TrimSpace(method); len(method) > 0 {
+				aliases[aliasName] = append(aliases[aliasName], method)
+			}
 		}
 	}
 
-	unixListener, err := net.Listen("unix", socketPath)
-	if err != nil {
-		panic(err)
-	}
-
-	return unixListener
+	return aliases, nil
 }
 
-// readFileLines : Read the contents of a file, and using newlines as the
-// delimiter, return a list where each element corresponds with a line from the
-// original file.
-func readFileLines(filepath string) []string {
-	var fileLines []string = []string{}
-	if len(filepath) == 0 {
-		return fileLines
-	}
+func main() {
+	var help *bool = flag.Bool("h", false, "usage help")
+	var showVersion *bool = flag.Bool("version", false, "print build metadata and exit")
+	var configPath *string = flag.String("config", "", "path to a JSON configuration file whose values apply to flags not set on the command line")
+	var requestTimeout *time.Duration = flag.Duration("timeout", veil.DefaultRequestTimeout, "maximum duration of a relayed request")
+	var waitForTarget *time.Duration = flag.Duration("wait-for-target", 0, "maximum time to wait at startup for the target socket to accept connections, or 0 not to wait")
+	var dialTimeout *time.Duration = flag.Duration("dial-timeout", 0, "maximum time to connect to the target socket, or 0 to be bounded only by -timeout")
+	var listenAddress *string = flag.String("listen", "", "address on which to expose the veil (tcp://host:port or unix://<path>), in place of the exposed socket argument")
+	var pidFile *string = flag.String("pidfile", "", "path of a file to write the veil's PID to, which is removed on shutdown")
+	var shutdownTimeout *time.Duration = flag.Duration("shutdown-timeout", defaultShutdownTimeout, "maximum time to wait for in-flight requests to complete on shutdown")
+	var targetHealthInterval *time.Duration = flag.Duration("target-health-interval", 0, "how often to check the health of each target socket, taking failing ones out of rotation, or 0 not to check")
+	var targetHealthPath *string = flag.String("target-health-path", "", "path requested from each target socket to check its health, or empty to only dial it")
+	var healthPath *string = flag.String("health-path", veil.DefaultHealthPath, "path of the built-in health endpoint, or empty to disable it")
+	var metricsAddress *string = flag.String("metrics-addr", "", "address (host:port or socket path) on which to serve Prometheus metrics")
+	var viaPseudonym *string = flag.String("via", veil.DefaultViaPseudonym, "name by which the veil identifies itself in the Via header of relayed requests and responses")
+	var compressResponses *bool = flag.Bool("gzip", false, "compress relayed responses with gzip for clients that accept it")
+	var decompressRequests *bool = flag.Bool("gunzip-requests", false, "decompress gzip-encoded request bodies before relaying them")
+	var adminSocket *string = flag.String("admin-socket", "", "path of a UNIX Domain Socket on which to serve the admin API")
+	var errorTemplates *string = flag.String("error-templates", "", "path to a JSON file mapping status codes to templates for the bodies of error responses")
+	var responseHeaders *string = flag.String("response-headers", "", "path to a JSON file naming headers to add to relayed responses, such as security headers")
+	var adminProfiling *bool = flag.Bool("admin-pprof", false, "serve runtime profiles under /debug/pprof/ on the admin socket")
+	var corsOrigins *string = flag.String("cors-origins", "", "comma-separated list of origins from which browsers may make cross-origin requests, or \"*\" for any, enabling CORS")
+	var corsMethods *string = flag.String("cors-methods", "", "comma-separated list of HTTP methods permitted in cross-origin requests (defaults to every supported method)")
+	var corsHeaders *string = flag.String("cors-headers", "", "comma-separated list of request headers permitted in cross-origin requests")
+	var tracing *bool = flag.Bool("tracing", false, "record OpenTelemetry spans for requests and export them over OTLP/HTTP as configured by the OTEL_* environment variables")
+	var logFormat *string = flag.String("log-format", veil.LogFormatText, "format of the access log written to standard output (\"text\" or \"json\")")
+	var logLevel *string = flag.String("log-level", veil.LogLevelInfo, "verbosity of the veil's own log (\"error\", \"warn\", \"info\" or \"debug\")")
+	var maxConcurrent *int = flag.Int("max-concurrent", 0, "maximum number of requests relayed at once, or 0 for no limit")
+	var rateLimit *float64 = flag.Float64("rate", 0, "maximum number of requests served per second, or 0 for no limit")
+	var burst *int = flag.Int("burst", 0, "maximum number of requests served in a burst beyond -rate (defaults to -rate, rounded up)")
+	var uidRateLimit *float64 = flag.Float64("uid-rate", 0, "maximum number of requests served per second to each user connecting to the exposed socket, or 0 for no limit")
+	var uidBurst *int = flag.Int("uid-burst", 0, "maximum number of requests served to each user in a burst beyond -uid-rate (defaults to -uid-rate, rounded up)")
+	var allowedCIDRs repeatedFlag
+	flag.Var(&allowedCIDRs, "allow-cidr", "CIDR block of client addresses allowed to connect over TCP (e.g. 10.0.0.0/8), which may be repeated")
+	var maxBodyBytes *int64 = flag.Int64("max-body-bytes", 0, "maximum size in bytes of a relayed request body, or 0 for no limit")
+	var cacheTTL *time.Duration = flag.Duration("cache-ttl", 0, "period for which responses to GET requests are cached and reused, or 0 to disable the cache")
+	var cacheMaxBytes *int64 = flag.Int64("cache-max-bytes", veil.DefaultCacheMaxBytes, "maximum total size in bytes of the response bodies held by the cache, beyond which the least recently used are evicted")
+	var maxResponseBytes *int64 = flag.Int64("max-response-bytes", 0, "maximum size in bytes of a relayed response body, or 0 for no limit")
+	var retries *int = flag.Int("retries", 0, "number of times to retry an idempotent request without a body when the target socket cannot be reached")
+	var breakerThreshold *int = flag.Int("breaker-threshold", 0, "consecutive upstream failures that trip the circuit breaker, or 0 to disable it")
+	var breakerWindow *time.Duration = flag.Duration("breaker-window", veil.DefaultBreakerWindow, "period within which consecutive upstream failures trip the circuit breaker")
+	var breakerCooldown *time.Duration = flag.Duration("breaker-cooldown", veil.DefaultBreakerCooldown, "period for which a tripped circuit breaker refuses requests")
+	var maxIdleConns *int = flag.Int("max-idle-conns", 100, "maximum number of idle connections to the target socket kept open for reuse")
+	var maxIdleConnsPerHost *int = flag.Int("max-idle-conns-per-host", 16, "maximum number of idle connections to the target socket kept open for reuse by each host name")
+	var idleConnTimeout *time.Duration = flag.Duration("idle-conn-timeout", 90*time.Second, "time after which an idle connection to the target socket is closed")
+	var tlsCertificate *string = flag.String("tls-cert", "", "path to a PEM-encoded certificate with which to serve a TCP listener over TLS")
+	var tlsKey *string = flag.String("tls-key", "", "path to the PEM-encoded private key for -tls-cert")
+	var clientCA *string = flag.String("client-ca", "", "path to PEM-encoded certificate authorities that TLS clients must present a certificate from")
+	var socketMode *string = flag.String("socket-mode", "", "octal permission bits for the exposed socket file (e.g. 0660), instead of those implied by the umask")
+	var socketOwner *string = flag.String("socket-owner", "", "user name or ID to assign ownership of the exposed socket file to")
+	var runAsUser *string = flag.String("user", "", "user name or ID to switch to once the sockets are bound")
+	var runAsGroup *string = flag.String("group", "", "group name or ID to switch to once the sockets are bound (defaults to the primary group of -user)")
+	var socketGroup *string = flag.String("socket-group", "", "group name or ID to assign ownership of the exposed socket file to")
+	var stripHeaders *string = flag.String("strip-headers", "", "comma-separated list of request headers to remove before relaying")
+	var rulesFormat *string = flag.String("format", "", "format of the access rules list (\"text\", \"json\" or \"yaml\"), inferred from the file extension if unset")
+	var methodAliases *string = flag.String("method-aliases", "", "comma-separated list of method aliases usable in access rules, each of the form NAME=METHOD+METHOD (e.g. INSPECT=GET+HEAD)")
+	var ruleDelimiter *string = flag.String("rule-delimiter", veil.DefaultAccessRuleDelimiter, "single character separating the fields of a text access rule")
+	var timeWindowZone *string = flag.String("time-window-zone", veil.DefaultTimeWindowZone, "time zone in which the time windows of access rules are evaluated (e.g. \"Europe/Berlin\" or \"Local\")")
+	var lenientRules *bool = flag.Bool("lenient", false, "skip malformed access rules instead of refusing to start")
+	var defaultAllow *bool = flag.Bool("default-allow", false, "relay requests that no access rule covers, leaving deny rules to refuse requests")
+	var dryRun *bool = flag.Bool("dry-run", false, "relay every request regardless of the access rules, logging the decision they would have made")
+	var implicitHead *bool = flag.Bool("implicit-head", false, "permit HEAD requests wherever GET requests are permitted by the access rules")
+	var headFromGet *bool = flag.Bool("head-from-get", false, "answer HEAD requests the target socket does not support from the equivalent GET request, discarding its body")
+	var strictSlash *bool = flag.Bool("strict-slash", false, "match request paths only against rules that agree on the presence of a trailing slash")
+	var watchRules *bool = flag.Bool("watch", false, "reload the access rules list automatically when it changes")
+	flag.Parse()
 
-	file, err := os.Open(filepath)
-	if err != nil {
-		log.Println("Error opening filepath: ", filepath, err)
-		return fileLines
+	if *showVersion {
+		fmt.Println("unix-socket-http-veil", version, "commit", gitCommit, "built", buildDate)
+		os.Exit(0)
 	}
 
-	defer file.Close()
-
-	var scanner *bufio.Scanner = bufio.NewScanner(file)
-	for scanner.Scan() {
-		currentText := scanner.Text()
-		if len(currentText) > 0 {
-			fileLines = append(fileLines, scanner.Text())
+	var explicitFlags map[string]bool = explicitlySetFlags(flag.CommandLine)
+	var arguments positionalArguments
+	if len(*configPath) > 0 {
+		var errConfig error
+		arguments, errConfig = applyConfigFile(flag.CommandLine, explicitFlags, *configPath)
+		if errConfig != nil {
+			fmt.Fprintln(os.Stderr, "unable to load configuration file:", *configPath, errConfig)
+			os.Exit(1)
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Println("Error scanning file: ", filepath, err)
+	if err := applyEnvironment(flag.CommandLine, explicitFlags, &arguments); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
-	return fileLines
-}
-
-// determineAccessRules : Computes a key-value map that describes what HTTP
-// requests will be made accessible. Each element in the mapping is from a
-// resource path to a list of HTTP method types.
-func determineAccessRules(accessRulesList []string) map[string][]string {
-	var accessRulesMap = make(map[string][]string)
+	// With -listen, the exposed socket argument is left out
+	var argumentCount int = 3
+	if len(*listenAddress) > 0 {
+		argumentCount = 2
+	}
 
-	for _, rule := range accessRulesList {
-		splitRule := strings.Split(rule, accessRuleStringDelimiter)
-		if len(splitRule) != 2 {
-			continue
+	if len(flag.Args()) == argumentCount {
+		arguments = positionalArguments{
+			targetSocketPath:    flag.Arg(0),
+			accessRulesFilepath: flag.Arg(argumentCount - 1),
 		}
 
-		var ruleHTTPMethod string = splitRule[0]
-		var ruleResourcePath string = splitRule[1]
-		_, exists := accessRulesMap[ruleResourcePath]
-		if !exists {
-			accessRulesMap[ruleResourcePath] = []string{}
+		if argumentCount == 3 {
+			arguments.exposedAddress = flag.Arg(1)
 		}
-
-		var accessRulesForPath []string = accessRulesMap[ruleResourcePath]
-		accessRulesMap[ruleResourcePath] = append(accessRulesForPath, ruleHTTPMethod)
 	}
 
-	for accessRulesPath := range accessRulesMap {
-		accessRulesListForPath := accessRulesMap[accessRulesPath]
-		sort.Strings(accessRulesListForPath)
-		accessRulesMap[accessRulesPath] = funk.UniqString(accessRulesListForPath)
+	var argumentsComplete bool = len(arguments.targetSocketPath) > 0 && (len(arguments.exposedAddress) > 0 || len(*listenAddress) > 0) && len(arguments.accessRulesFilepath) > 0
+	if *help || (len(flag.Args()) != argumentCount && (len(flag.Args()) != 0 || !argumentsComplete)) {
+		fmt.Fprintln(os.Stderr, "usage:", os.Args[0], "[-config <path-to-config-file>] <path-to-target-socket[,...]> <path-to-exposed-socket> <path-to-access-rules-list>")
+		fmt.Fprintln(os.Stderr, "      ", os.Args[0], "[-config <path-to-config-file>] -listen <tcp://host:port | unix://path> <path-to-target-socket[,...]> <path-to-access-rules-list>")
+		flag.PrintDefaults()
+		os.Exit(1)
 	}
 
-	return accessRulesMap
-}
+	if len(*listenAddress) > 0 && !strings.HasPrefix(*listenAddress, "tcp://") && !strings.HasPrefix(*listenAddress, "unix:") {
+		fmt.Fprintln(os.Stderr, "invalid listen address:", *listenAddress, "(must begin with tcp:// or unix://)")
+		os.Exit(1)
+	}
 
-func main() {
-	var help *bool = flag.Bool("h", false, "usage help")
-	flag.Parse()
+	if *shutdownTimeout < 0 {
+		fmt.Fprintln(os.Stderr, "invalid shutdown timeout:", *shutdownTimeout, "(must not be negative)")
+		os.Exit(1)
+	}
 
-	if *help || len(flag.Args()) != 3 {
-		fmt.Fprintln(os.Stderr, "usage:", os.Args[0], "<path-to-target-socket> <path-to-exposed-socket> <path-to-access-rules-list>")
-		flag.PrintDefaults()
+	parsedMethodAliases, errAliases := parseMethodAliases(*methodAliases)
+	if errAliases != nil {
+		fmt.Fprintln(os.Stderr, "invalid method aliases:", errAliases)
 		os.Exit(1)
 	}
 
-	var targetSocketPath string = flag.Arg(0)
-	var exposedSocketPath string = flag.Arg(1)
-	var accessRulesFilepath string = flag.Arg(2)
+	var targetSocketPath string = arguments.targetSocketPath
+	var exposedAddress string = unixAddressScheme + arguments.exposedAddress
+	if len(*listenAddress) > 0 {
+		exposedAddress = *listenAddress
+	}
+
+	var accessRulesFilepath string = arguments.accessRulesFilepath
+
+	var exposedSocketMode uint64
+	if len(*socketMode) > 0 {
+		var errMode error
+		exposedSocketMode, errMode = strconv.ParseUint(*socketMode, 8, 32)
+		if errMode != nil || exposedSocketMode == 0 {
+			fmt.Fprintln(os.Stderr, "invalid socket mode:", *socketMode, "(must be octal permission bits such as 0660)")
+			os.Exit(1)
+		}
+	}
 
 	log.Println("Launching Unix Socket HTTP Server...")
+	if len(*pidFile) > 0 {
+		if err := writePIDFile(*pidFile); err != nil {
+			log.Fatalln("Unable to write PID file", *pidFile+":", err)
+		}
+	}
 
-	incomingRequestRouter := mux.NewRouter()
-	incomingRequestRouter.MethodNotAllowedHandler = http.HandlerFunc(forbiddenRequestHandler)
-	incomingRequestRouter.NotFoundHandler = http.HandlerFunc(unknownRequestHandler)
+	if *dryRun {
+		log.Println("Dry-run mode: requests are relayed regardless of the access rules")
+	}
 
-	socketRequestHandler := obtainSocketRequestHandler(targetSocketPath)
-	accessRules := determineAccessRules(readFileLines(accessRulesFilepath))
-	for accessRulesPath := range accessRules {
-		accessRulesMethodsForPath := accessRules[accessRulesPath]
-		incomingRequestRouter.HandleFunc(accessRulesPath, socketRequestHandler).
-			Methods(accessRulesMethodsForPath...)
+	if *defaultAllow {
+		log.Println("Default-allow mode: requests that no access rule covers are relayed")
 	}
 
-	var apiAccessHTTPServer http.Server
-	apiAccessHTTPServer = http.Server{
-		Handler: incomingRequestRouter,
+	exposedVeil, errVeil := veil.New(veil.Options{
+		TargetSocketPaths:      veil.SplitCommaSeparated(targetSocketPath),
+		ExposedAddress:         exposedAddress,
+		AccessRulesPath:        accessRulesFilepath,
+		AccessRulesFormat:      *rulesFormat,
+		LenientAccessRules:     *lenientRules,
+		AccessRuleDelimiter:    *ruleDelimiter,
+		MethodAliases:          parsedMethodAliases,
+		WatchAccessRules:       *watchRules,
+		StrictTrailingSlash:    *strictSlash,
+		ImplicitHead:           *implicitHead,
+		HeadFromGet:            *headFromGet,
+		TimeWindowZone:         *timeWindowZone,
+		DryRun:                 *dryRun,
+		DefaultAllow:           *defaultAllow,
+		WaitForTarget:          *waitForTarget,
+		TargetHealthInterval:   *targetHealthInterval,
+		TargetHealthPath:       *targetHealthPath,
+		RequestTimeout:         *requestTimeout,
+		DialTimeout:            *dialTimeout,
+		StrippedRequestHeaders: veil.SplitCommaSeparated(*stripHeaders),
+		MaxConcurrentRequests:  *maxConcurrent,
+		Rate:                   *rateLimit,
+		Burst:                  *burst,
+		UIDRate:                *uidRateLimit,
+		UIDBurst:               *uidBurst,
+		AllowedCIDRs:           allowedCIDRs,
+		MaxBodyBytes:           *maxBodyBytes,
+		MaxResponseBytes:       *maxResponseBytes,
+		CacheTTL:               *cacheTTL,
+		CacheMaxBytes:          *cacheMaxBytes,
+		Retries:                *retries,
+		BreakerThreshold:       *breakerThreshold,
+		BreakerWindow:          *breakerWindow,
+		BreakerCooldown:        *breakerCooldown,
+		MaxIdleConns:           *maxIdleConns,
+		MaxIdleConnsPerHost:    *maxIdleConnsPerHost,
+		IdleConnTimeout:        *idleConnTimeout,
+		ViaPseudonym:           *viaPseudonym,
+		CompressResponses:      *compressResponses,
+		DecompressRequests:     *decompressRequests,
+		HealthPath:             *healthPath,
+		ErrorTemplatesPath:     *errorTemplates,
+		ResponseHeadersPath:    *responseHeaders,
+		CORSAllowedOrigins:     veil.SplitCommaSeparated(*corsOrigins),
+		CORSAllowedMethods:     veil.SplitCommaSeparated(*corsMethods),
+		CORSAllowedHeaders:     veil.SplitCommaSeparated(*corsHeaders),
+		Tracing:                *tracing,
+		LogFormat:              *logFormat,
+		LogLevel:               *logLevel,
+		MetricsAddress:         *metricsAddress,
+		AdminSocketPath:        *adminSocket,
+		AdminProfiling:         *adminProfiling,
+		TLSCertificatePath:     *tlsCertificate,
+		TLSKeyPath:             *tlsKey,
+		ClientCAPath:           *clientCA,
+		SocketMode:             os.FileMode(exposedSocketMode),
+		SocketOwner:            *socketOwner,
+		SocketGroup:            *socketGroup,
+		User:                   *runAsUser,
+		Group:                  *runAsGroup,
+	})
+	if errVeil != nil {
+		cleanUpPIDFile(*pidFile)
+		log.Fatalln("Unable to start Unix Socket HTTP Server:", errVeil)
 	}
 
-	apiAccessHTTPServer.Serve(createUnixSocketListener(exposedSocketPath))
+	reloadOnSignal(exposedVeil)
+
 	log.Println("Unix Socket HTTP Server started!")
+	var errServe error = serveUntilShutdown(exposedVeil, *shutdownTimeout)
+	cleanUpPIDFile(*pidFile)
+	if errServe != nil {
+		log.Fatalln("Unix Socket HTTP Server stopped unexpectedly:", errServe)
+	}
+
+	log.Println("Unix Socket HTTP Server stopped")
 }
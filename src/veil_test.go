@@ -0,0 +1,134 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// runMainEnvVar : Set when the test binary is run to stand in for the veil
+// itself, so that main runs in place of the tests
+const runMainEnvVar string = "VEIL_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnvVar) == "1" {
+		main()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+// runMain : Runs main in a separate process with the given command-line
+// arguments, returning what it writes to standard output and error along with
+// its exit code
+func runMain(t *testing.T, arguments ...string) (string, string, int) {
+	t.Helper()
+
+	var command *exec.Cmd = exec.Command(os.Args[0], arguments...)
+	command.Env = append(os.Environ(), runMainEnvVar+"=1")
+
+	var stdout, stderr bytes.Buffer
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+
+	var exitError *exec.ExitError
+	if err := command.Run(); errors.As(err, &exitError) {
+		return stdout.String(), stderr.String(), exitError.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	return stdout.String(), stderr.String(), 0
+}
+
+func TestVersionFlag(t *testing.T) {
+	var socketDirectory string = t.TempDir()
+	var exposedSocketPath string = filepath.Join(socketDirectory, "veil.sock")
+
+	testCases := []struct {
+		name      string
+		arguments []string
+	}{
+		{name: "alone", arguments: []string{"-version"}},
+		{name: "with positional arguments", arguments: []string{"-version", filepath.Join(socketDirectory, "target.sock"), exposedSocketPath, filepath.Join(socketDirectory, "rules.txt")}},
+		{name: "with other flags", arguments: []string{"-version", "-listen", "tcp://127.0.0.1:0", "-timeout", "1s"}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			stdout, stderr, exitCode := runMain(t, testCase.arguments...)
+			if exitCode != 0 {
+				t.Fatalf("expected to exit with 0, got %d: %s", exitCode, stderr)
+			}
+
+			if expectedOutput := "unix-socket-http-veil dev commit unknown built unknown\n"; stdout != expectedOutput {
+				t.Errorf("expected %q, got %q", expectedOutput, stdout)
+			}
+
+			if strings.Contains(stderr, "Launching") {
+				t.Errorf("expected the veil not to launch, got %q", stderr)
+			}
+
+			if _, err := os.Stat(exposedSocketPath); !os.IsNotExist(err) {
+				t.Errorf("expected the exposed socket not to be bound, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParseMethodAliases(t *testing.T) {
+	testCases := []struct {
+		value           string
+		expectedAliases map[string][]string
+	}{
+		{value: "", expectedAliases: map[string][]string{}},
+		{value: "INSPECT=GET+HEAD", expectedAliases: map[string][]string{"INSPECT": {"GET", "HEAD"}}},
+		{value: "INSPECT = GET + HEAD, MUTATE=POST+PUT", expectedAliases: map[string][]string{"INSPECT": {"GET", "HEAD"}, "MUTATE": {"POST", "PUT"}}},
+		{value: "INSPECT=GET++HEAD+", expectedAliases: map[string][]string{"INSPECT": {"GET", "HEAD"}}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.value, func(t *testing.T) {
+			aliases, err := parseMethodAliases(testCase.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(aliases, testCase.expectedAliases) {
+				t.Errorf("expected %v, got %v", testCase.expectedAliases, aliases)
+			}
+		})
+	}
+
+	for _, value := range []string{"INSPECT", "=GET", "INSPECT:GET"} {
+		t.Run(value, func(t *testing.T) {
+			if _, err := parseMethodAliases(value); err == nil {
+				t.Errorf("expected %q to be rejected", value)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pdulapalli/unix-socket-http-veil/veil"
+)
+
+func TestReloadOnSignal(t *testing.T) {
+	var socketDirectory string = t.TempDir()
+	var targetSocketPath string = filepath.Join(socketDirectory, "target.sock")
+	targetListener, err := net.Listen("unix", targetSocketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var target *http.Server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go target.Serve(targetListener)
+	defer target.Close()
+
+	var accessRulesPath string = filepath.Join(socketDirectory, "rules.txt")
+	if err := os.WriteFile(accessRulesPath, []byte("GET~/v2/snaps\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var exposedSocketPath string = filepath.Join(socketDirectory, "veil.sock")
+	exposedVeil, err := veil.New(veil.Options{
+		TargetSocketPath: targetSocketPath,
+		ExposedAddress:   exposedSocketPath,
+		AccessRulesPath:  accessRulesPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go exposedVeil.Serve()
+	defer exposedVeil.Shutdown(context.Background())
+
+	var client *http.Client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", exposedSocketPath)
+			},
+		},
+	}
+
+	var appsStatus func() int = func() int {
+		response, err := client.Get("http://veil/v2/apps")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	if status := appsStatus(); status != http.StatusNotFound {
+		t.Fatalf("expected status 404 before reloading, got %d", status)
+	}
+
+	reloadOnSignal(exposedVeil)
+	if err := os.WriteFile(accessRulesPath, []byte("GET~/v2/snaps\nGET~/v2/apps\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	// The signal is handled asynchronously, so the new rules are awaited
+	for deadline := time.Now().Add(5 * time.Second); appsStatus() != http.StatusOK; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected SIGHUP to reload the access rules")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,489 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// relayCounters : Running counts of the requests relayed by a Veil, which the
+// admin socket serves under /debug/vars in the JSON format of expvar. They are
+// kept by each Veil rather than published through expvar, which would share
+// them with every Veil in the process and serve them on http.DefaultServeMux.
+type relayCounters struct {
+	relayedRequests  int64
+	upstreamErrors   int64
+	inFlightRequests int64
+}
+
+// relayCountersContextKey : Key under which the counters of the Veil relaying a
+// request are stored in its context
+type relayCountersContextKey struct{}
+
+// withRelayCounters : Returns the request with the counters stored in its
+// context, so that the errors encountered while relaying it are counted
+func withRelayCounters(r *http.Request, counters *relayCounters) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), relayCountersContextKey{}, counters))
+}
+
+// countUpstreamError : Counts an upstream error against the counters stored
+// in the context, if any
+func countUpstreamError(ctx context.Context) {
+	if counters, exists := ctx.Value(relayCountersContextKey{}).(*relayCounters); exists {
+		atomic.AddInt64(&counters.upstreamErrors, 1)
+	}
+}
+
+// vars : Returns the counters, along with the command line and memory
+// statistics that expvar publishes, keyed as expvar would key them
+func (counters *relayCounters) vars() map[string]interface{} {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	return map[string]interface{}{
+		"cmdline":                 os.Args,
+		"memstats":                memStats,
+		"veil_relayed_requests":   atomic.LoadInt64(&counters.relayedRequests),
+		"veil_upstream_errors":    atomic.LoadInt64(&counters.upstreamErrors),
+		"veil_requests_in_flight": atomic.LoadInt64(&counters.inFlightRequests),
+	}
+}
+
+// profileNames : The runtime profiles that the admin socket serves by name
+// under /debug/pprof/ when profiling is enabled
+var profileNames []string = []string{"allocs", "block", "goroutine", "heap", "mutex", "threadcreate"}
+
+// adminResponse : Envelope of a response from the admin socket, matching that
+// of the veil's other responses
+type adminResponse struct {
+	Type       string      `json:"type"`
+	StatusCode int         `json:"status-code"`
+	Status     string      `json:"status"`
+	Result     interface{} `json:"result"`
+}
+
+// adminErrorResult : Result of a failed admin request
+type adminErrorResult struct {
+	Message string `json:"message"`
+}
+
+// adminDryRunState : Body of a request to toggle dry-run mode, and result
+// reporting whether it is enabled
+type adminDryRunState struct {
+	Enabled bool `json:"enabled"`
+}
+
+// adminLogLevel : Body of a request to change the log level, and result
+// reporting the log level in effect
+type adminLogLevel struct {
+	Level string `json:"level"`
+}
+
+// adminStats : Statistics about the requests served by the veil, as reported
+// by the admin socket
+type adminStats struct {
+	UptimeSeconds    float64          `json:"uptime_seconds"`
+	Requests         int64            `json:"requests"`
+	Decisions        map[string]int64 `json:"decisions"`
+	UpstreamErrors   int64            `json:"upstream_errors"`
+	UpstreamTimeouts int64            `json:"upstream_timeouts"`
+	Reloads          int64            `json:"reloads"`
+	DryRun           bool             `json:"dry_run"`
+}
+
+// adminTarget : Health of a target socket, as reported by the admin socket.
+// CheckedAt is omitted until the target socket has been checked.
+type adminTarget struct {
+	SocketPath string     `json:"socket_path"`
+	Healthy    bool       `json:"healthy"`
+	Since      time.Time  `json:"since"`
+	CheckedAt  *time.Time `json:"checked_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// relayStats : Counts of the requests served by the veil since it started
+type relayStats struct {
+	mutex            sync.Mutex
+	startTime        time.Time
+	requests         int64
+	decisions        map[string]int64
+	upstreamErrors   int64
+	upstreamTimeouts int64
+	reloads          int64
+}
+
+// newRelayStats : Creates empty statistics starting from the present moment
+func newRelayStats() *relayStats {
+	return &relayStats{
+		startTime: time.Now(),
+		decisions: make(map[string]int64),
+	}
+}
+
+// instrument : Wraps a request handler such that every request it serves is
+// counted in the statistics
+func (stats *relayStats) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, outcome := withRequestOutcome(r)
+		next.ServeHTTP(w, r)
+
+		decision, upstreamError := outcome.snapshot()
+		if len(decision) == 0 {
+			decision = "none"
+		}
+
+		stats.mutex.Lock()
+		defer stats.mutex.Unlock()
+
+		stats.requests++
+		stats.decisions[decision]++
+		if upstreamError != nil {
+			stats.upstreamErrors++
+			if isTimeoutError(upstreamError) {
+				stats.upstreamTimeouts++
+			}
+		}
+	})
+}
+
+// recordReload : Counts a successful reload of the access rules
+func (stats *relayStats) recordReload() {
+	stats.mutex.Lock()
+	stats.reloads++
+	stats.mutex.Unlock()
+}
+
+// snapshot : Returns the statistics gathered so far
+func (stats *relayStats) snapshot() adminStats {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	var decisions map[string]int64 = make(map[string]int64)
+	for decision, count := range stats.decisions {
+		decisions[decision] = count
+	}
+
+	return adminStats{
+		UptimeSeconds:    time.Since(stats.startTime).Seconds(),
+		Requests:         stats.requests,
+		Decisions:        decisions,
+		UpstreamErrors:   stats.upstreamErrors,
+		UpstreamTimeouts: stats.upstreamTimeouts,
+		Reloads:          stats.reloads,
+	}
+}
+
+// adminRulePath : The access rules registered for one rule path, as reported
+// by the admin socket
+type adminRulePath struct {
+	Path  string      `json:"path"`
+	Type  string      `json:"type"`
+	Rules []adminRule `json:"rules"`
+}
+
+// adminRule : A single access rule, as reported by the admin socket
+type adminRule struct {
+	Method       string   `json:"method"`
+	Deny         bool     `json:"deny,omitempty"`
+	Timeout      string   `json:"timeout,omitempty"`
+	UIDs         []uint32 `json:"uids,omitempty"`
+	GIDs         []uint32 `json:"gids,omitempty"`
+	CNs          []string `json:"cns,omitempty"`
+	Rewrite      string   `json:"rewrite,omitempty"`
+	Rate         string   `json:"rate,omitempty"`
+	Headers      []string `json:"headers,omitempty"`
+	Query        []string `json:"query,omitempty"`
+	Windows      []string `json:"windows,omitempty"`
+	Schema       string   `json:"schema,omitempty"`
+	ContentTypes []string `json:"content_types,omitempty"`
+}
+
+// accessRulePathType : Describes how a rule path is matched against request
+// paths: "exact", "wildcard", "prefix" or "regex"
+func accessRulePathType(rulePath string) string {
+	switch accessRulePathPrecedence(rulePath) {
+	case 0:
+		return "exact"
+	case 3:
+		return "prefix"
+	case 4:
+		return "regex"
+	default:
+		return "wildcard"
+	}
+}
+
+// describeAccessRules : Summarizes the access rules by rule path, in order of
+// path
+func describeAccessRules(accessRules map[string][]accessRule) []adminRulePath {
+	var rulePaths []string = []string{}
+	for rulePath := range accessRules {
+		rulePaths = append(rulePaths, rulePath)
+	}
+
+	sort.Strings(rulePaths)
+
+	var description []adminRulePath = []adminRulePath{}
+	for _, rulePath := range rulePaths {
+		var rulePathDescription adminRulePath = adminRulePath{
+			Path:  rulePath,
+			Type:  accessRulePathType(rulePath),
+			Rules: []adminRule{},
+		}
+
+		for _, rule := range accessRules[rulePath] {
+			var ruleDescription adminRule = adminRule{
+				Method:       rule.method,
+				Deny:         rule.deny,
+				UIDs:         rule.uids,
+				GIDs:         rule.gids,
+				CNs:          rule.commonNames,
+				Rewrite:      rule.rewrite,
+				Rate:         rule.rate,
+				Schema:       rule.schemaPath,
+				ContentTypes: rule.contentTypes,
+			}
+
+			for _, condition := range rule.headers {
+				ruleDescription.Headers = append(ruleDescription.Headers, condition.String())
+			}
+
+			for _, condition := range rule.queryParameters {
+				ruleDescription.Query = append(ruleDescription.Query, condition.String())
+			}
+
+			for _, window := range rule.timeWindows {
+				ruleDescription.Windows = append(ruleDescription.Windows, window.String())
+			}
+
+			if rule.timeout > 0 {
+				ruleDescription.Timeout = rule.timeout.String()
+			}
+
+			rulePathDescription.Rules = append(rulePathDescription.Rules, ruleDescription)
+		}
+
+		description = append(description, rulePathDescription)
+	}
+
+	return description
+}
+
+// describeTargets : Describes the health of each target socket for the admin
+// socket
+func describeTargets(upstreams []*targetUpstream) []adminTarget {
+	var description []adminTarget = []adminTarget{}
+	for _, upstream := range upstreams {
+		upstream.mutex.Lock()
+		var target adminTarget = adminTarget{
+			SocketPath: upstream.socketPath,
+			Healthy:    upstream.healthy,
+			Since:      upstream.changedAt,
+		}
+
+		if !upstream.checkedAt.IsZero() {
+			var checkedAt time.Time = upstream.checkedAt
+			target.CheckedAt = &checkedAt
+		}
+
+		if upstream.lastError != nil {
+			target.Error = upstream.lastError.Error()
+		}
+
+		upstream.mutex.Unlock()
+		description = append(description, target)
+	}
+
+	return description
+}
+
+// writeAdminResponse : Responds to an admin request with the result in the
+// veil's JSON envelope
+func writeAdminResponse(w http.ResponseWriter, statusCode int, result interface{}) {
+	var responseType string = "sync"
+	if statusCode >= http.StatusBadRequest {
+		responseType = "error"
+	}
+
+	encodedResponse, err := json.Marshal(adminResponse{
+		Type:       responseType,
+		StatusCode: statusCode,
+		Status:     http.StatusText(statusCode),
+		Result:     result,
+	})
+	if err != nil {
+		logError("Unable to encode admin response:", err)
+		writeJSONResponse(w, http.StatusInternalServerError, internalErrorString)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(encodedResponse)
+}
+
+// allowAdminMethod : Reports whether an admin request uses the HTTP method its
+// endpoint expects, refusing it otherwise
+func allowAdminMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+
+	w.Header().Set("Allow", method)
+	writeAdminResponse(w, http.StatusMethodNotAllowed, adminErrorResult{Message: "method not allowed"})
+	return false
+}
+
+// adminHandler : Returns a handler serving the admin API, through which the
+// running Veil can be inspected and controlled
+func (v *Veil) adminHandler() http.Handler {
+	var adminRouter *http.ServeMux = http.NewServeMux()
+	adminRouter.HandleFunc("/rules", func(w http.ResponseWriter, r *http.Request) {
+		if !allowAdminMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		writeAdminResponse(w, http.StatusOK, describeAccessRules(v.currentAccessRules().rules))
+	})
+
+	adminRouter.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if !allowAdminMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		if err := v.Reload(); err != nil {
+			writeAdminResponse(w, http.StatusInternalServerError, adminErrorResult{Message: err.Error()})
+			return
+		}
+
+		writeAdminResponse(w, http.StatusOK, describeAccessRules(v.currentAccessRules().rules))
+	})
+
+	adminRouter.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if !allowAdminMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		var stats adminStats = v.stats.snapshot()
+		stats.DryRun = v.isDryRun()
+		writeAdminResponse(w, http.StatusOK, stats)
+	})
+
+	adminRouter.HandleFunc("/targets", func(w http.ResponseWriter, r *http.Request) {
+		if !allowAdminMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		writeAdminResponse(w, http.StatusOK, describeTargets(v.upstreams))
+	})
+
+	adminRouter.HandleFunc("/dry-run", func(w http.ResponseWriter, r *http.Request) {
+		if !allowAdminMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		var state adminDryRunState
+		var decoder *json.Decoder = json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&state); err != nil {
+			writeAdminResponse(w, http.StatusBadRequest, adminErrorResult{Message: "expected {\"enabled\": true|false}"})
+			return
+		}
+
+		v.setDryRun(state.Enabled)
+		logInfo("Dry-run mode set to", state.Enabled, "through the admin socket")
+		writeAdminResponse(w, http.StatusOK, state)
+	})
+
+	adminRouter.HandleFunc("/loglevel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			writeAdminResponse(w, http.StatusOK, adminLogLevel{Level: currentLogLevel()})
+			return
+		}
+
+		if !allowAdminMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		var logLevel adminLogLevel
+		var decoder *json.Decoder = json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&logLevel); err != nil {
+			writeAdminResponse(w, http.StatusBadRequest, adminErrorResult{Message: "expected {\"level\": \"error\"|\"warn\"|\"info\"|\"debug\"}"})
+			return
+		}
+
+		if err := setLogLevel(logLevel.Level); err != nil {
+			writeAdminResponse(w, http.StatusBadRequest, adminErrorResult{Message: err.Error()})
+			return
+		}
+
+		logInfo("Log level set to", logLevel.Level, "through the admin socket")
+		writeAdminResponse(w, http.StatusOK, logLevel)
+	})
+
+	adminRouter.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		if !allowAdminMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		encodedVars, err := json.Marshal(v.counters.vars())
+		if err != nil {
+			logError("Unable to encode counters:", err)
+			writeJSONResponse(w, http.StatusInternalServerError, internalErrorString)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(encodedVars)
+	})
+
+	// The profiles are only ever served here, never on the exposed socket,
+	// as they reveal the internals of the veil
+	if v.options.AdminProfiling {
+		handleProfiles(adminRouter)
+	}
+
+	return adminRouter
+}
+
+// handleProfiles : Mounts the runtime profiles of net/http/pprof on the admin
+// router under /debug/pprof/, each handler registered explicitly. Importing
+// net/http/pprof also registers its handlers on http.DefaultServeMux, which
+// the veil never serves, so a program embedding the veil should take care not
+// to serve http.DefaultServeMux where the profiles must not be exposed.
+func handleProfiles(adminRouter *http.ServeMux) {
+	adminRouter.HandleFunc("/debug/pprof/", pprof.Index)
+	adminRouter.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	adminRouter.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	adminRouter.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	adminRouter.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	for _, profileName := range profileNames {
+		adminRouter.Handle("/debug/pprof/"+profileName, pprof.Handler(profileName))
+	}
+}
@@ -0,0 +1,560 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startAdminVeil : Starts a Veil exposed over TCP with an admin socket, as
+// configured by the options, returning it along with a client of its admin
+// socket
+func startAdminVeil(t *testing.T, options Options) (*Veil, *http.Client) {
+	t.Helper()
+
+	options.ExposedAddress = "tcp://127.0.0.1:0"
+	options.AdminSocketPath = filepath.Join(t.TempDir(), "admin.sock")
+	var v *Veil = startTestVeil(t, options)
+
+	return v, &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", options.AdminSocketPath)
+			},
+		},
+	}
+}
+
+// adminRequest : Makes a request of the admin socket, returning the status of
+// the response and decoding its result into the given value
+func adminRequest(t *testing.T, adminClient *http.Client, method string, requestURI string, body string, result interface{}) int {
+	t.Helper()
+
+	request, err := http.NewRequest(method, "http://veil"+requestURI, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := adminClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	var envelope struct {
+		adminResponse
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&envelope); err != nil {
+		t.Fatal(err)
+	}
+
+	if envelope.StatusCode != response.StatusCode {
+		t.Errorf("expected the envelope to carry status %d, got %d", response.StatusCode, envelope.StatusCode)
+	}
+
+	if result != nil {
+		if err := json.Unmarshal(envelope.Result, result); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return response.StatusCode
+}
+
+func TestAdminRules(t *testing.T) {
+	targetSocketPath, _ := recordingTargetSocket(t)
+	var accessRulesPath string = writeTestAccessRules(t, "GET~/v2/snaps\nPOST~/v2/snaps~timeout=5s\n!DELETE~/v2/snaps/*\nGET~prefix:/v2/apps/\nGET~re:^/v2/[a-z]+/conf$\n")
+	_, adminClient := startAdminVeil(t, Options{TargetSocketPath: targetSocketPath, AccessRulesPath: accessRulesPath})
+
+	var rules []adminRulePath
+	if status := adminRequest(t, adminClient, http.MethodGet, "/rules", "", &rules); status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+
+	var expectedRules []adminRulePath = []adminRulePath{
+		{Path: "/v2/snaps", Type: "exact", Rules: []adminRule{{Method: http.MethodGet}, {Method: http.MethodPost, Timeout: "5s"}}},
+		{Path: "/v2/snaps/*", Type: "wildcard", Rules: []adminRule{{Method: http.MethodDelete, Deny: true}}},
+		{Path: "prefix:/v2/apps/", Type: "prefix", Rules: []adminRule{{Method: http.MethodGet}}},
+		{Path: "re:^/v2/[a-z]+/conf$", Type: "regex", Rules: []adminRule{{Method: http.MethodGet}}},
+	}
+	if !reflect.DeepEqual(rules, expectedRules) {
+		t.Errorf("expected %+v, got %+v", expectedRules, rules)
+	}
+
+	// The rules reported follow those in effect once reloaded
+	if err := os.WriteFile(accessRulesPath, []byte("PUT~/v2/apps\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := adminRequest(t, adminClient, http.MethodPost, "/reload", "", nil); status != http.StatusOK {
+		t.Fatalf("expected the reload to succeed, got %d", status)
+	}
+
+	adminRequest(t, adminClient, http.MethodGet, "/rules", "", &rules)
+	if expectedRules = []adminRulePath{{Path: "/v2/apps", Type: "exact", Rules: []adminRule{{Method: http.MethodPut}}}}; !reflect.DeepEqual(rules, expectedRules) {
+		t.Errorf("expected %+v after reloading, got %+v", expectedRules, rules)
+	}
+
+	if status := adminRequest(t, adminClient, http.MethodPost, "/rules", "", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", status)
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	targetSocketPath, _ := recordingTargetSocket(t)
+	var accessRulesPath string = writeTestAccessRules(t, "GET~/v2/snaps\n")
+	v, adminClient := startAdminVeil(t, Options{TargetSocketPath: targetSocketPath, AccessRulesPath: accessRulesPath})
+	var client *http.Client = newVeilClient(v)
+
+	if status := requestStatus(t, client, http.MethodGet, "/v2/apps"); status != http.StatusNotFound {
+		t.Fatalf("expected status 404 before reloading, got %d", status)
+	}
+
+	if err := os.WriteFile(accessRulesPath, []byte("GET~/v2/apps\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := adminRequest(t, adminClient, http.MethodPost, "/reload", "", nil); status != http.StatusOK {
+		t.Fatalf("expected the reload to succeed, got %d", status)
+	}
+
+	if status := requestStatus(t, client, http.MethodGet, "/v2/apps"); status != http.StatusOK {
+		t.Errorf("expected status 200 once reloaded, got %d", status)
+	}
+
+	// Rules that fail to load leave those in effect untouched
+	if err := os.WriteFile(accessRulesPath, []byte("GET\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var failure adminErrorResult
+	if status := adminRequest(t, adminClient, http.MethodPost, "/reload", "", &failure); status != http.StatusInternalServerError || len(failure.Message) == 0 {
+		t.Errorf("expected the reload to fail with a message, got %d and %q", status, failure.Message)
+	}
+
+	if status := requestStatus(t, client, http.MethodGet, "/v2/apps"); status != http.StatusOK {
+		t.Errorf("expected status 200 after the failed reload, got %d", status)
+	}
+
+	if status := adminRequest(t, adminClient, http.MethodGet, "/reload", "", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", status)
+	}
+}
+
+func TestAdminDryRun(t *testing.T) {
+	targetSocketPath, _ := recordingTargetSocket(t)
+	v, adminClient := startAdminVeil(t, Options{TargetSocketPath: targetSocketPath, AccessRulesPath: writeTestAccessRules(t, "GET~/v2/snaps\n")})
+	var client *http.Client = newVeilClient(v)
+
+	testCases := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedDryRun bool
+		expectedRelay  int
+	}{
+		{name: "enable", body: `{"enabled": true}`, expectedStatus: http.StatusOK, expectedDryRun: true, expectedRelay: http.StatusOK},
+		{name: "disable", body: `{"enabled": false}`, expectedStatus: http.StatusOK, expectedDryRun: false, expectedRelay: http.StatusNotFound},
+		{name: "malformed body", body: `{"enabled": "yes"}`, expectedStatus: http.StatusBadRequest, expectedDryRun: false, expectedRelay: http.StatusNotFound},
+		{name: "unknown field", body: `{"enabled": true, "forever": true}`, expectedStatus: http.StatusBadRequest, expectedDryRun: false, expectedRelay: http.StatusNotFound},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if status := adminRequest(t, adminClient, http.MethodPost, "/dry-run", testCase.body, nil); status != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d", testCase.expectedStatus, status)
+			}
+
+			var stats adminStats
+			adminRequest(t, adminClient, http.MethodGet, "/stats", "", &stats)
+			if stats.DryRun != testCase.expectedDryRun {
+				t.Errorf("expected dry-run mode to be %t, got %t", testCase.expectedDryRun, stats.DryRun)
+			}
+
+			if status := requestStatus(t, client, http.MethodGet, "/v2/unlisted"); status != testCase.expectedRelay {
+				t.Errorf("expected an unlisted path to be answered with %d, got %d", testCase.expectedRelay, status)
+			}
+		})
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	targetSocketPath, _ := recordingTargetSocket(t)
+	v, adminClient := startAdminVeil(t, Options{TargetSocketPath: targetSocketPath, AccessRulesPath: writeTestAccessRules(t, "GET~/v2/snaps\n!GET~/v2/secret\n")})
+	var client *http.Client = newVeilClient(v)
+
+	for requestURI, expectedStatus := range map[string]int{"/v2/snaps": http.StatusOK, "/v2/secret": http.StatusUnauthorized, "/v2/unlisted": http.StatusNotFound} {
+		if status := requestStatus(t, client, http.MethodGet, requestURI); status != expectedStatus {
+			t.Fatalf("expected status %d for %s, got %d", expectedStatus, requestURI, status)
+		}
+	}
+
+	requestStatus(t, client, http.MethodGet, "/v2/snaps")
+	adminRequest(t, adminClient, http.MethodPost, "/reload", "", nil)
+
+	var stats adminStats
+	if status := adminRequest(t, adminClient, http.MethodGet, "/stats", "", &stats); status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+
+	if stats.Requests != 4 || stats.Reloads != 1 || stats.UpstreamErrors != 0 {
+		t.Errorf("expected 4 requests, 1 reload and no upstream errors, got %+v", stats)
+	}
+
+	var expectedDecisions map[string]int64 = map[string]int64{DecisionAllowed: 2, DecisionForbidden: 1, DecisionNotFound: 1}
+	if !reflect.DeepEqual(stats.Decisions, expectedDecisions) {
+		t.Errorf("expected the decisions %v, got %v", expectedDecisions, stats.Decisions)
+	}
+
+	if stats.UptimeSeconds <= 0 {
+		t.Errorf("expected a positive uptime, got %v", stats.UptimeSeconds)
+	}
+
+	// The admin API is only served on the admin socket
+	if status := requestStatus(t, client, http.MethodGet, "/stats"); status != http.StatusNotFound {
+		t.Errorf("expected the exposed socket to answer /stats with 404, got %d", status)
+	}
+}
+
+func TestAdminProfiling(t *testing.T) {
+	testCases := []struct {
+		name           string
+		profiling      bool
+		expectedStatus int
+	}{
+		{name: "enabled", profiling: true, expectedStatus: http.StatusOK},
+		{name: "disabled", profiling: false, expectedStatus: http.StatusNotFound},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			targetSocketPath, requestURIs := recordingTargetSocket(t)
+			v, adminClient := startAdminVeil(t, Options{
+				TargetSocketPath: targetSocketPath,
+				AccessRulesPath:  writeTestAccessRules(t, "GET~prefix:/debug/pprof/\n"),
+				AdminProfiling:   testCase.profiling,
+			})
+
+			response, err := adminClient.Get("http://veil/debug/pprof/")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body, err := io.ReadAll(response.Body)
+			response.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("expected the admin socket to answer with %d, got %d", testCase.expectedStatus, response.StatusCode)
+			}
+
+			if testCase.profiling && !strings.Contains(string(body), "goroutine") {
+				t.Errorf("expected the profile index, got %q", body)
+			}
+
+			for _, profileName := range profileNames {
+				response, err := adminClient.Get("http://veil/debug/pprof/" + profileName + "?debug=1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				response.Body.Close()
+
+				if response.StatusCode != testCase.expectedStatus {
+					t.Errorf("expected the admin socket to answer %s with %d, got %d", profileName, testCase.expectedStatus, response.StatusCode)
+				}
+			}
+
+			// Even where the rules allow it, the path is relayed to the
+			// target socket rather than served with the profiles
+			var client *http.Client = newVeilClient(v)
+			if status := requestStatus(t, client, http.MethodGet, "/debug/pprof/"); status != http.StatusOK {
+				t.Fatalf("expected status 200 from the target socket, got %d", status)
+			}
+
+			if requestURI := <-requestURIs; requestURI != "/debug/pprof/" {
+				t.Errorf("expected /debug/pprof/ to reach the target socket, got %q", requestURI)
+			}
+		})
+	}
+}
+
+// expvarCounters : The counters the veil serves in the JSON format of expvar
+type expvarCounters struct {
+	RelayedRequests  int64 `json:"veil_relayed_requests"`
+	UpstreamErrors   int64 `json:"veil_upstream_errors"`
+	InFlightRequests int64 `json:"veil_requests_in_flight"`
+}
+
+// readExpvarCounters : Reads the counters served on the admin socket
+func readExpvarCounters(t *testing.T, adminClient *http.Client) expvarCounters {
+	t.Helper()
+
+	response, err := adminClient.Get("http://veil/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	var counters expvarCounters
+	if err := json.NewDecoder(response.Body).Decode(&counters); err != nil {
+		t.Fatal(err)
+	}
+
+	return counters
+}
+
+func TestAdminExpvar(t *testing.T) {
+	var slowRequestStarted chan struct{} = make(chan struct{})
+	var releaseSlowRequest chan struct{} = make(chan struct{})
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/slow":
+			close(slowRequestStarted)
+			<-releaseSlowRequest
+		case "/v2/dropped":
+			connection, _, _ := w.(http.Hijacker).Hijack()
+			connection.Close()
+		}
+	}))
+
+	v, adminClient := startAdminVeil(t, Options{TargetSocketPath: targetSocketPath, AccessRulesPath: writeTestAccessRules(t, "GET~prefix:/v2/\n")})
+	var client *http.Client = newVeilClient(v)
+
+	// The counters are kept by each Veil, so those of another Veil in the
+	// process are left untouched
+	_, otherAdminClient := startAdminVeil(t, Options{TargetSocketPath: targetSocketPath, AccessRulesPath: writeTestAccessRules(t, "GET~prefix:/v2/\n")})
+
+	testCases := []struct {
+		requestURI       string
+		expectedStatus   int
+		expectedCounters expvarCounters
+	}{
+		{requestURI: "/v2/snaps", expectedStatus: http.StatusOK, expectedCounters: expvarCounters{RelayedRequests: 1}},
+		{requestURI: "/v2/apps", expectedStatus: http.StatusOK, expectedCounters: expvarCounters{RelayedRequests: 2}},
+		{requestURI: "/v2/dropped", expectedStatus: http.StatusBadGateway, expectedCounters: expvarCounters{RelayedRequests: 3, UpstreamErrors: 1}},
+		{requestURI: "/unlisted", expectedStatus: http.StatusNotFound, expectedCounters: expvarCounters{RelayedRequests: 3, UpstreamErrors: 1}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.requestURI, func(t *testing.T) {
+			if status := requestStatus(t, client, http.MethodGet, testCase.requestURI); status != testCase.expectedStatus {
+				t.Fatalf("expected status %d, got %d", testCase.expectedStatus, status)
+			}
+
+			if counters := readExpvarCounters(t, adminClient); counters != testCase.expectedCounters {
+				t.Errorf("expected the counters %+v, got %+v", testCase.expectedCounters, counters)
+			}
+
+			if counters := readExpvarCounters(t, otherAdminClient); counters != (expvarCounters{}) {
+				t.Errorf("expected the other veil's counters to be untouched, got %+v", counters)
+			}
+		})
+	}
+
+	// A request is counted as in flight until its response is relayed
+	var slowRequestDone chan int = make(chan int)
+	go func() {
+		slowRequestDone <- requestStatus(t, client, http.MethodGet, "/v2/slow")
+	}()
+
+	<-slowRequestStarted
+	if inFlightRequests := readExpvarCounters(t, adminClient).InFlightRequests; inFlightRequests != 1 {
+		t.Errorf("expected 1 request in flight, got %d", inFlightRequests)
+	}
+
+	close(releaseSlowRequest)
+	<-slowRequestDone
+	if inFlightRequests := readExpvarCounters(t, adminClient).InFlightRequests; inFlightRequests != 0 {
+		t.Errorf("expected no requests in flight, got %d", inFlightRequests)
+	}
+
+	// The counters are served alongside those expvar publishes of its own
+	response, err := adminClient.Get("http://veil/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	var vars map[string]json.RawMessage
+	if err := json.NewDecoder(response.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"cmdline", "memstats"} {
+		if _, exists := vars[name]; !exists {
+			t.Errorf("expected %s to be served", name)
+		}
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	var logged *bytes.Buffer = captureLog(t)
+	targetSocketPath, _ := recordingTargetSocket(t)
+	v, adminClient := startAdminVeil(t, Options{TargetSocketPath: targetSocketPath, AccessRulesPath: writeTestAccessRules(t, "GET~/v2/snaps\n")})
+	var client *http.Client = newVeilClient(v)
+
+	testCases := []struct {
+		name                 string
+		body                 string
+		expectedStatus       int
+		expectedLevel        string
+		expectedRequestLines bool
+	}{
+		{name: "default", expectedLevel: LogLevelInfo, expectedRequestLines: false},
+		{name: "debug", body: `{"level": "debug"}`, expectedStatus: http.StatusOK, expectedLevel: LogLevelDebug, expectedRequestLines: true},
+		{name: "unknown level", body: `{"level": "verbose"}`, expectedStatus: http.StatusBadRequest, expectedLevel: LogLevelDebug, expectedRequestLines: true},
+		{name: "malformed body", body: `{"level": 4}`, expectedStatus: http.StatusBadRequest, expectedLevel: LogLevelDebug, expectedRequestLines: true},
+		{name: "info", body: `{"level": "info"}`, expectedStatus: http.StatusOK, expectedLevel: LogLevelInfo, expectedRequestLines: false},
+		{name: "error", body: `{"level": "error"}`, expectedStatus: http.StatusOK, expectedLevel: LogLevelError, expectedRequestLines: false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if len(testCase.body) > 0 {
+				if status := adminRequest(t, adminClient, http.MethodPost, "/loglevel", testCase.body, nil); status != testCase.expectedStatus {
+					t.Errorf("expected status %d, got %d", testCase.expectedStatus, status)
+				}
+			}
+
+			var logLevel adminLogLevel
+			adminRequest(t, adminClient, http.MethodGet, "/loglevel", "", &logLevel)
+			if logLevel.Level != testCase.expectedLevel {
+				t.Errorf("expected the log level %s, got %s", testCase.expectedLevel, logLevel.Level)
+			}
+
+			logged.Reset()
+			if status := requestStatus(t, client, http.MethodGet, "/v2/snaps"); status != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", status)
+			}
+
+			if requestLines := strings.Contains(logged.String(), "Relaying GET /v2/snaps"); requestLines != testCase.expectedRequestLines {
+				t.Errorf("expected the request to be logged in detail to be %t, got %q", testCase.expectedRequestLines, logged.String())
+			}
+		})
+	}
+}
+
+// waitForTargetHealth : Waits for the admin socket to report the health of the
+// target socket as expected, returning its description
+func waitForTargetHealth(t *testing.T, adminClient *http.Client, socketPath string, expectedHealthy bool) adminTarget {
+	t.Helper()
+
+	var deadline time.Time = time.Now().Add(5 * time.Second)
+	for {
+		var targets []adminTarget
+		adminRequest(t, adminClient, http.MethodGet, "/targets", "", &targets)
+		for _, target := range targets {
+			if target.SocketPath == socketPath && target.Healthy == expectedHealthy && target.CheckedAt != nil {
+				return target
+			}
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s to be reported with healthy %t, got %+v", socketPath, expectedHealthy, targets)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAdminTargetHealth(t *testing.T) {
+	// The first target socket keeps serving requests while failing its
+	// health checks, so that only the checks take it out of rotation
+	var failingHealthChecks int32
+	var flakySocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && atomic.LoadInt32(&failingHealthChecks) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("X-Target", "flaky")
+	}))
+	var steadySocketPath string = namedTargetSocket(t, "steady")
+
+	v, adminClient := startAdminVeil(t, Options{
+		TargetSocketPaths:    []string{flakySocketPath, steadySocketPath},
+		AccessRulesPath:      writeTestAccessRules(t, "GET~/v2/snaps\n"),
+		TargetHealthInterval: 20 * time.Millisecond,
+		TargetHealthPath:     "/healthz",
+	})
+	var client *http.Client = newVeilClient(v)
+
+	// relayedTargets : Makes several requests, returning the set of target
+	// sockets that answered them
+	var relayedTargets func() map[string]bool = func() map[string]bool {
+		var targets map[string]bool = map[string]bool{}
+		for i := 0; i < 4; i++ {
+			response, err := client.Get("http://veil/v2/snaps")
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			targets[response.Header.Get("X-Target")] = true
+		}
+
+		return targets
+	}
+
+	testCases := []struct {
+		name            string
+		failing         int32
+		expectedHealthy bool
+		expectedTargets map[string]bool
+	}{
+		{name: "healthy", failing: 0, expectedHealthy: true, expectedTargets: map[string]bool{"flaky": true, "steady": true}},
+		{name: "down", failing: 1, expectedHealthy: false, expectedTargets: map[string]bool{"steady": true}},
+		{name: "recovered", failing: 0, expectedHealthy: true, expectedTargets: map[string]bool{"flaky": true, "steady": true}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			atomic.StoreInt32(&failingHealthChecks, testCase.failing)
+			var target adminTarget = waitForTargetHealth(t, adminClient, flakySocketPath, testCase.expectedHealthy)
+			if hasError := len(target.Error) > 0; hasError == testCase.expectedHealthy {
+				t.Errorf("expected an error to be reported to be %t, got %q", !testCase.expectedHealthy, target.Error)
+			}
+
+			if targets := relayedTargets(); !reflect.DeepEqual(targets, testCase.expectedTargets) {
+				t.Errorf("expected the requests to be relayed to %v, got %v", testCase.expectedTargets, targets)
+			}
+		})
+	}
+
+	waitForTargetHealth(t, adminClient, steadySocketPath, true)
+	if status := adminRequest(t, adminClient, http.MethodPost, "/targets", "", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", status)
+	}
+}
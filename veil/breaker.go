@@ -0,0 +1,155 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"sync"
+	"time"
+)
+
+const circuitClosed int = 0
+const circuitOpen int = 1
+const circuitHalfOpen int = 2
+
+// circuitBreaker : Tracks failures to communicate with the target socket and,
+// once too many occur in close succession, refuses requests outright for a
+// cooldown period rather than letting each of them wait out its timeout. After
+// the cooldown, a single probe request is relayed; its success closes the
+// circuit again while its failure restarts the cooldown. Each change of state
+// begins a new generation, and the outcomes of requests admitted in an earlier
+// generation are disregarded, so that a slow request admitted before the
+// circuit opened cannot close it in place of the probe.
+type circuitBreaker struct {
+	mutex sync.Mutex
+
+	// threshold is the number of consecutive failures that opens the circuit
+	threshold int
+	// window bounds the time between the first and last of those failures
+	window time.Duration
+	// cooldown is the time for which requests are refused once open
+	cooldown time.Duration
+
+	state        int
+	generation   uint64
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	probing      bool
+}
+
+// newCircuitBreaker : Creates a closed circuit breaker
+func newCircuitBreaker(threshold int, window time.Duration, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		state:     circuitClosed,
+	}
+}
+
+// transition : Changes the state of the circuit, beginning a new generation.
+// The breaker must be locked.
+func (breaker *circuitBreaker) transition(state int) {
+	breaker.state = state
+	breaker.generation++
+	breaker.probing = false
+}
+
+// allow : Reports whether a request may be relayed to the target socket, along
+// with the generation in which it was admitted. Every allowed request must be
+// followed by a call to record or release with that generation.
+func (breaker *circuitBreaker) allow() (uint64, bool) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	switch breaker.state {
+	case circuitOpen:
+		if time.Since(breaker.openedAt) < breaker.cooldown {
+			return breaker.generation, false
+		}
+
+		logInfo("Circuit breaker half-open, probing target socket")
+		breaker.transition(circuitHalfOpen)
+		breaker.probing = true
+		return breaker.generation, true
+	case circuitHalfOpen:
+		if breaker.probing {
+			return breaker.generation, false
+		}
+
+		breaker.probing = true
+		return breaker.generation, true
+	default:
+		return breaker.generation, true
+	}
+}
+
+// record : Notes whether a request admitted in the given generation failed to
+// communicate with the target socket, opening or closing the circuit as
+// appropriate. Requests admitted in an earlier generation are disregarded.
+func (breaker *circuitBreaker) record(generation uint64, failed bool) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	if generation != breaker.generation || breaker.state == circuitOpen {
+		return
+	}
+
+	if !failed {
+		if breaker.state != circuitClosed {
+			logInfo("Circuit breaker closed")
+			breaker.transition(circuitClosed)
+		}
+
+		breaker.failures = 0
+		return
+	}
+
+	if breaker.state == circuitHalfOpen {
+		logWarn("Circuit breaker reopened after failed probe")
+		breaker.transition(circuitOpen)
+		breaker.openedAt = time.Now()
+		return
+	}
+
+	if breaker.failures == 0 || time.Since(breaker.firstFailure) > breaker.window {
+		breaker.failures = 0
+		breaker.firstFailure = time.Now()
+	}
+
+	breaker.failures++
+	if breaker.failures >= breaker.threshold {
+		logWarn("Circuit breaker opened after", breaker.failures, "consecutive upstream failures")
+		breaker.transition(circuitOpen)
+		breaker.openedAt = time.Now()
+		breaker.failures = 0
+	}
+}
+
+// release : Frees the admission of a request whose outcome says nothing about
+// the target socket, such as one abandoned by its client, without changing the
+// state of the circuit. A probe released this way lets another request probe.
+func (breaker *circuitBreaker) release(generation uint64) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	if generation == breaker.generation && breaker.state == circuitHalfOpen {
+		breaker.probing = false
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"testing"
+	"time"
+)
+
+// expireCooldown : Ages the moment the circuit opened past its cooldown rather
+// than waiting for it
+func expireCooldown(breaker *circuitBreaker) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.openedAt = time.Now().Add(-breaker.cooldown)
+}
+
+// openCircuit : Records as many failures as it takes to open the circuit
+func openCircuit(t *testing.T, breaker *circuitBreaker) {
+	t.Helper()
+
+	for i := 0; i < breaker.threshold; i++ {
+		generation, allowed := breaker.allow()
+		if !allowed {
+			t.Fatalf("expected request %d to be allowed while closed", i+1)
+		}
+
+		breaker.record(generation, true)
+	}
+
+	if breaker.state != circuitOpen {
+		t.Fatalf("expected the circuit to open after %d failures, got state %d", breaker.threshold, breaker.state)
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	testCases := []struct {
+		name          string
+		probeFailed   bool
+		expectedState int
+	}{
+		{name: "successful probe closes the circuit", probeFailed: false, expectedState: circuitClosed},
+		{name: "failed probe reopens the circuit", probeFailed: true, expectedState: circuitOpen},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var breaker *circuitBreaker = newCircuitBreaker(3, time.Minute, time.Minute)
+			openCircuit(t, breaker)
+
+			if _, allowed := breaker.allow(); allowed {
+				t.Fatal("expected requests to be refused during the cooldown")
+			}
+
+			expireCooldown(breaker)
+			probe, allowed := breaker.allow()
+			if !allowed || breaker.state != circuitHalfOpen {
+				t.Fatalf("expected a probe to be allowed once the cooldown elapsed, got allowed %t in state %d", allowed, breaker.state)
+			}
+
+			if _, allowed := breaker.allow(); allowed {
+				t.Fatal("expected requests to be refused while the probe is outstanding")
+			}
+
+			breaker.record(probe, testCase.probeFailed)
+			if breaker.state != testCase.expectedState {
+				t.Fatalf("expected state %d after the probe, got %d", testCase.expectedState, breaker.state)
+			}
+
+			_, allowed = breaker.allow()
+			if allowed != (testCase.expectedState == circuitClosed) {
+				t.Fatalf("expected allowed %t after the probe, got %t", testCase.expectedState == circuitClosed, allowed)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerFailureWindow(t *testing.T) {
+	var breaker *circuitBreaker = newCircuitBreaker(2, time.Minute, time.Minute)
+
+	generation, _ := breaker.allow()
+	breaker.record(generation, true)
+
+	// The first failure is aged out of the window rather than waiting
+	breaker.firstFailure = time.Now().Add(-2 * time.Minute)
+	generation, _ = breaker.allow()
+	breaker.record(generation, true)
+	if breaker.state != circuitClosed {
+		t.Fatalf("expected failures outside the window not to open the circuit, got state %d", breaker.state)
+	}
+
+	generation, _ = breaker.allow()
+	breaker.record(generation, true)
+	if breaker.state != circuitOpen {
+		t.Fatalf("expected failures within the window to open the circuit, got state %d", breaker.state)
+	}
+}
+
+func TestCircuitBreakerIgnoresStaleResults(t *testing.T) {
+	var breaker *circuitBreaker = newCircuitBreaker(1, time.Minute, time.Minute)
+
+	// A slow request is admitted before the circuit opens
+	slow, _ := breaker.allow()
+	openCircuit(t, breaker)
+
+	expireCooldown(breaker)
+	probe, allowed := breaker.allow()
+	if !allowed {
+		t.Fatal("expected a probe to be allowed once the cooldown elapsed")
+	}
+
+	breaker.record(slow, false)
+	if breaker.state != circuitHalfOpen {
+		t.Fatalf("expected the slow request's success to be disregarded, got state %d", breaker.state)
+	}
+
+	if _, allowed := breaker.allow(); allowed {
+		t.Fatal("expected the slow request not to free the probe's slot")
+	}
+
+	breaker.record(probe, true)
+	if breaker.state != circuitOpen {
+		t.Fatalf("expected the failed probe to reopen the circuit, got state %d", breaker.state)
+	}
+}
+
+func TestCircuitBreakerRelease(t *testing.T) {
+	var breaker *circuitBreaker = newCircuitBreaker(1, time.Minute, time.Minute)
+	openCircuit(t, breaker)
+
+	expireCooldown(breaker)
+	abandoned, _ := breaker.allow()
+	breaker.release(abandoned)
+	if breaker.state != circuitHalfOpen {
+		t.Fatalf("expected a released probe to leave the circuit half-open, got state %d", breaker.state)
+	}
+
+	probe, allowed := breaker.allow()
+	if !allowed {
+		t.Fatal("expected a released probe to let another request probe")
+	}
+
+	breaker.record(probe, false)
+	if breaker.state != circuitClosed {
+		t.Fatalf("expected the successful probe to close the circuit, got state %d", breaker.state)
+	}
+}
@@ -0,0 +1,365 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"bytes"
+	"container/list"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thoas/go-funk"
+)
+
+// DefaultCacheMaxBytes : Total size of the response bodies held by the
+// response cache when no other limit is configured
+const DefaultCacheMaxBytes int64 = 64 << 20
+
+// cachedResponse : A response to a GET request, held so that requests for the
+// same path and query can be answered without relaying them
+type cachedResponse struct {
+	key        string
+	statusCode int
+	header     http.Header
+	body       []byte
+	storedAt   time.Time
+
+	// varyValues holds the values, in the request that produced the response,
+	// of each request header named by the response's Vary header
+	varyValues map[string]string
+}
+
+// responseCache : Holds responses to GET requests for up to ttl, evicting the
+// least recently used responses once their bodies exceed maxBytes in total
+type responseCache struct {
+	mutex sync.Mutex
+
+	ttl      time.Duration
+	maxBytes int64
+
+	usedBytes int64
+	entries   map[string]*list.Element
+	recency   *list.List
+}
+
+// newResponseCache : Creates an empty response cache
+func newResponseCache(ttl time.Duration, maxBytes int64) *responseCache {
+	return &responseCache{
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		recency:  list.New(),
+	}
+}
+
+// responseCacheKey : Identifies the responses that may answer a request, by
+// its path and query
+func responseCacheKey(r *http.Request) string {
+	return r.URL.RequestURI()
+}
+
+// cacheDirectives : Lists the directives of the Cache-Control header, in lower
+// case and without their arguments, along with a Pragma of no-cache
+func cacheDirectives(header http.Header) []string {
+	var directives []string = []string{}
+	for _, cacheControl := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(cacheControl, ",") {
+			directive = strings.ToLower(strings.TrimSpace(strings.SplitN(directive, "=", 2)[0]))
+			if len(directive) > 0 {
+				directives = append(directives, directive)
+			}
+		}
+	}
+
+	if strings.EqualFold(strings.TrimSpace(header.Get("Pragma")), "no-cache") {
+		directives = append(directives, "no-cache")
+	}
+
+	return directives
+}
+
+// varyHeaderNames : Lists the request headers named by the Vary header of a
+// response
+func varyHeaderNames(header http.Header) []string {
+	var headerNames []string = []string{}
+	for _, vary := range header.Values("Vary") {
+		for _, headerName := range strings.Split(vary, ",") {
+			if headerName = strings.TrimSpace(headerName); len(headerName) > 0 {
+				headerNames = append(headerNames, http.CanonicalHeaderKey(headerName))
+			}
+		}
+	}
+
+	return headerNames
+}
+
+// varyValuesOf : Collects the values of the request headers that a response
+// varies by
+func varyValuesOf(headerNames []string, requestHeader http.Header) map[string]string {
+	var varyValues map[string]string = make(map[string]string)
+	for _, headerName := range headerNames {
+		varyValues[headerName] = strings.Join(requestHeader.Values(headerName), ",")
+	}
+
+	return varyValues
+}
+
+// get : Returns the unexpired response held for the request, if it was
+// produced by a request agreeing on the headers the response varies by
+func (cache *responseCache) get(r *http.Request) (*cachedResponse, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, exists := cache.entries[responseCacheKey(r)]
+	if !exists {
+		return nil, false
+	}
+
+	var entry *cachedResponse = element.Value.(*cachedResponse)
+	if time.Since(entry.storedAt) >= cache.ttl {
+		cache.remove(element)
+		return nil, false
+	}
+
+	for headerName, headerValue := range entry.varyValues {
+		if strings.Join(r.Header.Values(headerName), ",") != headerValue {
+			return nil, false
+		}
+	}
+
+	cache.recency.MoveToFront(element)
+	return entry, true
+}
+
+// store : Holds the response, replacing any held for the same request and
+// evicting the least recently used responses until the bodies fit
+func (cache *responseCache) store(entry *cachedResponse) {
+	if int64(len(entry.body)) > cache.maxBytes {
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if element, exists := cache.entries[entry.key]; exists {
+		cache.remove(element)
+	}
+
+	for cache.usedBytes+int64(len(entry.body)) > cache.maxBytes {
+		cache.remove(cache.recency.Back())
+	}
+
+	cache.entries[entry.key] = cache.recency.PushFront(entry)
+	cache.usedBytes += int64(len(entry.body))
+}
+
+// remove : Discards a held response. The cache must be locked.
+func (cache *responseCache) remove(element *list.Element) {
+	var entry *cachedResponse = cache.recency.Remove(element).(*cachedResponse)
+	delete(cache.entries, entry.key)
+	cache.usedBytes -= int64(len(entry.body))
+}
+
+// etagMatches : Reports whether the entity tag is among those listed in the
+// If-None-Match headers of a request, or these match any entity tag. Entity
+// tags are compared weakly, disregarding any W/ prefix, as If-None-Match
+// requires.
+func etagMatches(ifNoneMatch []string, etag string) bool {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	for _, listedETags := range ifNoneMatch {
+		for _, listedETag := range strings.Split(listedETags, ",") {
+			listedETag = strings.TrimSpace(listedETag)
+			if listedETag == "*" || strings.TrimPrefix(listedETag, "W/") == etag {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// cachingResponseWriter : Wraps a response writer to keep a copy of the status,
+// headers and body written to it, up to a limit. The headers set by the
+// wrapped handler are kept apart from those already set on the response, and
+// merged into them as the response is written.
+type cachingResponseWriter struct {
+	http.ResponseWriter
+
+	header      http.Header
+	statusCode  int
+	body        bytes.Buffer
+	maxBytes    int64
+	overflowed  bool
+	flushed     bool
+	wroteHeader bool
+}
+
+func (w *cachingResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *cachingResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+	w.statusCode = statusCode
+	copyHeaders(w.ResponseWriter.Header(), w.header)
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *cachingResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.overflowed {
+		if int64(w.body.Len()+len(data)) > w.maxBytes {
+			w.overflowed = true
+			w.body.Reset()
+		} else {
+			w.body.Write(data)
+		}
+	}
+
+	return w.ResponseWriter.Write(data)
+}
+
+// Flush : Flushes the underlying response writer, if it supports flushing.
+// Flushed responses are being streamed, so are not kept.
+func (w *cachingResponseWriter) Flush() {
+	w.flushed = true
+	if flusher, canFlush := w.ResponseWriter.(http.Flusher); canFlush {
+		flusher.Flush()
+	}
+}
+
+// Unwrap : Returns the underlying response writer, for http.ResponseController
+func (w *cachingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// cacheableResponse : Reports whether a response recorded by the caching
+// response writer may be held, which it may only be if it is a complete 200
+// response to be shared among clients. As RFC 9111 requires of shared caches,
+// a response to a request carrying credentials is only held if it is marked
+// public, s-maxage or must-revalidate.
+func cacheableResponse(w *cachingResponseWriter, requestHeader http.Header) bool {
+	if w.statusCode != http.StatusOK || w.overflowed || w.flushed {
+		return false
+	}
+
+	var directives []string = cacheDirectives(w.header)
+	if funk.ContainsString(directives, "no-store") || funk.ContainsString(directives, "no-cache") || funk.ContainsString(directives, "private") {
+		return false
+	}
+
+	if len(requestHeader.Values("Authorization")) > 0 &&
+		!funk.ContainsString(directives, "public") && !funk.ContainsString(directives, "s-maxage") && !funk.ContainsString(directives, "must-revalidate") {
+		return false
+	}
+
+	if len(w.header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+
+	for _, headerName := range varyHeaderNames(w.header) {
+		if headerName == "*" {
+			return false
+		}
+	}
+
+	if mediaType, _, err := mime.ParseMediaType(w.header.Get("Content-Type")); err == nil && mediaType == "text/event-stream" {
+		return false
+	}
+
+	if contentLength := w.header.Get("Content-Length"); len(contentLength) > 0 && contentLength != strconv.Itoa(w.body.Len()) {
+		return false
+	}
+
+	return true
+}
+
+// withResponseCache : Wraps a relaying handler such that GET requests are
+// answered from the cache when an unexpired response is held for them, and
+// successful responses are held for subsequent requests. A conditional
+// request whose If-None-Match names the ETag of the held response is answered
+// with 304 Not Modified. A client sending Cache-Control: no-cache has its
+// request relayed and the cache refreshed with the response, while one
+// sending no-store, or any cookie, bypasses the cache.
+func withResponseCache(cache *responseCache, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var directives []string = cacheDirectives(r.Header)
+		if r.Method != http.MethodGet || isUpgradeRequest(r) || funk.ContainsString(directives, "no-store") || len(r.Header.Values("Cookie")) > 0 {
+			next(w, r)
+			return
+		}
+
+		if !funk.ContainsString(directives, "no-cache") {
+			if entry, hit := cache.get(r); hit {
+				logDebug("Answering", r.Method, r.URL.RequestURI(), "from the response cache", "request_id="+r.Header.Get(requestIDHeader))
+				recordRequestDecision(r.Context(), DecisionAllowed)
+				copyHeaders(w.Header(), entry.header)
+				w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.storedAt).Seconds())))
+
+				// A client already holding the cached response is told so
+				// rather than sent the body again
+				if etag := entry.header.Get("ETag"); len(etag) > 0 && etagMatches(r.Header.Values("If-None-Match"), etag) {
+					w.Header().Del("Content-Length")
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+
+				w.WriteHeader(entry.statusCode)
+				w.Write(entry.body)
+				return
+			}
+		}
+
+		r, outcome := withRequestOutcome(r)
+		var recordingWriter *cachingResponseWriter = &cachingResponseWriter{
+			ResponseWriter: w,
+			header:         make(http.Header),
+			maxBytes:       cache.maxBytes,
+		}
+
+		next(recordingWriter, r)
+		if !recordingWriter.wroteHeader {
+			recordingWriter.WriteHeader(http.StatusOK)
+		}
+
+		if _, upstreamError := outcome.snapshot(); upstreamError != nil || !cacheableResponse(recordingWriter, r.Header) {
+			return
+		}
+
+		cache.store(&cachedResponse{
+			key:        responseCacheKey(r),
+			statusCode: recordingWriter.statusCode,
+			header:     recordingWriter.header.Clone(),
+			body:       append([]byte{}, recordingWriter.body.Bytes()...),
+			storedAt:   time.Now(),
+			varyValues: varyValuesOf(varyHeaderNames(recordingWriter.header), r.Header),
+		})
+	}
+}
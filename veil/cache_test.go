@@ -0,0 +1,338 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// cacheTestResponse : Status and headers with which the test upstream answers
+// requests for a path
+type cacheTestResponse struct {
+	statusCode int
+	header     http.Header
+}
+
+// cacheTestRequest : Request made through the response cache, along with
+// whether it is expected to be answered from the cache
+type cacheTestRequest struct {
+	path         string
+	header       http.Header
+	expectCached bool
+}
+
+// cacheTestUpstream : Stands in for the relay behind the response cache,
+// counting the requests that reach it and answering each with a four-byte
+// body numbering it
+type cacheTestUpstream struct {
+	responses map[string]cacheTestResponse
+	requests  int
+}
+
+func (upstream *cacheTestUpstream) serve(w http.ResponseWriter, r *http.Request) {
+	upstream.requests++
+
+	var response cacheTestResponse = upstream.responses[r.URL.Path]
+	copyHeaders(w.Header(), response.header)
+	if response.statusCode != 0 {
+		w.WriteHeader(response.statusCode)
+	}
+
+	fmt.Fprintf(w, "%04d", upstream.requests)
+}
+
+// requestThroughCache : Makes a request through the response cache, reporting
+// whether it was answered without reaching the upstream
+func requestThroughCache(cached http.HandlerFunc, upstream *cacheTestUpstream, request cacheTestRequest) (*httptest.ResponseRecorder, bool) {
+	var upstreamRequests int = upstream.requests
+	var r *http.Request = httptest.NewRequest(http.MethodGet, request.path, nil)
+	copyHeaders(r.Header, request.header)
+
+	var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+	cached(recorder, r)
+	return recorder, upstream.requests == upstreamRequests
+}
+
+func TestResponseCacheStoragePolicy(t *testing.T) {
+	var testCases = []struct {
+		name      string
+		responses map[string]cacheTestResponse
+		requests  []cacheTestRequest
+	}{
+		{
+			name:     "repeated request",
+			requests: []cacheTestRequest{{path: "/a"}, {path: "/a", expectCached: true}},
+		},
+		{
+			name:     "different query",
+			requests: []cacheTestRequest{{path: "/a?x=1"}, {path: "/a?x=2"}, {path: "/a?x=1", expectCached: true}},
+		},
+		{
+			name:      "non-200 response",
+			responses: map[string]cacheTestResponse{"/a": {statusCode: http.StatusInternalServerError}},
+			requests:  []cacheTestRequest{{path: "/a"}, {path: "/a"}},
+		},
+		{
+			name:      "no-store response",
+			responses: map[string]cacheTestResponse{"/a": {header: http.Header{"Cache-Control": {"no-store"}}}},
+			requests:  []cacheTestRequest{{path: "/a"}, {path: "/a"}},
+		},
+		{
+			name:      "private response",
+			responses: map[string]cacheTestResponse{"/a": {header: http.Header{"Cache-Control": {"private, max-age=60"}}}},
+			requests:  []cacheTestRequest{{path: "/a"}, {path: "/a"}},
+		},
+		{
+			name:      "response setting a cookie",
+			responses: map[string]cacheTestResponse{"/a": {header: http.Header{"Set-Cookie": {"session=1"}}}},
+			requests:  []cacheTestRequest{{path: "/a"}, {path: "/a"}},
+		},
+		{
+			name:     "client sending no-store",
+			requests: []cacheTestRequest{{path: "/a"}, {path: "/a", header: http.Header{"Cache-Control": {"no-store"}}}},
+		},
+		{
+			name: "client sending no-cache",
+			requests: []cacheTestRequest{
+				{path: "/a"},
+				{path: "/a", header: http.Header{"Cache-Control": {"no-cache"}}},
+				{path: "/a", expectCached: true},
+			},
+		},
+		{
+			name: "client sending a cookie",
+			requests: []cacheTestRequest{
+				{path: "/a"},
+				{path: "/a", header: http.Header{"Cookie": {"session=1"}}},
+				{path: "/b", header: http.Header{"Cookie": {"session=1"}}},
+				{path: "/b"},
+			},
+		},
+		{
+			name: "credentials without shared caching",
+			requests: []cacheTestRequest{
+				{path: "/a", header: http.Header{"Authorization": {"Bearer alice"}}},
+				{path: "/a", header: http.Header{"Authorization": {"Bearer bob"}}},
+				{path: "/a"},
+			},
+		},
+		{
+			name:      "credentials with public response",
+			responses: map[string]cacheTestResponse{"/a": {header: http.Header{"Cache-Control": {"public"}}}},
+			requests: []cacheTestRequest{
+				{path: "/a", header: http.Header{"Authorization": {"Bearer alice"}}},
+				{path: "/a", header: http.Header{"Authorization": {"Bearer bob"}}, expectCached: true},
+			},
+		},
+		{
+			name:      "credentials with s-maxage response",
+			responses: map[string]cacheTestResponse{"/a": {header: http.Header{"Cache-Control": {"s-maxage=60"}}}},
+			requests: []cacheTestRequest{
+				{path: "/a", header: http.Header{"Authorization": {"Bearer alice"}}},
+				{path: "/a", expectCached: true},
+			},
+		},
+		{
+			name:      "credentials with must-revalidate response",
+			responses: map[string]cacheTestResponse{"/a": {header: http.Header{"Cache-Control": {"must-revalidate"}}}},
+			requests: []cacheTestRequest{
+				{path: "/a", header: http.Header{"Authorization": {"Bearer alice"}}},
+				{path: "/a", expectCached: true},
+			},
+		},
+		{
+			name:      "varying response",
+			responses: map[string]cacheTestResponse{"/a": {header: http.Header{"Vary": {"Accept"}}}},
+			requests: []cacheTestRequest{
+				{path: "/a", header: http.Header{"Accept": {"text/plain"}}},
+				{path: "/a", header: http.Header{"Accept": {"text/plain"}}, expectCached: true},
+				{path: "/a", header: http.Header{"Accept": {"application/json"}}},
+			},
+		},
+		{
+			name:      "response varying by everything",
+			responses: map[string]cacheTestResponse{"/a": {header: http.Header{"Vary": {"*"}}}},
+			requests:  []cacheTestRequest{{path: "/a"}, {path: "/a"}},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var upstream *cacheTestUpstream = &cacheTestUpstream{responses: testCase.responses}
+			var cached http.HandlerFunc = withResponseCache(newResponseCache(time.Minute, DefaultCacheMaxBytes), upstream.serve)
+			for i, request := range testCase.requests {
+				if _, wasCached := requestThroughCache(cached, upstream, request); wasCached != request.expectCached {
+					t.Errorf("request %d for %s: expected cached to be %v, got %v", i, request.path, request.expectCached, wasCached)
+				}
+			}
+		})
+	}
+}
+
+func TestResponseCacheHit(t *testing.T) {
+	var upstream *cacheTestUpstream = &cacheTestUpstream{}
+	var cached http.HandlerFunc = withResponseCache(newResponseCache(time.Minute, DefaultCacheMaxBytes), upstream.serve)
+
+	first, _ := requestThroughCache(cached, upstream, cacheTestRequest{path: "/a"})
+	second, wasCached := requestThroughCache(cached, upstream, cacheTestRequest{path: "/a"})
+	if !wasCached {
+		t.Fatal("expected the second request to be answered from the cache")
+	}
+
+	if second.Code != http.StatusOK || second.Body.String() != first.Body.String() {
+		t.Errorf("expected the cached response 200 %q, got %d %q", first.Body.String(), second.Code, second.Body.String())
+	}
+
+	if len(second.Header().Get("Age")) == 0 {
+		t.Error("expected the cached response to carry an Age header")
+	}
+}
+
+func TestResponseCacheExpiry(t *testing.T) {
+	var upstream *cacheTestUpstream = &cacheTestUpstream{}
+	var cache *responseCache = newResponseCache(time.Minute, DefaultCacheMaxBytes)
+	var cached http.HandlerFunc = withResponseCache(cache, upstream.serve)
+
+	requestThroughCache(cached, upstream, cacheTestRequest{path: "/a"})
+	if _, wasCached := requestThroughCache(cached, upstream, cacheTestRequest{path: "/a"}); !wasCached {
+		t.Fatal("expected the response to be cached before it expires")
+	}
+
+	// The held response is aged past its time to live rather than waiting
+	for element := cache.recency.Front(); element != nil; element = element.Next() {
+		element.Value.(*cachedResponse).storedAt = time.Now().Add(-time.Minute)
+	}
+
+	if _, wasCached := requestThroughCache(cached, upstream, cacheTestRequest{path: "/a"}); wasCached {
+		t.Fatal("expected the expired response to be relayed again")
+	}
+
+	if _, wasCached := requestThroughCache(cached, upstream, cacheTestRequest{path: "/a"}); !wasCached {
+		t.Fatal("expected the refreshed response to be cached")
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	var upstream *cacheTestUpstream = &cacheTestUpstream{}
+
+	// Each body is four bytes, so the cache holds two responses at once
+	var cache *responseCache = newResponseCache(time.Minute, 10)
+	var cached http.HandlerFunc = withResponseCache(cache, upstream.serve)
+
+	var requests = []cacheTestRequest{
+		{path: "/a"},
+		{path: "/b"},
+		{path: "/a", expectCached: true},
+		// Storing /c evicts /b, which was used less recently than /a
+		{path: "/c"},
+		{path: "/a", expectCached: true},
+		{path: "/c", expectCached: true},
+		{path: "/b"},
+	}
+
+	for i, request := range requests {
+		if _, wasCached := requestThroughCache(cached, upstream, request); wasCached != request.expectCached {
+			t.Errorf("request %d for %s: expected cached to be %v, got %v", i, request.path, request.expectCached, wasCached)
+		}
+	}
+
+	if cache.usedBytes > cache.maxBytes {
+		t.Errorf("expected at most %d bytes held, got %d", cache.maxBytes, cache.usedBytes)
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	testCases := []struct {
+		name          string
+		ifNoneMatch   []string
+		etag          string
+		expectedMatch bool
+	}{
+		{name: "same tag", ifNoneMatch: []string{`"v1"`}, etag: `"v1"`, expectedMatch: true},
+		{name: "different tag", ifNoneMatch: []string{`"v2"`}, etag: `"v1"`, expectedMatch: false},
+		{name: "weak request tag", ifNoneMatch: []string{`W/"v1"`}, etag: `"v1"`, expectedMatch: true},
+		{name: "weak response tag", ifNoneMatch: []string{`"v1"`}, etag: `W/"v1"`, expectedMatch: true},
+		{name: "tag within a list", ifNoneMatch: []string{`"v0", "v1"`}, etag: `"v1"`, expectedMatch: true},
+		{name: "tag within several headers", ifNoneMatch: []string{`"v0"`, `"v1"`}, etag: `"v1"`, expectedMatch: true},
+		{name: "any tag", ifNoneMatch: []string{"*"}, etag: `"v1"`, expectedMatch: true},
+		{name: "no tags", ifNoneMatch: nil, etag: `"v1"`, expectedMatch: false},
+		{name: "unquoted tag", ifNoneMatch: []string{"v1"}, etag: `"v1"`, expectedMatch: false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if match := etagMatches(testCase.ifNoneMatch, testCase.etag); match != testCase.expectedMatch {
+				t.Errorf("expected a match to be %t, got %t", testCase.expectedMatch, match)
+			}
+		})
+	}
+}
+
+func TestResponseCacheConditionalRequests(t *testing.T) {
+	var upstream *cacheTestUpstream = &cacheTestUpstream{responses: map[string]cacheTestResponse{
+		"/a": {header: http.Header{"ETag": {`"v1"`}}},
+	}}
+	var cached http.HandlerFunc = withResponseCache(newResponseCache(time.Minute, DefaultCacheMaxBytes), upstream.serve)
+
+	// The ETag of the relayed response is passed on to the client
+	first, _ := requestThroughCache(cached, upstream, cacheTestRequest{path: "/a"})
+	if etag := first.Header().Get("ETag"); etag != `"v1"` {
+		t.Fatalf("expected the ETag %q, got %q", `"v1"`, etag)
+	}
+
+	testCases := []struct {
+		name           string
+		ifNoneMatch    string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "matching tag", ifNoneMatch: `"v1"`, expectedStatus: http.StatusNotModified},
+		{name: "matching weak tag", ifNoneMatch: `W/"v1"`, expectedStatus: http.StatusNotModified},
+		{name: "any tag", ifNoneMatch: "*", expectedStatus: http.StatusNotModified},
+		{name: "different tag", ifNoneMatch: `"v2"`, expectedStatus: http.StatusOK, expectedBody: first.Body.String()},
+		{name: "unconditional", expectedStatus: http.StatusOK, expectedBody: first.Body.String()},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var header http.Header = http.Header{}
+			if len(testCase.ifNoneMatch) > 0 {
+				header.Set("If-None-Match", testCase.ifNoneMatch)
+			}
+
+			// Conditional or not, the request is answered without the upstream
+			recorder, wasCached := requestThroughCache(cached, upstream, cacheTestRequest{path: "/a", header: header})
+			if !wasCached {
+				t.Fatal("expected the request to be answered from the cache")
+			}
+
+			if recorder.Code != testCase.expectedStatus || recorder.Body.String() != testCase.expectedBody {
+				t.Errorf("expected %d %q, got %d %q", testCase.expectedStatus, testCase.expectedBody, recorder.Code, recorder.Body.String())
+			}
+
+			if etag := recorder.Header().Get("ETag"); etag != `"v1"` {
+				t.Errorf("expected the ETag %q, got %q", `"v1"`, etag)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// parseCIDRBlocks : Parses a list of CIDR blocks, such as "10.0.0.0/8" or
+// "fd00::/8"
+func parseCIDRBlocks(blocks []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet = []*net.IPNet{}
+	for _, block := range blocks {
+		_, network, err := net.ParseCIDR(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR block: %s", block)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// addressAllowed : Reports whether the IP address of a remote peer lies within
+// any of the networks. IPv4 addresses mapped into IPv6 match IPv4 networks.
+func addressAllowed(networks []*net.IPNet, remoteAddress string) bool {
+	host, _, err := net.SplitHostPort(remoteAddress)
+	if err != nil {
+		host = remoteAddress
+	}
+
+	var remoteIP net.IP = net.ParseIP(host)
+	if remoteIP == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(remoteIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withAllowedCIDRs : Wraps a request handler such that requests received over
+// TCP from addresses outside the networks are refused before they are handled
+// at all. Requests received on a UNIX Domain Socket are passed on untouched.
+func withAllowedCIDRs(networks []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, isTCP := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); !isTCP || addressAllowed(networks, r.RemoteAddr) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		logDebug("Refusing", r.Method, r.URL.RequestURI(), "from", r.RemoteAddr, "outside the allowed CIDR blocks")
+		writeErrorResponse(w, r, http.StatusForbidden, forbiddenAddressString)
+	})
+}
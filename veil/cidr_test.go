@@ -0,0 +1,148 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddressAllowed(t *testing.T) {
+	networks, err := parseCIDRBlocks([]string{"10.0.0.0/8", "192.168.1.0/24", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		remoteAddress   string
+		expectedAllowed bool
+	}{
+		{remoteAddress: "10.1.2.3:5000", expectedAllowed: true},
+		{remoteAddress: "192.168.1.255:5000", expectedAllowed: true},
+		{remoteAddress: "192.168.2.1:5000", expectedAllowed: false},
+		{remoteAddress: "11.0.0.1:5000", expectedAllowed: false},
+		{remoteAddress: "[fd00::1]:5000", expectedAllowed: true},
+		{remoteAddress: "[fe80::1]:5000", expectedAllowed: false},
+		{remoteAddress: "[::ffff:10.0.0.1]:5000", expectedAllowed: true},
+		{remoteAddress: "10.0.0.1", expectedAllowed: true},
+		{remoteAddress: "veil.example.com:5000", expectedAllowed: false},
+		{remoteAddress: "", expectedAllowed: false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.remoteAddress, func(t *testing.T) {
+			if allowed := addressAllowed(networks, testCase.remoteAddress); allowed != testCase.expectedAllowed {
+				t.Errorf("expected %s to be allowed to be %t, got %t", testCase.remoteAddress, testCase.expectedAllowed, allowed)
+			}
+		})
+	}
+}
+
+func TestParseCIDRBlocksRejected(t *testing.T) {
+	for _, block := range []string{"10.0.0.0", "10.0.0.0/33", "fd00::/129", "localhost/8", ""} {
+		t.Run(block, func(t *testing.T) {
+			if _, err := parseCIDRBlocks([]string{"10.0.0.0/8", block}); err == nil {
+				t.Errorf("expected %q to be rejected", block)
+			}
+		})
+	}
+}
+
+func TestAllowedCIDRs(t *testing.T) {
+	var allowedLoopback []string = []string{"10.0.0.0/8", "127.0.0.0/8"}
+	var refusedLoopback []string = []string{"10.0.0.0/8", "fd00::/8"}
+
+	testCases := []struct {
+		name           string
+		exposedAddress string
+		allowedCIDRs   []string
+		method         string
+		requestURI     string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "allowed over TCP", exposedAddress: "tcp://127.0.0.1:0", allowedCIDRs: allowedLoopback, expectedStatus: http.StatusOK},
+		{name: "refused over TCP", exposedAddress: "tcp://127.0.0.1:0", allowedCIDRs: refusedLoopback, expectedStatus: http.StatusForbidden, expectedBody: forbiddenAddressString},
+		{name: "unrestricted on a socket", allowedCIDRs: []string{"10.0.0.0/8"}, expectedStatus: http.StatusOK},
+		{name: "health path allowed over TCP", exposedAddress: "tcp://127.0.0.1:0", allowedCIDRs: allowedLoopback, requestURI: DefaultHealthPath, expectedStatus: http.StatusOK},
+		{name: "health path refused over TCP", exposedAddress: "tcp://127.0.0.1:0", allowedCIDRs: refusedLoopback, requestURI: DefaultHealthPath, expectedStatus: http.StatusForbidden, expectedBody: forbiddenAddressString},
+		{name: "preflight allowed over TCP", exposedAddress: "tcp://127.0.0.1:0", allowedCIDRs: allowedLoopback, method: http.MethodOptions, expectedStatus: http.StatusNoContent},
+		{name: "preflight refused over TCP", exposedAddress: "tcp://127.0.0.1:0", allowedCIDRs: refusedLoopback, method: http.MethodOptions, expectedStatus: http.StatusForbidden, expectedBody: forbiddenAddressString},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var exposedAddress string = testCase.exposedAddress
+			if len(exposedAddress) == 0 {
+				exposedAddress = filepath.Join(t.TempDir(), "veil.sock")
+			}
+
+			targetSocketPath, _ := recordingTargetSocket(t)
+			var v *Veil = startTestVeil(t, Options{
+				TargetSocketPath:   targetSocketPath,
+				ExposedAddress:     exposedAddress,
+				AccessRulesPath:    writeTestAccessRules(t, "GET~/v2/snaps\n"),
+				AllowedCIDRs:       testCase.allowedCIDRs,
+				HealthPath:         DefaultHealthPath,
+				CORSAllowedOrigins: []string{testCORSOrigin},
+			})
+
+			var method string = testCase.method
+			if len(method) == 0 {
+				method = http.MethodGet
+			}
+
+			var requestURI string = testCase.requestURI
+			if len(requestURI) == 0 {
+				requestURI = "/v2/snaps"
+			}
+
+			request, err := http.NewRequest(method, "http://veil"+requestURI, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if method == http.MethodOptions {
+				request.Header.Set("Origin", testCORSOrigin)
+				request.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			}
+
+			response, err := newVeilClient(v).Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d", testCase.expectedStatus, response.StatusCode)
+			}
+
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(testCase.expectedBody) > 0 && string(body) != testCase.expectedBody {
+				t.Errorf("expected the body %s, got %s", testCase.expectedBody, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipEncoding : Content coding with which relayed responses are compressed
+const gzipEncoding string = "gzip"
+
+// precompressedMediaTypes : Media types whose content is already compressed,
+// so gains nothing from being compressed again
+var precompressedMediaTypes []string = []string{
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/pdf",
+	"font/woff",
+	"font/woff2",
+}
+
+// acceptsGzip : Reports whether the client accepts gzip-encoded responses,
+// going by its Accept-Encoding header
+func acceptsGzip(r *http.Request) bool {
+	for _, acceptedEncodings := range r.Header.Values("Accept-Encoding") {
+		for _, acceptedEncoding := range strings.Split(acceptedEncodings, ",") {
+			var parameters []string = strings.Split(acceptedEncoding, ";")
+			var coding string = strings.ToLower(strings.TrimSpace(parameters[0]))
+			if coding != gzipEncoding && coding != "*" {
+				continue
+			}
+
+			var refused bool = false
+			for _, parameter := range parameters[1:] {
+				parameter = strings.ReplaceAll(parameter, " ", "")
+				if strings.HasPrefix(parameter, "q=") {
+					quality, err := strconv.ParseFloat(strings.TrimPrefix(parameter, "q="), 64)
+					refused = err != nil || quality == 0
+				}
+			}
+
+			if !refused {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isCompressible : Reports whether the response to a request would be made
+// smaller by compressing it. Responses without a body, partial responses,
+// responses already carrying a content coding and content that is already
+// compressed are left alone.
+func isCompressible(r *http.Request, response *http.Response) bool {
+	if r.Method == http.MethodHead || response.StatusCode == http.StatusNoContent || response.StatusCode == http.StatusNotModified || response.StatusCode == http.StatusPartialContent {
+		return false
+	}
+
+	if contentEncoding := response.Header.Get("Content-Encoding"); len(contentEncoding) > 0 && !strings.EqualFold(contentEncoding, "identity") {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil {
+		return true
+	}
+
+	for _, mediaTypePrefix := range []string{"image/", "audio/", "video/"} {
+		if strings.HasPrefix(mediaType, mediaTypePrefix) && mediaType != "image/svg+xml" {
+			return false
+		}
+	}
+
+	for _, precompressedMediaType := range precompressedMediaTypes {
+		if mediaType == precompressedMediaType {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isGzipEncoded : Reports whether a body is encoded with gzip alone, going by
+// its Content-Encoding header
+func isGzipEncoded(header http.Header) bool {
+	var contentEncoding string = strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	return contentEncoding == gzipEncoding || contentEncoding == "x-gzip"
+}
+
+// gzipRequestBody : The decompressed form of a gzip-encoded request body
+type gzipRequestBody struct {
+	*gzip.Reader
+	compressedBody io.ReadCloser
+}
+
+// newGzipRequestBody : Returns a reader decompressing the gzip-encoded body,
+// failing if the body does not begin with a gzip header
+func newGzipRequestBody(compressedBody io.ReadCloser) (*gzipRequestBody, error) {
+	decompressor, err := gzip.NewReader(compressedBody)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gzipRequestBody{Reader: decompressor, compressedBody: compressedBody}, nil
+}
+
+// Close : Closes both the decompressor and the compressed body
+func (body *gzipRequestBody) Close() error {
+	body.Reader.Close()
+	return body.compressedBody.Close()
+}
+
+// gzipResponseWriter : Wraps a response writer such that the body written to
+// it is compressed with gzip
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	compressor *gzip.Writer
+}
+
+// newGzipResponseWriter : Marks the response as gzip-encoded, dropping its
+// Content-Length since the compressed length is not known in advance, and
+// returns a writer compressing the body into it. The writer must be closed
+// once the body has been written.
+func newGzipResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Encoding", gzipEncoding)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	return &gzipResponseWriter{
+		ResponseWriter: w,
+		compressor:     gzip.NewWriter(w),
+	}
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	return w.compressor.Write(data)
+}
+
+// Close : Writes out the remainder of the compressed body
+func (w *gzipResponseWriter) Close() error {
+	return w.compressor.Close()
+}
+
+// Unwrap : Returns the underlying response writer, for http.ResponseController
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	testCases := []struct {
+		acceptEncoding string
+		expected       bool
+	}{
+		{acceptEncoding: "", expected: false},
+		{acceptEncoding: "gzip", expected: true},
+		{acceptEncoding: "deflate, GZIP", expected: true},
+		{acceptEncoding: "br;q=1.0, gzip;q=0.5", expected: true},
+		{acceptEncoding: "*", expected: true},
+		{acceptEncoding: "gzip;q=0", expected: false},
+		{acceptEncoding: "gzip; q=0.0, deflate", expected: false},
+		{acceptEncoding: "br, deflate", expected: false},
+		{acceptEncoding: "identity", expected: false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.acceptEncoding, func(t *testing.T) {
+			var r *http.Request = httptest.NewRequest(http.MethodGet, "/v2/snaps", nil)
+			r.Header.Set("Accept-Encoding", testCase.acceptEncoding)
+			if accepted := acceptsGzip(r); accepted != testCase.expected {
+				t.Errorf("expected %t, got %t", testCase.expected, accepted)
+			}
+		})
+	}
+}
+
+func TestRelayCompressesResponses(t *testing.T) {
+	var responseBody string = strings.Repeat(`{"name":"core","version":"16-2.61"},`, 64)
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		if contentEncoding := r.URL.Query().Get("encoding"); len(contentEncoding) > 0 {
+			w.Header().Set("Content-Encoding", contentEncoding)
+		}
+
+		io.WriteString(w, responseBody)
+	}))
+
+	var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{compressResponses: true})
+
+	testCases := []struct {
+		name             string
+		method           string
+		acceptEncoding   string
+		query            string
+		expectCompressed bool
+	}{
+		{name: "JSON for a client accepting gzip", acceptEncoding: "gzip", query: "type=application/json", expectCompressed: true},
+		{name: "JSON for a client not accepting gzip", query: "type=application/json"},
+		{name: "JSON for a client refusing gzip", acceptEncoding: "gzip;q=0", query: "type=application/json"},
+		{name: "already encoded", acceptEncoding: "gzip", query: "type=application/json&encoding=br"},
+		{name: "precompressed content type", acceptEncoding: "gzip", query: "type=application/zip"},
+		{name: "image", acceptEncoding: "gzip", query: "type=image/png"},
+		{name: "event stream", acceptEncoding: "gzip", query: "type=text/event-stream"},
+		{name: "HEAD request", method: http.MethodHead, acceptEncoding: "gzip", query: "type=application/json"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var method string = testCase.method
+			if len(method) == 0 {
+				method = http.MethodGet
+			}
+
+			var r *http.Request = httptest.NewRequest(method, "/v2/snaps?"+testCase.query, nil)
+			if len(testCase.acceptEncoding) > 0 {
+				r.Header.Set("Accept-Encoding", testCase.acceptEncoding)
+			}
+
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			relay(recorder, r)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", recorder.Code)
+			}
+
+			if compressed := recorder.Header().Get("Content-Encoding") == gzipEncoding; compressed != testCase.expectCompressed {
+				t.Fatalf("expected compression to be %t, got Content-Encoding %q", testCase.expectCompressed, recorder.Header().Get("Content-Encoding"))
+			}
+
+			if !testCase.expectCompressed {
+				if method == http.MethodGet && recorder.Body.String() != responseBody {
+					t.Errorf("expected the body to be relayed as it is, got %q", recorder.Body.String())
+				}
+
+				return
+			}
+
+			if !strings.Contains(recorder.Header().Get("Vary"), "Accept-Encoding") || len(recorder.Header().Get("Content-Length")) > 0 {
+				t.Errorf("expected Vary: Accept-Encoding without a Content-Length, got %v", recorder.Header())
+			}
+
+			if recorder.Body.Len() >= len(responseBody) {
+				t.Errorf("expected the body to be smaller than %d bytes, got %d", len(responseBody), recorder.Body.Len())
+			}
+
+			decompressor, err := gzip.NewReader(recorder.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if decompressedBody, err := io.ReadAll(decompressor); err != nil || string(decompressedBody) != responseBody {
+				t.Errorf("expected the body to decompress to the original, got %v", err)
+			}
+		})
+	}
+}
+
+// gzipCompress : Returns the data compressed with gzip
+func gzipCompress(t *testing.T, data string) string {
+	t.Helper()
+
+	var compressed strings.Builder
+	var compressor *gzip.Writer = gzip.NewWriter(&compressed)
+	if _, err := io.WriteString(compressor, data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := compressor.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return compressed.String()
+}
+
+func TestRelayDecompressesRequests(t *testing.T) {
+	type upstreamRequest struct {
+		body            string
+		contentEncoding string
+		contentLength   int64
+	}
+
+	var upstreamRequests chan upstreamRequest = make(chan upstreamRequest, 1)
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, err := io.ReadAll(r.Body); err == nil {
+			upstreamRequests <- upstreamRequest{string(body), r.Header.Get("Content-Encoding"), r.ContentLength}
+		}
+	}))
+
+	const maxBodyBytes int64 = 1024
+	var requestBody string = `{"action":"install","snaps":["core","hello"]}`
+	var compressedRequestBody string = gzipCompress(t, requestBody)
+	var bomb string = strings.Repeat("0", 64*1024)
+
+	testCases := []struct {
+		name             string
+		decompress       bool
+		body             string
+		contentEncoding  string
+		expectedStatus   int
+		expectedUpstream upstreamRequest
+	}{
+		{
+			name:             "gzip-encoded body",
+			decompress:       true,
+			body:             compressedRequestBody,
+			contentEncoding:  "gzip",
+			expectedStatus:   http.StatusOK,
+			expectedUpstream: upstreamRequest{body: requestBody, contentLength: -1},
+		},
+		{
+			name:             "unencoded body",
+			decompress:       true,
+			body:             requestBody,
+			expectedStatus:   http.StatusOK,
+			expectedUpstream: upstreamRequest{body: requestBody, contentLength: int64(len(requestBody))},
+		},
+		{
+			name:             "gzip-encoded body without decompression",
+			body:             compressedRequestBody,
+			contentEncoding:  "gzip",
+			expectedStatus:   http.StatusOK,
+			expectedUpstream: upstreamRequest{body: compressedRequestBody, contentEncoding: "gzip", contentLength: int64(len(compressedRequestBody))},
+		},
+		{
+			name:            "malformed gzip body",
+			decompress:      true,
+			body:            requestBody,
+			contentEncoding: "gzip",
+			expectedStatus:  http.StatusBadRequest,
+		},
+		{
+			name:            "decompressed body beyond the limit",
+			decompress:      true,
+			body:            gzipCompress(t, bomb),
+			contentEncoding: "gzip",
+			expectedStatus:  http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{decompressRequests: testCase.decompress, maxBodyBytes: maxBodyBytes})
+			var r *http.Request = httptest.NewRequest(http.MethodPost, "/v2/snaps", strings.NewReader(testCase.body))
+			if len(testCase.contentEncoding) > 0 {
+				r.Header.Set("Content-Encoding", testCase.contentEncoding)
+			}
+
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			relay(recorder, r)
+			if recorder.Code != testCase.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", testCase.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+
+			if testCase.expectedStatus != http.StatusOK {
+				return
+			}
+
+			if upstream := <-upstreamRequests; upstream != testCase.expectedUpstream {
+				t.Errorf("expected the target socket to receive %+v, got %+v", testCase.expectedUpstream, upstream)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/thoas/go-funk"
+)
+
+// corsAnyOrigin : Allowed origin permitting cross-origin requests from every
+// origin
+const corsAnyOrigin string = "*"
+
+// corsPolicy : The cross-origin requests that browsers are told to permit
+type corsPolicy struct {
+	allowedOrigins []string
+	allowedMethods []string
+	allowedHeaders []string
+}
+
+// allowsOrigin : Reports whether cross-origin requests from the origin are
+// permitted
+func (policy corsPolicy) allowsOrigin(origin string) bool {
+	return funk.ContainsString(policy.allowedOrigins, corsAnyOrigin) || funk.ContainsString(policy.allowedOrigins, origin)
+}
+
+// allowsHeaders : Reports whether every header named in the comma-separated
+// list may be sent with a cross-origin request
+func (policy corsPolicy) allowsHeaders(headerNames string) bool {
+	for _, headerName := range strings.Split(headerNames, ",") {
+		headerName = strings.TrimSpace(headerName)
+		if len(headerName) == 0 {
+			continue
+		}
+
+		var allowed bool = false
+		for _, allowedHeader := range policy.allowedHeaders {
+			if strings.EqualFold(allowedHeader, headerName) {
+				allowed = true
+			}
+		}
+
+		if !allowed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// setAllowedOrigin : Tells the browser that the response may be read by the
+// origin
+func (policy corsPolicy) setAllowedOrigin(header http.Header, origin string) {
+	if funk.ContainsString(policy.allowedOrigins, corsAnyOrigin) {
+		header.Set("Access-Control-Allow-Origin", corsAnyOrigin)
+		return
+	}
+
+	header.Set("Access-Control-Allow-Origin", origin)
+}
+
+// withCORS : Wraps a request handler such that preflight requests from the
+// allowed origins are answered directly, and the responses to their actual
+// requests carry the headers that let browsers read them. Preflight requests
+// for methods or headers the policy does not allow are answered without these
+// headers, so that browsers refuse to send the actual request.
+func withCORS(policy corsPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var origin string = r.Header.Get("Origin")
+		if len(origin) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !policy.allowsOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var requestedMethod string = r.Header.Get("Access-Control-Request-Method")
+		if r.Method != http.MethodOptions || len(requestedMethod) == 0 {
+			policy.setAllowedOrigin(w.Header(), origin)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		recordRequestDecision(r.Context(), DecisionPreflight)
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		if funk.ContainsString(policy.allowedMethods, requestedMethod) && policy.allowsHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+			policy.setAllowedOrigin(w.Header(), origin)
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(policy.allowedMethods, ", "))
+			if len(policy.allowedHeaders) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.allowedHeaders, ", "))
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
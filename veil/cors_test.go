@@ -0,0 +1,161 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// testCORSOrigin : Origin from which cross-origin requests are permitted
+const testCORSOrigin string = "https://app.example.com"
+
+func TestCORSPreflight(t *testing.T) {
+	var policy corsPolicy = corsPolicy{
+		allowedOrigins: []string{testCORSOrigin},
+		allowedMethods: []string{http.MethodGet, http.MethodPost},
+		allowedHeaders: []string{"Content-Type", "X-Allow-Interaction"},
+	}
+
+	testCases := []struct {
+		name                  string
+		policy                corsPolicy
+		origin                string
+		requestedMethod       string
+		requestedHeaders      string
+		expectedStatus        int
+		expectedAllowedOrigin string
+	}{
+		{name: "allowed", policy: policy, origin: testCORSOrigin, requestedMethod: http.MethodPost, requestedHeaders: "content-type, X-Allow-Interaction", expectedStatus: http.StatusNoContent, expectedAllowedOrigin: testCORSOrigin},
+		{name: "any origin", policy: corsPolicy{allowedOrigins: []string{corsAnyOrigin}, allowedMethods: policy.allowedMethods, allowedHeaders: policy.allowedHeaders}, origin: "https://other.example.com", requestedMethod: http.MethodGet, expectedStatus: http.StatusNoContent, expectedAllowedOrigin: corsAnyOrigin},
+		{name: "method not allowed", policy: policy, origin: testCORSOrigin, requestedMethod: http.MethodDelete, expectedStatus: http.StatusNoContent},
+		{name: "header not allowed", policy: policy, origin: testCORSOrigin, requestedMethod: http.MethodPost, requestedHeaders: "Content-Type, Authorization", expectedStatus: http.StatusNoContent},
+		{name: "origin not allowed", policy: policy, origin: "https://other.example.com", requestedMethod: http.MethodGet, expectedStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			// Requests that are not answered as preflight requests are left to
+			// the access rules, which do not permit OPTIONS
+			var handler http.Handler = withCORS(testCase.policy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}))
+
+			var r *http.Request = httptest.NewRequest(http.MethodOptions, "/v2/snaps", nil)
+			r.Header.Set("Origin", testCase.origin)
+			r.Header.Set("Access-Control-Request-Method", testCase.requestedMethod)
+			if len(testCase.requestedHeaders) > 0 {
+				r.Header.Set("Access-Control-Request-Headers", testCase.requestedHeaders)
+			}
+
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			handler.ServeHTTP(recorder, r)
+			if recorder.Code != testCase.expectedStatus {
+				t.Fatalf("expected status %d, got %d", testCase.expectedStatus, recorder.Code)
+			}
+
+			if allowedOrigin := recorder.Header().Get("Access-Control-Allow-Origin"); allowedOrigin != testCase.expectedAllowedOrigin {
+				t.Errorf("expected the allowed origin %q, got %q", testCase.expectedAllowedOrigin, allowedOrigin)
+			}
+
+			if len(testCase.expectedAllowedOrigin) == 0 {
+				if allowedMethods := recorder.Header().Get("Access-Control-Allow-Methods"); len(allowedMethods) > 0 {
+					t.Errorf("expected no allowed methods, got %q", allowedMethods)
+				}
+
+				return
+			}
+
+			if allowedMethods := recorder.Header().Get("Access-Control-Allow-Methods"); allowedMethods != "GET, POST" {
+				t.Errorf("expected the allowed methods %q, got %q", "GET, POST", allowedMethods)
+			}
+
+			if allowedHeaders := recorder.Header().Get("Access-Control-Allow-Headers"); allowedHeaders != "Content-Type, X-Allow-Interaction" {
+				t.Errorf("expected the allowed headers %q, got %q", "Content-Type, X-Allow-Interaction", allowedHeaders)
+			}
+
+			var expectedVary []string = []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"}
+			if vary := recorder.Header().Values("Vary"); !reflect.DeepEqual(vary, expectedVary) {
+				t.Errorf("expected Vary %q, got %q", expectedVary, vary)
+			}
+		})
+	}
+}
+
+func TestCORSRelayedResponses(t *testing.T) {
+	targetSocketPath, _ := recordingTargetSocket(t)
+	var v *Veil = startTestVeil(t, Options{
+		TargetSocketPath:   targetSocketPath,
+		ExposedAddress:     "tcp://127.0.0.1:0",
+		AccessRulesPath:    writeTestAccessRules(t, "GET~/v2/snaps\n"),
+		CORSAllowedOrigins: []string{testCORSOrigin},
+	})
+	var client *http.Client = newVeilClient(v)
+
+	testCases := []struct {
+		name                  string
+		method                string
+		origin                string
+		expectedStatus        int
+		expectedAllowedOrigin string
+		expectedVary          []string
+	}{
+		{name: "allowed origin", method: http.MethodGet, origin: testCORSOrigin, expectedStatus: http.StatusOK, expectedAllowedOrigin: testCORSOrigin, expectedVary: []string{"Origin"}},
+		{name: "other origin", method: http.MethodGet, origin: "https://other.example.com", expectedStatus: http.StatusOK, expectedVary: []string{"Origin"}},
+		{name: "same origin", method: http.MethodGet, expectedStatus: http.StatusOK},
+		{name: "preflight", method: http.MethodOptions, origin: testCORSOrigin, expectedStatus: http.StatusNoContent, expectedAllowedOrigin: testCORSOrigin, expectedVary: []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			request, err := http.NewRequest(testCase.method, "http://veil/v2/snaps", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(testCase.origin) > 0 {
+				request.Header.Set("Origin", testCase.origin)
+			}
+
+			if testCase.method == http.MethodOptions {
+				request.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			}
+
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d", testCase.expectedStatus, response.StatusCode)
+			}
+
+			if allowedOrigin := response.Header.Get("Access-Control-Allow-Origin"); allowedOrigin != testCase.expectedAllowedOrigin {
+				t.Errorf("expected the allowed origin %q, got %q", testCase.expectedAllowedOrigin, allowedOrigin)
+			}
+
+			if vary := response.Header.Values("Vary"); !reflect.DeepEqual(vary, testCase.expectedVary) {
+				t.Errorf("expected Vary %q, got %q", testCase.expectedVary, vary)
+			}
+		})
+	}
+}
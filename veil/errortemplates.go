@@ -0,0 +1,136 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"text/template"
+)
+
+// errorTemplateData : Values available to an error response template
+type errorTemplateData struct {
+	StatusCode int    `json:"status-code"`
+	Status     string `json:"status"`
+	Result     struct {
+		Message string `json:"message"`
+	} `json:"result"`
+
+	Message string `json:"-"`
+}
+
+// errorTemplates : Templates for the bodies of the veil's error responses, by
+// status code
+type errorTemplates map[int]*template.Template
+
+// loadErrorTemplates : Loads the error response templates from a JSON file
+// mapping status codes to Go templates, each of which is checked by rendering
+// it once
+func loadErrorTemplates(templatesPath string) (errorTemplates, error) {
+	templatesContents, errRead := os.ReadFile(templatesPath)
+	if errRead != nil {
+		return nil, errRead
+	}
+
+	var templateTexts map[string]string
+	if err := json.Unmarshal(templatesContents, &templateTexts); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	var templates errorTemplates = errorTemplates{}
+	for statusCodeString, templateText := range templateTexts {
+		statusCode, err := strconv.Atoi(statusCodeString)
+		if err != nil || statusCode < http.StatusBadRequest || statusCode > 599 {
+			return nil, fmt.Errorf("invalid status code %q (must be between 400 and 599)", statusCodeString)
+		}
+
+		bodyTemplate, err := template.New(statusCodeString).Option("missingkey=error").Parse(templateText)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for %d: %v", statusCode, err)
+		}
+
+		var sampleData errorTemplateData = errorTemplateData{StatusCode: statusCode, Status: http.StatusText(statusCode)}
+		if err := bodyTemplate.Execute(io.Discard, sampleData); err != nil {
+			return nil, fmt.Errorf("invalid template for %d: %v", statusCode, err)
+		}
+
+		templates[statusCode] = bodyTemplate
+	}
+
+	return templates, nil
+}
+
+// render : Renders the body of an error response from the template for its
+// status code, filled in from the built-in body. The built-in body is returned
+// if there is no such template or it cannot be rendered.
+func (templates errorTemplates) render(statusCode int, body string) string {
+	bodyTemplate, exists := templates[statusCode]
+	if !exists {
+		return body
+	}
+
+	var data errorTemplateData
+	if err := json.Unmarshal([]byte(body), &data); err != nil {
+		logError("Unable to fill in error template for", statusCode, err)
+		return body
+	}
+
+	data.Message = data.Result.Message
+
+	var renderedBody bytes.Buffer
+	if err := bodyTemplate.Execute(&renderedBody, data); err != nil {
+		logError("Unable to render error template for", statusCode, err)
+		return body
+	}
+
+	return renderedBody.String()
+}
+
+// errorTemplatesContextKey : Key under which the error response templates are
+// stored in the context of requests
+type errorTemplatesContextKey struct{}
+
+// withErrorTemplates : Wraps a request handler such that the error responses
+// it writes are rendered from the templates
+func withErrorTemplates(templates errorTemplates, next http.Handler) http.Handler {
+	if len(templates) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), errorTemplatesContextKey{}, templates)))
+	})
+}
+
+// writeErrorResponse : Responds with one of the veil's own error bodies and the
+// status code that it reports, rendered from the error response template for
+// the status code if there is one
+func writeErrorResponse(w http.ResponseWriter, r *http.Request, statusCode int, body string) {
+	if templates, exists := r.Context().Value(errorTemplatesContextKey{}).(errorTemplates); exists {
+		body = templates.render(statusCode, body)
+	}
+
+	writeJSONResponse(w, statusCode, body)
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestErrorTemplates : Writes the error response templates file to a
+// temporary file, returning its path
+func writeTestErrorTemplates(t *testing.T, contents string) string {
+	t.Helper()
+
+	var templatesPath string = filepath.Join(t.TempDir(), "errors.json")
+	if err := os.WriteFile(templatesPath, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return templatesPath
+}
+
+func TestErrorTemplates(t *testing.T) {
+	templates, err := loadErrorTemplates(writeTestErrorTemplates(t, `{
+		"404": "{\"error\":{\"code\":{{.StatusCode}},\"reason\":\"{{.Message}}\"}}",
+		"401": "{\"error\":\"{{.Status}}\"}"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targetSocketPath, _ := recordingTargetSocket(t)
+	var router http.Handler = createAccessRulesRouter(loadTestAccessRules(t, "GET~/v2/snaps\n!DELETE~/v2/snaps\n"), routingOptions{}, newTestRelay([]string{targetSocketPath}, relayOptions{}))
+	var handler http.Handler = withErrorTemplates(templates, router)
+
+	testCases := []struct {
+		name           string
+		method         string
+		requestURI     string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "template with placeholders", method: http.MethodGet, requestURI: "/v2/apps", expectedStatus: http.StatusNotFound, expectedBody: `{"error":{"code":404,"reason":"not found"}}`},
+		{name: "template with status text", method: http.MethodDelete, requestURI: "/v2/snaps", expectedStatus: http.StatusUnauthorized, expectedBody: `{"error":"Unauthorized"}`},
+		{name: "built-in body without a template", method: http.MethodPost, requestURI: "/v2/snaps", expectedStatus: http.StatusMethodNotAllowed, expectedBody: methodNotAllowedString},
+		{name: "relayed response untouched", method: http.MethodGet, requestURI: "/v2/snaps", expectedStatus: http.StatusOK, expectedBody: ""},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(testCase.method, testCase.requestURI, nil))
+			if recorder.Code != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d", testCase.expectedStatus, recorder.Code)
+			}
+
+			if recorder.Body.String() != testCase.expectedBody {
+				t.Errorf("expected the body %s, got %s", testCase.expectedBody, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestErrorTemplatesRejected(t *testing.T) {
+	testCases := []struct {
+		name          string
+		contents      string
+		expectedError string
+	}{
+		{name: "invalid JSON", contents: `{"404": `, expectedError: "invalid JSON"},
+		{name: "not a status code", contents: `{"missing": "gone"}`, expectedError: "invalid status code"},
+		{name: "status code of a success", contents: `{"200": "fine"}`, expectedError: "invalid status code"},
+		{name: "malformed template", contents: `{"404": "{{.Message"}`, expectedError: "invalid template for 404"},
+		{name: "unknown placeholder", contents: `{"404": "{{.Reason}}"}`, expectedError: "invalid template for 404"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := loadErrorTemplates(writeTestErrorTemplates(t, testCase.contents))
+			if err == nil || !strings.Contains(err.Error(), testCase.expectedError) {
+				t.Errorf("expected an error containing %q, got %v", testCase.expectedError, err)
+			}
+		})
+	}
+}
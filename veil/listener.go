@@ -0,0 +1,317 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// unixSocketOptions : Settings applied to a UNIX Domain Socket when it is
+// created
+type unixSocketOptions struct {
+	// mode holds the permission bits given to the socket file, unless zero in
+	// which case the process umask determines them
+	mode os.FileMode
+
+	// owner and group, when not empty, name the user and group (or hold their
+	// numeric IDs) that the socket file is assigned to
+	owner string
+	group string
+}
+
+// resolveUserID : Returns the numeric ID of a user given either its name or its
+// numeric ID
+func resolveUserID(owner string) (int, error) {
+	if uid, err := strconv.Atoi(owner); err == nil {
+		return uid, nil
+	}
+
+	resolvedUser, err := user.Lookup(owner)
+	if err != nil {
+		return -1, err
+	}
+
+	return strconv.Atoi(resolvedUser.Uid)
+}
+
+// resolveGroupID : Returns the numeric ID of a group given either its name or
+// its numeric ID
+func resolveGroupID(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+
+	resolvedGroup, err := user.LookupGroup(group)
+	if err != nil {
+		return -1, err
+	}
+
+	return strconv.Atoi(resolvedGroup.Gid)
+}
+
+// chownUnixSocket : Assigns the socket file to the owner and group named in the
+// socket options, leaving either unchanged when not named
+func chownUnixSocket(socketPath string, options unixSocketOptions) error {
+	var uid int = -1
+	var gid int = -1
+	var err error
+
+	if len(options.owner) > 0 {
+		if uid, err = resolveUserID(options.owner); err != nil {
+			return fmt.Errorf("unable to resolve socket owner %q: %v", options.owner, err)
+		}
+	}
+
+	if len(options.group) > 0 {
+		if gid, err = resolveGroupID(options.group); err != nil {
+			return fmt.Errorf("unable to resolve socket group %q: %v", options.group, err)
+		}
+	}
+
+	if err := os.Chown(socketPath, uid, gid); err != nil {
+		return fmt.Errorf("unable to change ownership of socket: %v", err)
+	}
+
+	return nil
+}
+
+// errLockHeld : Reported when another process holds the lock on a socket
+var errLockHeld error = errors.New("lock held by another process")
+
+// socketLockSuffix : Suffix of the lock file kept beside each socket the veil
+// binds, which is locked for as long as the socket is served
+const socketLockSuffix string = ".lock"
+
+// lockedUnixListener : A listener on a UNIX Domain Socket whose lock file is
+// held until the listener is closed
+type lockedUnixListener struct {
+	net.Listener
+	socketPath string
+	lockFile   *os.File
+
+	closeOnce  sync.Once
+	closeError error
+}
+
+// Close : Stops listening and removes the socket file before releasing the
+// lock, so that another veil may only bind the socket once it is gone
+func (listener *lockedUnixListener) Close() error {
+	listener.closeOnce.Do(func() {
+		listener.closeError = listener.Listener.Close()
+		if err := os.Remove(listener.socketPath); err != nil && !os.IsNotExist(err) {
+			logError("Unable to remove socket:", listener.socketPath, err)
+		}
+
+		listener.lockFile.Close()
+	})
+
+	return listener.closeError
+}
+
+// lockUnixSocket : Takes the lock on the socket path, failing if another veil
+// is serving the socket
+func lockUnixSocket(socketPath string) (*os.File, error) {
+	lockFile, err := os.OpenFile(socketPath+socketLockSuffix, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockExclusively(lockFile); err != nil {
+		lockFile.Close()
+		if err == errLockHeld {
+			return nil, fmt.Errorf("another instance is already serving on %s", socketPath)
+		}
+
+		return nil, fmt.Errorf("unable to lock %s: %v", lockFile.Name(), err)
+	}
+
+	return lockFile, nil
+}
+
+// removeStaleSocket : Removes a socket left at the path, refusing to remove
+// anything else that a misconfigured path might point to
+func removeStaleSocket(socketPath string) error {
+	socketInfo, err := os.Lstat(socketPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if socketInfo.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to replace %s, which is not a socket", socketPath)
+	}
+
+	return os.Remove(socketPath)
+}
+
+// createUnixSocketListener : Binds a listener to a UNIX Domain Socket at the
+// provided path, replacing any stale socket (but nothing else) and creating
+// parent directories as necessary. The socket path is locked while the listener is open, so that
+// the socket of another veil that is still serving is never replaced.
+func createUnixSocketListener(socketPath string, options unixSocketOptions) (net.Listener, error) {
+	socketParentDirPath := filepath.Dir(socketPath)
+	_, err := os.Stat(socketParentDirPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if err := os.MkdirAll(socketParentDirPath, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	lockFile, err := lockUnixSocket(socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := removeStaleSocket(socketPath); err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+
+	// The socket is bound under a umask at least as restrictive as the
+	// requested mode, so that it is never more accessible than intended
+	var restoreUmask func() = func() {}
+	if options.mode != 0 {
+		restoreUmask = restrictUmask(options.mode)
+	}
+
+	unixListener, err := net.Listen("unix", socketPath)
+	restoreUmask()
+	if err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+
+	if options.mode != 0 {
+		if err := os.Chmod(socketPath, options.mode); err != nil {
+			unixListener.Close()
+			lockFile.Close()
+			return nil, err
+		}
+	}
+
+	if len(options.owner) > 0 || len(options.group) > 0 {
+		if err := chownUnixSocket(socketPath, options); err != nil {
+			unixListener.Close()
+			lockFile.Close()
+			return nil, err
+		}
+	}
+
+	return &lockedUnixListener{Listener: unixListener, socketPath: socketPath, lockFile: lockFile}, nil
+}
+
+// createListener : Binds a listener to the provided address, which is either a
+// TCP host and port prefixed with "tcp://", or a UNIX Domain Socket path that
+// may optionally be prefixed with "unix://" or its shorter spelling "unix:".
+// The socket options only apply to UNIX Domain Sockets.
+func createListener(address string, options unixSocketOptions) (net.Listener, error) {
+	if strings.HasPrefix(address, tcpAddressScheme) {
+		return net.Listen("tcp", strings.TrimPrefix(address, tcpAddressScheme))
+	}
+
+	unixSocketPath, _ := unixSocketPathOf(address)
+	return createUnixSocketListener(unixSocketPath, options)
+}
+
+// createServerTLSConfig : Builds the TLS configuration used to serve the
+// exposed TCP listener from a PEM-encoded certificate and private key
+func createServerTLSConfig(certificateFilepath string, keyFilepath string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certificateFilepath, keyFilepath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// requireClientCertificates : Configures TLS to only accept clients that
+// present a certificate signed by one of the PEM-encoded certificate
+// authorities in the provided file
+func requireClientCertificates(tlsConfig *tls.Config, clientCAFilepath string) error {
+	clientCAPEM, err := os.ReadFile(clientCAFilepath)
+	if err != nil {
+		return err
+	}
+
+	var clientCAPool *x509.CertPool = x509.NewCertPool()
+	if !clientCAPool.AppendCertsFromPEM(clientCAPEM) {
+		return fmt.Errorf("no certificates found in %s", clientCAFilepath)
+	}
+
+	tlsConfig.ClientCAs = clientCAPool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return nil
+}
+
+// clientCommonName : Returns the common name of the verified certificate the
+// client presented over TLS, or an empty string if there is none
+func clientCommonName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// unixSocketPathOf : Returns the UNIX Domain Socket path designated by a
+// listener address, and whether the address designates one at all. Both
+// "unix://" and "unix:" are stripped from the path.
+func unixSocketPathOf(address string) (string, bool) {
+	if strings.HasPrefix(address, tcpAddressScheme) {
+		return "", false
+	}
+
+	if strings.HasPrefix(address, unixAddressScheme) {
+		return strings.TrimPrefix(address, unixAddressScheme), true
+	}
+
+	return strings.TrimPrefix(address, unixAddressShortScheme), true
+}
+
+// listenOnAddress : Binds a listener to the provided address as createListener
+// does, except that an address without a scheme is taken to be a TCP host and
+// port unless it is an absolute path
+func listenOnAddress(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, tcpAddressScheme) && !strings.HasPrefix(address, unixAddressShortScheme) && !strings.HasPrefix(address, "/") {
+		address = tcpAddressScheme + address
+	}
+
+	return createListener(address, unixSocketOptions{})
+}
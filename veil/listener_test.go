@@ -0,0 +1,425 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificateAuthority : A certificate authority issuing certificates for
+// the duration of a test
+type testCertificateAuthority struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pool        *x509.CertPool
+	pemPath     string
+}
+
+// newTestCertificateAuthority : Creates a self-signed certificate authority,
+// writing its certificate to a PEM file
+func newTestCertificateAuthority(t *testing.T) *testCertificateAuthority {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var template *x509.Certificate = &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "veil test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(certificateDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var authority *testCertificateAuthority = &testCertificateAuthority{
+		certificate: certificate,
+		key:         key,
+		pool:        x509.NewCertPool(),
+		pemPath:     filepath.Join(t.TempDir(), "ca.pem"),
+	}
+	authority.pool.AddCert(certificate)
+	writeTestPEM(t, authority.pemPath, "CERTIFICATE", certificateDER)
+
+	return authority
+}
+
+// issue : Issues a certificate for the common name, valid for the host name
+// "veil" when serving and for client authentication otherwise
+func (authority *testCertificateAuthority) issue(t *testing.T, commonName string, server bool) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var template *x509.Certificate = &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.DNSNames = []string{"veil"}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, authority.certificate, &key.PublicKey, authority.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{certificateDER}, PrivateKey: key}
+}
+
+// writeTestServerCertificate : Issues a server certificate, returning the
+// paths of the PEM files holding it and its private key
+func writeTestServerCertificate(t *testing.T, authority *testCertificateAuthority) (string, string) {
+	t.Helper()
+
+	var certificate tls.Certificate = authority.issue(t, "veil", true)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(certificate.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var certificatePath string = filepath.Join(t.TempDir(), "veil.crt")
+	var keyPath string = filepath.Join(t.TempDir(), "veil.key")
+	writeTestPEM(t, certificatePath, "CERTIFICATE", certificate.Certificate[0])
+	writeTestPEM(t, keyPath, "PRIVATE KEY", keyDER)
+
+	return certificatePath, keyPath
+}
+
+// writeTestPEM : Writes a single PEM block to a file
+func writeTestPEM(t *testing.T, path string, blockType string, der []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTLSVeilClient : Returns a client sending every request to the address the
+// Veil listens on over TLS, trusting the certificate authority and presenting
+// the client certificates
+func newTLSVeilClient(v *Veil, authority *testCertificateAuthority, clientCertificates []tls.Certificate) *http.Client {
+	var client *http.Client = newVeilClient(v)
+	client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{
+		RootCAs:      authority.pool,
+		Certificates: clientCertificates,
+	}
+
+	return client
+}
+
+func TestUnixSocketPathOf(t *testing.T) {
+	testCases := []struct {
+		address        string
+		expectedPath   string
+		expectedIsUnix bool
+	}{
+		{address: "/run/veil.sock", expectedPath: "/run/veil.sock", expectedIsUnix: true},
+		{address: "unix:///run/veil.sock", expectedPath: "/run/veil.sock", expectedIsUnix: true},
+		{address: "unix:/run/veil.sock", expectedPath: "/run/veil.sock", expectedIsUnix: true},
+		{address: "unix://relative.sock", expectedPath: "relative.sock", expectedIsUnix: true},
+		{address: "tcp://127.0.0.1:8080", expectedIsUnix: false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.address, func(t *testing.T) {
+			socketPath, isUnix := unixSocketPathOf(testCase.address)
+			if socketPath != testCase.expectedPath || isUnix != testCase.expectedIsUnix {
+				t.Errorf("expected %q and %t, got %q and %t", testCase.expectedPath, testCase.expectedIsUnix, socketPath, isUnix)
+			}
+		})
+	}
+}
+
+func TestCreateUnixSocketListenerExistingPath(t *testing.T) {
+	testCases := []struct {
+		name          string
+		createPath    func(t *testing.T, socketPath string)
+		expectedError string
+	}{
+		{
+			name:       "missing path",
+			createPath: func(t *testing.T, socketPath string) {},
+		},
+		{
+			name: "missing parent directory",
+			createPath: func(t *testing.T, socketPath string) {
+				if err := os.Remove(filepath.Dir(socketPath)); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "stale socket",
+			createPath: func(t *testing.T, socketPath string) {
+				staleListener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				staleListener.SetUnlinkOnClose(false)
+				staleListener.Close()
+			},
+		},
+		{
+			name: "regular file",
+			createPath: func(t *testing.T, socketPath string) {
+				if err := os.WriteFile(socketPath, []byte("precious"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			expectedError: "which is not a socket",
+		},
+		{
+			name: "directory",
+			createPath: func(t *testing.T, socketPath string) {
+				if err := os.Mkdir(socketPath, 0755); err != nil {
+					t.Fatal(err)
+				}
+			},
+			expectedError: "which is not a socket",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var socketPath string = filepath.Join(t.TempDir(), "sockets", "veil.sock")
+			if err := os.Mkdir(filepath.Dir(socketPath), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			testCase.createPath(t, socketPath)
+			existingInfo, _ := os.Lstat(socketPath)
+
+			listener, err := createUnixSocketListener(socketPath, unixSocketOptions{})
+			if len(testCase.expectedError) > 0 {
+				if err == nil {
+					listener.Close()
+					t.Fatalf("expected an error containing %q, got none", testCase.expectedError)
+				}
+
+				if !strings.Contains(err.Error(), testCase.expectedError) {
+					t.Errorf("expected an error containing %q, got %v", testCase.expectedError, err)
+				}
+
+				// Whatever was at the path is left untouched
+				socketInfo, err := os.Lstat(socketPath)
+				if err != nil {
+					t.Fatalf("expected the path to be left in place, got %v", err)
+				}
+
+				if socketInfo.Mode() != existingInfo.Mode() || socketInfo.ModTime() != existingInfo.ModTime() {
+					t.Errorf("expected the path to be left untouched, got mode %v", socketInfo.Mode())
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			connection, err := net.Dial("unix", socketPath)
+			if err != nil {
+				t.Fatalf("expected the socket to be bound, got %v", err)
+			}
+			connection.Close()
+		})
+	}
+}
+
+func TestListenOnAddress(t *testing.T) {
+	var socketDirectory string = t.TempDir()
+
+	testCases := []struct {
+		name            string
+		address         string
+		expectedNetwork string
+		expectedAddress string
+	}{
+		{name: "host and port", address: "127.0.0.1:0", expectedNetwork: "tcp"},
+		{name: "tcp scheme", address: "tcp://127.0.0.1:0", expectedNetwork: "tcp"},
+		{name: "absolute path", address: filepath.Join(socketDirectory, "plain.sock"), expectedNetwork: "unix", expectedAddress: filepath.Join(socketDirectory, "plain.sock")},
+		{name: "unix scheme", address: "unix://" + filepath.Join(socketDirectory, "scheme.sock"), expectedNetwork: "unix", expectedAddress: filepath.Join(socketDirectory, "scheme.sock")},
+		{name: "short unix scheme", address: "unix:" + filepath.Join(socketDirectory, "short.sock"), expectedNetwork: "unix", expectedAddress: filepath.Join(socketDirectory, "short.sock")},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			listener, err := listenOnAddress(testCase.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			var address net.Addr = listener.Addr()
+			if address.Network() != testCase.expectedNetwork {
+				t.Errorf("expected a %s listener, got %s", testCase.expectedNetwork, address.Network())
+			}
+
+			if len(testCase.expectedAddress) > 0 && address.String() != testCase.expectedAddress {
+				t.Errorf("expected to listen on %s, got %s", testCase.expectedAddress, address.String())
+			}
+		})
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	targetSocketPath, requestURIs := recordingTargetSocket(t)
+	var authority *testCertificateAuthority = newTestCertificateAuthority(t)
+	certificatePath, keyPath := writeTestServerCertificate(t, authority)
+
+	var v *Veil = startTestVeil(t, Options{
+		TargetSocketPath:   targetSocketPath,
+		ExposedAddress:     "tcp://127.0.0.1:0",
+		AccessRulesPath:    writeTestAccessRules(t, "GET~/v2/snaps\n"),
+		TLSCertificatePath: certificatePath,
+		TLSKeyPath:         keyPath,
+	})
+
+	testCases := []struct {
+		name          string
+		client        *http.Client
+		url           string
+		expectSuccess bool
+	}{
+		{name: "HTTPS", client: newTLSVeilClient(v, authority, nil), url: "https://veil/v2/snaps", expectSuccess: true},
+		{name: "plain HTTP", client: newVeilClient(v), url: "http://veil/v2/snaps"},
+		{name: "untrusted certificate", client: newTLSVeilClient(v, newTestCertificateAuthority(t), nil), url: "https://veil/v2/snaps"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			response, err := testCase.client.Get(testCase.url)
+			if err == nil {
+				response.Body.Close()
+			}
+
+			var succeeded bool = err == nil && response.StatusCode == http.StatusOK
+			if succeeded != testCase.expectSuccess {
+				t.Fatalf("expected success to be %t, got response %v and error %v", testCase.expectSuccess, response, err)
+			}
+
+			if testCase.expectSuccess {
+				if upstreamRequestURI := <-requestURIs; upstreamRequestURI != "/v2/snaps" {
+					t.Errorf("expected the target socket to receive /v2/snaps, got %q", upstreamRequestURI)
+				}
+			}
+		})
+	}
+
+	select {
+	case upstreamRequestURI := <-requestURIs:
+		t.Errorf("expected only requests over TLS to be relayed, got %q", upstreamRequestURI)
+	default:
+	}
+}
+
+func TestMutualTLSListener(t *testing.T) {
+	targetSocketPath, _ := recordingTargetSocket(t)
+	var serverAuthority *testCertificateAuthority = newTestCertificateAuthority(t)
+	var clientAuthority *testCertificateAuthority = newTestCertificateAuthority(t)
+	var untrustedAuthority *testCertificateAuthority = newTestCertificateAuthority(t)
+	certificatePath, keyPath := writeTestServerCertificate(t, serverAuthority)
+
+	var v *Veil = startTestVeil(t, Options{
+		TargetSocketPath:   targetSocketPath,
+		ExposedAddress:     "tcp://127.0.0.1:0",
+		AccessRulesPath:    writeTestAccessRules(t, "GET~/v2/snaps\nDELETE~/v2/snaps~cn=alice\n"),
+		TLSCertificatePath: certificatePath,
+		TLSKeyPath:         keyPath,
+		ClientCAPath:       clientAuthority.pemPath,
+	})
+
+	testCases := []struct {
+		name               string
+		clientCertificates []tls.Certificate
+		method             string
+		expectedStatus     int
+	}{
+		{name: "trusted certificate", clientCertificates: []tls.Certificate{clientAuthority.issue(t, "bob", false)}, method: http.MethodGet, expectedStatus: http.StatusOK},
+		{name: "common name allowed by rule", clientCertificates: []tls.Certificate{clientAuthority.issue(t, "alice", false)}, method: http.MethodDelete, expectedStatus: http.StatusOK},
+		{name: "common name refused by rule", clientCertificates: []tls.Certificate{clientAuthority.issue(t, "bob", false)}, method: http.MethodDelete, expectedStatus: http.StatusUnauthorized},
+		{name: "untrusted certificate", clientCertificates: []tls.Certificate{untrustedAuthority.issue(t, "alice", false)}, method: http.MethodGet},
+		{name: "missing certificate", method: http.MethodGet},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			request, err := http.NewRequest(testCase.method, "https://veil/v2/snaps", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response, err := newTLSVeilClient(v, serverAuthority, testCase.clientCertificates).Do(request)
+			if testCase.expectedStatus == 0 {
+				if err == nil {
+					response.Body.Close()
+					t.Fatalf("expected the TLS handshake to be refused, got status %d", response.StatusCode)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d", testCase.expectedStatus, response.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestUnixSocketMode(t *testing.T) {
+	testCases := []struct {
+		name string
+		mode os.FileMode
+	}{
+		{name: "owner only", mode: 0600},
+		{name: "owner and group", mode: 0660},
+		{name: "anyone", mode: 0666},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var socketPath string = filepath.Join(t.TempDir(), "veil.sock")
+			listener, err := createUnixSocketListener(socketPath, unixSocketOptions{mode: testCase.mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			socketInfo, err := os.Stat(socketPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if socketInfo.Mode().Perm() != testCase.mode {
+				t.Errorf("expected mode %#o, got %#o", testCase.mode, socketInfo.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestAdminSocketMode(t *testing.T) {
+	targetSocketPath, _ := recordingTargetSocket(t)
+	var socketDirectory string = t.TempDir()
+	var adminSocketPath string = filepath.Join(socketDirectory, "admin.sock")
+	startTestVeil(t, Options{
+		TargetSocketPath: targetSocketPath,
+		ExposedAddress:   filepath.Join(socketDirectory, "veil.sock"),
+		AccessRulesPath:  writeTestAccessRules(t, "GET~/v2/snaps\n"),
+		SocketMode:       0666,
+		AdminSocketPath:  adminSocketPath,
+	})
+
+	// The admin socket stays restricted to its owner, however open the
+	// exposed socket is
+	socketInfo, err := os.Stat(adminSocketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if socketInfo.Mode().Perm() != adminSocketMode {
+		t.Errorf("expected mode %#o, got %#o", adminSocketMode, socketInfo.Mode().Perm())
+	}
+}
+
+func TestUnixSocketLock(t *testing.T) {
+	var socketPath string = filepath.Join(t.TempDir(), "veil.sock")
+	firstListener, err := createUnixSocketListener(socketPath, unixSocketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := createUnixSocketListener(socketPath, unixSocketOptions{}); err == nil || !strings.Contains(err.Error(), "another instance is already serving") {
+		t.Fatalf("expected a second listener on the same socket to be refused, got %v", err)
+	}
+
+	// The socket of the first listener is left in place and still served
+	connection, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("expected the first listener to keep its socket, got %v", err)
+	}
+	connection.Close()
+
+	// Once the first listener is closed, the socket may be bound again
+	firstListener.Close()
+	secondListener, err := createUnixSocketListener(socketPath, unixSocketOptions{})
+	if err != nil {
+		t.Fatalf("expected the socket to be bound once released, got %v", err)
+	}
+	secondListener.Close()
+}
+
+func TestUnixSocketOwnership(t *testing.T) {
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Skip("unable to look up the current user:", err)
+	}
+
+	currentGroup, err := user.LookupGroupId(strconv.Itoa(os.Getgid()))
+	if err != nil {
+		t.Skip("unable to look up the current group:", err)
+	}
+
+	testCases := []struct {
+		name        string
+		owner       string
+		group       string
+		expectError bool
+	}{
+		{name: "owner by name", owner: currentUser.Username},
+		{name: "owner by ID", owner: currentUser.Uid},
+		{name: "group by name", group: currentGroup.Name},
+		{name: "group by ID", group: currentGroup.Gid},
+		{name: "owner and group by name", owner: currentUser.Username, group: currentGroup.Name},
+		{name: "unknown owner", owner: "no-such-veil-user", expectError: true},
+		{name: "unknown group", group: "no-such-veil-group", expectError: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var socketPath string = filepath.Join(t.TempDir(), "veil.sock")
+			listener, err := createUnixSocketListener(socketPath, unixSocketOptions{owner: testCase.owner, group: testCase.group})
+			if testCase.expectError {
+				if err == nil {
+					listener.Close()
+					t.Fatal("expected the ownership change to fail")
+				}
+
+				// A socket that cannot be assigned is never left behind
+				if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+					t.Errorf("expected the socket to be removed, got %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			socketInfo, err := os.Stat(socketPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var socketStat *syscall.Stat_t = socketInfo.Sys().(*syscall.Stat_t)
+			if strconv.Itoa(int(socketStat.Uid)) != currentUser.Uid || strconv.Itoa(int(socketStat.Gid)) != currentGroup.Gid {
+				t.Errorf("expected the socket to belong to %s:%s, got %d:%d", currentUser.Uid, currentGroup.Gid, socketStat.Uid, socketStat.Gid)
+			}
+		})
+	}
+}
+
+func TestResolveSocketOwnerIDs(t *testing.T) {
+	testCases := []struct {
+		name        string
+		resolve     func(string) (int, error)
+		value       string
+		expectedID  int
+		expectError bool
+	}{
+		{name: "numeric user", resolve: resolveUserID, value: "1234", expectedID: 1234},
+		{name: "root user by name", resolve: resolveUserID, value: "root", expectedID: 0},
+		{name: "unknown user", resolve: resolveUserID, value: "no-such-veil-user", expectError: true},
+		{name: "numeric group", resolve: resolveGroupID, value: "4321", expectedID: 4321},
+		{name: "unknown group", resolve: resolveGroupID, value: "no-such-veil-group", expectError: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			id, err := testCase.resolve(testCase.value)
+			if testCase.expectError {
+				if err == nil {
+					t.Fatalf("expected %q not to resolve, got %d", testCase.value, id)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if id != testCase.expectedID {
+				t.Errorf("expected ID %d, got %d", testCase.expectedID, id)
+			}
+		})
+	}
+}
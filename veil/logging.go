@@ -0,0 +1,145 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevelError : Logs only errors
+const LogLevelError string = "error"
+
+// LogLevelWarn : Logs errors and warnings
+const LogLevelWarn string = "warn"
+
+// LogLevelInfo : Logs errors, warnings and notable events, such as reloads
+const LogLevelInfo string = "info"
+
+// LogLevelDebug : Logs everything, including the details of every relayed
+// request
+const LogLevelDebug string = "debug"
+
+// logLevels : The log levels in increasing order of verbosity
+var logLevels []string = []string{LogLevelError, LogLevelWarn, LogLevelInfo, LogLevelDebug}
+
+// Verbosities of the log levels, as their indices within logLevels
+const (
+	logVerbosityError int32 = iota
+	logVerbosityWarn
+	logVerbosityInfo
+	logVerbosityDebug
+)
+
+// currentLogVerbosity : Verbosity of the log level in effect, shared by every
+// Veil in the process as the log package is
+var currentLogVerbosity int32 = logVerbosityInfo
+
+// logVerbosityOf : Returns the verbosity of the named log level, and whether
+// the level exists
+func logVerbosityOf(level string) (int32, bool) {
+	for verbosity, levelName := range logLevels {
+		if levelName == level {
+			return int32(verbosity), true
+		}
+	}
+
+	return -1, false
+}
+
+// setLogLevel : Changes the log level in effect
+func setLogLevel(level string) error {
+	verbosity, exists := logVerbosityOf(level)
+	if !exists {
+		return fmt.Errorf("invalid log level: %s (must be one of %s)", level, strings.Join(logLevels, ", "))
+	}
+
+	atomic.StoreInt32(&currentLogVerbosity, verbosity)
+	return nil
+}
+
+// currentLogLevel : Returns the name of the log level in effect
+func currentLogLevel() string {
+	return logLevels[atomic.LoadInt32(&currentLogVerbosity)]
+}
+
+// logEnabled : Reports whether messages of the verbosity are logged
+func logEnabled(verbosity int32) bool {
+	return atomic.LoadInt32(&currentLogVerbosity) >= verbosity
+}
+
+// logError : Logs an error, which is always logged
+func logError(v ...interface{}) {
+	if logEnabled(logVerbosityError) {
+		log.Println(v...)
+	}
+}
+
+// logWarn : Logs a warning, unless only errors are logged
+func logWarn(v ...interface{}) {
+	if logEnabled(logVerbosityWarn) {
+		log.Println(v...)
+	}
+}
+
+// logInfo : Logs a notable event, unless the log level is error or warn
+func logInfo(v ...interface{}) {
+	if logEnabled(logVerbosityInfo) {
+		log.Println(v...)
+	}
+}
+
+// logDebug : Logs detail that is only logged at the debug level
+func logDebug(v ...interface{}) {
+	if logEnabled(logVerbosityDebug) {
+		log.Println(v...)
+	}
+}
+
+// redactedHeaders : Request headers whose values are never logged
+var redactedHeaders []string = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// describeHeaders : Formats the headers for the debug log, in order of name,
+// with the values of credentials redacted
+func describeHeaders(header http.Header) string {
+	var headerNames []string = []string{}
+	for headerName := range header {
+		headerNames = append(headerNames, headerName)
+	}
+
+	sort.Strings(headerNames)
+
+	var descriptions []string = []string{}
+	for _, headerName := range headerNames {
+		var headerValue string = strings.Join(header[headerName], ", ")
+		for _, redactedHeader := range redactedHeaders {
+			if strings.EqualFold(headerName, redactedHeader) {
+				headerValue = "[redacted]"
+			}
+		}
+
+		descriptions = append(descriptions, fmt.Sprintf("%s=%q", headerName, headerValue))
+	}
+
+	return strings.Join(descriptions, " ")
+}
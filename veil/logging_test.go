@@ -0,0 +1,114 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLog : Captures what is logged for the rest of the test, restoring
+// the log level in effect once it is done
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var logged *bytes.Buffer = &bytes.Buffer{}
+	var initialLevel string = currentLogLevel()
+	log.SetOutput(logged)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		setLogLevel(initialLevel)
+	})
+
+	return logged
+}
+
+func TestLogLevels(t *testing.T) {
+	testCases := []struct {
+		level          string
+		expectedLogged []string
+	}{
+		{level: LogLevelError, expectedLogged: []string{"error"}},
+		{level: LogLevelWarn, expectedLogged: []string{"error", "warn"}},
+		{level: LogLevelInfo, expectedLogged: []string{"error", "warn", "info"}},
+		{level: LogLevelDebug, expectedLogged: []string{"error", "warn", "info", "debug"}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.level, func(t *testing.T) {
+			var logged *bytes.Buffer = captureLog(t)
+			if err := setLogLevel(testCase.level); err != nil {
+				t.Fatal(err)
+			}
+
+			if level := currentLogLevel(); level != testCase.level {
+				t.Errorf("expected the log level %s, got %s", testCase.level, level)
+			}
+
+			logError("error")
+			logWarn("warn")
+			logInfo("info")
+			logDebug("debug")
+
+			var loggedMessages []string = []string{}
+			for _, line := range strings.Split(strings.TrimSpace(logged.String()), "\n") {
+				loggedMessages = append(loggedMessages, line[strings.LastIndex(line, " ")+1:])
+			}
+
+			if strings.Join(loggedMessages, ",") != strings.Join(testCase.expectedLogged, ",") {
+				t.Errorf("expected %v to be logged, got %v", testCase.expectedLogged, loggedMessages)
+			}
+		})
+	}
+}
+
+func TestSetLogLevelRejected(t *testing.T) {
+	captureLog(t)
+	setLogLevel(LogLevelWarn)
+
+	for _, level := range []string{"", "verbose", "DEBUG", "trace"} {
+		t.Run(level, func(t *testing.T) {
+			if err := setLogLevel(level); err == nil {
+				t.Fatal("expected the log level to be rejected")
+			}
+
+			if currentLogLevel() != LogLevelWarn {
+				t.Errorf("expected the log level to remain %s, got %s", LogLevelWarn, currentLogLevel())
+			}
+		})
+	}
+}
+
+func TestDescribeHeaders(t *testing.T) {
+	var header http.Header = http.Header{
+		"User-Agent":    {"veil-test"},
+		"Authorization": {"Bearer secret"},
+		"Cookie":        {"session=secret"},
+		"Accept":        {"text/plain", "application/json"},
+	}
+
+	var expected string = `Accept="text/plain, application/json" Authorization="[redacted]" Cookie="[redacted]" User-Agent="veil-test"`
+	if description := describeHeaders(header); description != expected {
+		t.Errorf("expected %s, got %s", expected, description)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// relayMetrics : Prometheus metrics describing the requests served by the veil
+type relayMetrics struct {
+	registry         *prometheus.Registry
+	requests         *prometheus.CounterVec
+	upstreamErrors   prometheus.Counter
+	upstreamTimeouts prometheus.Counter
+	requestDuration  *prometheus.HistogramVec
+}
+
+// newRelayMetrics : Creates the veil's metrics within a dedicated registry
+func newRelayMetrics() *relayMetrics {
+	var metrics *relayMetrics = &relayMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "veil_requests_total",
+			Help: "Requests received by the veil, by HTTP method and access decision.",
+		}, []string{"method", "decision"}),
+		upstreamErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "veil_upstream_errors_total",
+			Help: "Relayed requests that failed while communicating with the target socket.",
+		}),
+		upstreamTimeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "veil_upstream_timeouts_total",
+			Help: "Relayed requests that exceeded their timeout.",
+		}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "veil_request_duration_seconds",
+			Help:    "Time taken to serve requests, by HTTP method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method"}),
+	}
+
+	metrics.registry.MustRegister(
+		metrics.requests,
+		metrics.upstreamErrors,
+		metrics.upstreamTimeouts,
+		metrics.requestDuration,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	return metrics
+}
+
+// instrument : Wraps a request handler such that every request it serves is
+// recorded in the metrics
+func (metrics *relayMetrics) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var startTime time.Time = time.Now()
+		r, outcome := withRequestOutcome(r)
+		next.ServeHTTP(w, r)
+
+		decision, upstreamError := outcome.snapshot()
+		if len(decision) == 0 {
+			decision = "none"
+		}
+
+		metrics.requests.WithLabelValues(r.Method, decision).Inc()
+		metrics.requestDuration.WithLabelValues(r.Method).Observe(time.Since(startTime).Seconds())
+		if upstreamError != nil {
+			metrics.upstreamErrors.Inc()
+			if isTimeoutError(upstreamError) {
+				metrics.upstreamTimeouts.Inc()
+			}
+		}
+	})
+}
+
+// handler : Returns a handler serving the metrics at /metrics
+func (metrics *relayMetrics) handler() http.Handler {
+	var metricsRouter *http.ServeMux = http.NewServeMux()
+	metricsRouter.Handle("/metrics", promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}))
+	return metricsRouter
+}
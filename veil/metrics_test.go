@@ -0,0 +1,110 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrapeMetrics : Returns the metrics exposition served by the Veil
+func scrapeMetrics(t *testing.T, v *Veil) string {
+	t.Helper()
+
+	response, err := http.Get("http://" + v.metricsListener.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	exposition, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(exposition)
+}
+
+func TestMetricsCountRequests(t *testing.T) {
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/slow" {
+			<-r.Context().Done()
+		}
+	}))
+
+	var v *Veil = startTestVeil(t, Options{
+		TargetSocketPath: targetSocketPath,
+		ExposedAddress:   "tcp://127.0.0.1:0",
+		AccessRulesPath:  writeTestAccessRules(t, "GET~/v2/snaps\nPOST~/v2/snaps\n!DELETE~/v2/snaps\nGET~/v2/slow~timeout=50ms\n"),
+		MetricsAddress:   "127.0.0.1:0",
+	})
+
+	var client *http.Client = newVeilClient(v)
+	for _, request := range []struct {
+		method     string
+		requestURI string
+	}{
+		{method: http.MethodGet, requestURI: "/v2/snaps"},
+		{method: http.MethodGet, requestURI: "/v2/snaps"},
+		{method: http.MethodPost, requestURI: "/v2/snaps"},
+		{method: http.MethodDelete, requestURI: "/v2/snaps"},
+		{method: http.MethodGet, requestURI: "/v2/apps"},
+		{method: http.MethodGet, requestURI: "/v2/slow"},
+	} {
+		requestStatus(t, client, request.method, request.requestURI)
+	}
+
+	var expectedSamples []string = []string{
+		`veil_requests_total{decision="allowed",method="GET"} 3`,
+		`veil_requests_total{decision="allowed",method="POST"} 1`,
+		`veil_requests_total{decision="forbidden",method="DELETE"} 1`,
+		`veil_requests_total{decision="not-found",method="GET"} 1`,
+		`veil_upstream_errors_total 1`,
+		`veil_upstream_timeouts_total 1`,
+		`veil_request_duration_seconds_count{method="GET"} 4`,
+		`veil_request_duration_seconds_count{method="POST"} 1`,
+		`veil_request_duration_seconds_count{method="DELETE"} 1`,
+	}
+
+	// Requests are recorded once their handler returns, which may follow the
+	// response reaching the client
+	var deadline time.Time = time.Now().Add(5 * time.Second)
+	for {
+		var exposition string = scrapeMetrics(t, v)
+		var missingSamples []string = []string{}
+		for _, expectedSample := range expectedSamples {
+			if !strings.Contains(exposition, expectedSample+"\n") {
+				missingSamples = append(missingSamples, expectedSample)
+			}
+		}
+
+		if len(missingSamples) == 0 {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the metrics to include:\n%s\ngot:\n%s", strings.Join(missingSamples, "\n"), exposition)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
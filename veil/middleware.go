@@ -0,0 +1,343 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// writeJSONResponse : Responds with one of the veil's own JSON bodies and the
+// status code that it reports
+func writeJSONResponse(w http.ResponseWriter, statusCode int, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	io.WriteString(w, body)
+}
+
+// withHealthEndpoint : Wraps a request handler such that requests for the
+// health path are answered directly by the veil, bypassing the access rules.
+// The health endpoint responds with 200 when any of the target sockets can be
+// dialed and 503 otherwise. An empty health path disables the endpoint.
+func withHealthEndpoint(healthPath string, targetSocketPaths []string, next http.Handler) http.Handler {
+	if len(healthPath) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != healthPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if err := dialAnyTargetSocket(targetSocketPaths); err != nil {
+			writeErrorResponse(w, r, http.StatusServiceUnavailable, serviceUnavailableString)
+			return
+		}
+
+		writeJSONResponse(w, http.StatusOK, healthyString)
+	})
+}
+
+// requestOutcome : Details of how a request was handled, filled in while the
+// request is served so that they can be reported once it completes
+type requestOutcome struct {
+	mutex sync.Mutex
+
+	// decision records whether the access rules allowed the request to be
+	// relayed, forbade it, or did not recognize its path
+	decision string
+
+	// upstreamError holds the first error encountered while relaying the
+	// request to the target socket, if any
+	upstreamError error
+}
+
+// requestOutcomeContextKey : Key under which the outcome of a request is
+// stored in the request context
+type requestOutcomeContextKey struct{}
+
+// withRequestOutcome : Returns the outcome recorded for the request, attaching
+// a new one to the request context if none is present yet
+func withRequestOutcome(r *http.Request) (*http.Request, *requestOutcome) {
+	if outcome, exists := r.Context().Value(requestOutcomeContextKey{}).(*requestOutcome); exists {
+		return r, outcome
+	}
+
+	var outcome *requestOutcome = &requestOutcome{}
+	return r.WithContext(context.WithValue(r.Context(), requestOutcomeContextKey{}, outcome)), outcome
+}
+
+// recordRequestDecision : Notes the access decision made for a request, if its
+// outcome is being recorded
+func recordRequestDecision(ctx context.Context, decision string) {
+	if outcome, exists := ctx.Value(requestOutcomeContextKey{}).(*requestOutcome); exists {
+		outcome.mutex.Lock()
+		outcome.decision = decision
+		outcome.mutex.Unlock()
+	}
+}
+
+// recordUpstreamError : Notes an error encountered while relaying a request,
+// if its outcome is being recorded, and counts it once per request
+func recordUpstreamError(ctx context.Context, err error) {
+	outcome, exists := ctx.Value(requestOutcomeContextKey{}).(*requestOutcome)
+	if !exists {
+		countUpstreamError(ctx)
+		return
+	}
+
+	outcome.mutex.Lock()
+	if outcome.upstreamError == nil {
+		outcome.upstreamError = err
+		countUpstreamError(ctx)
+	}
+	outcome.mutex.Unlock()
+}
+
+// snapshot : Returns the decision and upstream error recorded so far
+func (outcome *requestOutcome) snapshot() (string, error) {
+	outcome.mutex.Lock()
+	defer outcome.mutex.Unlock()
+
+	return outcome.decision, outcome.upstreamError
+}
+
+// isTimeoutError : Reports whether an error encountered while relaying a
+// request was caused by the request exceeding its deadline
+func isTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netError net.Error
+	return errors.As(err, &netError) && netError.Timeout()
+}
+
+// isDialError : Reports whether an error encountered while relaying a request
+// was caused by a failure to connect to the target socket, as happens when the
+// socket file does not exist or nothing is listening on it
+func isDialError(err error) bool {
+	var opError *net.OpError
+	return errors.As(err, &opError) && opError.Op == "dial"
+}
+
+// statusRecordingResponseWriter : Wraps a response writer to note the status
+// code and number of body bytes written to it
+type statusRecordingResponseWriter struct {
+	http.ResponseWriter
+	statusCode   int
+	bytesWritten int64
+}
+
+func (w *statusRecordingResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusRecordingResponseWriter) Write(data []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+
+	bytesWritten, err := w.ResponseWriter.Write(data)
+	w.bytesWritten += int64(bytesWritten)
+	return bytesWritten, err
+}
+
+// Hijack : Takes over the connection of the underlying response writer, if it
+// supports doing so, as happens when a request switches protocols
+func (w *statusRecordingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, canHijack := w.ResponseWriter.(http.Hijacker)
+	if !canHijack {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusSwitchingProtocols
+	}
+
+	return hijacker.Hijack()
+}
+
+// Unwrap : Returns the underlying response writer, for http.ResponseController
+func (w *statusRecordingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush : Flushes the underlying response writer, if it supports flushing
+func (w *statusRecordingResponseWriter) Flush() {
+	if flusher, canFlush := w.ResponseWriter.(http.Flusher); canFlush {
+		flusher.Flush()
+	}
+}
+
+// withRequestID : Wraps a request handler such that every request carries a
+// unique identifier in its X-Request-Id header, which is relayed to the target
+// socket and echoed back on the response. An identifier supplied by the client
+// is reused, and one is generated otherwise.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var requestID string = r.Header.Get(requestIDHeader)
+		if len(requestID) == 0 {
+			generatedID, err := generateRequestID()
+			if err != nil {
+				logError("Unable to generate request ID:", err)
+			}
+
+			requestID = generatedID
+			r.Header.Set(requestIDHeader, requestID)
+		}
+
+		w.Header().Set(requestIDHeader, requestID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withPanicRecovery : Wraps a request handler such that a panic while serving
+// a request is logged along with its stack trace and request ID, and answered
+// with 500 Internal Server Error if no response has been sent yet, rather than
+// affecting other requests
+func withPanicRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var recordingWriter *statusRecordingResponseWriter = &statusRecordingResponseWriter{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+
+			// The HTTP server deliberately aborts requests by panicking with
+			// this value, so it is passed along
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			logError(fmt.Sprintf("Panic serving %s %s request_id=%s: %v\n%s", r.Method, r.URL.Path, r.Header.Get(requestIDHeader), recovered, debug.Stack()))
+			if recordingWriter.statusCode == 0 {
+				writeErrorResponse(recordingWriter, r, http.StatusInternalServerError, internalErrorString)
+			}
+		}()
+
+		next.ServeHTTP(recordingWriter, r)
+	})
+}
+
+// generateRequestID : Returns a random (version 4) UUID
+func generateRequestID() (string, error) {
+	var uuid []byte = make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return "", err
+	}
+
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16]), nil
+}
+
+// accessLogEntry : A single line of the access log, describing one request
+type accessLogEntry struct {
+	Time       string  `json:"time"`
+	RequestID  string  `json:"request_id"`
+	ClientCN   string  `json:"client_cn,omitempty"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Decision   string  `json:"decision"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// withAccessLog : Wraps a request handler such that a line describing every
+// request it serves is written to standard output, either as a JSON object or
+// as human-readable text depending on the log format
+func withAccessLog(logFormat string, next http.Handler) http.Handler {
+	var accessLogger *log.Logger = log.New(os.Stdout, "", log.LstdFlags)
+	if logFormat == LogFormatJSON {
+		accessLogger = log.New(os.Stdout, "", 0)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var startTime time.Time = time.Now()
+		var recordingWriter *statusRecordingResponseWriter = &statusRecordingResponseWriter{ResponseWriter: w}
+		r, outcome := withRequestOutcome(r)
+		next.ServeHTTP(recordingWriter, r)
+
+		decision, upstreamError := outcome.snapshot()
+		if recordingWriter.statusCode == 0 {
+			recordingWriter.statusCode = http.StatusOK
+		}
+
+		var entry accessLogEntry = accessLogEntry{
+			Time:       startTime.UTC().Format(time.RFC3339Nano),
+			RequestID:  r.Header.Get(requestIDHeader),
+			ClientCN:   clientCommonName(r),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Decision:   decision,
+			Status:     recordingWriter.statusCode,
+			Bytes:      recordingWriter.bytesWritten,
+			DurationMs: float64(time.Since(startTime)) / float64(time.Millisecond),
+		}
+
+		if upstreamError != nil {
+			entry.Error = upstreamError.Error()
+		}
+
+		if logFormat == LogFormatJSON {
+			encodedEntry, err := json.Marshal(entry)
+			if err != nil {
+				logError("Unable to encode access log entry:", err)
+				return
+			}
+
+			accessLogger.Println(string(encodedEntry))
+			return
+		}
+
+		var optionalFields string = ""
+		if len(entry.ClientCN) > 0 {
+			optionalFields += " client_cn=" + strconv.Quote(entry.ClientCN)
+		}
+
+		if len(entry.Error) > 0 {
+			optionalFields += " error=" + strconv.Quote(entry.Error)
+		}
+
+		accessLogger.Printf("%s %s request_id=%s decision=%s status=%d bytes=%d duration=%.3fms%s",
+			entry.Method, entry.Path, entry.RequestID, entry.Decision, entry.Status, entry.Bytes, entry.DurationMs, optionalFields)
+	})
+}
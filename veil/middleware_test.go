@@ -0,0 +1,416 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthEndpoint(t *testing.T) {
+	targetSocketPath, _ := recordingTargetSocket(t)
+	var missingSocketPath string = filepath.Join(t.TempDir(), "missing.sock")
+
+	// Every other request reaches the access rules, which recognize no path
+	var rulesRouter http.Handler = http.NotFoundHandler()
+
+	testCases := []struct {
+		name              string
+		healthPath        string
+		targetSocketPaths []string
+		requestURI        string
+		expectedStatus    int
+	}{
+		{name: "healthy target", healthPath: DefaultHealthPath, targetSocketPaths: []string{targetSocketPath}, requestURI: "/healthz", expectedStatus: http.StatusOK},
+		{name: "unreachable target", healthPath: DefaultHealthPath, targetSocketPaths: []string{missingSocketPath}, requestURI: "/healthz", expectedStatus: http.StatusServiceUnavailable},
+		{name: "any target reachable", healthPath: DefaultHealthPath, targetSocketPaths: []string{missingSocketPath, targetSocketPath}, requestURI: "/healthz", expectedStatus: http.StatusOK},
+		{name: "custom path", healthPath: "/ping", targetSocketPaths: []string{targetSocketPath}, requestURI: "/ping", expectedStatus: http.StatusOK},
+		{name: "other path", healthPath: DefaultHealthPath, targetSocketPaths: []string{targetSocketPath}, requestURI: "/v2/snaps", expectedStatus: http.StatusNotFound},
+		{name: "disabled", targetSocketPaths: []string{targetSocketPath}, requestURI: "/healthz", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var handler http.Handler = withHealthEndpoint(testCase.healthPath, testCase.targetSocketPaths, rulesRouter)
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, testCase.requestURI, nil))
+
+			if recorder.Code != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d", testCase.expectedStatus, recorder.Code)
+			}
+		})
+	}
+}
+
+// newCapturedAccessLog : Wraps a request handler with the access log, which is
+// written to the returned reader in place of standard output
+func newCapturedAccessLog(t *testing.T, logFormat string, next http.Handler) (http.Handler, *bufio.Reader) {
+	t.Helper()
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		reader.Close()
+		writer.Close()
+	})
+
+	// The access log holds on to standard output as it is when wrapping
+	var stdout *os.File = os.Stdout
+	os.Stdout = writer
+	var handler http.Handler = withAccessLog(logFormat, next)
+	os.Stdout = stdout
+
+	return handler, bufio.NewReader(reader)
+}
+
+func TestAccessLog(t *testing.T) {
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+
+	var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{})
+	var router http.Handler = createAccessRulesRouter(loadTestAccessRules(t, "POST~/v2/snaps\n!DELETE~/v2/snaps\n"), routingOptions{}, relay)
+
+	testCases := []struct {
+		name             string
+		method           string
+		requestURI       string
+		expectedDecision string
+		expectedStatus   int
+		expectedBytes    int64
+	}{
+		{name: "allowed", method: http.MethodPost, requestURI: "/v2/snaps", expectedDecision: DecisionAllowed, expectedStatus: http.StatusCreated, expectedBytes: int64(len("created"))},
+		{name: "forbidden", method: http.MethodDelete, requestURI: "/v2/snaps", expectedDecision: DecisionForbidden, expectedStatus: http.StatusUnauthorized},
+		{name: "not found", method: http.MethodGet, requestURI: "/v2/apps", expectedDecision: DecisionNotFound, expectedStatus: http.StatusNotFound},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name+" as JSON", func(t *testing.T) {
+			handler, accessLog := newCapturedAccessLog(t, LogFormatJSON, router)
+			var request *http.Request = httptest.NewRequest(testCase.method, testCase.requestURI, nil)
+			request.Header.Set(requestIDHeader, "c0ffee")
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+
+			line, err := accessLog.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var entry accessLogEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("expected a JSON object, got %q: %v", line, err)
+			}
+
+			if entry.Method != testCase.method || entry.Path != testCase.requestURI || entry.RequestID != "c0ffee" {
+				t.Errorf("expected %s %s with request ID c0ffee, got %s %s with request ID %q", testCase.method, testCase.requestURI, entry.Method, entry.Path, entry.RequestID)
+			}
+			if entry.Decision != testCase.expectedDecision {
+				t.Errorf("expected decision %q, got %q", testCase.expectedDecision, entry.Decision)
+			}
+			if entry.Status != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d", testCase.expectedStatus, entry.Status)
+			}
+			if testCase.expectedBytes > 0 && entry.Bytes != testCase.expectedBytes {
+				t.Errorf("expected %d bytes, got %d", testCase.expectedBytes, entry.Bytes)
+			}
+			if len(entry.Time) == 0 || entry.DurationMs < 0 {
+				t.Errorf("expected a time and duration, got %q and %v", entry.Time, entry.DurationMs)
+			}
+		})
+
+		t.Run(testCase.name+" as text", func(t *testing.T) {
+			handler, accessLog := newCapturedAccessLog(t, LogFormatText, router)
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(testCase.method, testCase.requestURI, nil))
+
+			line, err := accessLog.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, expectedField := range []string{
+				testCase.method + " " + testCase.requestURI + " ",
+				" decision=" + testCase.expectedDecision + " ",
+				" status=" + strconv.Itoa(testCase.expectedStatus) + " ",
+			} {
+				if !strings.Contains(line, expectedField) {
+					t.Errorf("expected the access log line to contain %q, got %q", expectedField, line)
+				}
+			}
+		})
+	}
+}
+
+func TestDryRunAccessLog(t *testing.T) {
+	var upstreamRequests int32
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamRequests, 1)
+	}))
+
+	var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{})
+	var router http.Handler = createAccessRulesRouter(loadTestAccessRules(t, "GET~/v2/snaps/*\n!GET~/v2/snaps/core\nPOST~/v2/apps\n"), routingOptions{}, relay)
+	handler, accessLog := newCapturedAccessLog(t, LogFormatJSON, withDryRun(relay, router))
+
+	testCases := []struct {
+		name             string
+		method           string
+		requestURI       string
+		expectedDecision string
+	}{
+		{name: "allowed", method: http.MethodGet, requestURI: "/v2/snaps/hello", expectedDecision: DecisionAllowed},
+		{name: "denied", method: http.MethodGet, requestURI: "/v2/snaps/core", expectedDecision: DecisionDryRunForbidden},
+		{name: "method not allowed", method: http.MethodGet, requestURI: "/v2/apps", expectedDecision: DecisionDryRunForbidden},
+		{name: "not found", method: http.MethodGet, requestURI: "/v2/unlisted", expectedDecision: DecisionDryRunNotFound},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var relayedBefore int32 = atomic.LoadInt32(&upstreamRequests)
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(testCase.method, testCase.requestURI, nil))
+			if recorder.Code != http.StatusOK {
+				t.Errorf("expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+			}
+
+			if relayed := atomic.LoadInt32(&upstreamRequests) - relayedBefore; relayed != 1 {
+				t.Errorf("expected the request to be relayed once, got %d", relayed)
+			}
+
+			line, err := accessLog.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var entry accessLogEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("expected a JSON object, got %q: %v", line, err)
+			}
+
+			if entry.Decision != testCase.expectedDecision {
+				t.Errorf("expected decision %q, got %q", testCase.expectedDecision, entry.Decision)
+			}
+		})
+	}
+}
+
+func TestErrorResponseStatus(t *testing.T) {
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/slow" {
+			<-r.Context().Done()
+		}
+	}))
+
+	var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{requestTimeout: 100 * time.Millisecond})
+	var router http.Handler = createAccessRulesRouter(loadTestAccessRules(t, "GET~/v2/snaps/*\n!GET~/v2/snaps/core\nGET~/v2/slow\n"), routingOptions{}, relay)
+	var server *httptest.Server = httptest.NewServer(withPanicRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/panic" {
+			panic("relay failed")
+		}
+
+		router.ServeHTTP(w, r)
+	})))
+	defer server.Close()
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	testCases := []struct {
+		name           string
+		method         string
+		requestURI     string
+		expectedStatus int
+	}{
+		{name: "unknown", method: http.MethodGet, requestURI: "/v2/apps", expectedStatus: http.StatusNotFound},
+		{name: "forbidden", method: http.MethodGet, requestURI: "/v2/snaps/core", expectedStatus: http.StatusUnauthorized},
+		{name: "method not allowed", method: http.MethodPost, requestURI: "/v2/snaps/hello", expectedStatus: http.StatusMethodNotAllowed},
+		{name: "bad request", method: http.MethodGet, requestURI: "/v2/snaps/a%3Fb", expectedStatus: http.StatusBadRequest},
+		{name: "timeout", method: http.MethodGet, requestURI: "/v2/slow", expectedStatus: http.StatusGatewayTimeout},
+		{name: "internal error", method: http.MethodGet, requestURI: "/v2/panic", expectedStatus: http.StatusInternalServerError},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			request, err := http.NewRequest(testCase.method, server.URL+testCase.requestURI, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+
+			if contentType := response.Header.Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("expected the content type application/json, got %q", contentType)
+			}
+
+			var body struct {
+				StatusCode int `json:"status-code"`
+			}
+			if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+
+			if response.StatusCode != testCase.expectedStatus || body.StatusCode != response.StatusCode {
+				t.Errorf("expected the status line and body to carry %d, got %d and %d", testCase.expectedStatus, response.StatusCode, body.StatusCode)
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var upstreamRequestIDs chan string = make(chan string, 1)
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequestIDs <- r.Header.Get(requestIDHeader)
+	}))
+
+	var handler http.Handler = withRequestID(newTestRelay([]string{targetSocketPath}, relayOptions{}))
+	var uuidPattern *regexp.Regexp = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	testCases := []struct {
+		name              string
+		incomingRequestID string
+	}{
+		{name: "generated", incomingRequestID: ""},
+		{name: "reused", incomingRequestID: "c0ffee"},
+	}
+
+	var generatedRequestIDs map[string]bool = map[string]bool{}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for i := 0; i < 2; i++ {
+				var request *http.Request = httptest.NewRequest(http.MethodGet, "/v2/snaps", nil)
+				if len(testCase.incomingRequestID) > 0 {
+					request.Header.Set(requestIDHeader, testCase.incomingRequestID)
+				}
+
+				var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+				handler.ServeHTTP(recorder, request)
+
+				var requestID string = recorder.Header().Get(requestIDHeader)
+				if upstreamRequestID := <-upstreamRequestIDs; upstreamRequestID != requestID {
+					t.Errorf("expected the target socket to receive request ID %q, got %q", requestID, upstreamRequestID)
+				}
+
+				if len(testCase.incomingRequestID) > 0 {
+					if requestID != testCase.incomingRequestID {
+						t.Errorf("expected request ID %q to be reused, got %q", testCase.incomingRequestID, requestID)
+					}
+					continue
+				}
+
+				if !uuidPattern.MatchString(requestID) {
+					t.Errorf("expected a version 4 UUID, got %q", requestID)
+				}
+				if generatedRequestIDs[requestID] {
+					t.Errorf("expected a unique request ID, got %q twice", requestID)
+				}
+				generatedRequestIDs[requestID] = true
+			}
+		})
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	var handler http.Handler = withRequestID(withPanicRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/panic":
+			var response *http.Response
+			w.WriteHeader(response.StatusCode)
+		case "/panic-after-header":
+			w.WriteHeader(http.StatusAccepted)
+			panic("relay failed")
+		}
+	})))
+
+	var server *httptest.Server = httptest.NewServer(handler)
+	defer server.Close()
+
+	var logged *bytes.Buffer = &bytes.Buffer{}
+	log.SetOutput(logged)
+	defer log.SetOutput(os.Stderr)
+
+	testCases := []struct {
+		requestURI     string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{requestURI: "/panic", expectedStatus: http.StatusInternalServerError, expectedBody: internalErrorString},
+		{requestURI: "/panic-after-header", expectedStatus: http.StatusAccepted},
+		{requestURI: "/v2/snaps", expectedStatus: http.StatusOK},
+	}
+
+	// Repeating the requests shows that the server survives each panic
+	for i := 0; i < 2; i++ {
+		for _, testCase := range testCases {
+			t.Run(testCase.requestURI, func(t *testing.T) {
+				response, err := http.Get(server.URL + testCase.requestURI)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				body, _ := io.ReadAll(response.Body)
+				response.Body.Close()
+				if response.StatusCode != testCase.expectedStatus {
+					t.Errorf("expected status %d, got %d", testCase.expectedStatus, response.StatusCode)
+				}
+
+				if len(testCase.expectedBody) > 0 && string(body) != testCase.expectedBody {
+					t.Errorf("expected the body %s, got %s", testCase.expectedBody, body)
+				}
+
+				// The panic is logged along with the request ID and stack
+				if testCase.expectedStatus != http.StatusOK {
+					var requestID string = response.Header.Get(requestIDHeader)
+					if !strings.Contains(logged.String(), "Panic serving GET "+testCase.requestURI+" request_id="+requestID) {
+						t.Errorf("expected the panic to be logged with request ID %s, got %q", requestID, logged.String())
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestPanicRecoveryPassesAbortsOn(t *testing.T) {
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			t.Errorf("expected the abort to be passed on, got %v", recovered)
+		}
+	}()
+
+	withPanicRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/snaps", nil))
+}
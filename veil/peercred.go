@@ -0,0 +1,60 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"context"
+	"net"
+)
+
+// peerCredentials : Identity of the process on the other end of a connection
+// to the exposed UNIX Domain Socket
+type peerCredentials struct {
+	pid int32
+	uid uint32
+	gid uint32
+}
+
+// peerCredentialsContextKey : Key under which the credentials of the client
+// that opened a connection are stored in the connection's context
+type peerCredentialsContextKey struct{}
+
+// withPeerCredentials : Attaches the credentials of the connecting process to
+// the context of a connection accepted on a UNIX Domain Socket, where the
+// platform supports retrieving them
+func withPeerCredentials(ctx context.Context, connection net.Conn) context.Context {
+	unixConnection, isUnixConnection := connection.(*net.UnixConn)
+	if !isUnixConnection {
+		return ctx
+	}
+
+	credentials, err := readPeerCredentials(unixConnection)
+	if err != nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, peerCredentialsContextKey{}, credentials)
+}
+
+// peerCredentialsFromContext : Retrieves the credentials of the process that
+// sent a request, if they are known
+func peerCredentialsFromContext(ctx context.Context) (*peerCredentials, bool) {
+	credentials, exists := ctx.Value(peerCredentialsContextKey{}).(*peerCredentials)
+	return credentials, exists
+}
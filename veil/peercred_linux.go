@@ -0,0 +1,51 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"net"
+	"syscall"
+)
+
+// readPeerCredentials : Retrieves the credentials of the process connected to
+// the other end of a UNIX Domain Socket using SO_PEERCRED
+func readPeerCredentials(connection *net.UnixConn) (*peerCredentials, error) {
+	rawConnection, err := connection.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var ucred *syscall.Ucred
+	var errSockopt error
+	errControl := rawConnection.Control(func(fd uintptr) {
+		ucred, errSockopt = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if errControl != nil {
+		return nil, errControl
+	}
+
+	if errSockopt != nil {
+		return nil, errSockopt
+	}
+
+	return &peerCredentials{pid: ucred.Pid, uid: ucred.Uid, gid: ucred.Gid}, nil
+}
@@ -0,0 +1,95 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadPeerCredentials(t *testing.T) {
+	var socketPath string = filepath.Join(t.TempDir(), "peer.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	clientConnection, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConnection.Close()
+
+	serverConnection, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConnection.Close()
+
+	credentials, exists := peerCredentialsFromContext(withPeerCredentials(context.Background(), serverConnection))
+	if !exists {
+		t.Fatal("expected the peer credentials to be read")
+	}
+
+	var expectedCredentials peerCredentials = peerCredentials{pid: int32(os.Getpid()), uid: uint32(os.Getuid()), gid: uint32(os.Getgid())}
+	if *credentials != expectedCredentials {
+		t.Errorf("expected %+v, got %+v", expectedCredentials, *credentials)
+	}
+
+	// Connections other than UNIX Domain Sockets carry no credentials
+	pipeConnection, otherPipeConnection := net.Pipe()
+	defer pipeConnection.Close()
+	defer otherPipeConnection.Close()
+	if _, exists := peerCredentialsFromContext(withPeerCredentials(context.Background(), pipeConnection)); exists {
+		t.Error("expected no peer credentials for a pipe")
+	}
+}
+
+func TestPeerCredentialRulesOnExposedSocket(t *testing.T) {
+	targetSocketPath, _ := recordingTargetSocket(t)
+	var v *Veil = startTestVeil(t, Options{
+		TargetSocketPath: targetSocketPath,
+		ExposedAddress:   filepath.Join(t.TempDir(), "veil.sock"),
+		AccessRulesPath: writeTestAccessRules(t, fmt.Sprintf("GET~/v2/snaps~uid=%d\nDELETE~/v2/snaps~uid=%d\nPOST~/v2/snaps~gid=%d\n",
+			os.Getuid(), os.Getuid()+1, os.Getgid())),
+	})
+
+	var client *http.Client = newVeilClient(v)
+	for _, testCase := range []struct {
+		method         string
+		expectedStatus int
+	}{
+		{method: http.MethodGet, expectedStatus: http.StatusOK},
+		{method: http.MethodDelete, expectedStatus: http.StatusUnauthorized},
+		{method: http.MethodPost, expectedStatus: http.StatusOK},
+	} {
+		if status := requestStatus(t, client, testCase.method, "/v2/snaps"); status != testCase.expectedStatus {
+			t.Errorf("expected status %d for %s, got %d", testCase.expectedStatus, testCase.method, status)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"errors"
+	"net"
+)
+
+// readPeerCredentials : Peer credentials can only be retrieved on Linux, so
+// rules restricted to particular user or group IDs never match elsewhere
+func readPeerCredentials(connection *net.UnixConn) (*peerCredentials, error) {
+	return nil, errors.New("peer credentials are not supported on this platform")
+}
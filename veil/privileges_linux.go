@@ -0,0 +1,90 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges : Switches the process to the named user and group (or their
+// numeric IDs), clearing its supplementary groups. When only the user is
+// named, the process switches to the user's primary group.
+func dropPrivileges(userName string, groupName string) error {
+	var uid int = -1
+	var gid int = -1
+
+	if len(userName) > 0 {
+		resolvedUID, err := resolveUserID(userName)
+		if err != nil {
+			return fmt.Errorf("unknown user %q: %v", userName, err)
+		}
+
+		uid = resolvedUID
+		if len(groupName) == 0 {
+			resolvedUser, err := user.LookupId(strconv.Itoa(uid))
+			if err != nil {
+				return fmt.Errorf("unable to find the primary group of user %q: %v", userName, err)
+			}
+
+			if gid, err = strconv.Atoi(resolvedUser.Gid); err != nil {
+				return fmt.Errorf("unable to find the primary group of user %q: %v", userName, err)
+			}
+		}
+	}
+
+	if len(groupName) > 0 {
+		resolvedGID, err := resolveGroupID(groupName)
+		if err != nil {
+			return fmt.Errorf("unknown group %q: %v", groupName, err)
+		}
+
+		gid = resolvedGID
+	}
+
+	// The group must change while the process still has the privilege to do
+	// so, before the user changes
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return fmt.Errorf("unable to clear supplementary groups: %v", err)
+	}
+
+	if gid >= 0 {
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("unable to switch to group %d: %v", gid, err)
+		}
+	}
+
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("unable to switch to user %d: %v", uid, err)
+		}
+	}
+
+	if (uid >= 0 && os.Geteuid() != uid) || (gid >= 0 && os.Getegid() != gid) {
+		return fmt.Errorf("process still runs as user %d and group %d", os.Geteuid(), os.Getegid())
+	}
+
+	return nil
+}
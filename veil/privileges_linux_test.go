@@ -0,0 +1,125 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// Environment variables through which TestDropPrivileges directs the test
+// binary it runs to drop privileges as a veil would
+const privilegesHelperEnvVar string = "VEIL_TEST_PRIVILEGES_HELPER"
+const privilegesHelperSocketEnvVar string = "VEIL_TEST_PRIVILEGES_SOCKET"
+const privilegesHelperRulesEnvVar string = "VEIL_TEST_PRIVILEGES_RULES"
+
+// unprivilegedID : User and group ID of the conventional "nobody" user
+const unprivilegedID int = 65534
+
+// TestDroppedPrivilegesVeil : Creates a Veil that drops its privileges once
+// its socket is bound, reporting the IDs it is left running with, when run by
+// TestDropPrivileges
+func TestDroppedPrivilegesVeil(t *testing.T) {
+	if os.Getenv(privilegesHelperEnvVar) != "1" {
+		t.Skip("run by TestDropPrivileges")
+	}
+
+	// No longer privileged, the veil cannot clean up after itself, which is
+	// left to TestDropPrivileges
+	var socketPath string = os.Getenv(privilegesHelperSocketEnvVar)
+	_, err := New(Options{
+		TargetSocketPath: filepath.Join(filepath.Dir(socketPath), "target.sock"),
+		ExposedAddress:   socketPath,
+		AccessRulesPath:  os.Getenv(privilegesHelperRulesEnvVar),
+		User:             fmt.Sprint(unprivilegedID),
+		Group:            fmt.Sprint(unprivilegedID),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := syscall.Getgroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Printf("uid=%d gid=%d groups=%v\n", os.Geteuid(), os.Getegid(), groups)
+}
+
+func TestDropPrivileges(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("dropping privileges requires running as root")
+	}
+
+	var socketDirectory string = t.TempDir()
+	var exposedSocketPath string = filepath.Join(socketDirectory, "veil.sock")
+	var command *exec.Cmd = exec.Command(os.Args[0], "-test.run=^TestDroppedPrivilegesVeil$", "-test.v")
+	command.Env = append(os.Environ(),
+		privilegesHelperEnvVar+"=1",
+		privilegesHelperSocketEnvVar+"="+exposedSocketPath,
+		privilegesHelperRulesEnvVar+"="+writeTestAccessRules(t, "GET~/v2/snaps\n"),
+	)
+
+	output, err := command.CombinedOutput()
+	if err != nil {
+		t.Fatalf("expected the veil to drop its privileges, got %v: %s", err, output)
+	}
+
+	if expectedIDs := fmt.Sprintf("uid=%d gid=%d groups=[]\n", unprivilegedID, unprivilegedID); !strings.Contains(string(output), expectedIDs) {
+		t.Errorf("expected the veil to run with %q, got %s", expectedIDs, output)
+	}
+
+	// The socket is bound while still privileged, so belongs to root
+	socketInfo, err := os.Stat(exposedSocketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if owner := socketInfo.Sys().(*syscall.Stat_t).Uid; owner != 0 {
+		t.Errorf("expected the socket to be bound by root, got owner %d", owner)
+	}
+}
+
+func TestDropPrivilegesRejected(t *testing.T) {
+	testCases := []struct {
+		name          string
+		userName      string
+		groupName     string
+		expectedError string
+	}{
+		{name: "unknown user", userName: "no-such-veil-user", expectedError: `unknown user "no-such-veil-user"`},
+		{name: "unknown group", groupName: "no-such-veil-group", expectedError: `unknown group "no-such-veil-group"`},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if err := dropPrivileges(testCase.userName, testCase.groupName); err == nil || !strings.Contains(err.Error(), testCase.expectedError) {
+				t.Errorf("expected an error containing %q, got %v", testCase.expectedError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateUnits : Periods that may follow the "/" of a rate specification in place
+// of a Go duration
+var rateUnits map[string]time.Duration = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+}
+
+// parseRate : Parses a rate specification of the form "<count>/<period>", where
+// the period is "s", "m", "h" or a Go duration (e.g. "5/s" or "100/10m"), into
+// a limiter allowing bursts of up to count requests, replenished evenly over
+// each period
+func parseRate(specification string) (*rate.Limiter, error) {
+	var separatorIndex int = strings.Index(specification, "/")
+	if separatorIndex < 0 {
+		return nil, fmt.Errorf("expected <count>/<period>")
+	}
+
+	count, err := strconv.ParseUint(strings.TrimSpace(specification[:separatorIndex]), 10, 31)
+	if err != nil || count == 0 {
+		return nil, fmt.Errorf("count must be a positive integer")
+	}
+
+	var periodString string = strings.TrimSpace(specification[separatorIndex+1:])
+	period, isUnit := rateUnits[periodString]
+	if !isUnit {
+		period, err = time.ParseDuration(periodString)
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("period must be s, m, h or a positive duration")
+		}
+	}
+
+	return rate.NewLimiter(rate.Limit(float64(count)/period.Seconds()), int(count)), nil
+}
+
+// uidRateLimiter : Limits the rate of requests from each user, as identified
+// by the credentials of the processes connecting to the exposed socket, with a
+// limiter per user. The limiters of users that have been idle long enough for
+// them to be replenished are discarded, so that only users active within the
+// last refill period are tracked.
+type uidRateLimiter struct {
+	mutex sync.Mutex
+
+	limit rate.Limit
+	burst int
+
+	limiters  map[uint32]*rate.Limiter
+	lastSweep time.Time
+}
+
+// newUIDRateLimiter : Creates a limiter allowing each user bursts of up to
+// burst requests, replenished at limit requests per second
+func newUIDRateLimiter(limit rate.Limit, burst int) *uidRateLimiter {
+	return &uidRateLimiter{
+		limit:     limit,
+		burst:     burst,
+		limiters:  make(map[uint32]*rate.Limiter),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow : Reports whether the user may make a request now, counting it against
+// the user's limit if so
+func (limiter *uidRateLimiter) allow(uid uint32) bool {
+	limiter.mutex.Lock()
+	var now time.Time = time.Now()
+	if now.Sub(limiter.lastSweep).Seconds() >= float64(limiter.burst)/float64(limiter.limit) {
+		for limiterUID, userLimiter := range limiter.limiters {
+			if userLimiter.TokensAt(now) >= float64(limiter.burst) {
+				delete(limiter.limiters, limiterUID)
+			}
+		}
+
+		limiter.lastSweep = now
+	}
+
+	userLimiter, exists := limiter.limiters[uid]
+	if !exists {
+		userLimiter = rate.NewLimiter(limiter.limit, limiter.burst)
+		limiter.limiters[uid] = userLimiter
+	}
+
+	limiter.mutex.Unlock()
+
+	return userLimiter.AllowN(now, 1)
+}
+
+// withUIDRateLimit : Wraps a request handler such that requests beyond the rate
+// allowed for the user that sent them are refused immediately. Requests whose
+// sender's credentials are unknown, such as those received over TCP, are not
+// limited.
+func withUIDRateLimit(limiter *uidRateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if credentials, exists := peerCredentialsFromContext(r.Context()); exists && !limiter.allow(credentials.uid) {
+			recordRequestDecision(r.Context(), DecisionRateLimited)
+			writeErrorResponse(w, r, http.StatusTooManyRequests, tooManyRequestsString)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withRateLimit : Wraps a request handler such that requests beyond the rate
+// allowed by the limiter are refused immediately, rather than queued
+func withRateLimit(limiter *rate.Limiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.Allow() {
+			recordRequestDecision(r.Context(), DecisionRateLimited)
+			writeErrorResponse(w, r, http.StatusTooManyRequests, tooManyRequestsString)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// newVeilClientAsUser : Returns a client of the veil that connects with the
+// given effective user ID, which the veil then reads as that of its peer. Only
+// the thread dialing each connection takes on the user ID, and the thread is
+// discarded once the connection is made.
+func newVeilClientAsUser(v *Veil, uid int) *http.Client {
+	var address net.Addr = v.listener.Addr()
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				type dialResult struct {
+					connection net.Conn
+					err        error
+				}
+
+				var results chan dialResult = make(chan dialResult, 1)
+				go func() {
+					// The thread is never unlocked, so it exits along with the
+					// goroutine rather than serving others as the user
+					runtime.LockOSThread()
+					if _, _, errno := syscall.RawSyscall(syscall.SYS_SETRESUID, ^uintptr(0), uintptr(uid), ^uintptr(0)); errno != 0 {
+						results <- dialResult{err: errno}
+						return
+					}
+
+					var dialer net.Dialer
+					connection, err := dialer.DialContext(ctx, address.Network(), address.String())
+					results <- dialResult{connection: connection, err: err}
+				}()
+
+				var result dialResult = <-results
+				return result.connection, result.err
+			},
+		},
+	}
+}
+
+func TestUIDRateLimitsOnExposedSocket(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("connecting as another user requires running as root")
+	}
+
+	// The socket must be reachable by the other user
+	socketDirectory, err := os.MkdirTemp("", "veil-uid-rate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(socketDirectory) })
+
+	if err := os.Chmod(socketDirectory, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	targetSocketPath, _ := recordingTargetSocket(t)
+	var v *Veil = startTestVeil(t, Options{
+		TargetSocketPath: targetSocketPath,
+		ExposedAddress:   filepath.Join(socketDirectory, "veil.sock"),
+		SocketMode:       0666,
+		AccessRulesPath:  writeTestAccessRules(t, "GET~/v2/snaps\n"),
+		UIDRate:          0.001,
+		UIDBurst:         2,
+	})
+
+	var rootClient *http.Client = newVeilClient(v)
+	var otherClient *http.Client = newVeilClientAsUser(v, unprivilegedID)
+
+	testCases := []struct {
+		name           string
+		client         *http.Client
+		expectedStatus int
+	}{
+		{name: "first request of the first user", client: rootClient, expectedStatus: http.StatusOK},
+		{name: "second request of the first user", client: rootClient, expectedStatus: http.StatusOK},
+		{name: "first user beyond its burst", client: rootClient, expectedStatus: http.StatusTooManyRequests},
+		{name: "first request of the second user", client: otherClient, expectedStatus: http.StatusOK},
+		{name: "second request of the second user", client: otherClient, expectedStatus: http.StatusOK},
+		{name: "second user beyond its burst", client: otherClient, expectedStatus: http.StatusTooManyRequests},
+		{name: "first user still limited", client: rootClient, expectedStatus: http.StatusTooManyRequests},
+	}
+
+	for _, testCase := range testCases {
+		if status := requestStatus(t, testCase.client, http.MethodGet, "/v2/snaps"); status != testCase.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", testCase.name, testCase.expectedStatus, status)
+		}
+	}
+}
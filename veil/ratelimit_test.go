@@ -0,0 +1,141 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestParseRate(t *testing.T) {
+	testCases := []struct {
+		specification string
+		expectedLimit rate.Limit
+		expectedBurst int
+		expectError   bool
+	}{
+		{specification: "5/s", expectedLimit: 5, expectedBurst: 5},
+		{specification: "120/m", expectedLimit: 2, expectedBurst: 120},
+		{specification: "100/10m", expectedLimit: rate.Limit(100.0 / 600), expectedBurst: 100},
+		{specification: " 3 / h ", expectedLimit: rate.Limit(3.0 / 3600), expectedBurst: 3},
+		{specification: "5", expectError: true},
+		{specification: "0/s", expectError: true},
+		{specification: "-1/s", expectError: true},
+		{specification: "5/fortnight", expectError: true},
+		{specification: "5/-1s", expectError: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.specification, func(t *testing.T) {
+			limiter, err := parseRate(testCase.specification)
+			if testCase.expectError {
+				if err == nil {
+					t.Fatal("expected the rate to be rejected")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if limiter.Limit() != testCase.expectedLimit || limiter.Burst() != testCase.expectedBurst {
+				t.Errorf("expected %v/s with burst %d, got %v/s with burst %d", testCase.expectedLimit, testCase.expectedBurst, limiter.Limit(), limiter.Burst())
+			}
+		})
+	}
+}
+
+// requestAsUser : Makes a request through the handler as though it were sent
+// by the user with the given ID, or by an unknown user if uid is negative
+func requestAsUser(handler http.Handler, uid int64) int {
+	var r *http.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	if uid >= 0 {
+		r = r.WithContext(context.WithValue(r.Context(), peerCredentialsContextKey{}, &peerCredentials{uid: uint32(uid)}))
+	}
+
+	var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	return recorder.Code
+}
+
+func TestRateLimits(t *testing.T) {
+	var allowed http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {}
+
+	testCases := []struct {
+		name             string
+		handler          http.Handler
+		uids             []int64
+		expectedStatuses []int
+	}{
+		{
+			name:             "global burst",
+			handler:          withRateLimit(rate.NewLimiter(rate.Every(time.Hour), 2), allowed),
+			uids:             []int64{1000, 1001, 1002},
+			expectedStatuses: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:             "per-user burst",
+			handler:          withUIDRateLimit(newUIDRateLimiter(rate.Every(time.Hour), 2), allowed),
+			uids:             []int64{1000, 1000, 1001, 1000, 1001, 1001},
+			expectedStatuses: []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:             "unknown users are not limited per user",
+			handler:          withUIDRateLimit(newUIDRateLimiter(rate.Every(time.Hour), 1), allowed),
+			uids:             []int64{-1, -1, -1},
+			expectedStatuses: []int{http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for i, uid := range testCase.uids {
+				if status := requestAsUser(testCase.handler, uid); status != testCase.expectedStatuses[i] {
+					t.Errorf("expected request %d from user %d to get status %d, got %d", i+1, uid, testCase.expectedStatuses[i], status)
+				}
+			}
+		})
+	}
+}
+
+func TestUIDRateLimiterDiscardsIdleUsers(t *testing.T) {
+	var limiter *uidRateLimiter = newUIDRateLimiter(rate.Every(time.Minute), 1)
+	limiter.allow(1000)
+
+	// The last sweep is moved back a refill period rather than waiting, while
+	// the user's limiter is still depleted
+	limiter.lastSweep = time.Now().Add(-time.Minute)
+	limiter.allow(1001)
+	if _, tracked := limiter.limiters[1000]; !tracked {
+		t.Fatal("expected a user whose limiter is depleted to still be tracked")
+	}
+
+	limiter.limiters[1000] = rate.NewLimiter(limiter.limit, limiter.burst)
+	limiter.lastSweep = time.Now().Add(-time.Minute)
+	limiter.allow(1001)
+	if _, tracked := limiter.limiters[1000]; tracked {
+		t.Fatal("expected a user whose limiter is replenished to be discarded")
+	}
+}
@@ -0,0 +1,765 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thoas/go-funk"
+)
+
+// errResponseTooLarge : Noted as the upstream error of a request whose response
+// body exceeded the maximum size
+var errResponseTooLarge error = errors.New("response body exceeds the maximum size")
+
+// rejectsMethod : Reports whether the target socket answered a request with a
+// status saying that it does not support the request's method
+func rejectsMethod(response *http.Response) bool {
+	return response.StatusCode == http.StatusMethodNotAllowed || response.StatusCode == http.StatusNotImplemented
+}
+
+// createUnixSocketHTTPClient : Returns an HTTP client whose connections are
+// made to the UNIX Domain Socket, bounding the time taken to connect and
+// keeping idle connections open for reuse as governed by the relay options
+func createUnixSocketHTTPClient(unixSocketPath string, options relayOptions) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer = net.Dialer{Timeout: options.dialTimeout}
+				return dialer.DialContext(ctx, "unix", unixSocketPath)
+			},
+			MaxIdleConns:        options.maxIdleConns,
+			MaxIdleConnsPerHost: options.maxIdleConnsPerHost,
+			IdleConnTimeout:     options.idleConnTimeout,
+			// A request expecting 100-continue only has its body sent once the
+			// target socket agrees to it, or fails to answer in time. Reading
+			// the body then has the exposed server send 100 Continue on to the
+			// client, so that a request the target socket refuses never has
+			// its body uploaded.
+			ExpectContinueTimeout: expectContinueTimeout,
+		},
+	}
+}
+
+// dialAnyTargetSocket : Checks that at least one of the target sockets can be
+// dialed, returning the error from the last otherwise
+func dialAnyTargetSocket(targetSocketPaths []string) error {
+	var err error
+	for _, targetSocketPath := range targetSocketPaths {
+		var targetConnection net.Conn
+		if targetConnection, err = net.DialTimeout("unix", targetSocketPath, healthCheckDialTimeout); err == nil {
+			targetConnection.Close()
+			return nil
+		}
+	}
+
+	return err
+}
+
+// waitForTargetSocket : Polls the target sockets until any of them can be
+// dialed, returning an error if none can be within the timeout
+func waitForTargetSocket(targetSocketPaths []string, timeout time.Duration) error {
+	var deadline time.Time = time.Now().Add(timeout)
+	for {
+		err := dialAnyTargetSocket(targetSocketPaths)
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().Add(targetSocketPollInterval).After(deadline) {
+			return fmt.Errorf("target socket %s did not become available within %v: %v", strings.Join(targetSocketPaths, ", "), timeout, err)
+		}
+
+		time.Sleep(targetSocketPollInterval)
+	}
+}
+
+// relayOptions : Settings that govern how requests are relayed to the target
+// socket
+type relayOptions struct {
+	// requestTimeout bounds the duration of each relayed request, unless its
+	// access rule specifies otherwise
+	requestTimeout time.Duration
+
+	// dialTimeout bounds the time taken to connect to the target socket,
+	// separately from the request timeout, when greater than zero
+	dialTimeout time.Duration
+
+	// strippedRequestHeaders names headers that are removed from requests
+	// before they are relayed
+	strippedRequestHeaders []string
+
+	// maxConcurrentRequests bounds the number of requests relayed at once when
+	// greater than zero
+	maxConcurrentRequests int
+
+	// maxBodyBytes bounds the size of relayed request bodies when greater than
+	// zero
+	maxBodyBytes int64
+
+	// maxResponseBytes bounds the size of relayed response bodies, other than
+	// event streams, when greater than zero
+	maxResponseBytes int64
+
+	// retries is the number of further attempts made to relay an idempotent
+	// request without a body when the target socket cannot be reached
+	retries int
+
+	// breakerThreshold is the number of consecutive upstream failures within
+	// breakerWindow that trips the circuit breaker, which then refuses requests
+	// for breakerCooldown. The circuit breaker is disabled when it is zero.
+	breakerThreshold int
+	breakerWindow    time.Duration
+	breakerCooldown  time.Duration
+
+	// maxIdleConns and maxIdleConnsPerHost bound the idle connections to the
+	// target socket kept open for reuse, and idleConnTimeout is how long one
+	// may stay idle before it is closed. Zero values select the defaults of
+	// http.Transport.
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+
+	// counters tallies the requests relayed, and is replaced with counters of
+	// the relay's own if nil
+	counters *relayCounters
+
+	// viaPseudonym is the name by which the veil identifies itself in the Via
+	// header of relayed requests and responses
+	viaPseudonym string
+
+	// compressResponses enables gzip compression of relayed responses for
+	// clients that accept it
+	compressResponses bool
+
+	// decompressRequests enables decompression of gzip-encoded request bodies
+	// before they are relayed
+	decompressRequests bool
+
+	// responseHeaders are added to relayed responses, such as to harden them
+	// for browsers
+	responseHeaders []responseHeader
+
+	// headFromGet answers HEAD requests that the target socket does not
+	// support from the equivalent GET request, with its body discarded
+	headFromGet bool
+}
+
+// relayedRequestBody : Wraps the body of a request being relayed to note how
+// reading it from the client went, so that a failure to relay the request can
+// be attributed to either the client or the target socket
+type relayedRequestBody struct {
+	io.ReadCloser
+	// limit is the size in bytes beyond which the body was refused by
+	// http.MaxBytesReader, or zero if unlimited
+	limit     int64
+	bytesRead int64
+	finished  bool
+	readError error
+}
+
+func (body *relayedRequestBody) Read(data []byte) (int, error) {
+	bytesRead, err := body.ReadCloser.Read(data)
+	body.bytesRead += int64(bytesRead)
+	if err == io.EOF {
+		body.finished = true
+	} else if err != nil {
+		body.readError = err
+	}
+
+	return bytesRead, err
+}
+
+// exceeded : Reports whether the body was found to be larger than its limit
+func (body *relayedRequestBody) exceeded() bool {
+	return body.limit > 0 && body.readError != nil && body.bytesRead >= body.limit
+}
+
+// relayFailureResponse : Determines the status code and message with which to
+// answer a request that could not be relayed, and whether the target socket
+// rather than the client was at fault. The body may be nil for requests that
+// have none.
+func relayFailureResponse(err error, body *relayedRequestBody) (int, string, bool) {
+	if body != nil {
+		if body.exceeded() {
+			return http.StatusRequestEntityTooLarge, requestEntityTooLargeString, false
+		}
+
+		// A client still sending its body when the request times out was
+		// too slow, rather than the target socket
+		if (body.readError != nil && isTimeoutError(body.readError)) || (isTimeoutError(err) && !body.finished) {
+			return http.StatusRequestTimeout, requestTimeoutString, false
+		}
+
+		if body.readError != nil {
+			return http.StatusBadRequest, badRequestString, false
+		}
+	}
+
+	if isTimeoutError(err) {
+		return http.StatusGatewayTimeout, gatewayTimeoutString, true
+	}
+
+	if isDialError(err) {
+		return http.StatusBadGateway, targetUnreachableString, true
+	}
+
+	return http.StatusBadGateway, badGatewayString, true
+}
+
+// obtainSocketRequestHandler : Returns a handle to a function that can field and
+// filter incoming requests, relaying them to the target sockets as governed by
+// the relay options. Requests are distributed in turn among the target
+// sockets that are healthy. An idempotent request without a body that cannot
+// be relayed because a target socket fails to dial is relayed to the next one
+// instead.
+func obtainSocketRequestHandler(upstreams []*targetUpstream, options relayOptions) func(w http.ResponseWriter, r *http.Request) {
+	var nextUpstream uint64 = 0
+
+	var concurrencySemaphore chan struct{}
+	if options.maxConcurrentRequests > 0 {
+		concurrencySemaphore = make(chan struct{}, options.maxConcurrentRequests)
+	}
+
+	if options.counters == nil {
+		options.counters = &relayCounters{}
+	}
+
+	var breaker *circuitBreaker
+	if options.breakerThreshold > 0 {
+		breaker = newCircuitBreaker(options.breakerThreshold, options.breakerWindow, options.breakerCooldown)
+	}
+
+	// Fields and filters incoming requests, then relays those as
+	// appopriate to the encapsulated UNIX Domain Socket
+	return func(w http.ResponseWriter, r *http.Request) {
+		recordRequestDecision(r.Context(), DecisionAllowed)
+		r = withRelayCounters(r, options.counters)
+		atomic.AddInt64(&options.counters.relayedRequests, 1)
+		atomic.AddInt64(&options.counters.inFlightRequests, 1)
+		defer atomic.AddInt64(&options.counters.inFlightRequests, -1)
+
+		if concurrencySemaphore != nil {
+			select {
+			case concurrencySemaphore <- struct{}{}:
+				defer func() { <-concurrencySemaphore }()
+			default:
+				writeErrorResponse(w, r, http.StatusServiceUnavailable, tooManyRequestsInFlightString)
+				return
+			}
+		}
+
+		var upstreamPath string = r.URL.EscapedPath()
+		var timeout time.Duration = options.requestTimeout
+		if rule, exists := accessRuleFromContext(r.Context()); exists {
+			upstreamPath = rule.rewritePath(upstreamPath)
+			if rule.timeout > 0 {
+				timeout = rule.timeout
+			}
+		}
+
+		// The path is relayed escaped, so that an encoded "?" or "#" in the
+		// path remains part of the path rather than cutting it short
+		decodedUpstreamPath, errUnescape := url.PathUnescape(upstreamPath)
+		if errUnescape != nil {
+			logError("Unable to relay", r.Method, r.URL.Path, "with invalid path", upstreamPath, errUnescape)
+			writeErrorResponse(w, r, http.StatusInternalServerError, internalErrorString)
+			return
+		}
+
+		var requestURL *url.URL = &url.URL{
+			Scheme:   "http",
+			Host:     "unix",
+			Path:     decodedUpstreamPath,
+			RawPath:  upstreamPath,
+			RawQuery: r.URL.RawQuery,
+		}
+
+		var upstreamOrder []*targetUpstream = rotateUpstreams(upstreams, atomic.AddUint64(&nextUpstream, 1)-1)
+
+		if isUpgradeRequest(r) {
+			relayUpgradeRequest(w, r, upstreamOrder, requestURL, timeout, options)
+			return
+		}
+
+		// The request to the target socket is abandoned should the client
+		// disconnect before it completes
+		var requestContext *liftableTimeoutContext = withLiftableTimeout(r.Context(), timeout)
+		defer requestContext.release()
+
+		switch r.Method {
+		case http.MethodGet:
+			fallthrough
+		case http.MethodHead:
+			fallthrough
+		case http.MethodPost:
+			fallthrough
+		case http.MethodDelete:
+			fallthrough
+		case http.MethodPatch:
+			fallthrough
+		case http.MethodPut:
+			if options.maxBodyBytes > 0 && r.ContentLength > options.maxBodyBytes {
+				writeErrorResponse(w, r, http.StatusRequestEntityTooLarge, requestEntityTooLargeString)
+				return
+			}
+
+			var requestBody *relayedRequestBody = &relayedRequestBody{
+				ReadCloser: r.Body,
+				finished:   r.ContentLength == 0,
+			}
+
+			// A decompressed body is relayed without a Content-Length, as its
+			// length is only known once it has been read in full
+			var decompressBody bool = options.decompressRequests && r.ContentLength != 0 && isGzipEncoded(r.Header)
+			if decompressBody {
+				decompressedBody, err := newGzipRequestBody(r.Body)
+				if err != nil {
+					logWarn("Unable to decompress request body for", r.Method, r.URL.Path, err)
+					writeErrorResponse(w, r, http.StatusBadRequest, badRequestString)
+					return
+				}
+
+				requestBody.ReadCloser = decompressedBody
+			}
+
+			if options.maxBodyBytes > 0 {
+				// The limit is enforced as the body streams to the target
+				// socket, so bodies of unknown length are never buffered. For
+				// a decompressed body, the limit applies to its decompressed
+				// size.
+				requestBody.ReadCloser = http.MaxBytesReader(w, requestBody.ReadCloser, options.maxBodyBytes)
+				requestBody.limit = options.maxBodyBytes
+			}
+
+			var outgoingBody io.Reader = requestBody
+			if r.ContentLength == 0 {
+				outgoingBody = http.NoBody
+			} else {
+				// A client still sending its body once the request times out
+				// would hold the relay up until it sends the rest, so reading
+				// from the client is cut short for the request to be answered
+				stopCuttingShort := context.AfterFunc(requestContext, func() {
+					if requestContext.Err() == context.DeadlineExceeded {
+						http.NewResponseController(w).SetReadDeadline(time.Now())
+					}
+				})
+				defer stopCuttingShort()
+			}
+
+			// A request that fails through no fault of the target socket, such
+			// as one its client abandons, is neither a success nor a failure
+			var upstreamFailed bool = false
+			var clientFailed bool = false
+			if breaker != nil {
+				generation, allowed := breaker.allow()
+				if !allowed {
+					writeErrorResponse(w, r, http.StatusServiceUnavailable, circuitOpenString)
+					return
+				}
+
+				defer func() {
+					if clientFailed {
+						breaker.release(generation)
+					} else {
+						breaker.record(generation, upstreamFailed)
+					}
+				}()
+			}
+
+			// Only idempotent requests without a body can safely be sent
+			// again, whether to the next target socket or after a backoff
+			var repeatable bool = r.ContentLength == 0 && funk.ContainsString(idempotentHTTPMethods, r.Method)
+			var attempts int = 1
+			if options.retries > 0 && repeatable {
+				attempts += options.retries
+			}
+
+			var relayStartTime time.Time = time.Now()
+
+			var response *http.Response
+			var errReqPeform error
+			var upstreamIndex int = 0
+			for attempt := 0; attempt < attempts; attempt++ {
+				if attempt > 0 && !waitToRetry(requestContext, attempt) {
+					break
+				}
+
+				// Each attempt moves on through the target sockets that fail
+				// to dial until one of them answers or all have been tried
+				for skipped := 0; ; skipped++ {
+					var upstream *targetUpstream = upstreamOrder[upstreamIndex%len(upstreamOrder)]
+					upstreamIndex++
+
+					httpRequest, errReqCreate := http.NewRequest(r.Method, requestURL.String(), outgoingBody)
+					if errReqCreate != nil {
+						writeErrorResponse(w, r, http.StatusInternalServerError, internalErrorString)
+						return
+					}
+
+					// The body is wrapped, so its length must be carried over
+					// for the target socket to see the same framing the client
+					// sent
+					if r.ContentLength > 0 && !decompressBody {
+						httpRequest.ContentLength = r.ContentLength
+					}
+
+					copyHeaders(httpRequest.Header, r.Header)
+					if decompressBody {
+						httpRequest.Header.Del("Content-Encoding")
+					}
+
+					for _, strippedHeader := range options.strippedRequestHeaders {
+						httpRequest.Header.Del(strippedHeader)
+					}
+
+					appendViaHeader(httpRequest.Header, r.ProtoMajor, r.ProtoMinor, options.viaPseudonym)
+					injectTraceContext(requestContext, httpRequest.Header)
+
+					logDebug("Relaying", r.Method, r.URL.RequestURI(), "to", requestURL, "on", upstream.socketPath, "request_id="+r.Header.Get(requestIDHeader), describeHeaders(r.Header))
+					httpRequest = httpRequest.WithContext(requestContext)
+					response, errReqPeform = upstream.client.Do(httpRequest)
+					if errReqPeform == nil && options.headFromGet && r.Method == http.MethodHead && rejectsMethod(response) {
+						response.Body.Close()
+
+						// Only the status and headers of the GET request are
+						// relayed, as for any HEAD request
+						var getRequest *http.Request = httpRequest.Clone(requestContext)
+						getRequest.Method = http.MethodGet
+						response, errReqPeform = upstream.client.Do(getRequest)
+						if errReqPeform == nil {
+							response.Body.Close()
+							response.Body = http.NoBody
+						}
+					}
+
+					if errReqPeform == nil || requestContext.Err() != nil || !repeatable || !isDialError(errReqPeform) || skipped+1 >= len(upstreamOrder) {
+						break
+					}
+
+					logWarn("Skipping target socket", upstream.socketPath, "for", r.Method, r.URL.Path, "after dial error:", errReqPeform)
+				}
+
+				// Only failures to reach the target socket are retried, not
+				// requests that ran out of time
+				if errReqPeform == nil || requestContext.Err() != nil {
+					break
+				}
+
+				if attempt+1 < attempts {
+					logWarn("Retrying", r.Method, r.URL.Path, "after upstream error:", errReqPeform)
+				}
+			}
+
+			if errReqPeform != nil && clientDisconnected(r, requestContext) {
+				logInfo("Client disconnected during", r.Method, r.URL.Path)
+				clientFailed = true
+				w.WriteHeader(clientClosedRequestStatus)
+				return
+			}
+
+			if errReqPeform != nil {
+				statusCode, message, upstreamFault := relayFailureResponse(errReqPeform, requestBody)
+				if upstreamFault {
+					upstreamFailed = true
+					recordUpstreamError(r.Context(), errReqPeform)
+				} else {
+					clientFailed = true
+				}
+
+				writeErrorResponse(w, r, statusCode, message)
+				return
+			}
+
+			defer response.Body.Close()
+
+			logDebug("Received", response.StatusCode, "for", r.Method, r.URL.RequestURI(), "request_id="+r.Header.Get(requestIDHeader), "after", time.Since(relayStartTime))
+
+			// Event streams may never end, so they are exempt from the timeout
+			// and relayed as each event arrives
+			if isEventStream(response) && requestContext.liftTimeout() {
+				copyHeaders(w.Header(), response.Header)
+				applyResponseHeaders(w.Header(), options.responseHeaders)
+				appendViaHeader(w.Header(), response.ProtoMajor, response.ProtoMinor, options.viaPseudonym)
+				w.WriteHeader(response.StatusCode)
+				if errCopy := copyFlushing(w, response.Body); errCopy != nil {
+					logError("Error relaying event stream for", r.Method, r.URL.Path, errCopy)
+					recordUpstreamError(r.Context(), errCopy)
+				}
+				return
+			}
+
+			// A response declaring a body beyond the limit is refused before
+			// any of it reaches the client
+			if options.maxResponseBytes > 0 && r.Method != http.MethodHead && response.ContentLength > options.maxResponseBytes {
+				logWarn("Response of", response.ContentLength, "bytes for", r.Method, r.URL.Path, "exceeds the maximum of", options.maxResponseBytes)
+				recordUpstreamError(r.Context(), errResponseTooLarge)
+				writeErrorResponse(w, r, http.StatusBadGateway, responseTooLargeString)
+				return
+			}
+
+			// Wait for the first byte of the body so that an upstream failing
+			// before it sends anything can still be reported as an error
+			var responseBodyReader *bufio.Reader = bufio.NewReader(response.Body)
+			if _, errPeek := responseBodyReader.Peek(1); errPeek != nil && errPeek != io.EOF {
+				if clientDisconnected(r, requestContext) {
+					logInfo("Client disconnected during", r.Method, r.URL.Path)
+					clientFailed = true
+					w.WriteHeader(clientClosedRequestStatus)
+					return
+				}
+
+				logError("Error reading response for", r.Method, r.URL.Path, errPeek)
+				statusCode, message, _ := relayFailureResponse(errPeek, nil)
+				upstreamFailed = true
+				recordUpstreamError(r.Context(), errPeek)
+				writeErrorResponse(w, r, statusCode, message)
+				return
+			}
+
+			copyHeaders(w.Header(), response.Header)
+			applyResponseHeaders(w.Header(), options.responseHeaders)
+			appendViaHeader(w.Header(), response.ProtoMajor, response.ProtoMinor, options.viaPseudonym)
+
+			var responseBodyWriter io.Writer = w
+			var compressor *gzipResponseWriter
+			if options.compressResponses && acceptsGzip(r) && isCompressible(r, response) {
+				compressor = newGzipResponseWriter(w)
+				responseBodyWriter = compressor
+			}
+
+			var responseBodySource io.Reader = responseBodyReader
+			if options.maxResponseBytes > 0 {
+				responseBodySource = io.LimitReader(responseBodyReader, options.maxResponseBytes)
+			}
+
+			w.WriteHeader(response.StatusCode)
+			_, errCopy := io.Copy(responseBodyWriter, responseBodySource)
+			if errCopy != nil {
+				logError("Error relaying response for", r.Method, r.URL.Path, errCopy)
+				recordUpstreamError(r.Context(), errCopy)
+			}
+
+			if compressor != nil {
+				compressor.Close()
+			}
+
+			// A body of unknown length that runs past the limit has already
+			// been partly sent, so the response is cut short by aborting the
+			// connection rather than ending it as though it were complete
+			if options.maxResponseBytes > 0 && errCopy == nil {
+				if _, errPeek := responseBodyReader.Peek(1); errPeek == nil {
+					logWarn("Response for", r.Method, r.URL.Path, "exceeded the maximum of", options.maxResponseBytes, "bytes and was truncated")
+					recordUpstreamError(r.Context(), errResponseTooLarge)
+					panic(http.ErrAbortHandler)
+				}
+			}
+			break
+		default:
+			writeErrorResponse(w, r, http.StatusBadRequest, badRequestString)
+		}
+	}
+}
+
+// clientDisconnected : Reports whether the client went away before its request
+// was relayed. Once the request has timed out, the connection to the client
+// may instead have been cut short by the relay itself.
+func clientDisconnected(r *http.Request, requestContext *liftableTimeoutContext) bool {
+	return r.Context().Err() != nil && requestContext.Err() != context.DeadlineExceeded
+}
+
+// liftableTimeoutContext : A context that ends with context.DeadlineExceeded
+// once its timeout elapses, unless the timeout is lifted beforehand
+type liftableTimeoutContext struct {
+	context.Context
+	done      chan struct{}
+	endOnce   sync.Once
+	timer     *time.Timer
+	errMutex  sync.Mutex
+	endReason error
+}
+
+// withLiftableTimeout : Derives a context from the parent that times out after
+// the provided duration unless the timeout is lifted
+func withLiftableTimeout(parent context.Context, timeout time.Duration) *liftableTimeoutContext {
+	var ctx *liftableTimeoutContext = &liftableTimeoutContext{
+		Context: parent,
+		done:    make(chan struct{}),
+	}
+
+	ctx.timer = time.AfterFunc(timeout, func() {
+		ctx.end(context.DeadlineExceeded)
+	})
+
+	if parent.Done() != nil {
+		go func() {
+			select {
+			case <-parent.Done():
+				ctx.end(parent.Err())
+			case <-ctx.done:
+			}
+		}()
+	}
+
+	return ctx
+}
+
+func (ctx *liftableTimeoutContext) Done() <-chan struct{} {
+	return ctx.done
+}
+
+func (ctx *liftableTimeoutContext) Err() error {
+	ctx.errMutex.Lock()
+	defer ctx.errMutex.Unlock()
+	return ctx.endReason
+}
+
+// end : Ends the context for the given reason, unless it has already ended
+func (ctx *liftableTimeoutContext) end(reason error) {
+	ctx.endOnce.Do(func() {
+		ctx.errMutex.Lock()
+		ctx.endReason = reason
+		ctx.errMutex.Unlock()
+		close(ctx.done)
+	})
+}
+
+// liftTimeout : Stops the timeout from ending the context, returning false if
+// it already has
+func (ctx *liftableTimeoutContext) liftTimeout() bool {
+	return ctx.timer.Stop()
+}
+
+// release : Ends the context and frees its timer
+func (ctx *liftableTimeoutContext) release() {
+	ctx.timer.Stop()
+	ctx.end(context.Canceled)
+}
+
+// isEventStream : Reports whether a response is a stream of Server-Sent Events
+func isEventStream(response *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// copyFlushing : Copies the body into the response writer, flushing after every
+// read so that streamed data reaches the client as soon as it arrives
+func copyFlushing(w http.ResponseWriter, body io.Reader) error {
+	flusher, canFlush := w.(http.Flusher)
+	if canFlush {
+		flusher.Flush()
+	}
+
+	var buffer []byte = make([]byte, 32*1024)
+	for {
+		bytesRead, errRead := body.Read(buffer)
+		if bytesRead > 0 {
+			if _, errWrite := w.Write(buffer[:bytesRead]); errWrite != nil {
+				return errWrite
+			}
+
+			if canFlush {
+				flusher.Flush()
+			}
+		}
+
+		if errRead == io.EOF {
+			return nil
+		}
+
+		if errRead != nil {
+			return errRead
+		}
+	}
+}
+
+// waitToRetry : Waits out the backoff preceding the given retry attempt, which
+// doubles with each attempt, returning false if the request context ends first
+func waitToRetry(ctx context.Context, attempt int) bool {
+	var backoff *time.Timer = time.NewTimer(retryBackoffInterval << uint(attempt-1))
+	defer backoff.Stop()
+
+	select {
+	case <-backoff.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// hopByHopHeaderNames : Returns the canonical names of the hop-by-hop headers
+// of a request or response, being those defined by RFC 7230 along with any
+// listed in its Connection header
+func hopByHopHeaderNames(header http.Header) []string {
+	var headerNames []string = append([]string{}, hopByHopHeaders...)
+	for _, connectionValue := range header["Connection"] {
+		for _, token := range strings.Split(connectionValue, ",") {
+			token = strings.TrimSpace(token)
+			if len(token) > 0 {
+				headerNames = append(headerNames, http.CanonicalHeaderKey(token))
+			}
+		}
+	}
+
+	return headerNames
+}
+
+// appendViaHeader : Adds the veil to the Via header of a request or response
+// being relayed, after any intermediaries already listed there
+func appendViaHeader(header http.Header, protoMajor int, protoMinor int, pseudonym string) {
+	var viaEntry string = fmt.Sprintf("%d.%d %s", protoMajor, protoMinor, pseudonym)
+	if existingVia := header["Via"]; len(existingVia) > 0 {
+		viaEntry = strings.Join(existingVia, ", ") + ", " + viaEntry
+	}
+
+	header.Set("Via", viaEntry)
+}
+
+// copyHeaders : Copies every header from the source into the destination,
+// preserving multi-valued headers and omitting hop-by-hop headers. Headers
+// already set in the destination, such as those added by the veil itself, are
+// left untouched, except for Vary, whose values are combined.
+func copyHeaders(destination http.Header, source http.Header) {
+	var omittedHeaders []string = hopByHopHeaderNames(source)
+	for headerName, headerValues := range source {
+		if funk.ContainsString(omittedHeaders, http.CanonicalHeaderKey(headerName)) {
+			continue
+		}
+
+		if _, exists := destination[http.CanonicalHeaderKey(headerName)]; exists && http.CanonicalHeaderKey(headerName) != "Vary" {
+			continue
+		}
+
+		for _, headerValue := range headerValues {
+			destination.Add(headerName, headerValue)
+		}
+	}
+}
@@ -0,0 +1,1246 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startTargetSocket : Serves the handler on a UNIX Domain Socket in a
+// temporary directory for the duration of the test, returning the socket path
+func startTargetSocket(t testing.TB, handler http.Handler) string {
+	t.Helper()
+
+	// Socket paths are limited in length, so the directory is kept short
+	// rather than nested under the test's own temporary directory
+	socketDirectory, err := os.MkdirTemp("", "veil")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var socketPath string = filepath.Join(socketDirectory, "target.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		os.RemoveAll(socketDirectory)
+		t.Fatal(err)
+	}
+
+	var server *http.Server = &http.Server{Handler: handler}
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		server.Close()
+		os.RemoveAll(socketDirectory)
+	})
+
+	return socketPath
+}
+
+// newTestRelay : Returns a relay to the target sockets, as governed by the
+// relay options, with a request timeout unless the options set one
+func newTestRelay(targetSocketPaths []string, options relayOptions) http.HandlerFunc {
+	if options.requestTimeout == 0 {
+		options.requestTimeout = 5 * time.Second
+	}
+
+	return obtainSocketRequestHandler(newTargetUpstreams(targetSocketPaths, options), options)
+}
+
+func TestRelayPreservesEscapedPath(t *testing.T) {
+	var upstreamRequestURIs chan string = make(chan string, 1)
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequestURIs <- r.RequestURI
+	}))
+
+	var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{})
+	var testCases = []struct {
+		name       string
+		requestURI string
+	}{
+		{"plain path", "/v2/snaps"},
+		{"query string", "/v2/snaps?select=all&name=a%26b"},
+		{"encoded question mark", "/v2/secret%3F/conf"},
+		{"encoded hash", "/v2/secret%23/conf"},
+		{"encoded slash", "/v2/a%2Fb/conf"},
+		{"encoded space", "/v2/a%20b"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			relay(recorder, httptest.NewRequest(http.MethodGet, testCase.requestURI, nil))
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+			}
+
+			if upstreamRequestURI := <-upstreamRequestURIs; upstreamRequestURI != testCase.requestURI {
+				t.Errorf("expected the target socket to receive %q, got %q", testCase.requestURI, upstreamRequestURI)
+			}
+		})
+	}
+}
+
+func TestRelayPropagatesStatus(t *testing.T) {
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		statusCode, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		w.WriteHeader(statusCode)
+		fmt.Fprintf(w, "status %d", statusCode)
+	}))
+
+	var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{})
+	for _, statusCode := range []int{http.StatusOK, http.StatusCreated, http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		t.Run(strconv.Itoa(statusCode), func(t *testing.T) {
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			relay(recorder, httptest.NewRequest(http.MethodGet, "/v2/snaps?status="+strconv.Itoa(statusCode), nil))
+			if recorder.Code != statusCode {
+				t.Errorf("expected status %d, got %d", statusCode, recorder.Code)
+			}
+
+			if expectedBody := fmt.Sprintf("status %d", statusCode); recorder.Body.String() != expectedBody {
+				t.Errorf("expected the body %q, got %q", expectedBody, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestRelayCopiesResponseHeaders(t *testing.T) {
+	var responseHeader http.Header = http.Header{
+		"Content-Type":  {"application/json"},
+		"X-Snap-Count":  {"3"},
+		"Set-Cookie":    {"a=1", "b=2"},
+		"Cache-Control": {"no-cache"},
+	}
+
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for headerName, headerValues := range responseHeader {
+			w.Header()[headerName] = headerValues
+		}
+	}))
+
+	var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+	newTestRelay([]string{targetSocketPath}, relayOptions{})(recorder, httptest.NewRequest(http.MethodGet, "/v2/snaps", nil))
+	for headerName, expectedValues := range responseHeader {
+		t.Run(headerName, func(t *testing.T) {
+			if headerValues := recorder.Header().Values(headerName); !reflect.DeepEqual(headerValues, expectedValues) {
+				t.Errorf("expected %q, got %q", expectedValues, headerValues)
+			}
+		})
+	}
+}
+
+func TestRelayForwardsRequestHeaders(t *testing.T) {
+	var upstreamHeaders chan http.Header = make(chan http.Header, 1)
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeaders <- r.Header
+	}))
+
+	var requestHeader http.Header = http.Header{
+		"Accept":              {"application/json"},
+		"Authorization":       {"Bearer token"},
+		"X-Allow-Interaction": {"true"},
+		"X-Forwarded":         {"a", "b"},
+	}
+
+	var r *http.Request = httptest.NewRequest(http.MethodGet, "/v2/snaps", nil)
+	copyHeaders(r.Header, requestHeader)
+	newTestRelay([]string{targetSocketPath}, relayOptions{})(httptest.NewRecorder(), r)
+
+	var upstreamHeader http.Header = <-upstreamHeaders
+	for headerName, expectedValues := range requestHeader {
+		t.Run(headerName, func(t *testing.T) {
+			if headerValues := upstreamHeader.Values(headerName); !reflect.DeepEqual(headerValues, expectedValues) {
+				t.Errorf("expected %q, got %q", expectedValues, headerValues)
+			}
+		})
+	}
+}
+
+func TestRelayContentLength(t *testing.T) {
+	type upstreamFraming struct {
+		contentLength    int64
+		transferEncoding []string
+		body             string
+	}
+
+	var upstreamFramings chan upstreamFraming = make(chan upstreamFraming, 1)
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		upstreamFramings <- upstreamFraming{r.ContentLength, r.TransferEncoding, string(body)}
+	}))
+
+	var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{})
+	testCases := []struct {
+		name                     string
+		method                   string
+		body                     string
+		chunked                  bool
+		expectedContentLength    int64
+		expectedTransferEncoding []string
+	}{
+		{name: "known length POST", method: http.MethodPost, body: `{"action":"refresh"}`, expectedContentLength: 20},
+		{name: "known length PUT", method: http.MethodPut, body: "conf", expectedContentLength: 4},
+		{name: "unknown length", method: http.MethodPost, body: `{"action":"refresh"}`, chunked: true, expectedContentLength: -1, expectedTransferEncoding: []string{"chunked"}},
+		{name: "no body", method: http.MethodPost, expectedContentLength: 0},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var request *http.Request = httptest.NewRequest(testCase.method, "/v2/snaps", strings.NewReader(testCase.body))
+			if testCase.chunked {
+				request.ContentLength = -1
+			}
+
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			relay(recorder, request)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+			}
+
+			var framing upstreamFraming = <-upstreamFramings
+			if framing.contentLength != testCase.expectedContentLength {
+				t.Errorf("expected a Content-Length of %d, got %d", testCase.expectedContentLength, framing.contentLength)
+			}
+
+			if !reflect.DeepEqual(framing.transferEncoding, testCase.expectedTransferEncoding) {
+				t.Errorf("expected the transfer encoding %q, got %q", testCase.expectedTransferEncoding, framing.transferEncoding)
+			}
+
+			if framing.body != testCase.body {
+				t.Errorf("expected the body %q, got %q", testCase.body, framing.body)
+			}
+		})
+	}
+}
+
+// hopByHopTestHeader : Headers that must not be relayed in either direction,
+// being each of those defined by RFC 7230 and one listed in Connection
+var hopByHopTestHeader http.Header = http.Header{
+	"Connection":          {"keep-alive, X-Hop"},
+	"Keep-Alive":          {"timeout=5"},
+	"Proxy-Authenticate":  {"Basic"},
+	"Proxy-Authorization": {"Basic dmVpbDp2ZWls"},
+	"Te":                  {"trailers"},
+	"Trailer":             {"X-Checksum"},
+	"Transfer-Encoding":   {"gzip"},
+	"Upgrade":             {"h2c"},
+	"X-Hop":               {"1"},
+}
+
+func TestCopyHeadersOmitsHopByHopHeaders(t *testing.T) {
+	var source http.Header = hopByHopTestHeader.Clone()
+	source.Set("X-End-To-End", "1")
+
+	var destination http.Header = http.Header{}
+	copyHeaders(destination, source)
+	for headerName := range hopByHopTestHeader {
+		t.Run(headerName, func(t *testing.T) {
+			if headerValues, copied := destination[headerName]; copied {
+				t.Errorf("expected the header to be omitted, got %q", headerValues)
+			}
+		})
+	}
+
+	if destination.Get("X-End-To-End") != "1" {
+		t.Errorf("expected end-to-end headers to be copied, got %v", destination)
+	}
+}
+
+func TestRelayStripsHopByHopHeaders(t *testing.T) {
+	var upstreamHeaders chan http.Header = make(chan http.Header, 1)
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeaders <- r.Header
+		w.Header().Set("X-End-To-End", "1")
+		for headerName, headerValues := range hopByHopTestHeader {
+			// The target socket's server frames the response itself, so
+			// would reject a transfer encoding it did not apply
+			if headerName != "Transfer-Encoding" {
+				w.Header()[headerName] = headerValues
+			}
+		}
+	}))
+
+	var r *http.Request = httptest.NewRequest(http.MethodGet, "/v2/snaps", nil)
+	r.Header.Set("X-End-To-End", "1")
+	for headerName, headerValues := range hopByHopTestHeader {
+		r.Header[headerName] = headerValues
+	}
+
+	var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+	newTestRelay([]string{targetSocketPath}, relayOptions{})(recorder, r)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	var upstreamHeader http.Header = <-upstreamHeaders
+	for directionName, relayedHeader := range map[string]http.Header{"request": upstreamHeader, "response": recorder.Header()} {
+		t.Run(directionName, func(t *testing.T) {
+			for headerName := range hopByHopTestHeader {
+				if headerValues, relayed := relayedHeader[headerName]; relayed {
+					t.Errorf("expected %s to be stripped, got %q", headerName, headerValues)
+				}
+			}
+
+			if relayedHeader.Get("X-End-To-End") != "1" {
+				t.Errorf("expected end-to-end headers to be relayed, got %v", relayedHeader)
+			}
+		})
+	}
+}
+
+func TestRelayViaHeader(t *testing.T) {
+	var upstreamVias chan []string = make(chan []string, 1)
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamVias <- r.Header.Values("Via")
+		if responseVia := r.URL.Query().Get("via"); len(responseVia) > 0 {
+			w.Header().Set("Via", responseVia)
+		}
+	}))
+
+	testCases := []struct {
+		name                string
+		pseudonym           string
+		requestVia          []string
+		responseVia         string
+		expectedRequestVia  string
+		expectedResponseVia string
+	}{
+		{
+			name:                "added",
+			pseudonym:           DefaultViaPseudonym,
+			expectedRequestVia:  "1.1 unix-socket-http-veil",
+			expectedResponseVia: "1.1 unix-socket-http-veil",
+		},
+		{
+			name:                "custom pseudonym",
+			pseudonym:           "gateway",
+			expectedRequestVia:  "1.1 gateway",
+			expectedResponseVia: "1.1 gateway",
+		},
+		{
+			name:                "appended to existing",
+			pseudonym:           DefaultViaPseudonym,
+			requestVia:          []string{"1.0 fred, 1.1 p.example.net"},
+			responseVia:         "1.1 backend",
+			expectedRequestVia:  "1.0 fred, 1.1 p.example.net, 1.1 unix-socket-http-veil",
+			expectedResponseVia: "1.1 backend, 1.1 unix-socket-http-veil",
+		},
+		{
+			name:                "appended to several existing",
+			pseudonym:           DefaultViaPseudonym,
+			requestVia:          []string{"1.0 fred", "1.1 p.example.net"},
+			expectedRequestVia:  "1.0 fred, 1.1 p.example.net, 1.1 unix-socket-http-veil",
+			expectedResponseVia: "1.1 unix-socket-http-veil",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var r *http.Request = httptest.NewRequest(http.MethodGet, "/v2/snaps?via="+url.QueryEscape(testCase.responseVia), nil)
+			r.Header["Via"] = testCase.requestVia
+
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			newTestRelay([]string{targetSocketPath}, relayOptions{viaPseudonym: testCase.pseudonym})(recorder, r)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+			}
+
+			if upstreamVia := <-upstreamVias; !reflect.DeepEqual(upstreamVia, []string{testCase.expectedRequestVia}) {
+				t.Errorf("expected the target socket to receive Via %q, got %q", testCase.expectedRequestVia, upstreamVia)
+			}
+
+			if responseVia := recorder.Header().Values("Via"); !reflect.DeepEqual(responseVia, []string{testCase.expectedResponseVia}) {
+				t.Errorf("expected the response Via %q, got %q", testCase.expectedResponseVia, responseVia)
+			}
+		})
+	}
+}
+
+func TestRelayMaxResponseBytes(t *testing.T) {
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		if r.URL.Query().Get("stream") == "1" {
+			w.Header().Set("Content-Type", "text/event-stream")
+		}
+
+		// Without a declared length, the body is sent in chunks
+		if r.URL.Query().Get("chunked") == "1" {
+			w.(http.Flusher).Flush()
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+		}
+
+		w.Write([]byte(strings.Repeat("a", size)))
+	}))
+
+	var server *httptest.Server = httptest.NewServer(newTestRelay([]string{targetSocketPath}, relayOptions{maxResponseBytes: 16}))
+	defer server.Close()
+
+	testCases := []struct {
+		name           string
+		method         string
+		requestURI     string
+		expectedStatus int
+		expectedBody   string
+		expectedCutOff bool
+	}{
+		{name: "under the limit", method: http.MethodGet, requestURI: "/v2/snaps?size=8", expectedStatus: http.StatusOK, expectedBody: strings.Repeat("a", 8)},
+		{name: "at the limit", method: http.MethodGet, requestURI: "/v2/snaps?size=16", expectedStatus: http.StatusOK, expectedBody: strings.Repeat("a", 16)},
+		{name: "declared over the limit", method: http.MethodGet, requestURI: "/v2/snaps?size=32", expectedStatus: http.StatusBadGateway, expectedBody: responseTooLargeString},
+		{name: "chunked under the limit", method: http.MethodGet, requestURI: "/v2/snaps?size=8&chunked=1", expectedStatus: http.StatusOK, expectedBody: strings.Repeat("a", 8)},
+		{name: "chunked over the limit", method: http.MethodGet, requestURI: "/v2/snaps?size=32&chunked=1", expectedCutOff: true},
+		{name: "HEAD declared over the limit", method: http.MethodHead, requestURI: "/v2/snaps?size=32", expectedStatus: http.StatusOK},
+		{name: "event stream over the limit", method: http.MethodGet, requestURI: "/v2/snaps?size=32&chunked=1&stream=1", expectedStatus: http.StatusOK, expectedBody: strings.Repeat("a", 32)},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			request, err := http.NewRequest(testCase.method, server.URL+testCase.requestURI, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// A response cut short is aborted, whether before or after its
+			// headers were sent, so that the client cannot mistake it for a
+			// complete one
+			var body []byte
+			response, err := http.DefaultClient.Do(request)
+			if err == nil {
+				defer response.Body.Close()
+				body, err = io.ReadAll(response.Body)
+			}
+
+			if testCase.expectedCutOff {
+				if err == nil {
+					t.Error("expected the response to be cut short")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d", testCase.expectedStatus, response.StatusCode)
+			}
+
+			if string(body) != testCase.expectedBody {
+				t.Errorf("expected the body %q, got %q", testCase.expectedBody, body)
+			}
+		})
+	}
+}
+
+func TestRelayHeadFromGet(t *testing.T) {
+	var upstreamMethods chan string = make(chan string, 2)
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamMethods <- r.Method
+		if r.Method == http.MethodHead && r.URL.Path == "/v2/get-only" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("X-Snap-Count", "3")
+		w.Header().Set("Content-Length", "5")
+		w.Write([]byte("snaps"))
+	}))
+
+	testCases := []struct {
+		name            string
+		headFromGet     bool
+		requestURI      string
+		expectedStatus  int
+		expectedMethods []string
+	}{
+		{name: "HEAD supported", headFromGet: true, requestURI: "/v2/snaps", expectedStatus: http.StatusOK, expectedMethods: []string{http.MethodHead}},
+		{name: "HEAD answered from GET", headFromGet: true, requestURI: "/v2/get-only", expectedStatus: http.StatusOK, expectedMethods: []string{http.MethodHead, http.MethodGet}},
+		{name: "disabled", headFromGet: false, requestURI: "/v2/get-only", expectedStatus: http.StatusMethodNotAllowed, expectedMethods: []string{http.MethodHead}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			newTestRelay([]string{targetSocketPath}, relayOptions{headFromGet: testCase.headFromGet})(recorder, httptest.NewRequest(http.MethodHead, testCase.requestURI, nil))
+			if recorder.Code != testCase.expectedStatus {
+				t.Fatalf("expected status %d, got %d", testCase.expectedStatus, recorder.Code)
+			}
+
+			var methods []string = []string{}
+			for range testCase.expectedMethods {
+				methods = append(methods, <-upstreamMethods)
+			}
+
+			if !reflect.DeepEqual(methods, testCase.expectedMethods) {
+				t.Errorf("expected the target socket to receive %v, got %v", testCase.expectedMethods, methods)
+			}
+
+			if recorder.Body.Len() != 0 {
+				t.Errorf("expected no body, got %q", recorder.Body.String())
+			}
+
+			if testCase.expectedStatus != http.StatusOK {
+				return
+			}
+
+			if snapCount, contentLength := recorder.Header().Get("X-Snap-Count"), recorder.Header().Get("Content-Length"); snapCount != "3" || contentLength != "5" {
+				t.Errorf("expected the headers of the GET response, got X-Snap-Count %q and Content-Length %q", snapCount, contentLength)
+			}
+		})
+	}
+}
+
+func TestRelayReleasesAbandonedUpstreamRequests(t *testing.T) {
+	var upstreamReleased chan struct{} = make(chan struct{}, 1)
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1024")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		// The body is never finished, so the request only ends once the
+		// veil lets go of it
+		<-r.Context().Done()
+		upstreamReleased <- struct{}{}
+	}))
+
+	var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+	newTestRelay([]string{targetSocketPath}, relayOptions{requestTimeout: time.Minute, maxResponseBytes: 16})(recorder, httptest.NewRequest(http.MethodGet, "/v2/snaps", nil))
+	if recorder.Code != http.StatusBadGateway {
+		t.Fatalf("expected the oversized response to be refused with 502, got %d", recorder.Code)
+	}
+
+	select {
+	case <-upstreamReleased:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the upstream request to be released once the relay finished")
+	}
+}
+
+// countUpstreamDials : Counts the connections made to the target sockets as
+// they are dialed
+func countUpstreamDials(upstreams []*targetUpstream, dials *int32) {
+	for _, upstream := range upstreams {
+		var transport *http.Transport = upstream.client.Transport.(*http.Transport)
+		var dial func(ctx context.Context, network string, address string) (net.Conn, error) = transport.DialContext
+		transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			atomic.AddInt32(dials, 1)
+			return dial(ctx, network, address)
+		}
+	}
+}
+
+func TestRelayReusesUpstreamConnections(t *testing.T) {
+	var newConnections int32
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "snaps")
+	}))
+
+	var options relayOptions = relayOptions{requestTimeout: 5 * time.Second}
+	var upstreams []*targetUpstream = newTargetUpstreams([]string{targetSocketPath}, options)
+	countUpstreamDials(upstreams, &newConnections)
+
+	var relay http.HandlerFunc = obtainSocketRequestHandler(upstreams, options)
+	for i := 0; i < 10; i++ {
+		var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+		relay(recorder, httptest.NewRequest(http.MethodGet, "/v2/snaps", nil))
+		if recorder.Body.String() != "snaps" {
+			t.Fatalf("expected the body %q, got %q", "snaps", recorder.Body.String())
+		}
+	}
+
+	if connections := atomic.LoadInt32(&newConnections); connections != 1 {
+		t.Errorf("expected every request to reuse one upstream connection, got %d connections", connections)
+	}
+}
+
+func TestRelayReportsBrokenResponses(t *testing.T) {
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connection, buffered, _ := w.(http.Hijacker).Hijack()
+		defer connection.Close()
+
+		// Each response promises more of its body than it sends
+		buffered.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 64\r\n\r\n")
+		buffered.WriteString(r.URL.Query().Get("body"))
+		buffered.Flush()
+	}))
+
+	var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{})
+	testCases := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "closed before the body", body: "", expectedStatus: http.StatusBadGateway, expectedBody: badGatewayString},
+		{name: "closed during the body", body: "partial", expectedStatus: http.StatusOK, expectedBody: "partial"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			relay(recorder, httptest.NewRequest(http.MethodGet, "/v2/snaps?body="+testCase.body, nil))
+			if recorder.Code != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d", testCase.expectedStatus, recorder.Code)
+			}
+
+			if recorder.Body.String() != testCase.expectedBody {
+				t.Errorf("expected the body %q, got %q", testCase.expectedBody, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestRelayRequestTimeout(t *testing.T) {
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}))
+
+	testCases := []struct {
+		name           string
+		requestTimeout time.Duration
+		expectedStatus int
+	}{
+		{name: "timeout beyond response time", requestTimeout: 5 * time.Second, expectedStatus: http.StatusOK},
+		{name: "timeout within response time", requestTimeout: 50 * time.Millisecond, expectedStatus: http.StatusGatewayTimeout},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			newTestRelay([]string{targetSocketPath}, relayOptions{requestTimeout: testCase.requestTimeout})(recorder, httptest.NewRequest(http.MethodGet, "/v2/snaps", nil))
+			if recorder.Code != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d", testCase.expectedStatus, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestRelayConcurrencyLimit(t *testing.T) {
+	for _, maxConcurrentRequests := range []int{1, 3} {
+		t.Run(strconv.Itoa(maxConcurrentRequests), func(t *testing.T) {
+			var arrived chan struct{} = make(chan struct{}, maxConcurrentRequests)
+			var release chan struct{} = make(chan struct{})
+			var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v2/slow" {
+					arrived <- struct{}{}
+					<-release
+				}
+			}))
+
+			var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{maxConcurrentRequests: maxConcurrentRequests})
+
+			var statuses chan int = make(chan int, maxConcurrentRequests)
+			for i := 0; i < maxConcurrentRequests; i++ {
+				go func() {
+					var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+					relay(recorder, httptest.NewRequest(http.MethodGet, "/v2/slow", nil))
+					statuses <- recorder.Code
+				}()
+			}
+			for i := 0; i < maxConcurrentRequests; i++ {
+				<-arrived
+			}
+
+			// Requests beyond the limit are refused at once rather than queued
+			for i := 0; i < 2; i++ {
+				var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+				relay(recorder, httptest.NewRequest(http.MethodGet, "/v2/snaps", nil))
+				if recorder.Code != http.StatusServiceUnavailable {
+					t.Errorf("expected an overflowing request to be refused with 503, got %d", recorder.Code)
+				}
+				if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+					t.Errorf("expected a JSON body, got Content-Type %q", contentType)
+				}
+			}
+
+			close(release)
+			for i := 0; i < maxConcurrentRequests; i++ {
+				if status := <-statuses; status != http.StatusOK {
+					t.Errorf("expected an in-flight request to complete with 200, got %d", status)
+				}
+			}
+
+			// The slots are released once the requests complete
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			relay(recorder, httptest.NewRequest(http.MethodGet, "/v2/snaps", nil))
+			if recorder.Code != http.StatusOK {
+				t.Errorf("expected a request to be relayed once the limit frees up, got %d", recorder.Code)
+			}
+		})
+	}
+}
+
+func TestRelayConcurrencyLimitReleasedOnTimeout(t *testing.T) {
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/slow" {
+			<-r.Context().Done()
+		}
+	}))
+
+	var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{maxConcurrentRequests: 1, requestTimeout: 50 * time.Millisecond})
+	for _, testCase := range []struct {
+		requestURI     string
+		expectedStatus int
+	}{
+		{requestURI: "/v2/slow", expectedStatus: http.StatusGatewayTimeout},
+		{requestURI: "/v2/snaps", expectedStatus: http.StatusOK},
+	} {
+		var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+		relay(recorder, httptest.NewRequest(http.MethodGet, testCase.requestURI, nil))
+		if recorder.Code != testCase.expectedStatus {
+			t.Errorf("expected status %d for %s, got %d", testCase.expectedStatus, testCase.requestURI, recorder.Code)
+		}
+	}
+}
+
+func TestRelayMaxBodyBytes(t *testing.T) {
+	var upstreamBodies chan string = make(chan string, 1)
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Bodies cut short by the limit never arrive in full
+		if body, err := io.ReadAll(r.Body); err == nil {
+			upstreamBodies <- string(body)
+		}
+	}))
+
+	const maxBodyBytes int64 = 16
+	var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{maxBodyBytes: maxBodyBytes})
+
+	testCases := []struct {
+		name           string
+		bodySize       int64
+		chunked        bool
+		expectedStatus int
+	}{
+		{name: "just under the limit", bodySize: maxBodyBytes - 1, expectedStatus: http.StatusOK},
+		{name: "at the limit", bodySize: maxBodyBytes, expectedStatus: http.StatusOK},
+		{name: "just over the limit", bodySize: maxBodyBytes + 1, expectedStatus: http.StatusRequestEntityTooLarge},
+		{name: "streamed just under the limit", bodySize: maxBodyBytes - 1, chunked: true, expectedStatus: http.StatusOK},
+		{name: "streamed just over the limit", bodySize: maxBodyBytes + 1, chunked: true, expectedStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var body string = strings.Repeat("x", int(testCase.bodySize))
+			var request *http.Request = httptest.NewRequest(http.MethodPost, "/v2/snaps", strings.NewReader(body))
+			if testCase.chunked {
+				// The length is only discovered as the body streams
+				request.ContentLength = -1
+			}
+
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			relay(recorder, request)
+			if recorder.Code != testCase.expectedStatus {
+				t.Fatalf("expected status %d, got %d", testCase.expectedStatus, recorder.Code)
+			}
+
+			if testCase.expectedStatus == http.StatusOK {
+				if upstreamBody := <-upstreamBodies; upstreamBody != body {
+					t.Errorf("expected the body to be relayed in full, got %q", upstreamBody)
+				}
+			}
+		})
+	}
+}
+
+// flakyListener : A listener that drops the first connections it accepts, as
+// a target socket restarting would
+type flakyListener struct {
+	net.Listener
+	droppedConnections  int32
+	acceptedConnections int32
+}
+
+func (listener *flakyListener) Accept() (net.Conn, error) {
+	for {
+		connection, err := listener.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		atomic.AddInt32(&listener.acceptedConnections, 1)
+		if atomic.AddInt32(&listener.droppedConnections, -1) >= 0 {
+			connection.Close()
+			continue
+		}
+
+		return connection, nil
+	}
+}
+
+// startFlakyTargetSocket : Serves 200 on a UNIX Domain Socket that drops the
+// given number of connections first, returning its path and listener
+func startFlakyTargetSocket(t *testing.T, droppedConnections int32) (string, *flakyListener) {
+	t.Helper()
+
+	// As for startTargetSocket, the directory is kept short
+	socketDirectory, err := os.MkdirTemp("", "veil")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var socketPath string = filepath.Join(socketDirectory, "flaky.sock")
+	unixListener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		os.RemoveAll(socketDirectory)
+		t.Fatal(err)
+	}
+
+	var listener *flakyListener = &flakyListener{Listener: unixListener, droppedConnections: droppedConnections}
+	var server *http.Server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		server.Close()
+		os.RemoveAll(socketDirectory)
+	})
+
+	return socketPath, listener
+}
+
+func TestRelayRetries(t *testing.T) {
+	testCases := []struct {
+		name               string
+		method             string
+		body               string
+		retries            int
+		droppedConnections int32
+		expectedStatus     int
+		expectedAttempts   int32
+	}{
+		{name: "GET retried", method: http.MethodGet, retries: 2, droppedConnections: 1, expectedStatus: http.StatusOK, expectedAttempts: 2},
+		{name: "HEAD retried", method: http.MethodHead, retries: 2, droppedConnections: 1, expectedStatus: http.StatusOK, expectedAttempts: 2},
+		{name: "DELETE retried", method: http.MethodDelete, retries: 2, droppedConnections: 2, expectedStatus: http.StatusOK, expectedAttempts: 3},
+		{name: "PUT without body retried", method: http.MethodPut, retries: 1, droppedConnections: 1, expectedStatus: http.StatusOK, expectedAttempts: 2},
+		{name: "retries exhausted", method: http.MethodGet, retries: 2, droppedConnections: 3, expectedStatus: http.StatusBadGateway, expectedAttempts: 3},
+		{name: "retries disabled", method: http.MethodGet, droppedConnections: 1, expectedStatus: http.StatusBadGateway, expectedAttempts: 1},
+		{name: "POST never retried", method: http.MethodPost, retries: 2, droppedConnections: 1, expectedStatus: http.StatusBadGateway, expectedAttempts: 1},
+		{name: "PATCH never retried", method: http.MethodPatch, retries: 2, droppedConnections: 1, expectedStatus: http.StatusBadGateway, expectedAttempts: 1},
+		{name: "PUT with body never retried", method: http.MethodPut, body: "{}", retries: 2, droppedConnections: 1, expectedStatus: http.StatusBadGateway, expectedAttempts: 1},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			targetSocketPath, listener := startFlakyTargetSocket(t, testCase.droppedConnections)
+			var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{retries: testCase.retries})
+
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			relay(recorder, httptest.NewRequest(testCase.method, "/v2/snaps", strings.NewReader(testCase.body)))
+			if recorder.Code != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d", testCase.expectedStatus, recorder.Code)
+			}
+
+			if attempts := atomic.LoadInt32(&listener.acceptedConnections); attempts != testCase.expectedAttempts {
+				t.Errorf("expected %d attempts, got %d", testCase.expectedAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestUpstreamConnectionPoolOptions(t *testing.T) {
+	testCases := []struct {
+		name    string
+		options relayOptions
+	}{
+		{name: "defaults", options: relayOptions{}},
+		{name: "tuned", options: relayOptions{maxIdleConns: 200, maxIdleConnsPerHost: 64, idleConnTimeout: 30 * time.Second}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var transport *http.Transport = createUnixSocketHTTPClient("/run/target.sock", testCase.options).Transport.(*http.Transport)
+			if transport.MaxIdleConns != testCase.options.maxIdleConns ||
+				transport.MaxIdleConnsPerHost != testCase.options.maxIdleConnsPerHost ||
+				transport.IdleConnTimeout != testCase.options.idleConnTimeout {
+				t.Errorf("expected the pool to be bounded by %d, %d and %v, got %d, %d and %v",
+					testCase.options.maxIdleConns, testCase.options.maxIdleConnsPerHost, testCase.options.idleConnTimeout,
+					transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+			}
+		})
+	}
+}
+
+// BenchmarkRelay : Relays requests from many clients at once, reporting how
+// many connections to the target socket each request costs. With the default
+// of 2 idle connections per host, most concurrent requests dial anew, while a
+// pool sized for the load reuses its connections.
+func BenchmarkRelay(b *testing.B) {
+	testCases := []struct {
+		name    string
+		options relayOptions
+	}{
+		{name: "default pool", options: relayOptions{}},
+		{name: "tuned pool", options: relayOptions{maxIdleConns: 256, maxIdleConnsPerHost: 256}},
+	}
+
+	for _, testCase := range testCases {
+		b.Run(testCase.name, func(b *testing.B) {
+			var targetSocketPath string = startTargetSocket(b, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "snaps")
+			}))
+
+			var options relayOptions = testCase.options
+			options.requestTimeout = 5 * time.Second
+			var upstreams []*targetUpstream = newTargetUpstreams([]string{targetSocketPath}, options)
+			var dials int32
+			countUpstreamDials(upstreams, &dials)
+			var relay http.HandlerFunc = obtainSocketRequestHandler(upstreams, options)
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+					relay(recorder, httptest.NewRequest(http.MethodGet, "/v2/snaps", nil))
+					if recorder.Code != http.StatusOK {
+						b.Errorf("expected status 200, got %d", recorder.Code)
+						return
+					}
+				}
+			})
+
+			b.ReportMetric(float64(atomic.LoadInt32(&dials))/float64(b.N), "dials/op")
+		})
+	}
+}
+
+func TestRelayStreamsEvents(t *testing.T) {
+	// Each event is only emitted once the previous one has reached the client,
+	// so that events held back by buffering stall the stream
+	const eventCount int = 5
+	var received chan struct{} = make(chan struct{})
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < eventCount; i++ {
+			select {
+			case <-time.After(50 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+
+			select {
+			case <-received:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+
+	// The stream outlasts the request timeout, which only bounds the wait for
+	// the response to begin
+	var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{requestTimeout: 100 * time.Millisecond})
+	var server *httptest.Server = httptest.NewServer(relay)
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/v2/notices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	var events chan string = make(chan string)
+	go func() {
+		defer close(events)
+		var scanner *bufio.Scanner = bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			if len(scanner.Text()) > 0 {
+				events <- scanner.Text()
+			}
+		}
+	}()
+
+	for i := 0; i < eventCount; i++ {
+		select {
+		case event := <-events:
+			if expectedEvent := fmt.Sprintf("data: %d", i); event != expectedEvent {
+				t.Fatalf("expected %q, got %q", expectedEvent, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected event %d to arrive promptly", i)
+		}
+
+		received <- struct{}{}
+	}
+}
+
+func TestRelayFailureResponse(t *testing.T) {
+	var dialError error = &net.OpError{Op: "dial", Net: "unix", Err: syscall.ECONNREFUSED}
+	var readError error = &net.OpError{Op: "read", Net: "unix", Err: syscall.ECONNRESET}
+
+	testCases := []struct {
+		name                  string
+		err                   error
+		body                  *relayedRequestBody
+		expectedStatus        int
+		expectedMessage       string
+		expectedUpstreamFault bool
+	}{
+		{name: "upstream deadline", err: context.DeadlineExceeded, expectedStatus: http.StatusGatewayTimeout, expectedMessage: gatewayTimeoutString, expectedUpstreamFault: true},
+		{name: "upstream deadline after the body", err: context.DeadlineExceeded, body: &relayedRequestBody{finished: true}, expectedStatus: http.StatusGatewayTimeout, expectedMessage: gatewayTimeoutString, expectedUpstreamFault: true},
+		{name: "connection refused", err: dialError, expectedStatus: http.StatusBadGateway, expectedMessage: targetUnreachableString, expectedUpstreamFault: true},
+		{name: "connection reset", err: readError, expectedStatus: http.StatusBadGateway, expectedMessage: badGatewayString, expectedUpstreamFault: true},
+		{name: "deadline while the client sends its body", err: context.DeadlineExceeded, body: &relayedRequestBody{}, expectedStatus: http.StatusRequestTimeout, expectedMessage: requestTimeoutString},
+		{name: "client body read timeout", err: readError, body: &relayedRequestBody{readError: os.ErrDeadlineExceeded}, expectedStatus: http.StatusRequestTimeout, expectedMessage: requestTimeoutString},
+		{name: "client body read failure", err: readError, body: &relayedRequestBody{readError: io.ErrUnexpectedEOF}, expectedStatus: http.StatusBadRequest, expectedMessage: badRequestString},
+		{name: "client body too large", err: readError, body: &relayedRequestBody{limit: 16, bytesRead: 16, readError: &http.MaxBytesError{Limit: 16}}, expectedStatus: http.StatusRequestEntityTooLarge, expectedMessage: requestEntityTooLargeString},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			status, message, upstreamFault := relayFailureResponse(testCase.err, testCase.body)
+			if status != testCase.expectedStatus || message != testCase.expectedMessage || upstreamFault != testCase.expectedUpstreamFault {
+				t.Errorf("expected %d, %s and %t, got %d, %s and %t",
+					testCase.expectedStatus, testCase.expectedMessage, testCase.expectedUpstreamFault, status, message, upstreamFault)
+			}
+		})
+	}
+}
+
+func TestRelayTimeouts(t *testing.T) {
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if r.URL.Path == "/v2/slow" {
+			<-r.Context().Done()
+		}
+	}))
+
+	var v *Veil = startTestVeil(t, Options{
+		TargetSocketPath: targetSocketPath,
+		ExposedAddress:   "tcp://127.0.0.1:0",
+		AccessRulesPath:  writeTestAccessRules(t, "POST~/v2/snaps\nPOST~/v2/slow\n"),
+		RequestTimeout:   100 * time.Millisecond,
+	})
+
+	testCases := []struct {
+		name            string
+		requestURI      string
+		contentLength   int
+		body            string
+		expectedStatus  int
+		expectedMessage string
+	}{
+		{name: "slow target socket", requestURI: "/v2/slow", expectedStatus: http.StatusGatewayTimeout, expectedMessage: gatewayTimeoutString},
+		{name: "slow client body", requestURI: "/v2/snaps", contentLength: 64, body: "{\"action\":", expectedStatus: http.StatusRequestTimeout, expectedMessage: requestTimeoutString},
+		{name: "prompt request", requestURI: "/v2/snaps", contentLength: 2, body: "{}", expectedStatus: http.StatusOK},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			connection, err := net.Dial("tcp", v.listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer connection.Close()
+			connection.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// The client declares a body it may never finish sending
+			fmt.Fprintf(connection, "POST %s HTTP/1.1\r\nHost: veil\r\nContent-Length: %d\r\n\r\n%s", testCase.requestURI, testCase.contentLength, testCase.body)
+			response, err := http.ReadResponse(bufio.NewReader(connection), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Fatalf("expected status %d, got %d", testCase.expectedStatus, response.StatusCode)
+			}
+
+			if len(testCase.expectedMessage) > 0 {
+				body, _ := io.ReadAll(response.Body)
+				if string(body) != testCase.expectedMessage {
+					t.Errorf("expected the body %s, got %s", testCase.expectedMessage, body)
+				}
+			}
+		})
+	}
+}
+
+func TestRelayDialTimeout(t *testing.T) {
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delay, _ := time.ParseDuration(r.URL.Query().Get("delay"))
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+		}
+	}))
+
+	// Connecting to a UNIX Domain Socket completes or fails at once, so the
+	// dial timeout is seen not to cut short the response, which the request
+	// timeout alone bounds
+	testCases := []struct {
+		name           string
+		dialTimeout    time.Duration
+		requestTimeout time.Duration
+		delay          time.Duration
+		expectedStatus int
+	}{
+		{name: "response slower than the dial timeout", dialTimeout: 20 * time.Millisecond, requestTimeout: 2 * time.Second, delay: 200 * time.Millisecond, expectedStatus: http.StatusOK},
+		{name: "response slower than the request timeout", dialTimeout: 2 * time.Second, requestTimeout: 100 * time.Millisecond, delay: time.Second, expectedStatus: http.StatusGatewayTimeout},
+		{name: "no dial timeout", requestTimeout: 2 * time.Second, delay: 50 * time.Millisecond, expectedStatus: http.StatusOK},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{dialTimeout: testCase.dialTimeout, requestTimeout: testCase.requestTimeout})
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			var startTime time.Time = time.Now()
+			relay(recorder, httptest.NewRequest(http.MethodGet, "/v2/snaps?delay="+testCase.delay.String(), nil))
+			if recorder.Code != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d: %s", testCase.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+
+			if elapsed := time.Since(startTime); testCase.expectedStatus == http.StatusGatewayTimeout && elapsed >= testCase.delay {
+				t.Errorf("expected the request timeout to end the request early, took %v", elapsed)
+			}
+		})
+	}
+
+}
+
+func TestRelayExpectContinue(t *testing.T) {
+	type upstreamRequest struct {
+		expect string
+		body   string
+	}
+
+	var upstreamRequests chan upstreamRequest = make(chan upstreamRequest, 1)
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Uploads to this path are refused before their body is read, so
+		// the target socket never asks for it
+		if r.URL.Path == "/v2/refused" {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		upstreamRequests <- upstreamRequest{r.Header.Get("Expect"), string(body)}
+	}))
+
+	var v *Veil = startTestVeil(t, Options{
+		TargetSocketPath: targetSocketPath,
+		ExposedAddress:   "tcp://127.0.0.1:0",
+		AccessRulesPath:  writeTestAccessRules(t, "PUT~/v2/snaps\nPUT~/v2/refused\n"),
+	})
+
+	testCases := []struct {
+		name           string
+		requestURI     string
+		expectContinue bool
+		expectedStatus int
+	}{
+		{name: "accepted upload", requestURI: "/v2/snaps", expectContinue: true, expectedStatus: http.StatusOK},
+		{name: "refused upload", requestURI: "/v2/refused", expectContinue: false, expectedStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	const body string = `{"action":"install"}`
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			connection, err := net.Dial("tcp", v.listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer connection.Close()
+			connection.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// The client holds back its body until it is asked for it
+			fmt.Fprintf(connection, "PUT %s HTTP/1.1\r\nHost: veil\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n", testCase.requestURI, len(body))
+			var reader *bufio.Reader = bufio.NewReader(connection)
+			response, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if continued := response.StatusCode == http.StatusContinue; continued != testCase.expectContinue {
+				t.Fatalf("expected an interim 100 Continue to be %t, got status %d", testCase.expectContinue, response.StatusCode)
+			}
+
+			if testCase.expectContinue {
+				io.WriteString(connection, body)
+				if response, err = http.ReadResponse(reader, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			response.Body.Close()
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Fatalf("expected status %d, got %d", testCase.expectedStatus, response.StatusCode)
+			}
+
+			if testCase.expectContinue {
+				if upstream := <-upstreamRequests; upstream != (upstreamRequest{"100-continue", body}) {
+					t.Errorf("expected the target socket to receive the expectation and the body, got %+v", upstream)
+				}
+			}
+		})
+	}
+}
+
+func TestRelayUnreachableTarget(t *testing.T) {
+	var socketDirectory string = t.TempDir()
+
+	// A socket file left behind by a target that stopped refuses connections
+	var staleSocketPath string = filepath.Join(socketDirectory, "stale.sock")
+	staleListener, err := net.Listen("unix", staleSocketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleListener.(*net.UnixListener).SetUnlinkOnClose(false)
+	staleListener.Close()
+
+	testCases := []struct {
+		name             string
+		targetSocketPath string
+	}{
+		{name: "nonexistent socket", targetSocketPath: filepath.Join(socketDirectory, "missing.sock")},
+		{name: "stale socket", targetSocketPath: staleSocketPath},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			newTestRelay([]string{testCase.targetSocketPath}, relayOptions{})(recorder, httptest.NewRequest(http.MethodGet, "/v2/snaps", nil))
+			if recorder.Code != http.StatusBadGateway {
+				t.Errorf("expected status 502, got %d", recorder.Code)
+			}
+
+			if recorder.Body.String() != targetUnreachableString {
+				t.Errorf("expected the body %s, got %s", targetUnreachableString, recorder.Body.String())
+			}
+		})
+	}
+}
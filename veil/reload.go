@@ -0,0 +1,155 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// reloadableHandler : Serves requests through a handler that can be replaced
+// while the server is running. Requests already being served by a replaced
+// handler are allowed to complete.
+type reloadableHandler struct {
+	mutex   sync.RWMutex
+	handler http.Handler
+}
+
+func (h *reloadableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mutex.RLock()
+	var handler http.Handler = h.handler
+	h.mutex.RUnlock()
+
+	handler.ServeHTTP(w, r)
+}
+
+// swap : Atomically replaces the handler used for subsequent requests
+func (h *reloadableHandler) swap(handler http.Handler) {
+	h.mutex.Lock()
+	h.handler = handler
+	h.mutex.Unlock()
+}
+
+// Reload : Reloads the access rules list and applies it to subsequent
+// requests. If the access rules fail to load, the previous access rules remain
+// in effect and the error is returned.
+func (v *Veil) Reload() error {
+	logInfo("Reloading access rules")
+	accessRules, err := v.loadAccessRules()
+	if err != nil {
+		logError("Unable to reload access rules, keeping previous rules:", err)
+		return err
+	}
+
+	v.applyAccessRules(accessRules)
+	if v.stats != nil {
+		v.stats.recordReload()
+	}
+
+	logInfo("Access rules reloaded")
+	return nil
+}
+
+// accessRulesModification : Returns the time at which the access rules list was
+// last modified along with its size. These cover the files read when the
+// access rules were last loaded, such as included files and schemas, along with
+// the list itself and, for a directory of access rules fragments, the
+// directory and every fragment within it.
+func accessRulesModification(accessRulesPath string, readPaths []string) (time.Time, int64, error) {
+	fileInfo, err := os.Stat(accessRulesPath)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	var polledPaths []string = readPaths
+	if fileInfo.IsDir() {
+		fragmentPaths, err := accessRulesFragmentPaths(accessRulesPath)
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+
+		polledPaths = append(fragmentPaths, readPaths...)
+	}
+
+	var modTime time.Time = fileInfo.ModTime()
+	var size int64 = 0
+	if !fileInfo.IsDir() {
+		size = fileInfo.Size()
+	}
+
+	var polled map[string]bool = map[string]bool{accessRulesPath: true}
+	for _, polledPath := range polledPaths {
+		if polled[polledPath] {
+			continue
+		}
+
+		polled[polledPath] = true
+		polledInfo, err := os.Stat(polledPath)
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+
+		if polledInfo.ModTime().After(modTime) {
+			modTime = polledInfo.ModTime()
+		}
+
+		size += polledInfo.Size()
+	}
+
+	return modTime, size, nil
+}
+
+// watchAccessRulesFile : Polls the access rules list, and the files it was
+// loaded from, for modifications and reloads the access rules once the files
+// have stopped changing for the debounce period, so that a burst of writes
+// results in a single reload. It returns once the Veil is shut down.
+func (v *Veil) watchAccessRulesFile() {
+	var accessRulesPath string = v.options.AccessRulesPath
+	lastModTime, lastSize, _ := accessRulesModification(accessRulesPath, v.currentAccessRules().readPaths)
+
+	var lastChange time.Time
+	var reloadPending bool = false
+
+	var ticker *time.Ticker = time.NewTicker(rulesWatchPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-v.stopWatching:
+			return
+		case <-ticker.C:
+		}
+
+		modTime, size, err := accessRulesModification(accessRulesPath, v.currentAccessRules().readPaths)
+		if err == nil && (!modTime.Equal(lastModTime) || size != lastSize) {
+			lastModTime = modTime
+			lastSize = size
+			lastChange = time.Now()
+			reloadPending = true
+			continue
+		}
+
+		if reloadPending && time.Since(lastChange) >= rulesWatchDebouncePeriod {
+			reloadPending = false
+			v.Reload()
+		}
+	}
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	targetSocketPath, _ := recordingTargetSocket(t)
+	var accessRulesPath string = writeTestAccessRules(t, "GET~/v2/snaps\n")
+	var v *Veil = startTestVeil(t, Options{
+		TargetSocketPath: targetSocketPath,
+		ExposedAddress:   filepath.Join(t.TempDir(), "veil.sock"),
+		AccessRulesPath:  accessRulesPath,
+	})
+
+	var client *http.Client = newVeilClient(v)
+	testCases := []struct {
+		name                string
+		accessRulesContents string
+		expectReloadError   bool
+		expectedStatuses    map[string]int
+	}{
+		{name: "added rule", accessRulesContents: "GET~/v2/snaps\nGET~/v2/apps\n", expectedStatuses: map[string]int{"/v2/snaps": http.StatusOK, "/v2/apps": http.StatusOK}},
+		{name: "removed rule", accessRulesContents: "GET~/v2/apps\n", expectedStatuses: map[string]int{"/v2/snaps": http.StatusNotFound, "/v2/apps": http.StatusOK}},
+		{name: "malformed rules keep previous rules", accessRulesContents: "GET~/v2/snaps\nFETCH~/v2/apps\n", expectReloadError: true, expectedStatuses: map[string]int{"/v2/snaps": http.StatusNotFound, "/v2/apps": http.StatusOK}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if err := os.WriteFile(accessRulesPath, []byte(testCase.accessRulesContents), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := v.Reload(); (err != nil) != testCase.expectReloadError {
+				t.Fatalf("expected reload error %t, got %v", testCase.expectReloadError, err)
+			}
+
+			for requestURI, expectedStatus := range testCase.expectedStatuses {
+				if status := requestStatus(t, client, http.MethodGet, requestURI); status != expectedStatus {
+					t.Errorf("expected status %d for %s, got %d", expectedStatus, requestURI, status)
+				}
+			}
+		})
+	}
+}
+
+func TestWatchAccessRules(t *testing.T) {
+	targetSocketPath, _ := recordingTargetSocket(t)
+
+	testCases := []struct {
+		name  string
+		write func(t *testing.T, accessRulesPath string, contents string)
+		path  func(t *testing.T) string
+	}{
+		{
+			name: "file",
+			path: func(t *testing.T) string { return writeTestAccessRules(t, "GET~/v2/snaps\n") },
+			write: func(t *testing.T, accessRulesPath string, contents string) {
+				if err := os.WriteFile(accessRulesPath, []byte(contents), 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "directory",
+			path: func(t *testing.T) string {
+				var accessRulesDirectory string = t.TempDir()
+				if err := os.WriteFile(filepath.Join(accessRulesDirectory, "10-snaps.conf"), []byte("GET~/v2/snaps\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+
+				return accessRulesDirectory
+			},
+			write: func(t *testing.T, accessRulesPath string, contents string) {
+				if err := os.WriteFile(filepath.Join(accessRulesPath, "20-apps.conf"), []byte(contents), 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "included file",
+			path: func(t *testing.T) string {
+				var accessRulesDirectory string = t.TempDir()
+				if err := os.WriteFile(filepath.Join(accessRulesDirectory, "snaps.conf"), []byte("GET~/v2/snaps\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+
+				var accessRulesPath string = filepath.Join(accessRulesDirectory, "rules.txt")
+				if err := os.WriteFile(accessRulesPath, []byte("include snaps.conf\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+
+				return accessRulesPath
+			},
+			write: func(t *testing.T, accessRulesPath string, contents string) {
+				if err := os.WriteFile(filepath.Join(filepath.Dir(accessRulesPath), "snaps.conf"), []byte(contents), 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var accessRulesPath string = testCase.path(t)
+			var v *Veil = startTestVeil(t, Options{
+				TargetSocketPath: targetSocketPath,
+				ExposedAddress:   filepath.Join(t.TempDir(), "veil.sock"),
+				AccessRulesPath:  accessRulesPath,
+				WatchAccessRules: true,
+			})
+
+			var client *http.Client = newVeilClient(v)
+			if status := requestStatus(t, client, http.MethodGet, "/v2/apps"); status != http.StatusNotFound {
+				t.Fatalf("expected status 404 before the rules change, got %d", status)
+			}
+
+			testCase.write(t, accessRulesPath, "GET~/v2/snaps\nGET~/v2/apps\n")
+			awaitStatus(t, client, http.MethodGet, "/v2/apps", http.StatusOK, 5*time.Second)
+		})
+	}
+}
+
+func TestWatchAccessRuleSchemas(t *testing.T) {
+	targetSocketPath, _ := recordingTargetSocket(t)
+	var accessRulesDirectory string = t.TempDir()
+	var schemaPath string = filepath.Join(accessRulesDirectory, "snap.json")
+	if err := os.WriteFile(schemaPath, []byte(`{"type": "object", "required": ["name"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var accessRulesPath string = filepath.Join(accessRulesDirectory, "rules.txt")
+	if err := os.WriteFile(accessRulesPath, []byte("POST~/v2/snaps~schema=snap.json\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var v *Veil = startTestVeil(t, Options{
+		TargetSocketPath: targetSocketPath,
+		ExposedAddress:   filepath.Join(t.TempDir(), "veil.sock"),
+		AccessRulesPath:  accessRulesPath,
+		WatchAccessRules: true,
+	})
+
+	var client *http.Client = newVeilClient(v)
+	var postStatus func() int = func() int {
+		response, err := client.Post("http://veil/v2/snaps", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		return response.StatusCode
+	}
+
+	if status := postStatus(); status != http.StatusBadRequest {
+		t.Fatalf("expected status 400 before the schema changes, got %d", status)
+	}
+
+	if err := os.WriteFile(schemaPath, []byte(`{"type": "object"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var deadline time.Time = time.Now().Add(5 * time.Second)
+	for status := postStatus(); status != http.StatusOK; status = postStatus() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected status 200 once the schema changes, got %d", status)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/thoas/go-funk"
+)
+
+// responseHeader : A header added to relayed responses, which replaces the
+// target socket's own value for it only when forced
+type responseHeader struct {
+	name  string
+	value string
+	force bool
+}
+
+// forcedResponseHeader : Form of a response header in the JSON file whose
+// value replaces any set by the target socket
+type forcedResponseHeader struct {
+	Value string `json:"value"`
+	Force bool   `json:"force"`
+}
+
+// loadResponseHeaders : Loads the headers to add to relayed responses from a
+// JSON file mapping header names either to values, which are added when the
+// target socket has not set the header, or to objects of the form
+// {"value": ..., "force": true}, whose values are always applied
+func loadResponseHeaders(headersPath string) ([]responseHeader, error) {
+	headersContents, errRead := os.ReadFile(headersPath)
+	if errRead != nil {
+		return nil, errRead
+	}
+
+	var encodedHeaders map[string]json.RawMessage
+	if err := json.Unmarshal(headersContents, &encodedHeaders); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	var responseHeaders []responseHeader = []responseHeader{}
+	for headerName, encodedHeader := range encodedHeaders {
+		if len(headerName) == 0 || strings.ContainsAny(headerName, " \t\r\n:") {
+			return nil, fmt.Errorf("invalid header name %q", headerName)
+		}
+
+		if funk.ContainsString(hopByHopHeaders, http.CanonicalHeaderKey(headerName)) {
+			return nil, fmt.Errorf("invalid header name %q: hop-by-hop headers cannot be added", headerName)
+		}
+
+		var header responseHeader = responseHeader{name: http.CanonicalHeaderKey(headerName)}
+		if err := json.Unmarshal(encodedHeader, &header.value); err != nil {
+			var forcedHeader forcedResponseHeader
+			var decoder *json.Decoder = json.NewDecoder(strings.NewReader(string(encodedHeader)))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&forcedHeader); err != nil {
+				return nil, fmt.Errorf("invalid value for header %q: expected a string or {\"value\": ..., \"force\": true|false}", headerName)
+			}
+
+			header.value = forcedHeader.Value
+			header.force = forcedHeader.Force
+		}
+
+		if strings.ContainsAny(header.value, "\r\n") {
+			return nil, fmt.Errorf("invalid value for header %q: must not contain line breaks", headerName)
+		}
+
+		responseHeaders = append(responseHeaders, header)
+	}
+
+	sort.Slice(responseHeaders, func(i, j int) bool {
+		return responseHeaders[i].name < responseHeaders[j].name
+	})
+
+	return responseHeaders, nil
+}
+
+// applyResponseHeaders : Adds the response headers to those of a relayed
+// response, leaving any the target socket set unless they are forced
+func applyResponseHeaders(header http.Header, responseHeaders []responseHeader) {
+	for _, responseHeader := range responseHeaders {
+		if _, exists := header[responseHeader.name]; exists && !responseHeader.force {
+			continue
+		}
+
+		header.Set(responseHeader.name, responseHeader.value)
+	}
+}
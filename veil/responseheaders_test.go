@@ -0,0 +1,122 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTestResponseHeaders : Writes the response headers JSON to a file in a
+// temporary directory, returning its path
+func writeTestResponseHeaders(t *testing.T, contents string) string {
+	t.Helper()
+
+	var headersPath string = filepath.Join(t.TempDir(), "headers.json")
+	if err := os.WriteFile(headersPath, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return headersPath
+}
+
+func TestLoadResponseHeaders(t *testing.T) {
+	responseHeaders, err := loadResponseHeaders(writeTestResponseHeaders(t, `{
+		"x-content-type-options": "nosniff",
+		"X-Frame-Options": {"value": "DENY"},
+		"Content-Security-Policy": {"value": "default-src 'none'", "force": true}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expectedHeaders []responseHeader = []responseHeader{
+		{name: "Content-Security-Policy", value: "default-src 'none'", force: true},
+		{name: "X-Content-Type-Options", value: "nosniff", force: false},
+		{name: "X-Frame-Options", value: "DENY", force: false},
+	}
+	if !reflect.DeepEqual(responseHeaders, expectedHeaders) {
+		t.Errorf("expected %+v, got %+v", expectedHeaders, responseHeaders)
+	}
+}
+
+func TestLoadResponseHeadersRejected(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents string
+	}{
+		{name: "malformed JSON", contents: `{"X-Frame-Options": "DENY"`},
+		{name: "not an object", contents: `["X-Frame-Options"]`},
+		{name: "empty name", contents: `{"": "DENY"}`},
+		{name: "name with a colon", contents: `{"X-Frame-Options:": "DENY"}`},
+		{name: "hop-by-hop header", contents: `{"connection": "close"}`},
+		{name: "numeric value", contents: `{"X-Frame-Options": 1}`},
+		{name: "unknown field", contents: `{"X-Frame-Options": {"value": "DENY", "always": true}}`},
+		{name: "line break in value", contents: `{"X-Frame-Options": "DENY\r\nX-Injected: 1"}`},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if _, err := loadResponseHeaders(writeTestResponseHeaders(t, testCase.contents)); err == nil {
+				t.Error("expected the response headers to be rejected")
+			}
+		})
+	}
+}
+
+func TestRelayResponseHeaders(t *testing.T) {
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		w.Header().Set("Content-Security-Policy", "default-src *")
+	}))
+
+	responseHeaders, err := loadResponseHeaders(writeTestResponseHeaders(t, `{
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options": "DENY",
+		"Content-Security-Policy": {"value": "default-src 'none'", "force": true}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+	newTestRelay([]string{targetSocketPath}, relayOptions{responseHeaders: responseHeaders})(recorder, httptest.NewRequest(http.MethodGet, "/v2/snaps", nil))
+
+	testCases := []struct {
+		name          string
+		header        string
+		expectedValue string
+	}{
+		{name: "added when absent", header: "X-Content-Type-Options", expectedValue: "nosniff"},
+		{name: "target socket's value kept", header: "X-Frame-Options", expectedValue: "SAMEORIGIN"},
+		{name: "forced over the target socket's value", header: "Content-Security-Policy", expectedValue: "default-src 'none'"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if values := recorder.Header().Values(testCase.header); !reflect.DeepEqual(values, []string{testCase.expectedValue}) {
+				t.Errorf("expected %s %q, got %q", testCase.header, testCase.expectedValue, values)
+			}
+		})
+	}
+}
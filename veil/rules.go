@@ -0,0 +1,1700 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/thoas/go-funk"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v2"
+)
+
+func unknownRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if relay, dryRun := dryRunRelayFromContext(r.Context()); dryRun {
+		relay(w, r)
+		recordRequestDecision(r.Context(), DecisionDryRunNotFound)
+		return
+	}
+
+	recordRequestDecision(r.Context(), DecisionNotFound)
+	writeErrorResponse(w, r, http.StatusNotFound, unknownMsgString)
+}
+
+// unsupportedMediaTypeHandler : Refuses a request whose body has a media type
+// that the access rule it matched does not accept
+func unsupportedMediaTypeHandler(w http.ResponseWriter, r *http.Request) {
+	if relay, dryRun := dryRunRelayFromContext(r.Context()); dryRun {
+		relay(w, r)
+		recordRequestDecision(r.Context(), DecisionDryRunForbidden)
+		return
+	}
+
+	recordRequestDecision(r.Context(), DecisionInvalidBody)
+	writeErrorResponse(w, r, http.StatusUnsupportedMediaType, unsupportedMediaTypeString)
+}
+
+// rateLimitedRequestHandler : Refuses a request beyond the rate limit of the
+// access rule it matched
+func rateLimitedRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if relay, dryRun := dryRunRelayFromContext(r.Context()); dryRun {
+		relay(w, r)
+		recordRequestDecision(r.Context(), DecisionDryRunForbidden)
+		return
+	}
+
+	recordRequestDecision(r.Context(), DecisionRateLimited)
+	writeErrorResponse(w, r, http.StatusTooManyRequests, tooManyRequestsString)
+}
+
+func forbiddenRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if relay, dryRun := dryRunRelayFromContext(r.Context()); dryRun {
+		relay(w, r)
+		recordRequestDecision(r.Context(), DecisionDryRunForbidden)
+		return
+	}
+
+	recordRequestDecision(r.Context(), DecisionForbidden)
+	writeErrorResponse(w, r, http.StatusUnauthorized, unauthorizedMsgString)
+}
+
+// methodNotAllowedHandler : Returns a handler refusing requests for a path that
+// the access rules cover, but not with the request's HTTP method. The Allow
+// header lists the methods with which the access rules would allow the path,
+// as found by matching the request against the router with each of the
+// methods of the permitting routes.
+func methodNotAllowedHandler(router *mux.Router, permittingRoutes map[*mux.Route]string) http.HandlerFunc {
+	var candidateMethods []string = []string{}
+	for _, method := range permittingRoutes {
+		if !funk.ContainsString(candidateMethods, method) {
+			candidateMethods = append(candidateMethods, method)
+		}
+	}
+
+	sort.Strings(candidateMethods)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if relay, dryRun := dryRunRelayFromContext(r.Context()); dryRun {
+			relay(w, r)
+			recordRequestDecision(r.Context(), DecisionDryRunForbidden)
+			return
+		}
+
+		var allowedMethods []string = []string{}
+		for _, method := range candidateMethods {
+			var match mux.RouteMatch
+			var candidateRequest *http.Request = r.Clone(r.Context())
+			candidateRequest.Method = method
+			if router.Match(candidateRequest, &match) && match.MatchErr == nil && len(permittingRoutes[match.Route]) > 0 {
+				allowedMethods = append(allowedMethods, method)
+			}
+		}
+
+		recordRequestDecision(r.Context(), DecisionForbidden)
+		w.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+		writeErrorResponse(w, r, http.StatusMethodNotAllowed, methodNotAllowedString)
+	}
+}
+
+// dryRunRelayContextKey : Key under which the relay is stored in the context of
+// requests served in dry-run mode
+type dryRunRelayContextKey struct{}
+
+// withDryRun : Wraps a router such that requests the access rules would refuse
+// are relayed anyway, with the refusal being recorded as their decision
+func withDryRun(relay http.HandlerFunc, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), dryRunRelayContextKey{}, relay)))
+	})
+}
+
+// dryRunRelayFromContext : Retrieves the relay through which refused requests
+// are passed, if the request is being served in dry-run mode
+func dryRunRelayFromContext(ctx context.Context) (http.HandlerFunc, bool) {
+	relay, exists := ctx.Value(dryRunRelayContextKey{}).(http.HandlerFunc)
+	return relay, exists
+}
+
+// readFileLines : Read the contents of a file, and using newlines as the
+// delimiter, return a list where each element corresponds with a line from the
+// original file. An error is returned if the file cannot be opened or read.
+func readFileLines(filepath string) ([]string, error) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var fileLines []string = []string{}
+	var scanner *bufio.Scanner = bufio.NewScanner(file)
+	for scanner.Scan() {
+		fileLines = append(fileLines, scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read %s: %v", filepath, err)
+	}
+
+	return fileLines, nil
+}
+
+// accessRule : A single allowance parsed from the access rules list, granting
+// requests of one HTTP method type against one resource path
+type accessRule struct {
+	method string
+	path   string
+
+	// deny marks the rule as refusing, rather than granting, matching requests
+	deny bool
+
+	// pathPattern holds the compiled expression for rules whose path is a
+	// regular expression, and is nil otherwise
+	pathPattern *regexp.Regexp
+
+	// timeout overrides the global request timeout for requests matching this
+	// rule when greater than zero
+	timeout time.Duration
+
+	// uids and gids, when not empty, restrict the rule to clients connected
+	// over a UNIX Domain Socket whose process runs as one of the listed user
+	// or group IDs
+	uids []uint32
+	gids []uint32
+
+	// commonNames, when not empty, restricts the rule to TLS clients that
+	// presented a verified certificate with one of the listed common names
+	commonNames []string
+
+	// rewrite, when not empty, replaces the path of matching requests before
+	// they are relayed. It replaces the whole path of a literal rule, the
+	// matched prefix of a prefix rule, and is expanded with the capture groups
+	// of a regular expression rule.
+	rewrite string
+
+	// rate holds the rate specification limiting matching requests, enforced
+	// by rateLimiter, which is shared by every copy of the rule. Both are empty
+	// for rules without a rate limit.
+	rate        string
+	rateLimiter *rate.Limiter
+
+	// headers, when not empty, restricts the rule to requests carrying every
+	// one of the listed headers
+	headers []headerCondition
+
+	// queryParameters, when not empty, restricts the rule to requests whose
+	// query string holds every one of the listed parameters
+	queryParameters []queryCondition
+
+	// timeWindows, when not empty, restricts the rule to requests made during
+	// any one of the listed time windows
+	timeWindows []timeWindow
+
+	// contentTypes, when not empty, restricts the rule to requests whose body
+	// has one of the listed media types, or no Content-Type at all should the
+	// list hold missingContentTypeToken
+	contentTypes []string
+
+	// schemaPath, when not empty, names a JSON Schema that the bodies of
+	// matching requests must conform to, compiled into schema once the rules
+	// are loaded
+	schemaPath string
+	schema     *jsonschema.Schema
+}
+
+// headerCondition : A request header that a rule requires, either with a
+// particular value or merely present
+type headerCondition struct {
+	name         string
+	value        string
+	presenceOnly bool
+}
+
+// parseHeaderCondition : Parses a header condition of the form "Name:value",
+// which requires the header to have the value, or "Name", which only requires
+// the header to be present
+func parseHeaderCondition(condition string) (headerCondition, error) {
+	var conditionParts []string = strings.SplitN(condition, ":", 2)
+	var headerName string = strings.TrimSpace(conditionParts[0])
+	if len(headerName) == 0 || strings.ContainsAny(headerName, " \t") {
+		return headerCondition{}, fmt.Errorf("invalid header name %q", headerName)
+	}
+
+	if len(conditionParts) == 1 {
+		return headerCondition{name: http.CanonicalHeaderKey(headerName), presenceOnly: true}, nil
+	}
+
+	return headerCondition{name: http.CanonicalHeaderKey(headerName), value: strings.TrimSpace(conditionParts[1])}, nil
+}
+
+// satisfiedBy : Reports whether the request headers meet the condition
+func (condition headerCondition) satisfiedBy(header http.Header) bool {
+	headerValues, exists := header[condition.name]
+	if !exists {
+		return false
+	}
+
+	if condition.presenceOnly {
+		return true
+	}
+
+	for _, headerValue := range headerValues {
+		if strings.TrimSpace(headerValue) == condition.value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String : Formats the condition as it is written in an access rule
+func (condition headerCondition) String() string {
+	if condition.presenceOnly {
+		return condition.name
+	}
+
+	return condition.name + ":" + condition.value
+}
+
+// queryCondition : A query parameter that a rule requires, either with a
+// particular value or merely present
+type queryCondition struct {
+	name         string
+	value        string
+	presenceOnly bool
+}
+
+// parseQueryCondition : Parses a query parameter condition of the form
+// "name=value", which requires the parameter to have the value, or "name",
+// which only requires the parameter to be present. Unlike header names,
+// parameter names are case-sensitive.
+func parseQueryCondition(condition string) (queryCondition, error) {
+	var conditionParts []string = strings.SplitN(condition, "=", 2)
+	if len(conditionParts[0]) == 0 {
+		return queryCondition{}, fmt.Errorf("invalid query parameter name %q", conditionParts[0])
+	}
+
+	if len(conditionParts) == 1 {
+		return queryCondition{name: conditionParts[0], presenceOnly: true}, nil
+	}
+
+	return queryCondition{name: conditionParts[0], value: conditionParts[1]}, nil
+}
+
+// satisfiedBy : Reports whether the decoded query parameters of a request meet
+// the condition
+func (condition queryCondition) satisfiedBy(query url.Values) bool {
+	parameterValues, exists := query[condition.name]
+	if !exists {
+		return false
+	}
+
+	if condition.presenceOnly {
+		return true
+	}
+
+	return funk.ContainsString(parameterValues, condition.value)
+}
+
+// String : Formats the condition as it is written in an access rule
+func (condition queryCondition) String() string {
+	if condition.presenceOnly {
+		return condition.name
+	}
+
+	return condition.name + "=" + condition.value
+}
+
+// parseContentTypes : Parses a list of the media types a rule accepts, each of
+// the form "type/subtype", "type/*" or missingContentTypeToken, normalizing
+// them to lower case
+func parseContentTypes(contentTypes []string) ([]string, error) {
+	var parsedContentTypes []string = []string{}
+	for _, contentType := range contentTypes {
+		contentType = strings.ToLower(strings.TrimSpace(contentType))
+		if contentType != missingContentTypeToken {
+			mediaTypeParts := strings.Split(contentType, "/")
+			if len(mediaTypeParts) != 2 || len(mediaTypeParts[0]) == 0 || len(mediaTypeParts[1]) == 0 || mediaTypeParts[0] == "*" {
+				return nil, fmt.Errorf("invalid media type %q (expected type/subtype, type/* or %s)", contentType, missingContentTypeToken)
+			}
+		}
+
+		parsedContentTypes = append(parsedContentTypes, contentType)
+	}
+
+	if len(parsedContentTypes) == 0 {
+		return nil, errors.New("no media types listed")
+	}
+
+	return parsedContentTypes, nil
+}
+
+// contentTypeAllowed : Reports whether the media type of a request's
+// Content-Type header, disregarding its parameters, is one of those the rule
+// accepts
+func contentTypeAllowed(contentTypes []string, header http.Header) bool {
+	var contentType string = header.Get("Content-Type")
+	if len(strings.TrimSpace(contentType)) == 0 {
+		return funk.ContainsString(contentTypes, missingContentTypeToken)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, allowedContentType := range contentTypes {
+		if mediaType == allowedContentType || (strings.HasSuffix(allowedContentType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowedContentType, "*"))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rewritePath : Returns the escaped path with which a request matching the
+// rule is relayed to the target socket, given the escaped path it requested
+func (rule accessRule) rewritePath(requestPath string) string {
+	if len(rule.rewrite) == 0 {
+		return requestPath
+	}
+
+	if rule.pathPattern != nil {
+		return rule.pathPattern.ReplaceAllString(requestPath, rule.rewrite)
+	}
+
+	if strings.HasPrefix(rule.path, prefixPathPrefix) {
+		return escapedPath(rule.rewrite) + strings.TrimPrefix(requestPath, escapedPath(strings.TrimPrefix(rule.path, prefixPathPrefix)))
+	}
+
+	return escapedPath(rule.rewrite)
+}
+
+// accessRuleContextKey : Key under which the access rule matched by an
+// incoming request is stored in the request context
+type accessRuleContextKey struct{}
+
+// withAccessRule : Wraps a request handler such that the access rule that
+// routed a request to it is made available through the request context
+func withAccessRule(rule accessRule, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(w, r.WithContext(context.WithValue(r.Context(), accessRuleContextKey{}, rule)))
+	}
+}
+
+// accessRuleFromContext : Retrieves the access rule that routed a request, if
+// any was recorded by withAccessRule
+func accessRuleFromContext(ctx context.Context) (accessRule, bool) {
+	rule, exists := ctx.Value(accessRuleContextKey{}).(accessRule)
+	return rule, exists
+}
+
+// stripRuleComment : Removes any comment from a line of the access rules list,
+// along with surrounding whitespace. A comment begins at a "#" that either
+// starts the line or is preceded by whitespace, so a "#" within a path is left
+// intact.
+func stripRuleComment(line string) string {
+	for i := strings.Index(line, ruleCommentMarker); i >= 0; {
+		if i == 0 || strings.TrimSpace(line[i-1:i]) == "" {
+			line = line[:i]
+			break
+		}
+
+		nextIndex := strings.Index(line[i+1:], ruleCommentMarker)
+		if nextIndex < 0 {
+			break
+		}
+
+		i += nextIndex + 1
+	}
+
+	return strings.TrimSpace(line)
+}
+
+// invalidAccessRulesError : Describes every malformed rule found in an access
+// rules list
+type invalidAccessRulesError struct {
+	problems []string
+}
+
+func (e *invalidAccessRulesError) Error() string {
+	return "invalid access rules:\n\t" + strings.Join(e.problems, "\n\t")
+}
+
+// normalizeMethod : Canonicalizes an HTTP method token from an access rule, so
+// that rules may spell methods in any letter case
+func normalizeMethod(method string) string {
+	return strings.ToUpper(strings.TrimSpace(method))
+}
+
+// methodAliases : Custom method tokens of access rules, each granting a group
+// of HTTP method types
+type methodAliases map[string][]string
+
+// expand : Returns the HTTP method types granted by a method token of an
+// access rule, which may be an HTTP method type, a wildcard or an alias, and
+// whether the token is recognized
+func (aliases methodAliases) expand(method string) ([]string, bool) {
+	if funk.ContainsString(supportedHTTPMethods, method) {
+		return []string{method}, true
+	}
+
+	if funk.ContainsString(anyMethodTokens, method) {
+		return supportedHTTPMethods, true
+	}
+
+	if methods, exists := aliases[method]; exists {
+		return methods, true
+	}
+
+	methods, exists := builtInMethodAliases[method]
+	return methods, exists
+}
+
+// validateMethodAliases : Checks that the name of every custom method alias is
+// distinct from the HTTP method types and wildcards, and cannot be confused
+// with the delimiter, and that it only groups supported HTTP method types. The
+// aliases are returned with their names and methods canonicalized.
+func validateMethodAliases(aliases map[string][]string, delimiter string) (methodAliases, error) {
+	var validAliases methodAliases = methodAliases{}
+	for aliasName, methods := range aliases {
+		var normalizedName string = normalizeMethod(aliasName)
+		if len(normalizedName) == 0 || strings.ContainsAny(normalizedName, denyMethodPrefix+ruleCommentMarker+" \t") ||
+			strings.Contains(normalizedName, strings.ToUpper(delimiter)) {
+			return nil, fmt.Errorf("invalid method alias name %q", aliasName)
+		}
+
+		if funk.ContainsString(supportedHTTPMethods, normalizedName) || funk.ContainsString(anyMethodTokens, normalizedName) {
+			return nil, fmt.Errorf("invalid method alias name %q: must not be an HTTP method or wildcard", aliasName)
+		}
+
+		if len(methods) == 0 {
+			return nil, fmt.Errorf("method alias %q must name at least one HTTP method", aliasName)
+		}
+
+		for _, method := range methods {
+			if !funk.ContainsString(supportedHTTPMethods, normalizeMethod(method)) {
+				return nil, fmt.Errorf("method alias %q: unsupported HTTP method %q", aliasName, method)
+			}
+
+			validAliases[normalizedName] = append(validAliases[normalizedName], normalizeMethod(method))
+		}
+	}
+
+	return validAliases, nil
+}
+
+// validateAccessRuleDelimiter : Checks that the delimiter is a single character
+// that cannot be confused with the HTTP method of a rule, its deny prefix or a
+// comment
+func validateAccessRuleDelimiter(delimiter string) error {
+	if utf8.RuneCountInString(delimiter) != 1 {
+		return fmt.Errorf("invalid access rule delimiter %q (must be a single character)", delimiter)
+	}
+
+	var reservedCharacters string = denyMethodPrefix + ruleCommentMarker + strings.Join(anyMethodTokens, "") + strings.Join(supportedHTTPMethods, "")
+	for aliasName := range builtInMethodAliases {
+		reservedCharacters += aliasName
+	}
+	if strings.Contains(strings.ToUpper(reservedCharacters)+strings.ToLower(reservedCharacters), delimiter) {
+		return fmt.Errorf("invalid access rule delimiter %q (must not appear in HTTP methods, %q or %q)", delimiter, denyMethodPrefix, ruleCommentMarker)
+	}
+
+	return nil
+}
+
+// parseAccessRule : Parses a single, non-empty line of the access rules list
+// into an access rule, returning an error describing why the line is malformed
+// if it cannot be parsed. The fields of the rule are separated by either the
+// delimiter or runs of whitespace, whichever follows the HTTP method.
+func parseAccessRule(line string, delimiter string, aliases methodAliases) (accessRule, error) {
+	var splitRule []string = strings.Fields(line)
+	if delimiterIndex := strings.Index(line, delimiter); delimiterIndex >= 0 && len(strings.TrimSpace(delimiter)) > 0 &&
+		!strings.ContainsAny(strings.TrimSpace(line[:delimiterIndex]), " \t") {
+		splitRule = strings.Split(line, delimiter)
+	}
+
+	if len(splitRule) < 2 {
+		return accessRule{}, fmt.Errorf("expected at least 2 %q- or whitespace-delimited fields but found %d", delimiter, len(splitRule))
+	}
+
+	var methodField string = strings.TrimSpace(splitRule[0])
+	var rule accessRule = accessRule{
+		method: normalizeMethod(strings.TrimPrefix(methodField, denyMethodPrefix)),
+		path:   splitRule[1],
+		deny:   strings.HasPrefix(methodField, denyMethodPrefix),
+	}
+
+	if len(rule.method) == 0 {
+		return accessRule{}, fmt.Errorf("missing HTTP method")
+	}
+
+	if _, exists := aliases.expand(rule.method); !exists {
+		return accessRule{}, fmt.Errorf("unsupported HTTP method %q", rule.method)
+	}
+
+	if len(rule.path) == 0 {
+		return accessRule{}, fmt.Errorf("missing request path")
+	}
+
+	for _, option := range splitRule[2:] {
+		if err := applyAccessRuleOption(&rule, strings.TrimSpace(option)); err != nil {
+			return accessRule{}, err
+		}
+	}
+
+	return rule, nil
+}
+
+// applyAccessRuleOption : Applies an optional field following the path of a
+// line-delimited access rule. Options take the form "name=value", except that
+// a bare duration is accepted as the rule's timeout.
+func applyAccessRuleOption(rule *accessRule, option string) error {
+	var optionName string = ruleOptionTimeout
+	var optionValue string = option
+	if separatorIndex := strings.Index(option, "="); separatorIndex >= 0 {
+		optionName = strings.ToLower(strings.TrimSpace(option[:separatorIndex]))
+		optionValue = strings.TrimSpace(option[separatorIndex+1:])
+	}
+
+	switch optionName {
+	case ruleOptionTimeout:
+		ruleTimeout, err := time.ParseDuration(optionValue)
+		if err != nil || ruleTimeout <= 0 {
+			return fmt.Errorf("invalid timeout %q", optionValue)
+		}
+
+		rule.timeout = ruleTimeout
+	case ruleOptionUID:
+		uids, err := parseIDList(optionValue)
+		if err != nil {
+			return fmt.Errorf("invalid user ID list %q: %v", optionValue, err)
+		}
+
+		rule.uids = uids
+	case ruleOptionGID:
+		gids, err := parseIDList(optionValue)
+		if err != nil {
+			return fmt.Errorf("invalid group ID list %q: %v", optionValue, err)
+		}
+
+		rule.gids = gids
+	case ruleOptionCommonName:
+		commonNames := SplitCommaSeparated(optionValue)
+		if len(commonNames) == 0 {
+			return fmt.Errorf("invalid common name list %q", optionValue)
+		}
+
+		rule.commonNames = commonNames
+	case ruleOptionRewrite:
+		if !strings.HasPrefix(optionValue, "/") {
+			return fmt.Errorf("invalid rewrite %q (must begin with \"/\")", optionValue)
+		}
+
+		rule.rewrite = optionValue
+	case ruleOptionRate:
+		rateLimiter, err := parseRate(optionValue)
+		if err != nil {
+			return fmt.Errorf("invalid rate %q: %v", optionValue, err)
+		}
+
+		rule.rate = optionValue
+		rule.rateLimiter = rateLimiter
+	case ruleOptionHeader:
+		condition, err := parseHeaderCondition(optionValue)
+		if err != nil {
+			return fmt.Errorf("invalid header condition %q: %v", optionValue, err)
+		}
+
+		rule.headers = append(rule.headers, condition)
+	case ruleOptionQuery:
+		condition, err := parseQueryCondition(optionValue)
+		if err != nil {
+			return fmt.Errorf("invalid query parameter condition %q: %v", optionValue, err)
+		}
+
+		rule.queryParameters = append(rule.queryParameters, condition)
+	case ruleOptionWindow:
+		window, err := parseTimeWindow(optionValue)
+		if err != nil {
+			return fmt.Errorf("invalid time window %q: %v", optionValue, err)
+		}
+
+		rule.timeWindows = append(rule.timeWindows, window)
+	case ruleOptionSchema:
+		if len(optionValue) == 0 {
+			return fmt.Errorf("invalid schema path %q", optionValue)
+		}
+
+		rule.schemaPath = optionValue
+	case ruleOptionContentType:
+		contentTypes, err := parseContentTypes(SplitCommaSeparated(optionValue))
+		if err != nil {
+			return fmt.Errorf("invalid content type list %q: %v", optionValue, err)
+		}
+
+		rule.contentTypes = contentTypes
+	default:
+		return fmt.Errorf("unknown rule option %q", optionName)
+	}
+
+	return nil
+}
+
+// containsID : Reports whether the user or group ID is among those listed
+func containsID(ids []uint32, id uint32) bool {
+	for _, listedID := range ids {
+		if listedID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseIDList : Parses a comma-separated list of numeric user or group IDs
+func parseIDList(value string) ([]uint32, error) {
+	var ids []uint32 = []uint32{}
+	for _, idString := range SplitCommaSeparated(value) {
+		id, err := strconv.ParseUint(idString, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, uint32(id))
+	}
+
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no IDs listed")
+	}
+
+	return ids, nil
+}
+
+// determineAccessRules : Computes a key-value map that describes what HTTP
+// requests will be made accessible, from the line-delimited access rules list
+// at the provided path. Each element in the mapping is from a resource path to
+// a list of access rules, one per HTTP method type. Unless lenient is set, an
+// error listing every malformed line is returned if any line cannot be parsed;
+// otherwise malformed lines are logged and skipped. An error is always
+// returned if any rule holds a path that is an invalid regular expression, or
+// if an included file cannot be read. The fields of each line are separated by
+// the delimiter. The paths of the files read, including those included, are
+// returned along with the rules.
+func determineAccessRules(accessRulesFilepath string, lenient bool, delimiter string, aliases methodAliases) (map[string][]accessRule, []string, error) {
+	parsedAccessRules, problems, readPaths, err := parseAccessRulesFile(accessRulesFilepath, delimiter, aliases, []string{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(problems) > 0 {
+		if !lenient {
+			return nil, nil, &invalidAccessRulesError{problems: problems}
+		}
+
+		for _, problem := range problems {
+			logWarn("Ignoring malformed access rule:", problem)
+		}
+	}
+
+	accessRules, err := groupAccessRules(parsedAccessRules, aliases)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return accessRules, readPaths, nil
+}
+
+// parseAccessRulesFile : Parses every line of a line-delimited access rules
+// list, returning the rules parsed along with a description of each malformed
+// line, and the paths of the files read. A line of the form "include <path>"
+// parses the referenced file in its place, resolving a relative path against
+// the directory of the including file. The include chain lists the files
+// currently being parsed, so that a file including itself, directly or
+// indirectly, is rejected.
+func parseAccessRulesFile(accessRulesFilepath string, delimiter string, aliases methodAliases, includeChain []string) ([]accessRule, []string, []string, error) {
+	absoluteFilepath, err := filepath.Abs(accessRulesFilepath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if funk.ContainsString(includeChain, absoluteFilepath) {
+		return nil, nil, nil, fmt.Errorf("include cycle: %s", strings.Join(append(includeChain, absoluteFilepath), " -> "))
+	}
+
+	includeChain = append(append([]string{}, includeChain...), absoluteFilepath)
+
+	accessRulesList, err := readFileLines(accessRulesFilepath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var parsedAccessRules []accessRule = []accessRule{}
+	var problems []string = []string{}
+	var readPaths []string = []string{accessRulesFilepath}
+
+	for i, line := range accessRulesList {
+		line = stripRuleComment(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		if lineFields := strings.Fields(line); len(lineFields) > 0 && lineFields[0] == ruleIncludeDirective {
+			if len(lineFields) != 2 {
+				problems = append(problems, fmt.Sprintf("%s line %d: expected a single path to include: %q", accessRulesFilepath, i+1, line))
+				continue
+			}
+
+			var includedFilepath string = lineFields[1]
+			if !filepath.IsAbs(includedFilepath) {
+				includedFilepath = filepath.Join(filepath.Dir(accessRulesFilepath), includedFilepath)
+			}
+
+			includedAccessRules, includedProblems, includedPaths, err := parseAccessRulesFile(includedFilepath, delimiter, aliases, includeChain)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("%s line %d: %v", accessRulesFilepath, i+1, err)
+			}
+
+			parsedAccessRules = append(parsedAccessRules, includedAccessRules...)
+			problems = append(problems, includedProblems...)
+			readPaths = append(readPaths, includedPaths...)
+			continue
+		}
+
+		rule, err := parseAccessRule(line, delimiter, aliases)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s line %d: %v: %q", accessRulesFilepath, i+1, err, line))
+			continue
+		}
+
+		// Schemas are compiled once every file has been parsed, so paths are
+		// resolved against the file naming them while it is known
+		if len(rule.schemaPath) > 0 && !filepath.IsAbs(rule.schemaPath) {
+			rule.schemaPath = filepath.Join(filepath.Dir(absoluteFilepath), rule.schemaPath)
+		}
+
+		parsedAccessRules = append(parsedAccessRules, rule)
+	}
+
+	return parsedAccessRules, problems, readPaths, nil
+}
+
+// groupAccessRules : Arranges parsed access rules into a key-value map from
+// resource path to the rules for that path, expanding wildcard method tokens and
+// method aliases and compiling regular expression paths along the way
+func groupAccessRules(parsedAccessRules []accessRule, aliases methodAliases) (map[string][]accessRule, error) {
+	var accessRulesMap = make(map[string][]accessRule)
+
+	for _, rule := range parsedAccessRules {
+		if strings.HasPrefix(rule.path, regexpPathPrefix) {
+			// Anchor the expression so that it must match the entire path
+			pathPattern, err := regexp.Compile("^(?:" + strings.TrimPrefix(rule.path, regexpPathPrefix) + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression in access rule path %q: %v", rule.path, err)
+			}
+
+			rule.pathPattern = pathPattern
+		}
+
+		if strings.HasPrefix(rule.path, prefixPathPrefix) && !strings.HasPrefix(strings.TrimPrefix(rule.path, prefixPathPrefix), "/") {
+			return nil, fmt.Errorf("invalid path prefix in access rule path %q: must begin with \"/\"", rule.path)
+		}
+
+		if len(rule.rewrite) > 0 && rule.pathPattern == nil && !strings.HasPrefix(rule.path, prefixPathPrefix) && accessRulePathPrecedence(rule.path) != 0 {
+			return nil, fmt.Errorf("invalid rewrite in access rule for path %q: only literal, prefix and regular expression rules may be rewritten", rule.path)
+		}
+
+		methods, _ := aliases.expand(rule.method)
+		for _, method := range methods {
+			var expandedRule accessRule = rule
+			expandedRule.method = method
+			accessRulesMap[rule.path] = append(accessRulesMap[rule.path], expandedRule)
+		}
+	}
+
+	for accessRulesPath := range accessRulesMap {
+		accessRulesListForPath := accessRulesMap[accessRulesPath]
+		sort.SliceStable(accessRulesListForPath, func(i, j int) bool {
+			if accessRulesListForPath[i].method != accessRulesListForPath[j].method {
+				return accessRulesListForPath[i].method < accessRulesListForPath[j].method
+			}
+
+			return accessRulesListForPath[i].deny && !accessRulesListForPath[j].deny
+		})
+
+		// Only the first allow rule and first deny rule listed for a given
+		// method type and set of conditions are kept
+		var uniqueAccessRules []accessRule = []accessRule{}
+		var listedAccessRules map[string]bool = make(map[string]bool)
+		for _, rule := range accessRulesListForPath {
+			var ruleKey string = fmt.Sprintf("%s %t %s", rule.method, rule.deny, accessRuleConditions(rule))
+			if listedAccessRules[ruleKey] {
+				continue
+			}
+
+			listedAccessRules[ruleKey] = true
+			uniqueAccessRules = append(uniqueAccessRules, rule)
+		}
+
+		accessRulesMap[accessRulesPath] = uniqueAccessRules
+	}
+
+	return accessRulesMap, nil
+}
+
+// accessRuleConditions : Describes the conditions deciding whether an access
+// rule applies to a request, such that rules with the same conditions are
+// described alike
+func accessRuleConditions(rule accessRule) string {
+	return fmt.Sprintf("%v %v %q %q %q %q", rule.uids, rule.gids, rule.commonNames, rule.headers, rule.queryParameters, rule.timeWindows)
+}
+
+// structuredAccessRule : A single access rule as expressed in a JSON or YAML
+// access rules list
+type structuredAccessRule struct {
+	Method       string   `json:"method" yaml:"method"`
+	Path         string   `json:"path" yaml:"path"`
+	Timeout      string   `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Deny         bool     `json:"deny,omitempty" yaml:"deny,omitempty"`
+	UIDs         []uint32 `json:"uids,omitempty" yaml:"uids,omitempty"`
+	GIDs         []uint32 `json:"gids,omitempty" yaml:"gids,omitempty"`
+	CNs          []string `json:"cns,omitempty" yaml:"cns,omitempty"`
+	Rewrite      string   `json:"rewrite,omitempty" yaml:"rewrite,omitempty"`
+	Rate         string   `json:"rate,omitempty" yaml:"rate,omitempty"`
+	Headers      []string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Query        []string `json:"query,omitempty" yaml:"query,omitempty"`
+	Windows      []string `json:"windows,omitempty" yaml:"windows,omitempty"`
+	Schema       string   `json:"schema,omitempty" yaml:"schema,omitempty"`
+	ContentTypes []string `json:"content_types,omitempty" yaml:"content_types,omitempty"`
+}
+
+// determineJSONAccessRules : Computes the same key-value map as
+// determineAccessRules from the contents of a JSON access rules list, which
+// holds an array of rule objects. Unknown fields, unsupported HTTP methods and
+// invalid timeouts are rejected.
+func determineJSONAccessRules(accessRulesJSON []byte, aliases methodAliases) (map[string][]accessRule, error) {
+	var structuredAccessRules []structuredAccessRule
+	var decoder *json.Decoder = json.NewDecoder(bytes.NewReader(accessRulesJSON))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&structuredAccessRules); err != nil {
+		return nil, fmt.Errorf("invalid JSON access rules: %v", err)
+	}
+
+	return convertStructuredAccessRules(structuredAccessRules, aliases)
+}
+
+// determineYAMLAccessRules : Computes the same key-value map as
+// determineAccessRules from the contents of a YAML access rules list. The
+// document may either hold a list of rule objects, as in the JSON format, or a
+// map from each resource path to a list of HTTP methods.
+func determineYAMLAccessRules(accessRulesYAML []byte, aliases methodAliases) (map[string][]accessRule, error) {
+	var document interface{}
+	if err := yaml.Unmarshal(accessRulesYAML, &document); err != nil {
+		return nil, fmt.Errorf("invalid YAML access rules: %v", err)
+	}
+
+	var structuredAccessRules []structuredAccessRule = []structuredAccessRule{}
+	switch document.(type) {
+	case nil:
+	case []interface{}:
+		if err := yaml.UnmarshalStrict(accessRulesYAML, &structuredAccessRules); err != nil {
+			return nil, fmt.Errorf("invalid YAML access rules: %v", err)
+		}
+	case map[interface{}]interface{}:
+		var methodsByPath map[string][]string
+		if err := yaml.UnmarshalStrict(accessRulesYAML, &methodsByPath); err != nil {
+			return nil, fmt.Errorf("invalid YAML access rules: %v", err)
+		}
+
+		var rulePaths []string = []string{}
+		for rulePath := range methodsByPath {
+			rulePaths = append(rulePaths, rulePath)
+		}
+
+		sort.Strings(rulePaths)
+		for _, rulePath := range rulePaths {
+			for _, method := range methodsByPath[rulePath] {
+				structuredAccessRules = append(structuredAccessRules, structuredAccessRule{
+					Method: strings.TrimPrefix(method, denyMethodPrefix),
+					Path:   rulePath,
+					Deny:   strings.HasPrefix(method, denyMethodPrefix),
+				})
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid YAML access rules: expected a list of rules or a map of paths to methods")
+	}
+
+	return convertStructuredAccessRules(structuredAccessRules, aliases)
+}
+
+// convertStructuredAccessRules : Validates access rules decoded from a
+// structured access rules list and arranges them as determineAccessRules does
+func convertStructuredAccessRules(structuredAccessRules []structuredAccessRule, aliases methodAliases) (map[string][]accessRule, error) {
+	var parsedAccessRules []accessRule = []accessRule{}
+	for i, structuredRule := range structuredAccessRules {
+		structuredRule.Method = normalizeMethod(structuredRule.Method)
+		if _, exists := aliases.expand(structuredRule.Method); !exists {
+			return nil, fmt.Errorf("access rule %d: unsupported HTTP method %q", i, structuredRule.Method)
+		}
+
+		if len(structuredRule.Path) == 0 {
+			return nil, fmt.Errorf("access rule %d: missing path", i)
+		}
+
+		var rule accessRule = accessRule{
+			method:      structuredRule.Method,
+			path:        structuredRule.Path,
+			deny:        structuredRule.Deny,
+			uids:        structuredRule.UIDs,
+			gids:        structuredRule.GIDs,
+			commonNames: structuredRule.CNs,
+		}
+
+		if len(structuredRule.Rewrite) > 0 {
+			if !strings.HasPrefix(structuredRule.Rewrite, "/") {
+				return nil, fmt.Errorf("access rule %d: invalid rewrite %q (must begin with \"/\")", i, structuredRule.Rewrite)
+			}
+
+			rule.rewrite = structuredRule.Rewrite
+		}
+
+		if len(structuredRule.Rate) > 0 {
+			rateLimiter, err := parseRate(structuredRule.Rate)
+			if err != nil {
+				return nil, fmt.Errorf("access rule %d: invalid rate %q: %v", i, structuredRule.Rate, err)
+			}
+
+			rule.rate = structuredRule.Rate
+			rule.rateLimiter = rateLimiter
+		}
+
+		for _, headerConditionString := range structuredRule.Headers {
+			condition, err := parseHeaderCondition(headerConditionString)
+			if err != nil {
+				return nil, fmt.Errorf("access rule %d: invalid header condition %q: %v", i, headerConditionString, err)
+			}
+
+			rule.headers = append(rule.headers, condition)
+		}
+
+		for _, queryConditionString := range structuredRule.Query {
+			condition, err := parseQueryCondition(queryConditionString)
+			if err != nil {
+				return nil, fmt.Errorf("access rule %d: invalid query parameter condition %q: %v", i, queryConditionString, err)
+			}
+
+			rule.queryParameters = append(rule.queryParameters, condition)
+		}
+
+		for _, windowSpec := range structuredRule.Windows {
+			window, err := parseTimeWindow(windowSpec)
+			if err != nil {
+				return nil, fmt.Errorf("access rule %d: invalid time window %q: %v", i, windowSpec, err)
+			}
+
+			rule.timeWindows = append(rule.timeWindows, window)
+		}
+
+		rule.schemaPath = structuredRule.Schema
+
+		if len(structuredRule.ContentTypes) > 0 {
+			contentTypes, err := parseContentTypes(structuredRule.ContentTypes)
+			if err != nil {
+				return nil, fmt.Errorf("access rule %d: invalid content type list: %v", i, err)
+			}
+
+			rule.contentTypes = contentTypes
+		}
+
+		if len(structuredRule.Timeout) > 0 {
+			ruleTimeout, err := time.ParseDuration(structuredRule.Timeout)
+			if err != nil || ruleTimeout <= 0 {
+				return nil, fmt.Errorf("access rule %d: invalid timeout %q", i, structuredRule.Timeout)
+			}
+
+			rule.timeout = ruleTimeout
+		}
+
+		parsedAccessRules = append(parsedAccessRules, rule)
+	}
+
+	return groupAccessRules(parsedAccessRules, aliases)
+}
+
+// loadAccessRules : Reads the access rules list at the provided path, which
+// may either be a single file or a directory of access rules fragments, as
+// described by loadAccessRulesFile and loadAccessRulesDirectory. The paths of
+// every file read are returned along with the rules.
+func loadAccessRules(accessRulesPath string, format string, lenient bool, delimiter string, aliases methodAliases) (map[string][]accessRule, []string, error) {
+	fileInfo, err := os.Stat(accessRulesPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if fileInfo.IsDir() {
+		return loadAccessRulesDirectory(accessRulesPath, format, lenient, delimiter, aliases)
+	}
+
+	return loadAccessRulesFile(accessRulesPath, format, lenient, delimiter, aliases)
+}
+
+// accessRulesFragmentPaths : Returns the paths of the access rules fragments
+// within a directory, in lexical order
+func accessRulesFragmentPaths(accessRulesDirectory string) ([]string, error) {
+	fragmentPaths, err := filepath.Glob(filepath.Join(accessRulesDirectory, accessRulesFragmentPattern))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(fragmentPaths)
+	return fragmentPaths, nil
+}
+
+// loadAccessRulesDirectory : Reads every access rules fragment within the
+// directory in lexical order and merges them into a single set of access
+// rules. Fragments add to the rules of earlier fragments; where a later
+// fragment repeats the allow or deny rule for a path, HTTP method type and set
+// of conditions, the earlier rule is kept and the repetition is logged.
+func loadAccessRulesDirectory(accessRulesDirectory string, format string, lenient bool, delimiter string, aliases methodAliases) (map[string][]accessRule, []string, error) {
+	fragmentPaths, err := accessRulesFragmentPaths(accessRulesDirectory)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var mergedAccessRules []accessRule = []accessRule{}
+	var ruleSources map[string]string = make(map[string]string)
+	var readPaths []string = []string{}
+	for _, fragmentPath := range fragmentPaths {
+		fragmentAccessRules, fragmentReadPaths, err := loadAccessRulesFile(fragmentPath, format, lenient, delimiter, aliases)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", fragmentPath, err)
+		}
+
+		readPaths = append(readPaths, fragmentReadPaths...)
+
+		var fragmentRulePaths []string = []string{}
+		for rulePath := range fragmentAccessRules {
+			fragmentRulePaths = append(fragmentRulePaths, rulePath)
+		}
+
+		sort.Strings(fragmentRulePaths)
+		for _, rulePath := range fragmentRulePaths {
+			for _, rule := range fragmentAccessRules[rulePath] {
+				var ruleKey string = fmt.Sprintf("%s %s %t %s", rule.method, rule.path, rule.deny, accessRuleConditions(rule))
+				if source, exists := ruleSources[ruleKey]; exists {
+					logWarn("Ignoring access rule for", rule.method, rule.path, "from", fragmentPath, "as it is already defined by", source)
+					continue
+				}
+
+				ruleSources[ruleKey] = fragmentPath
+				mergedAccessRules = append(mergedAccessRules, rule)
+			}
+		}
+	}
+
+	accessRules, err := groupAccessRules(mergedAccessRules, aliases)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return accessRules, readPaths, nil
+}
+
+// loadAccessRulesFile : Reads the access rules list at the provided path in the
+// given format. When no format is given, it is inferred from the file
+// extension, with files other than ".json", ".yaml" and ".yml" read as
+// line-delimited rules, whose fields are separated by the delimiter. Malformed
+// line-delimited rules are skipped rather than rejected when lenient is set.
+// The paths of the files read are returned along with the rules, covering the
+// files included by line-delimited rules and the schemas of the rules.
+func loadAccessRulesFile(accessRulesFilepath string, format string, lenient bool, delimiter string, aliases methodAliases) (map[string][]accessRule, []string, error) {
+	if len(format) == 0 {
+		switch strings.ToLower(filepath.Ext(accessRulesFilepath)) {
+		case ".json":
+			format = accessRulesFormatJSON
+		case ".yaml", ".yml":
+			format = accessRulesFormatYAML
+		default:
+			format = accessRulesFormatText
+		}
+	}
+
+	var accessRules map[string][]accessRule
+	var readPaths []string = []string{accessRulesFilepath}
+	var err error
+	switch format {
+	case accessRulesFormatText:
+		accessRules, readPaths, err = determineAccessRules(accessRulesFilepath, lenient, delimiter, aliases)
+	case accessRulesFormatJSON:
+		accessRulesJSON, errRead := os.ReadFile(accessRulesFilepath)
+		if errRead != nil {
+			return nil, nil, errRead
+		}
+
+		accessRules, err = determineJSONAccessRules(accessRulesJSON, aliases)
+	case accessRulesFormatYAML:
+		accessRulesYAML, errRead := os.ReadFile(accessRulesFilepath)
+		if errRead != nil {
+			return nil, nil, errRead
+		}
+
+		accessRules, err = determineYAMLAccessRules(accessRulesYAML, aliases)
+	default:
+		return nil, nil, fmt.Errorf("unknown access rules format %q", format)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Schema paths of the structured formats are resolved against the
+	// directory of the access rules list
+	schemaPaths, err := compileAccessRuleSchemas(accessRules, filepath.Dir(accessRulesFilepath))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return accessRules, append(readPaths, schemaPaths...), nil
+}
+
+// accessRulePathPrecedence : Ranks a rule path such that literal paths are
+// matched before paths with single-segment wildcards, which in turn are
+// matched before paths with multi-segment wildcards, then path prefixes and
+// finally regular expressions
+func accessRulePathPrecedence(rulePath string) int {
+	if strings.HasPrefix(rulePath, regexpPathPrefix) {
+		return 4
+	}
+
+	if strings.HasPrefix(rulePath, prefixPathPrefix) {
+		return 3
+	}
+
+	var precedence int = 0
+	for _, pathSegment := range strings.Split(rulePath, "/") {
+		if pathSegment == multiSegmentWildcard {
+			return 2
+		}
+
+		if pathSegment == singleSegmentWildcard {
+			precedence = 1
+		}
+	}
+
+	return precedence
+}
+
+// escapedPath : Escapes a path in the canonical form in which the router
+// matches request paths and the relay sends them to the target socket
+func escapedPath(path string) string {
+	return (&url.URL{Path: path}).EscapedPath()
+}
+
+// withCanonicalPath : Wraps a router such that requests are matched against
+// the canonical escaped form of their path, which is also the form in which
+// they are relayed, however the client chose to encode it. Requests whose
+// decoded path contains a "?" or "#" are refused, as the path would be cut
+// short should the target socket decode it.
+func withCanonicalPath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.ContainsAny(r.URL.Path, ambiguousPathCharacters) {
+			recordRequestDecision(r.Context(), DecisionForbidden)
+			writeErrorResponse(w, r, http.StatusBadRequest, ambiguousPathString)
+			return
+		}
+
+		if len(r.URL.RawPath) > 0 {
+			r = r.Clone(r.Context())
+			r.URL.RawPath = ""
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// muxPathTemplate : Translates a rule path containing wildcard segments into a
+// path template understood by the router, escaping its other segments. A "*"
+// segment matches exactly one path segment while a "**" segment matches the
+// remainder of the path.
+func muxPathTemplate(rulePath string) string {
+	var pathSegments []string = strings.Split(rulePath, "/")
+	for i, pathSegment := range pathSegments {
+		switch pathSegment {
+		case singleSegmentWildcard:
+			pathSegments[i] = fmt.Sprintf("{wildcard%d:[^/]+}", i)
+		case multiSegmentWildcard:
+			pathSegments[i] = fmt.Sprintf("{wildcard%d:.*}", i)
+		default:
+			pathSegments[i] = escapedPath(pathSegment)
+		}
+	}
+
+	return strings.Join(pathSegments, "/")
+}
+
+// registerAccessRules : Adds a route to the router for every access rule,
+// relaying matching requests through the provided handler. Routes are
+// registered in order of precedence so that the most specific rule matching a
+// request is the one applied, with every deny rule whose conditions the request
+// satisfies taking precedence over all allow rules. The allow rules for a path
+// and HTTP method share a route, and the routes are returned along with their
+// HTTP methods. The conditions of the rules are enforced as governed by the
+// routing options.
+func registerAccessRules(router *mux.Router, accessRules map[string][]accessRule, routing routingOptions, handler http.HandlerFunc) map[*mux.Route]string {
+	var accessRulesPaths []string = []string{}
+	for accessRulesPath := range accessRules {
+		accessRulesPaths = append(accessRulesPaths, accessRulesPath)
+	}
+
+	sort.Slice(accessRulesPaths, func(i, j int) bool {
+		precedenceI := accessRulePathPrecedence(accessRulesPaths[i])
+		precedenceJ := accessRulePathPrecedence(accessRulesPaths[j])
+		if precedenceI != precedenceJ {
+			return precedenceI < precedenceJ
+		}
+
+		// Longer path prefixes are more specific, so are matched first
+		if strings.HasPrefix(accessRulesPaths[i], prefixPathPrefix) && len(accessRulesPaths[i]) != len(accessRulesPaths[j]) {
+			return len(accessRulesPaths[i]) > len(accessRulesPaths[j])
+		}
+
+		return accessRulesPaths[i] < accessRulesPaths[j]
+	})
+
+	// Deny rules only match requests satisfying their conditions, leaving the
+	// others to be decided by the rules that follow
+	for _, accessRulesPath := range accessRulesPaths {
+		for _, rule := range accessRules[accessRulesPath] {
+			if rule.deny {
+				var denyingRule accessRule = rule
+				newAccessRuleRoute(router, rule).
+					MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+						return accessRuleApplies(denyingRule, routing, r)
+					}).
+					HandlerFunc(withAccessRule(rule, forbiddenRequestHandler))
+			}
+		}
+	}
+
+	var permittingRoutes map[*mux.Route]string = make(map[*mux.Route]string)
+	for _, accessRulesPath := range accessRulesPaths {
+		var permittingRules map[string][]accessRule = make(map[string][]accessRule)
+		var methods []string = []string{}
+		for _, rule := range accessRules[accessRulesPath] {
+			if !rule.deny {
+				if _, exists := permittingRules[rule.method]; !exists {
+					methods = append(methods, rule.method)
+				}
+
+				permittingRules[rule.method] = append(permittingRules[rule.method], rule)
+			}
+		}
+
+		for _, method := range methods {
+			var route *mux.Route = newAccessRuleRoute(router, permittingRules[method][0])
+			route.HandlerFunc(selectAccessRule(permittingRules[method], routing, handler))
+			permittingRoutes[route] = method
+		}
+	}
+
+	return permittingRoutes
+}
+
+// selectAccessRule : Returns a handler for requests matching the path and HTTP
+// method of the allow rules, which are tried in the order listed. A request is
+// passed on under the first rule whose conditions it satisfies, and is refused
+// as the first rule refuses it should it satisfy none of them.
+func selectAccessRule(rules []accessRule, routing routingOptions, handler http.HandlerFunc) http.HandlerFunc {
+	var ruleHandlers []http.HandlerFunc = []http.HandlerFunc{}
+	for _, rule := range rules {
+		ruleHandlers = append(ruleHandlers, withAccessRule(rule, enforceAccessRuleConditions(rule, routing, handler)))
+	}
+
+	if len(rules) == 1 {
+		return ruleHandlers[0]
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		for i, rule := range rules {
+			if accessRuleApplies(rule, routing, r) {
+				ruleHandlers[i](w, r)
+				return
+			}
+		}
+
+		ruleHandlers[0](w, r)
+	}
+}
+
+// accessRuleApplies : Tells whether the request satisfies the conditions of
+// the access rule on who makes it, what it carries and when it is made
+func accessRuleApplies(rule accessRule, routing routingOptions, r *http.Request) bool {
+	return requestConditionsSatisfied(rule, r) &&
+		(len(rule.timeWindows) == 0 || withinTimeWindows(rule.timeWindows, routing.now(), routing.timeWindowLocation))
+}
+
+// requestConditionsSatisfied : Tells whether the request satisfies every
+// condition of the access rule on the client's user and group IDs and common
+// name, and on the request's headers and query parameters
+func requestConditionsSatisfied(rule accessRule, r *http.Request) bool {
+	if len(rule.uids) > 0 || len(rule.gids) > 0 {
+		credentials, exists := peerCredentialsFromContext(r.Context())
+		if !exists ||
+			(len(rule.uids) > 0 && !containsID(rule.uids, credentials.uid)) ||
+			(len(rule.gids) > 0 && !containsID(rule.gids, credentials.gid)) {
+			return false
+		}
+	}
+
+	if len(rule.commonNames) > 0 && !funk.ContainsString(rule.commonNames, clientCommonName(r)) {
+		return false
+	}
+
+	for _, condition := range rule.headers {
+		if !condition.satisfiedBy(r.Header) {
+			return false
+		}
+	}
+
+	if len(rule.queryParameters) > 0 {
+		var query url.Values = r.URL.Query()
+		for _, condition := range rule.queryParameters {
+			if !condition.satisfiedBy(query) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// enforceAccessRuleConditions : Wraps a request handler such that requests
+// are only passed on if they satisfy every condition attached to the access
+// rule and are within its rate limit, and are refused otherwise. Requests
+// whose body does not conform to the rule's schema are refused last, so that
+// bodies are only buffered for requests that are otherwise allowed.
+func enforceAccessRuleConditions(rule accessRule, routing routingOptions, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requestConditionsSatisfied(rule, r) {
+			forbiddenRequestHandler(w, r)
+			return
+		}
+
+		if len(rule.timeWindows) > 0 && !withinTimeWindows(rule.timeWindows, routing.now(), routing.timeWindowLocation) {
+			outsideTimeWindowHandler(w, r, rule.timeWindows, routing.timeWindowLocation)
+			return
+		}
+
+		if len(rule.contentTypes) > 0 && !contentTypeAllowed(rule.contentTypes, r.Header) {
+			unsupportedMediaTypeHandler(w, r)
+			return
+		}
+
+		if rule.rateLimiter != nil && !rule.rateLimiter.Allow() {
+			rateLimitedRequestHandler(w, r)
+			return
+		}
+
+		if rule.schema != nil && !validateRequestBody(w, r, rule, routing.maxValidatedBodyBytes) {
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// newAccessRuleRoute : Adds a route to the router that matches requests
+// against the path and HTTP method type of the access rule
+func newAccessRuleRoute(router *mux.Router, rule accessRule) *mux.Route {
+	var route *mux.Route = router.NewRoute()
+	if rule.pathPattern != nil {
+		var pathPattern *regexp.Regexp = rule.pathPattern
+		route = route.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			return pathPattern.MatchString(r.URL.EscapedPath())
+		})
+	} else if strings.HasPrefix(rule.path, prefixPathPrefix) {
+		route = route.PathPrefix(escapedPath(strings.TrimPrefix(rule.path, prefixPathPrefix)))
+	} else {
+		route = route.Path(muxPathTemplate(rule.path))
+	}
+
+	return route.Methods(rule.method)
+}
+
+// withTrailingSlashVariants : Returns the access rules along with, for every
+// literal or wildcard rule path, a copy of its rules under the same path with
+// its trailing slash added or removed, so that both forms of a request path
+// match. Paths whose other form has rules of its own are left as they are.
+func withTrailingSlashVariants(accessRules map[string][]accessRule) map[string][]accessRule {
+	var expandedAccessRules map[string][]accessRule = make(map[string][]accessRule)
+	for accessRulesPath, accessRulesListForPath := range accessRules {
+		expandedAccessRules[accessRulesPath] = accessRulesListForPath
+	}
+
+	for accessRulesPath, accessRulesListForPath := range accessRules {
+		if accessRulesPath == "/" || strings.HasPrefix(accessRulesPath, regexpPathPrefix) || strings.HasPrefix(accessRulesPath, prefixPathPrefix) {
+			continue
+		}
+
+		var variantPath string = accessRulesPath + "/"
+		if strings.HasSuffix(accessRulesPath, "/") {
+			variantPath = strings.TrimSuffix(accessRulesPath, "/")
+		}
+
+		if _, exists := accessRules[variantPath]; exists || len(variantPath) == 0 {
+			continue
+		}
+
+		var variantRules []accessRule = []accessRule{}
+		for _, rule := range accessRulesListForPath {
+			rule.path = variantPath
+			variantRules = append(variantRules, rule)
+		}
+
+		expandedAccessRules[variantPath] = variantRules
+	}
+
+	return expandedAccessRules
+}
+
+// withImplicitHeadRules : Returns the access rules along with, for every path
+// with rules for GET but not HEAD, a copy of its GET rules for HEAD. Both
+// allowance and deny rules are copied, so that a HEAD request is decided just
+// as the equivalent GET request would be.
+func withImplicitHeadRules(accessRules map[string][]accessRule) map[string][]accessRule {
+	var expandedAccessRules map[string][]accessRule = make(map[string][]accessRule)
+	for accessRulesPath, accessRulesListForPath := range accessRules {
+		var hasHeadRule bool = false
+		for _, rule := range accessRulesListForPath {
+			if rule.method == http.MethodHead {
+				hasHeadRule = true
+			}
+		}
+
+		var expandedRules []accessRule = append([]accessRule{}, accessRulesListForPath...)
+		if !hasHeadRule {
+			for _, rule := range accessRulesListForPath {
+				if rule.method == http.MethodGet {
+					rule.method = http.MethodHead
+					expandedRules = append(expandedRules, rule)
+				}
+			}
+		}
+
+		expandedAccessRules[accessRulesPath] = expandedRules
+	}
+
+	return expandedAccessRules
+}
+
+// routingOptions : Settings that govern how requests are matched against the
+// access rules
+type routingOptions struct {
+	// strictTrailingSlash matches request paths only against rules that agree
+	// on the presence of a trailing slash
+	strictTrailingSlash bool
+
+	// defaultAllow relays requests that no access rule covers, rather than
+	// refusing them, leaving deny rules to refuse requests
+	defaultAllow bool
+
+	// implicitHead applies the rules for GET requests to HEAD requests, for
+	// paths without rules of their own for HEAD
+	implicitHead bool
+
+	// timeWindowLocation is the time zone in which the time windows of access
+	// rules are evaluated, which is UTC if nil
+	timeWindowLocation *time.Location
+
+	// now tells the time against which the time windows of access rules are
+	// evaluated, and is time.Now if nil
+	now func() time.Time
+
+	// maxValidatedBodyBytes bounds the request bodies buffered for validation
+	// against the schemas of access rules, and is DefaultMaxValidatedBodyBytes
+	// if zero
+	maxValidatedBodyBytes int64
+}
+
+// createAccessRulesRouter : Returns a router that relays requests permitted by
+// the access rules through the provided handler, as governed by the routing
+// options. Request paths are matched in their canonical escaped form.
+func createAccessRulesRouter(accessRules map[string][]accessRule, routing routingOptions, handler http.HandlerFunc) http.Handler {
+	if routing.implicitHead {
+		accessRules = withImplicitHeadRules(accessRules)
+	}
+
+	if !routing.strictTrailingSlash {
+		accessRules = withTrailingSlashVariants(accessRules)
+	}
+
+	incomingRequestRouter := mux.NewRouter().UseEncodedPath()
+	if routing.timeWindowLocation == nil {
+		routing.timeWindowLocation = time.UTC
+	}
+
+	if routing.now == nil {
+		routing.now = time.Now
+	}
+
+	if routing.maxValidatedBodyBytes == 0 {
+		routing.maxValidatedBodyBytes = DefaultMaxValidatedBodyBytes
+	}
+
+	permittingRoutes := registerAccessRules(incomingRequestRouter, accessRules, routing, handler)
+
+	incomingRequestRouter.MethodNotAllowedHandler = methodNotAllowedHandler(incomingRequestRouter, permittingRoutes)
+	incomingRequestRouter.NotFoundHandler = http.HandlerFunc(unknownRequestHandler)
+	if routing.defaultAllow {
+		incomingRequestRouter.MethodNotAllowedHandler = handler
+		incomingRequestRouter.NotFoundHandler = handler
+	}
+
+	return withCanonicalPath(incomingRequestRouter)
+}
+
+// AccessRules : A loaded access rules list, which can be consulted for the
+// access decisions it makes without relaying any requests
+type AccessRules struct {
+	rules   map[string][]accessRule
+	routing routingOptions
+	matcher http.Handler
+
+	// readPaths lists the files read to load the access rules, which are
+	// polled for changes when the access rules are watched
+	readPaths []string
+}
+
+// newAccessRules : Wraps the access rules, loaded from the files read, so that
+// they can be consulted, matching requests to rules as governed by the routing
+// options
+func newAccessRules(accessRules map[string][]accessRule, readPaths []string, routing routingOptions) *AccessRules {
+	return &AccessRules{
+		rules:     accessRules,
+		routing:   routing,
+		matcher:   createAccessRulesRouter(withoutRateLimits(accessRules), routing, matchedRequestHandler),
+		readPaths: readPaths,
+	}
+}
+
+// withoutRateLimits : Returns a copy of the access rules with their rate limits
+// removed, so that matching requests against them does not use up the tokens
+// of the requests actually relayed
+func withoutRateLimits(accessRules map[string][]accessRule) map[string][]accessRule {
+	var unlimitedRules map[string][]accessRule = make(map[string][]accessRule)
+	for rulePath, rules := range accessRules {
+		for _, rule := range rules {
+			rule.rateLimiter = nil
+			unlimitedRules[rulePath] = append(unlimitedRules[rulePath], rule)
+		}
+	}
+
+	return unlimitedRules
+}
+
+// LoadAccessRules : Loads the access rules list at the provided path in the
+// given format ("text", "json" or "yaml"), which is inferred from the file
+// extension if empty. Malformed text rules are skipped when lenient, and
+// otherwise cause an error. The fields of text rules are separated by
+// DefaultAccessRuleDelimiter.
+func LoadAccessRules(accessRulesFilepath string, format string, lenient bool) (*AccessRules, error) {
+	accessRules, readPaths, err := loadAccessRules(accessRulesFilepath, format, lenient, DefaultAccessRuleDelimiter, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAccessRules(accessRules, readPaths, routingOptions{}), nil
+}
+
+// Match : Returns the access decision (DecisionAllowed, DecisionForbidden or
+// DecisionNotFound) made for a request with the method and path. A rule
+// restricted to particular peer credentials, client certificates or request
+// headers forbids the request, as it carries none of them.
+func (accessRules *AccessRules) Match(method string, path string) string {
+	var request *http.Request = &http.Request{
+		Method: normalizeMethod(method),
+		URL:    &url.URL{Path: path},
+		Header: http.Header{},
+	}
+
+	request, outcome := withRequestOutcome(request)
+	accessRules.matcher.ServeHTTP(&discardingResponseWriter{header: http.Header{}}, request)
+
+	decision, _ := outcome.snapshot()
+	if len(decision) == 0 {
+		return DecisionNotFound
+	}
+
+	return decision
+}
+
+// matchedRequestHandler : Stands in for the relay when matching requests
+// against the access rules, recording that the request would be relayed
+func matchedRequestHandler(w http.ResponseWriter, r *http.Request) {
+	recordRequestDecision(r.Context(), DecisionAllowed)
+}
+
+// discardingResponseWriter : A response writer that drops everything written
+// to it
+type discardingResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardingResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardingResponseWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (w *discardingResponseWriter) WriteHeader(statusCode int) {}
+
+// SplitCommaSeparated : Splits a comma-separated value, such as that of an
+// access rule option or command-line flag, into its trimmed, non-empty elements
+func SplitCommaSeparated(value string) []string {
+	var elements []string = []string{}
+	for _, element := range strings.Split(value, ",") {
+		element = strings.TrimSpace(element)
+		if len(element) > 0 {
+			elements = append(elements, element)
+		}
+	}
+
+	return elements
+}
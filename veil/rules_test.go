@@ -0,0 +1,1221 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadTestAccessRules : Loads an access rules list with the given contents,
+// written in the text format
+func loadTestAccessRules(t *testing.T, contents string) map[string][]accessRule {
+	t.Helper()
+
+	var accessRulesPath string = filepath.Join(t.TempDir(), "rules.txt")
+	if err := os.WriteFile(accessRulesPath, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	accessRules, _, err := loadAccessRules(accessRulesPath, "", false, DefaultAccessRuleDelimiter, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return accessRules
+}
+
+// recordingTargetSocket : Starts a target socket that answers every request
+// with 200, returning its path along with the request URIs it receives
+func recordingTargetSocket(t *testing.T) (string, chan string) {
+	var requestURIs chan string = make(chan string, 16)
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestURIs <- r.RequestURI
+	}))
+
+	return targetSocketPath, requestURIs
+}
+
+// routingTestCase : A request routed through the access rules, along with the
+// status expected in response and the request URI expected to reach the
+// target socket, or none if the request should be refused
+type routingTestCase struct {
+	name                string
+	method              string
+	requestURI          string
+	expectedStatus      int
+	expectedUpstreamURI string
+
+	// header is sent with the request
+	header http.Header
+
+	// dryRun serves the request in dry-run mode
+	dryRun bool
+}
+
+// runRoutingTestCases : Routes each request through the access rules, written
+// in the text format, to a recording target socket, checking the status and
+// what reached the target
+func runRoutingTestCases(t *testing.T, accessRulesContents string, routing routingOptions, testCases []routingTestCase) {
+	t.Helper()
+
+	runLoadedRoutingTestCases(t, loadTestAccessRules(t, accessRulesContents), routing, testCases)
+}
+
+// runLoadedRoutingTestCases : Routes each request through the loaded access
+// rules as runRoutingTestCases does
+func runLoadedRoutingTestCases(t *testing.T, accessRules map[string][]accessRule, routing routingOptions, testCases []routingTestCase) {
+	t.Helper()
+
+	targetSocketPath, requestURIs := recordingTargetSocket(t)
+	var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{})
+	var router http.Handler = createAccessRulesRouter(accessRules, routing, relay)
+	var dryRunRouter http.Handler = withDryRun(relay, router)
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var method string = testCase.method
+			if len(method) == 0 {
+				method = http.MethodGet
+			}
+
+			var handler http.Handler = router
+			if testCase.dryRun {
+				handler = dryRunRouter
+			}
+
+			var request *http.Request = httptest.NewRequest(method, testCase.requestURI, nil)
+			copyHeaders(request.Header, testCase.header)
+
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if recorder.Code != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d: %s", testCase.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+
+			select {
+			case upstreamRequestURI := <-requestURIs:
+				if upstreamRequestURI != testCase.expectedUpstreamURI {
+					t.Errorf("expected the target socket to receive %q, got %q", testCase.expectedUpstreamURI, upstreamRequestURI)
+				}
+			default:
+				if len(testCase.expectedUpstreamURI) > 0 {
+					t.Errorf("expected the target socket to receive %q, but it received nothing", testCase.expectedUpstreamURI)
+				}
+			}
+		})
+	}
+}
+
+func TestWildcardRulesMatchRelayedPath(t *testing.T) {
+	runRoutingTestCases(t, "GET~/v2/**/conf\nGET~/v2/snaps/*\n!GET~/v2/snaps/secret\n", routingOptions{}, []routingTestCase{
+		{name: "multi-segment wildcard", requestURI: "/v2/a/b/conf", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/a/b/conf"},
+		{name: "single-segment wildcard", requestURI: "/v2/snaps/hello", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps/hello"},
+		{name: "encoded question mark", requestURI: "/v2/secret%3F/conf", expectedStatus: http.StatusBadRequest},
+		{name: "encoded hash", requestURI: "/v2/secret%23/conf", expectedStatus: http.StatusBadRequest},
+		{name: "encoded space", requestURI: "/v2/a%20b/conf", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/a%20b/conf"},
+		{name: "needlessly encoded letter", requestURI: "/v2/%61/conf", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/a/conf"},
+		{name: "deny rule with encoded letter", requestURI: "/v2/snaps/%73ecret", expectedStatus: http.StatusUnauthorized},
+		{name: "encoded slash", requestURI: "/v2/snaps/secret%2Fx", expectedStatus: http.StatusNotFound},
+	})
+}
+
+func TestRegexpRulesMatchRelayedPath(t *testing.T) {
+	runRoutingTestCases(t, "GET~re:^/api/.+/public$\n", routingOptions{}, []routingTestCase{
+		{name: "matching path", requestURI: "/api/docs/public", expectedStatus: http.StatusOK, expectedUpstreamURI: "/api/docs/public"},
+		{name: "encoded question mark", requestURI: "/api/private%3F/public", expectedStatus: http.StatusBadRequest},
+		{name: "encoded hash", requestURI: "/api/private%23/public", expectedStatus: http.StatusBadRequest},
+		{name: "encoded space", requestURI: "/api/a%20b/public", expectedStatus: http.StatusOK, expectedUpstreamURI: "/api/a%20b/public"},
+		{name: "non-matching path", requestURI: "/api/private", expectedStatus: http.StatusNotFound},
+	})
+}
+
+func TestPrefixRules(t *testing.T) {
+	// The more specific rules admit only a user that the test requests do not
+	// come from, so are seen to apply by refusing them
+	var accessRulesContents string = "GET~prefix:/v2/snaps/\n" +
+		"GET~/v2/snaps/core~uid=4242\n" +
+		"GET~prefix:/v2/snaps/private/~uid=4242\n"
+
+	runRoutingTestCases(t, accessRulesContents, routingOptions{}, []routingTestCase{
+		{name: "direct child", requestURI: "/v2/snaps/hello", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps/hello"},
+		{name: "nested descendant", requestURI: "/v2/snaps/hello/conf", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps/hello/conf"},
+		{name: "prefix itself", requestURI: "/v2/snaps/", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps/"},
+		{name: "query string", requestURI: "/v2/snaps/hello?select=all", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps/hello?select=all"},
+		{name: "exact rule within the subtree", requestURI: "/v2/snaps/core", expectedStatus: http.StatusUnauthorized},
+		{name: "longer prefix within the subtree", requestURI: "/v2/snaps/private/key", expectedStatus: http.StatusUnauthorized},
+		{name: "sibling of the exact rule", requestURI: "/v2/snaps/core2", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps/core2"},
+		{name: "sibling path", requestURI: "/v2/snapshots", expectedStatus: http.StatusNotFound},
+		{name: "sibling subtree", requestURI: "/v2/snapshots/hello", expectedStatus: http.StatusNotFound},
+		{name: "parent path", requestURI: "/v2", expectedStatus: http.StatusNotFound},
+		{name: "unlisted method", method: http.MethodPost, requestURI: "/v2/snaps/hello", expectedStatus: http.StatusMethodNotAllowed},
+	})
+}
+
+func TestPrefixRulesRejected(t *testing.T) {
+	var accessRulesPath string = filepath.Join(t.TempDir(), "rules.txt")
+	if err := os.WriteFile(accessRulesPath, []byte("GET~prefix:v2/snaps/\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := loadAccessRules(accessRulesPath, "", false, DefaultAccessRuleDelimiter, nil); err == nil || !strings.Contains(err.Error(), "must begin with") {
+		t.Errorf("expected a prefix without a leading slash to be rejected, got %v", err)
+	}
+}
+
+func TestRewrittenPathsStayEscaped(t *testing.T) {
+	var accessRulesContents string = "GET~/v2/snaps~rewrite=/api/v2/snaps\n" +
+		"GET~/v2/spaced~rewrite=/api/with space\n" +
+		"GET~prefix:/v1/~rewrite=/api/v1/\n" +
+		"GET~re:^/v3/([^/]+)/conf$~rewrite=/api/v3/$1/config\n"
+
+	runRoutingTestCases(t, accessRulesContents, routingOptions{}, []routingTestCase{
+		{name: "literal rewrite", requestURI: "/v2/snaps?select=all", expectedStatus: http.StatusOK, expectedUpstreamURI: "/api/v2/snaps?select=all"},
+		{name: "literal rewrite needing escapes", requestURI: "/v2/spaced", expectedStatus: http.StatusOK, expectedUpstreamURI: "/api/with%20space"},
+		{name: "prefix rewrite", requestURI: "/v1/snaps/core", expectedStatus: http.StatusOK, expectedUpstreamURI: "/api/v1/snaps/core"},
+		{name: "prefix rewrite keeps escapes", requestURI: "/v1/a%20b", expectedStatus: http.StatusOK, expectedUpstreamURI: "/api/v1/a%20b"},
+		{name: "prefix rewrite with encoded question mark", requestURI: "/v1/secret%3F/x", expectedStatus: http.StatusBadRequest},
+		{name: "regexp rewrite", requestURI: "/v3/core/conf", expectedStatus: http.StatusOK, expectedUpstreamURI: "/api/v3/core/config"},
+		{name: "regexp rewrite keeps escapes", requestURI: "/v3/a%20b/conf", expectedStatus: http.StatusOK, expectedUpstreamURI: "/api/v3/a%20b/config"},
+	})
+}
+
+func TestRewrittenRequestsRelayResponse(t *testing.T) {
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream-Path", r.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, "relayed ", r.URL.Path)
+	}))
+
+	var accessRulesContents string = "GET~prefix:/v2/~rewrite=/api/v2/\nGET~re:^/v3/([^/]+)/conf$~rewrite=/api/v3/$1/config\n"
+	var router http.Handler = createAccessRulesRouter(loadTestAccessRules(t, accessRulesContents), routingOptions{}, newTestRelay([]string{targetSocketPath}, relayOptions{}))
+
+	testCases := []struct {
+		requestURI   string
+		upstreamPath string
+	}{
+		{requestURI: "/v2/snaps", upstreamPath: "/api/v2/snaps"},
+		{requestURI: "/v3/core/conf", upstreamPath: "/api/v3/core/config"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.requestURI, func(t *testing.T) {
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, testCase.requestURI, nil))
+			if recorder.Code != http.StatusAccepted {
+				t.Errorf("expected status 202, got %d", recorder.Code)
+			}
+
+			if upstreamPath := recorder.Header().Get("X-Upstream-Path"); upstreamPath != testCase.upstreamPath {
+				t.Errorf("expected the response header %q, got %q", testCase.upstreamPath, upstreamPath)
+			}
+
+			if expectedBody := "relayed " + testCase.upstreamPath; recorder.Body.String() != expectedBody {
+				t.Errorf("expected the body %q, got %q", expectedBody, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestTrailingSlashNormalized(t *testing.T) {
+	var accessRulesContents string = "GET~/v2/snaps\nGET~/v2/apps/\nGET~/v2/snaps/*/conf\nGET~/v2/find\n!GET~/v2/find/\n"
+	runRoutingTestCases(t, accessRulesContents, routingOptions{}, []routingTestCase{
+		{name: "rule without slash, request without", requestURI: "/v2/snaps", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps"},
+		{name: "rule without slash, request with", requestURI: "/v2/snaps/", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps/"},
+		{name: "rule with slash, request with", requestURI: "/v2/apps/", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/apps/"},
+		{name: "rule with slash, request without", requestURI: "/v2/apps", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/apps"},
+		{name: "wildcard rule, request with", requestURI: "/v2/snaps/core/conf/", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps/core/conf/"},
+		{name: "query string kept", requestURI: "/v2/snaps/?select=all", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps/?select=all"},
+		{name: "both forms with rules of their own, without slash", requestURI: "/v2/find", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/find"},
+		{name: "both forms with rules of their own, with slash", requestURI: "/v2/find/", expectedStatus: http.StatusUnauthorized},
+	})
+}
+
+func TestTrailingSlashStrict(t *testing.T) {
+	runRoutingTestCases(t, "GET~/v2/snaps\nGET~/v2/apps/\n", routingOptions{strictTrailingSlash: true}, []routingTestCase{
+		{name: "rule without slash, request without", requestURI: "/v2/snaps", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps"},
+		{name: "rule without slash, request with", requestURI: "/v2/snaps/", expectedStatus: http.StatusNotFound},
+		{name: "rule with slash, request with", requestURI: "/v2/apps/", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/apps/"},
+		{name: "rule with slash, request without", requestURI: "/v2/apps", expectedStatus: http.StatusNotFound},
+	})
+}
+
+func TestRuleRateLimit(t *testing.T) {
+	runRoutingTestCases(t, "GET~/v2/find~rate=2/h\n", routingOptions{}, []routingTestCase{
+		{name: "first request in burst", requestURI: "/v2/find", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/find"},
+		{name: "second request in burst", requestURI: "/v2/find", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/find"},
+		{name: "request beyond limit", requestURI: "/v2/find", expectedStatus: http.StatusTooManyRequests},
+		{name: "request beyond limit in dry-run mode", requestURI: "/v2/find", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/find", dryRun: true},
+	})
+}
+
+func TestRuleTimeouts(t *testing.T) {
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}))
+
+	var accessRulesContents string = "GET~/v2/snaps~timeout=50ms\nGET~/v2/find~50ms\nGET~/v2/apps\nPOST~/v2/snaps~timeout=5s\n"
+	var router http.Handler = createAccessRulesRouter(loadTestAccessRules(t, accessRulesContents), routingOptions{}, newTestRelay([]string{targetSocketPath}, relayOptions{requestTimeout: 100 * time.Millisecond}))
+
+	testCases := []struct {
+		name           string
+		method         string
+		requestURI     string
+		expectedStatus int
+	}{
+		{name: "timeout option shorter than response", method: http.MethodGet, requestURI: "/v2/snaps", expectedStatus: http.StatusGatewayTimeout},
+		{name: "bare timeout shorter than response", method: http.MethodGet, requestURI: "/v2/find", expectedStatus: http.StatusGatewayTimeout},
+		{name: "default timeout shorter than response", method: http.MethodGet, requestURI: "/v2/apps", expectedStatus: http.StatusGatewayTimeout},
+		{name: "timeout option longer than response", method: http.MethodPost, requestURI: "/v2/snaps", expectedStatus: http.StatusOK},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(testCase.method, testCase.requestURI, nil))
+			if recorder.Code != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d", testCase.expectedStatus, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestWildcardMethodRules(t *testing.T) {
+	runRoutingTestCases(t, "*~/v2/debug\nANY~/v2/any\n", routingOptions{}, []routingTestCase{
+		{name: "GET with *", method: http.MethodGet, requestURI: "/v2/debug", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/debug"},
+		{name: "POST with *", method: http.MethodPost, requestURI: "/v2/debug", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/debug"},
+		{name: "DELETE with *", method: http.MethodDelete, requestURI: "/v2/debug", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/debug"},
+		{name: "PATCH with ANY", method: http.MethodPatch, requestURI: "/v2/any", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/any"},
+		{name: "PUT with ANY", method: http.MethodPut, requestURI: "/v2/any", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/any"},
+		{name: "other path", method: http.MethodGet, requestURI: "/v2/snaps", expectedStatus: http.StatusNotFound},
+	})
+}
+
+func TestDenyRules(t *testing.T) {
+	var accessRulesContents string = "GET~/v2/snaps/*\n!GET~/v2/snaps/core\n*~/v2/debug\n!DELETE~/v2/debug\n!GET~/v2/unlisted\n"
+	runRoutingTestCases(t, accessRulesContents, routingOptions{}, []routingTestCase{
+		{name: "allowed by wildcard", requestURI: "/v2/snaps/hello", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps/hello"},
+		{name: "denied despite wildcard", requestURI: "/v2/snaps/core", expectedStatus: http.StatusUnauthorized},
+		{name: "method allowed by *", method: http.MethodPost, requestURI: "/v2/debug", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/debug"},
+		{name: "method denied despite *", method: http.MethodDelete, requestURI: "/v2/debug", expectedStatus: http.StatusUnauthorized},
+		{name: "denied without allowance", requestURI: "/v2/unlisted", expectedStatus: http.StatusUnauthorized},
+		{name: "denied in dry-run mode", requestURI: "/v2/snaps/core", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps/core", dryRun: true},
+	})
+}
+
+func TestStripRuleComment(t *testing.T) {
+	testCases := []struct {
+		line         string
+		expectedRule string
+	}{
+		{line: "GET~/v2/snaps", expectedRule: "GET~/v2/snaps"},
+		{line: "# GET~/v2/snaps", expectedRule: ""},
+		{line: "   ", expectedRule: ""},
+		{line: "GET~/v2/snaps # used by the dashboard", expectedRule: "GET~/v2/snaps"},
+		{line: "GET~/v2/snaps\t# used by the dashboard", expectedRule: "GET~/v2/snaps"},
+		{line: "GET~/v2/a#b", expectedRule: "GET~/v2/a#b"},
+		{line: "GET~/v2/a#b # with a comment", expectedRule: "GET~/v2/a#b"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.line, func(t *testing.T) {
+			if rule := stripRuleComment(testCase.line); rule != testCase.expectedRule {
+				t.Errorf("expected %q, got %q", testCase.expectedRule, rule)
+			}
+		})
+	}
+}
+
+func TestCommentsAndBlankLinesIgnored(t *testing.T) {
+	var accessRulesContents string = "# snapd rules\n\n   \nGET~/v2/snaps # used by the dashboard\n\t# GET~/v2/apps\nPOST~/v2/snaps\n"
+	runRoutingTestCases(t, accessRulesContents, routingOptions{}, []routingTestCase{
+		{name: "rule followed by comment", requestURI: "/v2/snaps", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps"},
+		{name: "rule after blank lines", method: http.MethodPost, requestURI: "/v2/snaps", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps"},
+		{name: "commented-out rule", requestURI: "/v2/apps", expectedStatus: http.StatusNotFound},
+	})
+}
+
+func TestStructuredAccessRules(t *testing.T) {
+	const jsonRules string = `[
+  {"method": "GET", "path": "/v2/snaps"},
+  {"method": "post", "path": "/v2/snaps", "timeout": "300s"},
+  {"method": "DELETE", "path": "/v2/snaps/*"},
+  {"method": "DELETE", "path": "/v2/snaps/core", "deny": true}
+]`
+	const yamlListRules string = `- method: GET
+  path: /v2/snaps
+- method: post
+  path: /v2/snaps
+  timeout: 300s
+- method: DELETE
+  path: /v2/snaps/*
+- method: DELETE
+  path: /v2/snaps/core
+  deny: true
+`
+	const yamlMapRules string = `# Read and remove snaps, except core
+/v2/snaps:
+  - GET
+  - post
+/v2/snaps/*:
+  - DELETE
+/v2/snaps/core:
+  - "!DELETE"
+`
+
+	testCases := []struct {
+		name     string
+		fileName string
+		format   string
+		contents string
+	}{
+		{name: "JSON by extension", fileName: "rules.json", contents: jsonRules},
+		{name: "JSON by format", fileName: "rules.conf", format: "json", contents: jsonRules},
+		{name: "YAML list by extension", fileName: "rules.yaml", contents: yamlListRules},
+		{name: "YAML list by short extension", fileName: "rules.yml", contents: yamlListRules},
+		{name: "YAML map by extension", fileName: "rules.yaml", contents: yamlMapRules},
+		{name: "YAML map by format", fileName: "rules.conf", format: "yaml", contents: yamlMapRules},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var accessRulesPath string = filepath.Join(t.TempDir(), testCase.fileName)
+			if err := os.WriteFile(accessRulesPath, []byte(testCase.contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			accessRules, _, err := loadAccessRules(accessRulesPath, testCase.format, false, DefaultAccessRuleDelimiter, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			runLoadedRoutingTestCases(t, accessRules, routingOptions{}, []routingTestCase{
+				{name: "allowed GET", requestURI: "/v2/snaps", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps"},
+				{name: "allowed POST", method: http.MethodPost, requestURI: "/v2/snaps", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps"},
+				{name: "allowed wildcard DELETE", method: http.MethodDelete, requestURI: "/v2/snaps/hello", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps/hello"},
+				{name: "denied DELETE", method: http.MethodDelete, requestURI: "/v2/snaps/core", expectedStatus: http.StatusUnauthorized},
+				{name: "unlisted path", requestURI: "/v2/apps", expectedStatus: http.StatusNotFound},
+			})
+		})
+	}
+}
+
+func TestStructuredAccessRulesRejected(t *testing.T) {
+	testCases := []struct {
+		name     string
+		fileName string
+		contents string
+	}{
+		{name: "JSON unknown field", fileName: "rules.json", contents: `[{"method": "GET", "path": "/v2/snaps", "paths": ["/v2/apps"]}]`},
+		{name: "JSON unknown method", fileName: "rules.json", contents: `[{"method": "FETCH", "path": "/v2/snaps"}]`},
+		{name: "JSON missing path", fileName: "rules.json", contents: `[{"method": "GET"}]`},
+		{name: "JSON syntax error", fileName: "rules.json", contents: `[{"method": "GET", "path": "/v2/snaps"}`},
+		{name: "YAML unknown method", fileName: "rules.yaml", contents: "/v2/snaps:\n  - FETCH\n"},
+		{name: "YAML unknown field", fileName: "rules.yaml", contents: "- method: GET\n  path: /v2/snaps\n  paths: [/v2/apps]\n"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var accessRulesPath string = filepath.Join(t.TempDir(), testCase.fileName)
+			if err := os.WriteFile(accessRulesPath, []byte(testCase.contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, err := loadAccessRules(accessRulesPath, "", false, DefaultAccessRuleDelimiter, nil); err == nil {
+				t.Fatal("expected the access rules to be rejected")
+			}
+		})
+	}
+}
+
+func TestAccessRulesValidation(t *testing.T) {
+	testCases := []struct {
+		name            string
+		malformedLine   string
+		expectedProblem string
+	}{
+		{name: "unknown method", malformedLine: "GZT~/v2/snaps", expectedProblem: `unsupported HTTP method "GZT"`},
+		{name: "single field", malformedLine: "GET", expectedProblem: "expected at least 2"},
+		{name: "empty method", malformedLine: "~/v2/snaps", expectedProblem: "missing HTTP method"},
+		{name: "empty path", malformedLine: "GET~", expectedProblem: "missing request path"},
+		{name: "include without path", malformedLine: "include", expectedProblem: "expected a single path to include"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var accessRulesPath string = filepath.Join(t.TempDir(), "rules.txt")
+			var contents string = "GET~/v2/apps\n\n" + testCase.malformedLine + "\nGZT~/v2/apps\n"
+			if err := os.WriteFile(accessRulesPath, []byte(contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err := loadAccessRules(accessRulesPath, "", false, DefaultAccessRuleDelimiter, nil)
+			var invalidRulesErr *invalidAccessRulesError
+			if !errors.As(err, &invalidRulesErr) {
+				t.Fatalf("expected the malformed lines to be reported, got %v", err)
+			}
+
+			// Every malformed line is reported with its line number, not just the first
+			if len(invalidRulesErr.problems) != 2 {
+				t.Fatalf("expected 2 problems, got %q", invalidRulesErr.problems)
+			}
+			if !strings.Contains(invalidRulesErr.problems[0], "line 3") || !strings.Contains(invalidRulesErr.problems[0], testCase.expectedProblem) {
+				t.Errorf("expected line 3 to be reported with %q, got %q", testCase.expectedProblem, invalidRulesErr.problems[0])
+			}
+			if !strings.Contains(invalidRulesErr.problems[1], "line 4") {
+				t.Errorf("expected line 4 to be reported, got %q", invalidRulesErr.problems[1])
+			}
+
+			accessRules, _, err := loadAccessRules(accessRulesPath, "", true, DefaultAccessRuleDelimiter, nil)
+			if err != nil {
+				t.Fatalf("expected lenient loading to skip the malformed lines, got %v", err)
+			}
+
+			runLoadedRoutingTestCases(t, accessRules, routingOptions{}, []routingTestCase{
+				{name: "valid rule kept", requestURI: "/v2/apps", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/apps"},
+				{name: "malformed rule skipped", requestURI: "/v2/snaps", expectedStatus: http.StatusNotFound},
+			})
+		})
+	}
+}
+
+func TestMethodCaseInsensitive(t *testing.T) {
+	for _, method := range []string{"get", "Get", "GET", " gEt "} {
+		t.Run(method, func(t *testing.T) {
+			runRoutingTestCases(t, method+"~/v2/snaps\n", routingOptions{}, []routingTestCase{
+				{name: "GET", requestURI: "/v2/snaps", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps"},
+				{name: "POST", method: http.MethodPost, requestURI: "/v2/snaps", expectedStatus: http.StatusMethodNotAllowed},
+			})
+		})
+	}
+
+	for _, method := range []string{"GZT", "gzt", "GET2"} {
+		t.Run(method, func(t *testing.T) {
+			if _, err := parseAccessRule(method+"~/v2/snaps", DefaultAccessRuleDelimiter, nil); err == nil {
+				t.Fatalf("expected %q to be rejected as an HTTP method", method)
+			}
+		})
+	}
+}
+
+func TestMethodAliases(t *testing.T) {
+	testCases := []struct {
+		name             string
+		aliases          map[string][]string
+		contents         string
+		expectedContents string
+	}{
+		{name: "READ", contents: "READ~/v2/snaps\n", expectedContents: "GET~/v2/snaps\nHEAD~/v2/snaps\n"},
+		{name: "WRITE", contents: "write~/v2/snaps~uid=0\n", expectedContents: "POST~/v2/snaps~uid=0\nPUT~/v2/snaps~uid=0\nPATCH~/v2/snaps~uid=0\nDELETE~/v2/snaps~uid=0\n"},
+		{name: "denied alias", contents: "*~/v2/snaps\n!WRITE~/v2/snaps\n", expectedContents: "*~/v2/snaps\n!POST~/v2/snaps\n!PUT~/v2/snaps\n!PATCH~/v2/snaps\n!DELETE~/v2/snaps\n"},
+		{name: "custom alias", aliases: map[string][]string{"inspect": {"get", "DELETE"}}, contents: "INSPECT~/v2/snaps\n", expectedContents: "GET~/v2/snaps\nDELETE~/v2/snaps\n"},
+		{name: "redefined built-in alias", aliases: map[string][]string{"READ": {"GET"}}, contents: "READ~/v2/snaps\n", expectedContents: "GET~/v2/snaps\n"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			aliases, err := validateMethodAliases(testCase.aliases, DefaultAccessRuleDelimiter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var accessRulesPath string = filepath.Join(t.TempDir(), "rules.txt")
+			if err := os.WriteFile(accessRulesPath, []byte(testCase.contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			accessRules, _, err := loadAccessRules(accessRulesPath, "", false, DefaultAccessRuleDelimiter, aliases)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expectedAccessRules := loadTestAccessRules(t, testCase.expectedContents); !reflect.DeepEqual(accessRules, expectedAccessRules) {
+				t.Errorf("expected %+v, got %+v", expectedAccessRules, accessRules)
+			}
+		})
+	}
+}
+
+func TestMethodAliasesRejected(t *testing.T) {
+	testCases := []struct {
+		name    string
+		aliases map[string][]string
+	}{
+		{name: "HTTP method name", aliases: map[string][]string{"get": {"GET", "HEAD"}}},
+		{name: "wildcard name", aliases: map[string][]string{"ANY": {"GET"}}},
+		{name: "empty name", aliases: map[string][]string{"": {"GET"}}},
+		{name: "deny prefix in name", aliases: map[string][]string{"!READ": {"GET"}}},
+		{name: "delimiter in name", aliases: map[string][]string{"RE~AD": {"GET"}}},
+		{name: "no methods", aliases: map[string][]string{"NOTHING": {}}},
+		{name: "unsupported method", aliases: map[string][]string{"FETCH": {"GET", "FETCH"}}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if _, err := validateMethodAliases(testCase.aliases, DefaultAccessRuleDelimiter); err == nil {
+				t.Error("expected the method aliases to be rejected")
+			}
+		})
+	}
+
+	// Only defined aliases may be used in rules
+	if _, err := parseAccessRule("INSPECT~/v2/snaps", DefaultAccessRuleDelimiter, nil); err == nil {
+		t.Error("expected an undefined alias to be rejected")
+	}
+}
+
+func TestAccessRuleDelimiter(t *testing.T) {
+	var expectedAccessRules map[string][]accessRule = loadTestAccessRules(t, "GET~/v2/snaps\n!DELETE~/v2/snaps/*~uid=1000\nPOST~/v2/apps~timeout=5s\n")
+
+	testCases := []struct {
+		name      string
+		delimiter string
+		contents  string
+	}{
+		{name: "pipe", delimiter: "|", contents: "GET|/v2/snaps\n!DELETE|/v2/snaps/*|uid=1000\nPOST|/v2/apps|timeout=5s\n"},
+		{name: "semicolon", delimiter: ";", contents: "GET;/v2/snaps\n!DELETE;/v2/snaps/*;uid=1000\nPOST;/v2/apps;timeout=5s\n"},
+		{name: "tab", delimiter: "\t", contents: "GET\t/v2/snaps\n!DELETE\t/v2/snaps/*\tuid=1000\nPOST\t/v2/apps\ttimeout=5s\n"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var accessRulesPath string = filepath.Join(t.TempDir(), "rules.txt")
+			if err := os.WriteFile(accessRulesPath, []byte(testCase.contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			accessRules, _, err := loadAccessRules(accessRulesPath, "", false, testCase.delimiter, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(accessRules, expectedAccessRules) {
+				t.Errorf("expected the same rules as with %q, got %+v", DefaultAccessRuleDelimiter, accessRules)
+			}
+		})
+	}
+}
+
+func TestAccessRuleDelimiterRejected(t *testing.T) {
+	for _, delimiter := range []string{"", "~~", "::", "G", "e", "!", "#", "*"} {
+		t.Run(strconv.Quote(delimiter), func(t *testing.T) {
+			if err := validateAccessRuleDelimiter(delimiter); err == nil {
+				t.Errorf("expected the delimiter %q to be rejected", delimiter)
+			}
+		})
+	}
+
+	for _, delimiter := range []string{DefaultAccessRuleDelimiter, "|", ";", ",", " ", "\t"} {
+		t.Run(strconv.Quote(delimiter), func(t *testing.T) {
+			if err := validateAccessRuleDelimiter(delimiter); err != nil {
+				t.Errorf("expected the delimiter %q to be accepted, got %v", delimiter, err)
+			}
+		})
+	}
+}
+
+func TestWhitespaceSeparatedRules(t *testing.T) {
+	var expectedAccessRules map[string][]accessRule = loadTestAccessRules(t, "GET~/v2/snaps\n!DELETE~/v2/snaps/*~uid=1000\nPOST~/v2/apps~timeout=5s\n")
+
+	testCases := []struct {
+		name     string
+		contents string
+	}{
+		{name: "single space", contents: "GET /v2/snaps\n!DELETE /v2/snaps/* uid=1000\nPOST /v2/apps timeout=5s\n"},
+		{name: "multiple spaces", contents: "GET    /v2/snaps\n!DELETE  /v2/snaps/*   uid=1000\nPOST /v2/apps     timeout=5s\n"},
+		{name: "tabs", contents: "GET\t/v2/snaps\n!DELETE\t\t/v2/snaps/*\tuid=1000\nPOST\t/v2/apps\t\ttimeout=5s\n"},
+		{name: "mixed spaces and tabs", contents: "GET \t /v2/snaps\n!DELETE\t /v2/snaps/* \tuid=1000\nPOST  \t/v2/apps\t timeout=5s\n"},
+		{name: "mixed with the delimited form", contents: "GET /v2/snaps\n!DELETE~/v2/snaps/*~uid=1000\nPOST\t/v2/apps\ttimeout=5s\n"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if accessRules := loadTestAccessRules(t, testCase.contents); !reflect.DeepEqual(accessRules, expectedAccessRules) {
+				t.Errorf("expected the same rules as the delimited form, got %+v", accessRules)
+			}
+		})
+	}
+
+	// The delimiter may then appear within the path
+	if accessRules := loadTestAccessRules(t, "GET /home/~user\n"); len(accessRules["/home/~user"]) != 1 {
+		t.Errorf("expected a rule for /home/~user, got %+v", accessRules)
+	}
+}
+
+// writeTestAccessRulesFiles : Writes each access rules file, named relative to
+// the directory, returning the directory
+func writeTestAccessRulesFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	var accessRulesDirectory string = t.TempDir()
+	for name, contents := range files {
+		var accessRulesPath string = filepath.Join(accessRulesDirectory, name)
+		if err := os.MkdirAll(filepath.Dir(accessRulesPath), 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(accessRulesPath, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return accessRulesDirectory
+}
+
+func TestAccessRulesDirectory(t *testing.T) {
+	var accessRulesDirectory string = writeTestAccessRulesFiles(t, map[string]string{
+		"10-snaps.conf": "GET~/v2/snaps\nGET~/v2/apps\n",
+		"20-apps.conf":  "POST~/v2/apps\n!GET~/v2/snaps/core\nGET~/v2/snaps/*\n",
+		// Repeats a rule of an earlier fragment, which is kept in its place
+		"30-repeat.conf": "GET~/v2/apps~timeout=1ms\n",
+		// Rules with other conditions for the same path are not repetitions
+		"40-scoped.conf": "GET~/v2/logs~uid=4242\n",
+		"50-scoped.conf": "GET~/v2/logs~header=X-Debug\n",
+		"notes.txt":      "GET~/v2/notes\n",
+	})
+
+	accessRules, _, err := loadAccessRules(accessRulesDirectory, "", false, DefaultAccessRuleDelimiter, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runLoadedRoutingTestCases(t, accessRules, routingOptions{}, []routingTestCase{
+		{name: "rule of the first fragment", requestURI: "/v2/snaps", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps"},
+		{name: "rule of the second fragment", requestURI: "/v2/snaps/hello", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps/hello"},
+		{name: "method added by a later fragment", method: http.MethodPost, requestURI: "/v2/apps", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/apps"},
+		{name: "repeated rule keeps the earlier one", requestURI: "/v2/apps", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/apps"},
+		{name: "deny rule of a later fragment", requestURI: "/v2/snaps/core", expectedStatus: http.StatusUnauthorized},
+		{name: "rule of another condition", requestURI: "/v2/logs", header: http.Header{"X-Debug": {"1"}}, expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/logs"},
+		{name: "conditions of neither rule", requestURI: "/v2/logs", expectedStatus: http.StatusUnauthorized},
+		{name: "file that is not a fragment", requestURI: "/v2/notes", expectedStatus: http.StatusNotFound},
+	})
+}
+
+func TestAccessRulesDirectoryRejected(t *testing.T) {
+	var accessRulesDirectory string = writeTestAccessRulesFiles(t, map[string]string{
+		"10-snaps.conf":  "GET~/v2/snaps\n",
+		"20-broken.conf": "GET\n",
+	})
+
+	_, _, err := loadAccessRules(accessRulesDirectory, "", false, DefaultAccessRuleDelimiter, nil)
+	if err == nil || !strings.Contains(err.Error(), "20-broken.conf") {
+		t.Errorf("expected the malformed fragment to be reported, got %v", err)
+	}
+}
+
+func TestAccessRulesInclude(t *testing.T) {
+	var accessRulesDirectory string = writeTestAccessRulesFiles(t, map[string]string{
+		"rules.txt":                "GET~/v2/snaps\ninclude shared/apps.conf\n",
+		"shared/apps.conf":         "POST~/v2/apps\ninclude nested/debug.conf\n",
+		"shared/nested/debug.conf": "GET~/v2/debug\n",
+	})
+
+	accessRules, _, err := loadAccessRules(filepath.Join(accessRulesDirectory, "rules.txt"), "", false, DefaultAccessRuleDelimiter, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runLoadedRoutingTestCases(t, accessRules, routingOptions{}, []routingTestCase{
+		{name: "rule of the including file", requestURI: "/v2/snaps", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps"},
+		{name: "rule of an included file", method: http.MethodPost, requestURI: "/v2/apps", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/apps"},
+		{name: "rule of a nested include", requestURI: "/v2/debug", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/debug"},
+	})
+}
+
+func TestAccessRulesIncludeRejected(t *testing.T) {
+	testCases := []struct {
+		name          string
+		files         map[string]string
+		expectedError string
+	}{
+		{
+			name:          "includes itself",
+			files:         map[string]string{"rules.txt": "GET~/v2/snaps\ninclude rules.txt\n"},
+			expectedError: "include cycle",
+		},
+		{
+			name:          "cycle through another file",
+			files:         map[string]string{"rules.txt": "include a.conf\n", "a.conf": "include b.conf\n", "b.conf": "include a.conf\n"},
+			expectedError: "include cycle",
+		},
+		{
+			name:          "missing file",
+			files:         map[string]string{"rules.txt": "include missing.conf\n"},
+			expectedError: "missing.conf",
+		},
+		{
+			name:          "more than one path",
+			files:         map[string]string{"rules.txt": "include a.conf b.conf\n", "a.conf": "GET~/v2/snaps\n", "b.conf": "GET~/v2/apps\n"},
+			expectedError: "expected a single path to include",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var accessRulesPath string = filepath.Join(writeTestAccessRulesFiles(t, testCase.files), "rules.txt")
+			_, _, err := loadAccessRules(accessRulesPath, "", false, DefaultAccessRuleDelimiter, nil)
+			if err == nil || !strings.Contains(err.Error(), testCase.expectedError) {
+				t.Errorf("expected an error containing %q, got %v", testCase.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestDefaultAllow(t *testing.T) {
+	var accessRulesContents string = "!GET~/v2/snaps/core\n!*~/v2/debug\nGET~/v2/apps~uid=4242\n"
+	runRoutingTestCases(t, accessRulesContents, routingOptions{defaultAllow: true}, []routingTestCase{
+		{name: "unlisted path", requestURI: "/v2/snaps", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps"},
+		{name: "unlisted method on a denied path", method: http.MethodPost, requestURI: "/v2/snaps/core", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps/core"},
+		{name: "denied path", requestURI: "/v2/snaps/core", expectedStatus: http.StatusUnauthorized},
+		{name: "path denied for every method", method: http.MethodDelete, requestURI: "/v2/debug", expectedStatus: http.StatusUnauthorized},
+		{name: "allowance rule still applies its options", requestURI: "/v2/apps", expectedStatus: http.StatusUnauthorized},
+	})
+
+	runRoutingTestCases(t, accessRulesContents, routingOptions{}, []routingTestCase{
+		{name: "unlisted path without default-allow", requestURI: "/v2/snaps", expectedStatus: http.StatusNotFound},
+	})
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	targetSocketPath, _ := recordingTargetSocket(t)
+	var accessRules map[string][]accessRule = loadTestAccessRules(t, "GET~/v2/snaps\nPOST~/v2/snaps\n!DELETE~/v2/snaps\nPUT~/v2/snaps/*\nGET~/v2/snaps/core\n")
+	var router http.Handler = createAccessRulesRouter(accessRules, routingOptions{}, newTestRelay([]string{targetSocketPath}, relayOptions{}))
+
+	testCases := []struct {
+		name           string
+		method         string
+		requestURI     string
+		expectedStatus int
+		expectedAllow  string
+	}{
+		{name: "methods of a literal path", method: http.MethodPatch, requestURI: "/v2/snaps", expectedStatus: http.StatusMethodNotAllowed, expectedAllow: "GET, POST"},
+		{name: "methods of a wildcard path", method: http.MethodGet, requestURI: "/v2/snaps/hello", expectedStatus: http.StatusMethodNotAllowed, expectedAllow: "PUT"},
+		{name: "methods of overlapping paths", method: http.MethodPost, requestURI: "/v2/snaps/core", expectedStatus: http.StatusMethodNotAllowed, expectedAllow: "GET, PUT"},
+		{name: "denied method", method: http.MethodDelete, requestURI: "/v2/snaps", expectedStatus: http.StatusUnauthorized},
+		{name: "unknown path", method: http.MethodGet, requestURI: "/v2/apps", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(testCase.method, testCase.requestURI, nil))
+			if recorder.Code != testCase.expectedStatus {
+				t.Fatalf("expected status %d, got %d", testCase.expectedStatus, recorder.Code)
+			}
+
+			if allow := recorder.Header().Get("Allow"); allow != testCase.expectedAllow {
+				t.Errorf("expected the Allow header %q, got %q", testCase.expectedAllow, allow)
+			}
+
+			if testCase.expectedStatus == http.StatusMethodNotAllowed && recorder.Body.String() != methodNotAllowedString {
+				t.Errorf("expected the body %s, got %s", methodNotAllowedString, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestImplicitHeadRules(t *testing.T) {
+	var upstreamMethods chan string = make(chan string, 1)
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamMethods <- r.Method
+		w.Header().Set("X-Snap-Count", "3")
+		w.Write([]byte("snaps"))
+	}))
+
+	var accessRules map[string][]accessRule = loadTestAccessRules(t, "GET~/v2/snaps\n!GET~/v2/secret\nGET~/v2/apps\n!HEAD~/v2/apps\nGET~/v2/apps/*\n")
+
+	testCases := []struct {
+		name           string
+		implicitHead   bool
+		requestURI     string
+		expectedStatus int
+	}{
+		{name: "allowed GET path", implicitHead: true, requestURI: "/v2/snaps", expectedStatus: http.StatusOK},
+		{name: "allowed GET wildcard path", implicitHead: true, requestURI: "/v2/apps/hello", expectedStatus: http.StatusOK},
+		{name: "denied GET path", implicitHead: true, requestURI: "/v2/secret", expectedStatus: http.StatusUnauthorized},
+		{name: "explicit HEAD rule", implicitHead: true, requestURI: "/v2/apps", expectedStatus: http.StatusUnauthorized},
+		{name: "unknown path", implicitHead: true, requestURI: "/v2/unlisted", expectedStatus: http.StatusNotFound},
+		{name: "disabled", implicitHead: false, requestURI: "/v2/snaps", expectedStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var router http.Handler = createAccessRulesRouter(accessRules, routingOptions{implicitHead: testCase.implicitHead}, newTestRelay([]string{targetSocketPath}, relayOptions{}))
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodHead, testCase.requestURI, nil))
+			if recorder.Code != testCase.expectedStatus {
+				t.Fatalf("expected status %d, got %d", testCase.expectedStatus, recorder.Code)
+			}
+
+			if testCase.expectedStatus != http.StatusOK {
+				return
+			}
+
+			// The HEAD request itself is relayed, and only the status and
+			// headers of its response
+			if method := <-upstreamMethods; method != http.MethodHead {
+				t.Errorf("expected a HEAD request to reach the target socket, got %s", method)
+			}
+
+			if snapCount := recorder.Header().Get("X-Snap-Count"); snapCount != "3" {
+				t.Errorf("expected the response headers to be relayed, got X-Snap-Count %q", snapCount)
+			}
+
+			if recorder.Body.Len() != 0 {
+				t.Errorf("expected no body, got %q", recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestHeaderConditionRules(t *testing.T) {
+	var accessRulesContents string = "GET~/v2/snaps~header=X-Internal:true\nGET~/v2/apps~header=X-Internal\nGET~/v2/both~header=X-Internal~header=X-Team:core\n"
+	runRoutingTestCases(t, accessRulesContents, routingOptions{}, []routingTestCase{
+		{name: "matching value", requestURI: "/v2/snaps", header: http.Header{"X-Internal": {"true"}}, expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps"},
+		{name: "matching value among several", requestURI: "/v2/snaps", header: http.Header{"X-Internal": {"false", " true "}}, expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps"},
+		{name: "mismatched value", requestURI: "/v2/snaps", header: http.Header{"X-Internal": {"TRUE"}}, expectedStatus: http.StatusUnauthorized},
+		{name: "absent header", requestURI: "/v2/snaps", expectedStatus: http.StatusUnauthorized},
+		{name: "present header", requestURI: "/v2/apps", header: http.Header{"X-Internal": {"anything"}}, expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/apps"},
+		{name: "present but empty header", requestURI: "/v2/apps", header: http.Header{"X-Internal": {""}}, expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/apps"},
+		{name: "similarly named header", requestURI: "/v2/apps", header: http.Header{"X-Internals": {"true"}}, expectedStatus: http.StatusUnauthorized},
+		{name: "every condition met", requestURI: "/v2/both", header: http.Header{"X-Internal": {"1"}, "X-Team": {"core"}}, expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/both"},
+		{name: "one condition unmet", requestURI: "/v2/both", header: http.Header{"X-Internal": {"1"}, "X-Team": {"apps"}}, expectedStatus: http.StatusUnauthorized},
+	})
+
+	// Header names are matched whatever their case, in either format
+	var expectedAccessRules map[string][]accessRule = loadTestAccessRules(t, accessRulesContents)
+	for name, contents := range map[string]string{
+		"text": "GET~/v2/snaps~header=x-internal:true\nGET~/v2/apps~header=X-INTERNAL\nGET~/v2/both~header=x-internal~header=x-team:core\n",
+		"json": `[{"method": "GET", "path": "/v2/snaps", "headers": ["X-Internal: true"]}, {"method": "GET", "path": "/v2/apps", "headers": ["X-Internal"]}, {"method": "GET", "path": "/v2/both", "headers": ["X-Internal", "X-Team:core"]}]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			var accessRulesPath string = filepath.Join(t.TempDir(), "rules."+name)
+			if err := os.WriteFile(accessRulesPath, []byte(contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			accessRules, _, err := loadAccessRules(accessRulesPath, "", false, DefaultAccessRuleDelimiter, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(accessRules, expectedAccessRules) {
+				t.Errorf("expected %+v, got %+v", expectedAccessRules, accessRules)
+			}
+		})
+	}
+}
+
+func TestHeaderConditionRulesRejected(t *testing.T) {
+	for _, line := range []string{"GET~/v2/snaps~header=", "GET~/v2/snaps~header=:true", "GET~/v2/snaps~header=X Internal:true"} {
+		t.Run(line, func(t *testing.T) {
+			if _, err := parseAccessRule(line, DefaultAccessRuleDelimiter, nil); err == nil {
+				t.Errorf("expected %q to be rejected", line)
+			}
+		})
+	}
+}
+
+func TestQueryConditionRules(t *testing.T) {
+	var accessRulesContents string = "GET~/v2/snaps~query=scope=system\nGET~/v2/apps~query=select\nGET~/v2/both~query=select~query=scope=system\n"
+	runRoutingTestCases(t, accessRulesContents, routingOptions{}, []routingTestCase{
+		{name: "matching value", requestURI: "/v2/snaps?scope=system", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps?scope=system"},
+		{name: "matching value among several", requestURI: "/v2/snaps?scope=user&scope=system", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps?scope=user&scope=system"},
+		{name: "escaped matching value", requestURI: "/v2/snaps?scope=sys%74em", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps?scope=sys%74em"},
+		{name: "mismatched value", requestURI: "/v2/snaps?scope=user", expectedStatus: http.StatusUnauthorized},
+		{name: "differently cased name", requestURI: "/v2/snaps?Scope=system", expectedStatus: http.StatusUnauthorized},
+		{name: "absent parameter", requestURI: "/v2/snaps", expectedStatus: http.StatusUnauthorized},
+		{name: "present parameter", requestURI: "/v2/apps?select=all", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/apps?select=all"},
+		{name: "present but empty parameter", requestURI: "/v2/apps?select", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/apps?select"},
+		{name: "similarly named parameter", requestURI: "/v2/apps?selected=all", expectedStatus: http.StatusUnauthorized},
+		{name: "every condition met", requestURI: "/v2/both?select=all&scope=system", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/both?select=all&scope=system"},
+		{name: "one condition unmet", requestURI: "/v2/both?select=all&scope=user", expectedStatus: http.StatusUnauthorized},
+	})
+
+	var accessRulesPath string = filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(accessRulesPath, []byte(`[{"method": "GET", "path": "/v2/snaps", "query": ["scope=system"]}, {"method": "GET", "path": "/v2/apps", "query": ["select"]}, {"method": "GET", "path": "/v2/both", "query": ["select", "scope=system"]}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	accessRules, _, err := loadAccessRules(accessRulesPath, "", false, DefaultAccessRuleDelimiter, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expectedAccessRules := loadTestAccessRules(t, accessRulesContents); !reflect.DeepEqual(accessRules, expectedAccessRules) {
+		t.Errorf("expected the same rules as in the text format, got %+v", accessRules)
+	}
+}
+
+func TestQueryConditionRulesRejected(t *testing.T) {
+	for _, line := range []string{"GET~/v2/snaps~query=", "GET~/v2/snaps~query==system"} {
+		t.Run(line, func(t *testing.T) {
+			if _, err := parseAccessRule(line, DefaultAccessRuleDelimiter, nil); err == nil {
+				t.Errorf("expected %q to be rejected", line)
+			}
+		})
+	}
+}
+
+func TestContentTypeRules(t *testing.T) {
+	var accessRulesContents string = "POST~/v2/snaps~content-type=application/json\nPOST~/v2/apps~content-type=application/json,none\nPOST~/v2/icons~content-type=image/*\n"
+	runRoutingTestCases(t, accessRulesContents, routingOptions{}, []routingTestCase{
+		{name: "accepted media type", method: http.MethodPost, requestURI: "/v2/snaps", header: http.Header{"Content-Type": {"application/json"}}, expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps"},
+		{name: "accepted media type with parameters", method: http.MethodPost, requestURI: "/v2/snaps", header: http.Header{"Content-Type": {"application/json; charset=utf-8"}}, expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps"},
+		{name: "accepted media type in another case", method: http.MethodPost, requestURI: "/v2/snaps", header: http.Header{"Content-Type": {"Application/JSON"}}, expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/snaps"},
+		{name: "unaccepted media type", method: http.MethodPost, requestURI: "/v2/snaps", header: http.Header{"Content-Type": {"text/plain"}}, expectedStatus: http.StatusUnsupportedMediaType},
+		{name: "malformed media type", method: http.MethodPost, requestURI: "/v2/snaps", header: http.Header{"Content-Type": {"application/json/"}}, expectedStatus: http.StatusUnsupportedMediaType},
+		{name: "missing media type", method: http.MethodPost, requestURI: "/v2/snaps", expectedStatus: http.StatusUnsupportedMediaType},
+		{name: "missing media type accepted", method: http.MethodPost, requestURI: "/v2/apps", expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/apps"},
+		{name: "blank media type accepted", method: http.MethodPost, requestURI: "/v2/apps", header: http.Header{"Content-Type": {" "}}, expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/apps"},
+		{name: "media type within a range", method: http.MethodPost, requestURI: "/v2/icons", header: http.Header{"Content-Type": {"image/png"}}, expectedStatus: http.StatusOK, expectedUpstreamURI: "/v2/icons"},
+		{name: "media type outside a range", method: http.MethodPost, requestURI: "/v2/icons", header: http.Header{"Content-Type": {"imagery/png"}}, expectedStatus: http.StatusUnsupportedMediaType},
+	})
+}
+
+func TestContentTypeRulesRejected(t *testing.T) {
+	for _, line := range []string{"POST~/v2/snaps~content-type=", "POST~/v2/snaps~content-type=json", "POST~/v2/snaps~content-type=*/json"} {
+		t.Run(line, func(t *testing.T) {
+			if _, err := parseAccessRule(line, DefaultAccessRuleDelimiter, nil); err == nil {
+				t.Errorf("expected %q to be rejected", line)
+			}
+		})
+	}
+}
+
+func TestPeerCredentialRules(t *testing.T) {
+	targetSocketPath, _ := recordingTargetSocket(t)
+	var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{})
+	var router http.Handler = createAccessRulesRouter(loadTestAccessRules(t, "GET~/v2/snaps\nDELETE~/v2/snaps~uid=0\nPOST~/v2/snaps~uid=0,1000~gid=100\n"), routingOptions{}, relay)
+
+	testCases := []struct {
+		name           string
+		method         string
+		credentials    *peerCredentials
+		expectedStatus int
+	}{
+		{name: "unscoped rule without credentials", method: http.MethodGet, expectedStatus: http.StatusOK},
+		{name: "unscoped rule with credentials", method: http.MethodGet, credentials: &peerCredentials{uid: 1000, gid: 1000}, expectedStatus: http.StatusOK},
+		{name: "listed UID", method: http.MethodDelete, credentials: &peerCredentials{uid: 0, gid: 0}, expectedStatus: http.StatusOK},
+		{name: "unlisted UID", method: http.MethodDelete, credentials: &peerCredentials{uid: 1000, gid: 0}, expectedStatus: http.StatusUnauthorized},
+		{name: "unknown credentials", method: http.MethodDelete, expectedStatus: http.StatusUnauthorized},
+		{name: "listed UID and GID", method: http.MethodPost, credentials: &peerCredentials{uid: 1000, gid: 100}, expectedStatus: http.StatusOK},
+		{name: "listed UID with unlisted GID", method: http.MethodPost, credentials: &peerCredentials{uid: 1000, gid: 1000}, expectedStatus: http.StatusUnauthorized},
+		{name: "listed GID with unlisted UID", method: http.MethodPost, credentials: &peerCredentials{uid: 1001, gid: 100}, expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var request *http.Request = httptest.NewRequest(testCase.method, "/v2/snaps", nil)
+			if testCase.credentials != nil {
+				request = request.WithContext(context.WithValue(request.Context(), peerCredentialsContextKey{}, testCase.credentials))
+			}
+
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d", testCase.expectedStatus, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestConditionedRulesSharingPath(t *testing.T) {
+	var accessRules map[string][]accessRule = loadTestAccessRules(t, "GET~/v2/logs~uid=0\nGET~/v2/logs~uid=1000\nGET~/v2/logs~uid=0\n"+
+		"GET~/v2/snaps/*\n!GET~/v2/snaps/*~uid=1000\n"+
+		"POST~/v2/debug~header=X-Internal:true\nPOST~/v2/debug~query=token\n!POST~/v2/debug~header=X-Blocked\n")
+	if len(accessRules["/v2/logs"]) != 2 {
+		t.Errorf("expected the repeated rule to be dropped, got %d rules", len(accessRules["/v2/logs"]))
+	}
+
+	targetSocketPath, _ := recordingTargetSocket(t)
+	var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{})
+	var router http.Handler = createAccessRulesRouter(accessRules, routingOptions{}, relay)
+
+	testCases := []struct {
+		name           string
+		method         string
+		requestURI     string
+		credentials    *peerCredentials
+		header         http.Header
+		expectedStatus int
+	}{
+		{name: "first rule", method: http.MethodGet, requestURI: "/v2/logs", credentials: &peerCredentials{uid: 0}, expectedStatus: http.StatusOK},
+		{name: "second rule", method: http.MethodGet, requestURI: "/v2/logs", credentials: &peerCredentials{uid: 1000}, expectedStatus: http.StatusOK},
+		{name: "neither rule", method: http.MethodGet, requestURI: "/v2/logs", credentials: &peerCredentials{uid: 1001}, expectedStatus: http.StatusUnauthorized},
+		{name: "unknown credentials", method: http.MethodGet, requestURI: "/v2/logs", expectedStatus: http.StatusUnauthorized},
+		{name: "deny rule for another UID", method: http.MethodGet, requestURI: "/v2/snaps/core", credentials: &peerCredentials{uid: 0}, expectedStatus: http.StatusOK},
+		{name: "deny rule without credentials", method: http.MethodGet, requestURI: "/v2/snaps/core", expectedStatus: http.StatusOK},
+		{name: "deny rule for the UID", method: http.MethodGet, requestURI: "/v2/snaps/core", credentials: &peerCredentials{uid: 1000}, expectedStatus: http.StatusUnauthorized},
+		{name: "header rule", method: http.MethodPost, requestURI: "/v2/debug", header: http.Header{"X-Internal": {"true"}}, expectedStatus: http.StatusOK},
+		{name: "query rule", method: http.MethodPost, requestURI: "/v2/debug?token=1", expectedStatus: http.StatusOK},
+		{name: "neither header nor query", method: http.MethodPost, requestURI: "/v2/debug", expectedStatus: http.StatusUnauthorized},
+		{name: "deny rule for the header", method: http.MethodPost, requestURI: "/v2/debug?token=1", header: http.Header{"X-Blocked": {"1"}}, expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var request *http.Request = httptest.NewRequest(testCase.method, testCase.requestURI, nil)
+			for name, values := range testCase.header {
+				request.Header[name] = values
+			}
+
+			if testCase.credentials != nil {
+				request = request.WithContext(context.WithValue(request.Context(), peerCredentialsContextKey{}, testCase.credentials))
+			}
+
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d", testCase.expectedStatus, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestMatchRequest(t *testing.T) {
+	var accessRulesPath string = filepath.Join(t.TempDir(), "rules.txt")
+	var contents string = "GET~/v2/snaps\nGET~/v2/snaps/*\n!GET~/v2/snaps/core\nPOST~re:^/v2/apps/[a-z]+$\nDELETE~/v2/snaps~uid=0\n"
+	if err := os.WriteFile(accessRulesPath, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	accessRules, err := LoadAccessRules(accessRulesPath, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targetSocketPath, _ := recordingTargetSocket(t)
+	var v *Veil = startTestVeil(t, Options{
+		TargetSocketPath: targetSocketPath,
+		ExposedAddress:   filepath.Join(t.TempDir(), "veil.sock"),
+		AccessRulesPath:  accessRulesPath,
+	})
+
+	testCases := []struct {
+		name             string
+		method           string
+		path             string
+		expectedDecision string
+	}{
+		{name: "exact path", method: http.MethodGet, path: "/v2/snaps", expectedDecision: DecisionAllowed},
+		{name: "lowercase method", method: "get", path: "/v2/snaps", expectedDecision: DecisionAllowed},
+		{name: "wildcard path", method: http.MethodGet, path: "/v2/snaps/hello", expectedDecision: DecisionAllowed},
+		{name: "deny rule", method: http.MethodGet, path: "/v2/snaps/core", expectedDecision: DecisionForbidden},
+		{name: "regexp path", method: http.MethodPost, path: "/v2/apps/hello", expectedDecision: DecisionAllowed},
+		{name: "regexp mismatch", method: http.MethodPost, path: "/v2/apps/Hello", expectedDecision: DecisionNotFound},
+		{name: "unlisted method", method: http.MethodPut, path: "/v2/snaps", expectedDecision: DecisionForbidden},
+		{name: "credentials required", method: http.MethodDelete, path: "/v2/snaps", expectedDecision: DecisionForbidden},
+		{name: "unlisted path", method: http.MethodGet, path: "/v2/secret", expectedDecision: DecisionNotFound},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if decision := accessRules.Match(testCase.method, testCase.path); decision != testCase.expectedDecision {
+				t.Errorf("expected the access rules to decide %q, got %q", testCase.expectedDecision, decision)
+			}
+
+			if decision := v.MatchRequest(testCase.method, testCase.path); decision != testCase.expectedDecision {
+				t.Errorf("expected the Veil to decide %q, got %q", testCase.expectedDecision, decision)
+			}
+		})
+	}
+}
+
+func TestReadFileLines(t *testing.T) {
+	var directory string = t.TempDir()
+
+	var readablePath string = filepath.Join(directory, "readable.txt")
+	if err := os.WriteFile(readablePath, []byte("GET~/v2/snaps\n\nPOST~/v2/snaps"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var unreadablePath string = filepath.Join(directory, "unreadable.txt")
+	if err := os.WriteFile(unreadablePath, []byte("GET~/v2/snaps\n"), 0000); err != nil {
+		t.Fatal(err)
+	}
+
+	var overlongPath string = filepath.Join(directory, "overlong.txt")
+	if err := os.WriteFile(overlongPath, []byte("GET~/"+strings.Repeat("a", 1<<17)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name          string
+		path          string
+		expectedLines []string
+		expectedError func(error) bool
+	}{
+		{name: "readable", path: readablePath, expectedLines: []string{"GET~/v2/snaps", "", "POST~/v2/snaps"}},
+		{name: "nonexistent", path: filepath.Join(directory, "missing.txt"), expectedError: os.IsNotExist},
+		{name: "permission denied", path: unreadablePath, expectedError: os.IsPermission},
+		{name: "directory", path: directory, expectedError: func(err error) bool { return err != nil }},
+		{name: "overlong line", path: overlongPath, expectedError: func(err error) bool { return err != nil }},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.path == unreadablePath && os.Geteuid() == 0 {
+				t.Skip("file permissions do not apply to root")
+			}
+
+			lines, err := readFileLines(testCase.path)
+			if testCase.expectedError != nil {
+				if !testCase.expectedError(err) {
+					t.Fatalf("expected a matching error, got %v", err)
+				}
+				if lines != nil {
+					t.Errorf("expected no lines alongside the error, got %q", lines)
+				}
+
+				// An access rules list that cannot be read is an error rather
+				// than an empty route table, even when lenient. A directory is
+				// instead read as a directory of access rules lists.
+				if testCase.path == directory {
+					return
+				}
+
+				if _, err := LoadAccessRules(testCase.path, "", true); err == nil {
+					t.Error("expected loading the access rules to fail")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(lines, testCase.expectedLines) {
+				t.Errorf("expected %q, got %q", testCase.expectedLines, lines)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// DefaultMaxValidatedBodyBytes : Size beyond which request bodies are not
+// buffered for validation against a schema, unless MaxBodyBytes sets another
+// limit
+const DefaultMaxValidatedBodyBytes int64 = 10 << 20
+
+// schemaViolation : Part of a request body that does not conform to the schema
+// of the access rule it matched, located by a JSON pointer
+type schemaViolation struct {
+	Location string `json:"location"`
+	Error    string `json:"error"`
+}
+
+// schemaValidationResult : Result of a request refused because its body does
+// not conform to the schema of the access rule it matched
+type schemaValidationResult struct {
+	Message    string            `json:"message"`
+	Violations []schemaViolation `json:"violations,omitempty"`
+}
+
+// compileAccessRuleSchemas : Compiles the JSON Schemas referenced by the access
+// rules, resolving relative paths against the base directory, and returns the
+// paths of the schema files. Each schema file is compiled once, however many
+// rules reference it.
+func compileAccessRuleSchemas(accessRules map[string][]accessRule, baseDirectory string) ([]string, error) {
+	var compiledSchemas map[string]*jsonschema.Schema = make(map[string]*jsonschema.Schema)
+	var schemaPaths []string = []string{}
+	for accessRulesPath, accessRulesListForPath := range accessRules {
+		for i, rule := range accessRulesListForPath {
+			if len(rule.schemaPath) == 0 {
+				continue
+			}
+
+			if !filepath.IsAbs(rule.schemaPath) {
+				rule.schemaPath = filepath.Join(baseDirectory, rule.schemaPath)
+			}
+
+			schema, compiled := compiledSchemas[rule.schemaPath]
+			if !compiled {
+				var err error
+				if schema, err = jsonschema.NewCompiler().Compile(rule.schemaPath); err != nil {
+					return nil, fmt.Errorf("unable to compile schema for %s %s: %v", rule.method, rule.path, err)
+				}
+
+				compiledSchemas[rule.schemaPath] = schema
+				schemaPaths = append(schemaPaths, rule.schemaPath)
+			}
+
+			rule.schema = schema
+			accessRules[accessRulesPath][i] = rule
+		}
+	}
+
+	return schemaPaths, nil
+}
+
+// decodeJSONBody : Decodes a request body holding a single JSON value, keeping
+// numbers in their textual form so that they are validated exactly
+func decodeJSONBody(body []byte) (interface{}, error) {
+	var decoder *json.Decoder = json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+
+	return value, nil
+}
+
+// schemaViolations : Lists the parts of a value that fail validation, taking
+// the most specific cause of each failure
+func schemaViolations(validationError *jsonschema.ValidationError) []schemaViolation {
+	if len(validationError.Causes) == 0 {
+		return []schemaViolation{{Location: validationError.InstanceLocation, Error: validationError.Message}}
+	}
+
+	var violations []schemaViolation = []schemaViolation{}
+	for _, cause := range validationError.Causes {
+		violations = append(violations, schemaViolations(cause)...)
+	}
+
+	return violations
+}
+
+// partlyReadBody : Request body whose beginning has already been read, which
+// is replayed ahead of the remainder
+type partlyReadBody struct {
+	io.Reader
+	io.Closer
+}
+
+// relayInvalidBodyInDryRun : Relays a request whose body failed validation if
+// it is being served in dry-run mode, logging the failure it would otherwise
+// have been refused for. Returns whether the request was relayed.
+func relayInvalidBodyInDryRun(w http.ResponseWriter, r *http.Request, result schemaValidationResult) bool {
+	relay, dryRun := dryRunRelayFromContext(r.Context())
+	if !dryRun {
+		return false
+	}
+
+	var failures []string = []string{result.Message}
+	for _, violation := range result.Violations {
+		failures = append(failures, fmt.Sprintf("%s: %s", violation.Location, violation.Error))
+	}
+
+	logWarn("Dry run relaying", r.Method, r.URL.Path, "with invalid body:", strings.Join(failures, "; "))
+	relay(w, r)
+	recordRequestDecision(r.Context(), DecisionDryRunForbidden)
+	return true
+}
+
+// invalidBodyHandler : Refuses a request whose body does not conform to the
+// schema of the access rule it matched, describing why in the response
+func invalidBodyHandler(w http.ResponseWriter, r *http.Request, result schemaValidationResult) {
+	if relayInvalidBodyInDryRun(w, r, result) {
+		return
+	}
+
+	encodedResponse, err := json.Marshal(adminResponse{
+		Type:       "error",
+		StatusCode: http.StatusBadRequest,
+		Status:     http.StatusText(http.StatusBadRequest),
+		Result:     result,
+	})
+	if err != nil {
+		encodedResponse = []byte(badRequestString)
+	}
+
+	recordRequestDecision(r.Context(), DecisionInvalidBody)
+	writeErrorResponse(w, r, http.StatusBadRequest, string(encodedResponse))
+}
+
+// validateRequestBody : Buffers the body of a request, up to the limit, and
+// validates it against the schema of the access rule it matched. A gzip-encoded
+// body is validated in its decompressed form. Should the body not conform, the
+// request is refused, or relayed regardless in dry-run mode, and false returned;
+// otherwise, the buffered body replaces that of the request, so that the
+// original bytes are relayed.
+func validateRequestBody(w http.ResponseWriter, r *http.Request, rule accessRule, limit int64) bool {
+	var tooLargeResult schemaValidationResult = schemaValidationResult{Message: "request body is too large to validate"}
+	if r.ContentLength > limit {
+		if !relayInvalidBodyInDryRun(w, r, tooLargeResult) {
+			writeErrorResponse(w, r, http.StatusRequestEntityTooLarge, requestEntityTooLargeString)
+		}
+		return false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		r.Body.Close()
+		logWarn("Unable to read request body for", r.Method, r.URL.Path, err)
+		writeErrorResponse(w, r, http.StatusBadRequest, badRequestString)
+		return false
+	}
+
+	if int64(len(body)) > limit {
+		r.Body = partlyReadBody{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+		if !relayInvalidBodyInDryRun(w, r, tooLargeResult) {
+			writeErrorResponse(w, r, http.StatusRequestEntityTooLarge, requestEntityTooLargeString)
+		}
+		return false
+	}
+
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var decodedBody []byte = body
+	if isGzipEncoded(r.Header) {
+		decompressedBody, err := newGzipRequestBody(io.NopCloser(bytes.NewReader(body)))
+		if err == nil {
+			decodedBody, err = io.ReadAll(io.LimitReader(decompressedBody, limit+1))
+		}
+
+		if err != nil || int64(len(decodedBody)) > limit {
+			invalidBodyHandler(w, r, schemaValidationResult{Message: "request body could not be decompressed"})
+			return false
+		}
+	}
+
+	value, err := decodeJSONBody(decodedBody)
+	if err != nil {
+		invalidBodyHandler(w, r, schemaValidationResult{Message: fmt.Sprintf("request body is not valid JSON: %v", err)})
+		return false
+	}
+
+	if err := rule.schema.Validate(value); err != nil {
+		var validationError *jsonschema.ValidationError
+		if !errors.As(err, &validationError) {
+			logError("Unable to validate request body for", r.Method, r.URL.Path, err)
+			writeErrorResponse(w, r, http.StatusInternalServerError, internalErrorString)
+			return false
+		}
+
+		invalidBodyHandler(w, r, schemaValidationResult{
+			Message:    "request body does not match schema",
+			Violations: schemaViolations(validationError),
+		})
+		return false
+	}
+
+	return true
+}
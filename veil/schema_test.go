@@ -0,0 +1,94 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSchemaValidation(t *testing.T) {
+	var schemaPath string = filepath.Join(t.TempDir(), "snap-action.json")
+	var schema string = `{"type": "object", "required": ["action"], "properties": {"action": {"enum": ["install", "remove"]}}}`
+	if err := os.WriteFile(schemaPath, []byte(schema), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var relayedBodies chan string = make(chan string, 1)
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		relayedBodies <- string(body)
+	}))
+
+	var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{})
+	var router http.Handler = createAccessRulesRouter(loadTestAccessRules(t, "POST~/v2/snaps~schema="+schemaPath+"\n"), routingOptions{maxValidatedBodyBytes: 64}, relay)
+
+	testCases := []struct {
+		name           string
+		body           string
+		dryRun         bool
+		expectedStatus int
+		expectRelayed  bool
+	}{
+		{name: "conforming body", body: `{"action": "install"}`, expectedStatus: http.StatusOK, expectRelayed: true},
+		{name: "violating body", body: `{"action": "refresh"}`, expectedStatus: http.StatusBadRequest},
+		{name: "malformed body", body: `{"action"`, expectedStatus: http.StatusBadRequest},
+		{name: "body beyond limit", body: `{"action": "install", "padding": "` + strings.Repeat("x", 64) + `"}`, expectedStatus: http.StatusRequestEntityTooLarge},
+		{name: "violating body in dry-run mode", body: `{"action": "refresh"}`, dryRun: true, expectedStatus: http.StatusOK, expectRelayed: true},
+		{name: "malformed body in dry-run mode", body: `{"action"`, dryRun: true, expectedStatus: http.StatusOK, expectRelayed: true},
+		{name: "body beyond limit in dry-run mode", body: `{"action": "install", "padding": "` + strings.Repeat("x", 64) + `"}`, dryRun: true, expectedStatus: http.StatusOK, expectRelayed: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var handler http.Handler = router
+			if testCase.dryRun {
+				handler = withDryRun(relay, router)
+			}
+
+			var r *http.Request = httptest.NewRequest(http.MethodPost, "/v2/snaps", strings.NewReader(testCase.body))
+			// Leaving the length unknown makes the body be read to find its size
+			r.ContentLength = -1
+
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			handler.ServeHTTP(recorder, r)
+			if recorder.Code != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d: %s", testCase.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+
+			select {
+			case relayedBody := <-relayedBodies:
+				if !testCase.expectRelayed {
+					t.Errorf("expected the request to be refused, but %q was relayed", relayedBody)
+				} else if relayedBody != testCase.body {
+					t.Errorf("expected the body %q to be relayed, got %q", testCase.body, relayedBody)
+				}
+			default:
+				if testCase.expectRelayed {
+					t.Error("expected the request to be relayed, but the target socket received nothing")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// Environment variables through which systemd passes listening sockets to the
+// services it activates
+const listenFDsEnvVar string = "LISTEN_FDS"
+const listenPIDEnvVar string = "LISTEN_PID"
+const listenFDNamesEnvVar string = "LISTEN_FDNAMES"
+
+// notifySocketEnvVar : Environment variable naming the socket through which
+// systemd receives notifications of the service's state
+const notifySocketEnvVar string = "NOTIFY_SOCKET"
+
+// States reported to systemd once the veil is ready to serve, and as it shuts
+// down
+const systemdReadyState string = "READY=1"
+const systemdStoppingState string = "STOPPING=1"
+
+// listenFDsStart : The first file descriptor of the sockets passed by systemd
+const listenFDsStart uintptr = 3
+
+// systemdListener : Returns the listening socket passed to the process by
+// systemd socket activation, or nil if the process was not activated this way.
+// The environment variables describing the socket are cleared so that child
+// processes do not mistake it for their own.
+func systemdListener() (net.Listener, error) {
+	var listenFDs string = os.Getenv(listenFDsEnvVar)
+	var listenPID string = os.Getenv(listenPIDEnvVar)
+	if len(listenFDs) == 0 || listenPID != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	os.Unsetenv(listenFDsEnvVar)
+	os.Unsetenv(listenPIDEnvVar)
+	os.Unsetenv(listenFDNamesEnvVar)
+
+	fdCount, err := strconv.Atoi(listenFDs)
+	if err != nil || fdCount < 1 {
+		return nil, fmt.Errorf("invalid %s: %q", listenFDsEnvVar, listenFDs)
+	}
+
+	if fdCount > 1 {
+		logWarn("Received", fdCount, "sockets from systemd, serving only the first")
+	}
+
+	var listenerFile *os.File = os.NewFile(listenFDsStart, "systemd-socket")
+	defer listenerFile.Close()
+
+	listener, err := net.FileListener(listenerFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use socket passed by systemd: %v", err)
+	}
+
+	return listener, nil
+}
+
+// systemdNotify : Reports the state of the veil to systemd through the socket
+// named by NOTIFY_SOCKET, doing nothing when the variable is unset as the veil
+// is not then run by systemd
+func systemdNotify(state string) error {
+	var notifySocketPath string = os.Getenv(notifySocketEnvVar)
+	if len(notifySocketPath) == 0 {
+		return nil
+	}
+
+	// A leading "@", designating a socket in the abstract namespace, is
+	// understood by the net package
+	notifyConnection, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: notifySocketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+
+	defer notifyConnection.Close()
+
+	_, err = notifyConnection.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,243 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Environment variables through which TestSystemdSocketActivation directs the
+// test binary it runs to stand in for a socket-activated veil
+const systemdHelperEnvVar string = "VEIL_TEST_SYSTEMD_HELPER"
+const systemdHelperTargetEnvVar string = "VEIL_TEST_SYSTEMD_TARGET"
+const systemdHelperRulesEnvVar string = "VEIL_TEST_SYSTEMD_RULES"
+const systemdHelperExposedEnvVar string = "VEIL_TEST_SYSTEMD_EXPOSED"
+
+func TestSystemdListenerNotActivated(t *testing.T) {
+	testCases := []struct {
+		name        string
+		listenFDs   string
+		listenPID   string
+		expectError bool
+	}{
+		{name: "not activated", listenFDs: "", listenPID: ""},
+		{name: "activated for another process", listenFDs: "1", listenPID: strconv.Itoa(os.Getpid() + 1)},
+		{name: "no sockets", listenFDs: "0", listenPID: strconv.Itoa(os.Getpid()), expectError: true},
+		{name: "malformed socket count", listenFDs: "one", listenPID: strconv.Itoa(os.Getpid()), expectError: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Setenv(listenFDsEnvVar, testCase.listenFDs)
+			t.Setenv(listenPIDEnvVar, testCase.listenPID)
+
+			listener, err := systemdListener()
+			if listener != nil {
+				listener.Close()
+				t.Fatal("expected no socket to be taken from systemd")
+			}
+
+			if (err != nil) != testCase.expectError {
+				t.Errorf("expected an error to be %t, got %v", testCase.expectError, err)
+			}
+		})
+	}
+}
+
+// TestSystemdActivatedVeil : Serves a Veil on the socket passed to the process
+// as systemd would, when run by TestSystemdSocketActivation
+func TestSystemdActivatedVeil(t *testing.T) {
+	if os.Getenv(systemdHelperEnvVar) != "1" {
+		t.Skip("run by TestSystemdSocketActivation")
+	}
+
+	// systemd names the process the socket is meant for once it has started
+	os.Setenv(listenFDsEnvVar, "1")
+	os.Setenv(listenPIDEnvVar, strconv.Itoa(os.Getpid()))
+
+	v, err := New(Options{
+		TargetSocketPath: os.Getenv(systemdHelperTargetEnvVar),
+		ExposedAddress:   os.Getenv(systemdHelperExposedEnvVar),
+		AccessRulesPath:  os.Getenv(systemdHelperRulesEnvVar),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v.Serve()
+}
+
+func TestSystemdSocketActivation(t *testing.T) {
+	targetSocketPath, requestURIs := recordingTargetSocket(t)
+
+	// As for startTargetSocket, the directory is kept short
+	socketDirectory, err := os.MkdirTemp("", "veil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(socketDirectory)
+
+	var activationSocketPath string = filepath.Join(socketDirectory, "activated.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: activationSocketPath, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The socket is handed over in full, as systemd would, remaining in place
+	// once the test lets go of it
+	listener.SetUnlinkOnClose(false)
+	listenerFile, err := listener.File()
+	listener.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listenerFile.Close()
+
+	var exposedSocketPath string = filepath.Join(socketDirectory, "exposed.sock")
+	var command *exec.Cmd = exec.Command(os.Args[0], "-test.run=^TestSystemdActivatedVeil$")
+	command.ExtraFiles = []*os.File{listenerFile}
+	command.Env = append(os.Environ(),
+		systemdHelperEnvVar+"=1",
+		systemdHelperTargetEnvVar+"="+targetSocketPath,
+		systemdHelperRulesEnvVar+"="+writeTestAccessRules(t, "GET~/v2/snaps\n"),
+		systemdHelperExposedEnvVar+"="+exposedSocketPath,
+	)
+	if err := command.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		command.Process.Kill()
+		command.Wait()
+	}()
+
+	var client *http.Client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", activationSocketPath)
+			},
+		},
+	}
+
+	awaitStatus(t, client, http.MethodGet, "/v2/snaps", http.StatusOK, 10*time.Second)
+	if upstreamRequestURI := <-requestURIs; upstreamRequestURI != "/v2/snaps" {
+		t.Errorf("expected the target socket to receive /v2/snaps, got %q", upstreamRequestURI)
+	}
+
+	if status := requestStatus(t, client, http.MethodGet, "/v2/apps"); status != http.StatusNotFound {
+		t.Errorf("expected the access rules to apply, got status %d", status)
+	}
+
+	if _, err := os.Stat(exposedSocketPath); !os.IsNotExist(err) {
+		t.Errorf("expected the exposed socket not to be created, got %v", err)
+	}
+}
+
+// listenForNotifications : Listens on a datagram socket named by NOTIFY_SOCKET
+// for the duration of the test, returning the socket
+func listenForNotifications(t *testing.T) *net.UnixConn {
+	t.Helper()
+
+	// As for startTargetSocket, the directory is kept short
+	socketDirectory, err := os.MkdirTemp("", "veil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(socketDirectory) })
+
+	var notifySocketPath string = filepath.Join(socketDirectory, "notify.sock")
+	notifyConnection, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: notifySocketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { notifyConnection.Close() })
+
+	t.Setenv(notifySocketEnvVar, notifySocketPath)
+	return notifyConnection
+}
+
+// readNotification : Reads the next notification sent to the socket
+func readNotification(t *testing.T, notifyConnection *net.UnixConn) string {
+	t.Helper()
+
+	var notification []byte = make([]byte, 256)
+	notifyConnection.SetReadDeadline(time.Now().Add(5 * time.Second))
+	notificationLength, err := notifyConnection.Read(notification)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(notification[:notificationLength])
+}
+
+func TestSystemdNotify(t *testing.T) {
+	var notifyConnection *net.UnixConn = listenForNotifications(t)
+	for _, state := range []string{systemdReadyState, systemdStoppingState} {
+		if err := systemdNotify(state); err != nil {
+			t.Fatal(err)
+		}
+
+		if notification := readNotification(t, notifyConnection); notification != state {
+			t.Errorf("expected %q, got %q", state, notification)
+		}
+	}
+
+	t.Setenv(notifySocketEnvVar, "")
+	if err := systemdNotify(systemdReadyState); err != nil {
+		t.Errorf("expected nothing to be sent outside of systemd, got %v", err)
+	}
+}
+
+func TestSystemdNotifyReadiness(t *testing.T) {
+	var notifyConnection *net.UnixConn = listenForNotifications(t)
+	targetSocketPath, _ := recordingTargetSocket(t)
+	var v *Veil = startTestVeil(t, Options{
+		TargetSocketPath: targetSocketPath,
+		ExposedAddress:   "tcp://127.0.0.1:0",
+		AccessRulesPath:  writeTestAccessRules(t, "GET~/v2/snaps\n"),
+	})
+
+	if notification := readNotification(t, notifyConnection); notification != systemdReadyState {
+		t.Fatalf("expected %q once serving, got %q", systemdReadyState, notification)
+	}
+
+	// Having reported readiness, the veil accepts requests
+	if status := requestStatus(t, newVeilClient(v), http.MethodGet, "/v2/snaps"); status != http.StatusOK {
+		t.Errorf("expected status 200 once ready, got %d", status)
+	}
+
+	if err := v.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if notification := readNotification(t, notifyConnection); notification != systemdStoppingState {
+		t.Errorf("expected %q on shutdown, got %q", systemdStoppingState, notification)
+	}
+}
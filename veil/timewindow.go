@@ -0,0 +1,225 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTimeWindowZone : Time zone in which the time windows of access rules
+// are evaluated unless another is configured
+const DefaultTimeWindowZone string = "UTC"
+
+// timeWindowDaysSeparator : Separates the days of a time window from its hours
+const timeWindowDaysSeparator string = "@"
+
+// minutesPerDay : Number of minutes from the start of a day to its end
+const minutesPerDay int = 24 * 60
+
+// timeWindow : Days of the week, and a range of hours on each of them, during
+// which a rule allows requests
+type timeWindow struct {
+	spec string
+
+	days [7]bool
+
+	// startMinute and endMinute are the minutes after midnight at which the
+	// window opens and closes. A window closing no later than it opens spans
+	// midnight, closing on the day after each of its days.
+	startMinute int
+	endMinute   int
+}
+
+// parseTimeWindow : Parses a time window of the form "days@HH:MM-HH:MM", where
+// days is a comma-separated list of days of the week or ranges of them (e.g.
+// "Mon-Fri,Sun"). Either part may be given alone, the window then covering
+// every day or the whole of each day respectively.
+func parseTimeWindow(spec string) (timeWindow, error) {
+	var window timeWindow = timeWindow{spec: spec, endMinute: minutesPerDay}
+	var daysSpec string = spec
+	var hoursSpec string = ""
+	if separatorIndex := strings.Index(spec, timeWindowDaysSeparator); separatorIndex >= 0 {
+		daysSpec = spec[:separatorIndex]
+		hoursSpec = spec[separatorIndex+1:]
+		if len(daysSpec) == 0 || len(hoursSpec) == 0 {
+			return timeWindow{}, fmt.Errorf("expected days%sHH:MM-HH:MM", timeWindowDaysSeparator)
+		}
+	} else if strings.Contains(spec, ":") {
+		daysSpec = ""
+		hoursSpec = spec
+	}
+
+	if len(daysSpec) == 0 {
+		for day := range window.days {
+			window.days[day] = true
+		}
+	} else {
+		for _, dayRange := range strings.Split(daysSpec, ",") {
+			if err := window.addDays(strings.TrimSpace(dayRange)); err != nil {
+				return timeWindow{}, err
+			}
+		}
+	}
+
+	if len(hoursSpec) > 0 {
+		hoursParts := strings.Split(hoursSpec, "-")
+		if len(hoursParts) != 2 {
+			return timeWindow{}, fmt.Errorf("invalid hours %q (expected HH:MM-HH:MM)", hoursSpec)
+		}
+
+		var err error
+		if window.startMinute, err = parseTimeOfDay(hoursParts[0]); err != nil {
+			return timeWindow{}, err
+		}
+
+		if window.endMinute, err = parseTimeOfDay(hoursParts[1]); err != nil {
+			return timeWindow{}, err
+		}
+
+		if window.startMinute == minutesPerDay {
+			return timeWindow{}, fmt.Errorf("invalid hours %q (cannot open at 24:00)", hoursSpec)
+		}
+	}
+
+	return window, nil
+}
+
+// addDays : Adds a day of the week, or a range of days such as "Mon-Fri" or
+// "Fri-Mon", to the time window
+func (window *timeWindow) addDays(dayRange string) error {
+	rangeParts := strings.Split(dayRange, "-")
+	if len(rangeParts) > 2 {
+		return fmt.Errorf("invalid day range %q", dayRange)
+	}
+
+	firstDay, err := parseWeekday(rangeParts[0])
+	if err != nil {
+		return err
+	}
+
+	var lastDay time.Weekday = firstDay
+	if len(rangeParts) == 2 {
+		if lastDay, err = parseWeekday(rangeParts[1]); err != nil {
+			return err
+		}
+	}
+
+	for day := firstDay; ; day = (day + 1) % 7 {
+		window.days[day] = true
+		if day == lastDay {
+			return nil
+		}
+	}
+}
+
+// parseWeekday : Parses the full or three-letter name of a day of the week,
+// ignoring case
+func parseWeekday(name string) (time.Weekday, error) {
+	name = strings.TrimSpace(name)
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(name, day.String()) || strings.EqualFold(name, day.String()[:3]) {
+			return day, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid day of the week %q", name)
+}
+
+// parseTimeOfDay : Parses a time of day of the form "HH:MM" into minutes after
+// midnight, accepting "24:00" as the end of the day
+func parseTimeOfDay(timeOfDay string) (int, error) {
+	timeParts := strings.Split(strings.TrimSpace(timeOfDay), ":")
+	if len(timeParts) != 2 || len(timeParts[1]) != 2 {
+		return 0, fmt.Errorf("invalid time of day %q (expected HH:MM)", timeOfDay)
+	}
+
+	hour, errHour := strconv.Atoi(timeParts[0])
+	minute, errMinute := strconv.Atoi(timeParts[1])
+	if errHour != nil || errMinute != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > minutesPerDay {
+		return 0, fmt.Errorf("invalid time of day %q (expected HH:MM)", timeOfDay)
+	}
+
+	return hour*60 + minute, nil
+}
+
+// contains : Reports whether the instant, in the time zone the windows are
+// evaluated in, falls within the time window
+func (window timeWindow) contains(instant time.Time) bool {
+	var minute int = instant.Hour()*60 + instant.Minute()
+	var day time.Weekday = instant.Weekday()
+	if window.startMinute < window.endMinute {
+		return window.days[day] && minute >= window.startMinute && minute < window.endMinute
+	}
+
+	var previousDay time.Weekday = (day + 6) % 7
+	return (window.days[day] && minute >= window.startMinute) || (window.days[previousDay] && minute < window.endMinute)
+}
+
+// String : Formats the time window as it is written in an access rule
+func (window timeWindow) String() string {
+	return window.spec
+}
+
+// withinTimeWindows : Reports whether the instant falls within any of the time
+// windows, converting it to the time zone they are evaluated in
+func withinTimeWindows(windows []timeWindow, instant time.Time, location *time.Location) bool {
+	instant = instant.In(location)
+	for _, window := range windows {
+		if window.contains(instant) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// outsideTimeWindowHandler : Refuses a request made outside the time windows
+// of the access rule it matched, naming the windows in the response
+func outsideTimeWindowHandler(w http.ResponseWriter, r *http.Request, windows []timeWindow, location *time.Location) {
+	if relay, dryRun := dryRunRelayFromContext(r.Context()); dryRun {
+		relay(w, r)
+		recordRequestDecision(r.Context(), DecisionDryRunForbidden)
+		return
+	}
+
+	var windowSpecs []string = []string{}
+	for _, window := range windows {
+		windowSpecs = append(windowSpecs, window.String())
+	}
+
+	encodedResponse, err := json.Marshal(adminResponse{
+		Type:       "error",
+		StatusCode: http.StatusForbidden,
+		Status:     http.StatusText(http.StatusForbidden),
+		Result: adminErrorResult{
+			Message: fmt.Sprintf("access is only permitted during %s (%s)", strings.Join(windowSpecs, ", "), location),
+		},
+	})
+	if err != nil {
+		encodedResponse = []byte(internalErrorString)
+	}
+
+	recordRequestDecision(r.Context(), DecisionForbidden)
+	writeErrorResponse(w, r, http.StatusForbidden, string(encodedResponse))
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeWindowRules(t *testing.T) {
+	var accessRules map[string][]accessRule = loadTestAccessRules(t, "POST~/v2/snaps~window=Mon-Fri@09:00-17:00\nGET~/v2/backup~window=22:00-06:00\n")
+	targetSocketPath, requestURIs := recordingTargetSocket(t)
+	var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{})
+
+	testCases := []struct {
+		name           string
+		method         string
+		requestURI     string
+		now            time.Time
+		location       *time.Location
+		expectedStatus int
+	}{
+		{name: "weekday within hours", method: http.MethodPost, requestURI: "/v2/snaps", now: time.Date(2026, time.October, 12, 9, 0, 0, 0, time.UTC), expectedStatus: http.StatusOK},
+		{name: "weekday after hours", method: http.MethodPost, requestURI: "/v2/snaps", now: time.Date(2026, time.October, 12, 17, 0, 0, 0, time.UTC), expectedStatus: http.StatusForbidden},
+		{name: "weekend within hours", method: http.MethodPost, requestURI: "/v2/snaps", now: time.Date(2026, time.October, 17, 12, 0, 0, 0, time.UTC), expectedStatus: http.StatusForbidden},
+		{name: "window spanning midnight before it", method: http.MethodGet, requestURI: "/v2/backup", now: time.Date(2026, time.October, 12, 23, 30, 0, 0, time.UTC), expectedStatus: http.StatusOK},
+		{name: "window spanning midnight after it", method: http.MethodGet, requestURI: "/v2/backup", now: time.Date(2026, time.October, 13, 5, 59, 0, 0, time.UTC), expectedStatus: http.StatusOK},
+		{name: "outside window spanning midnight", method: http.MethodGet, requestURI: "/v2/backup", now: time.Date(2026, time.October, 13, 12, 0, 0, 0, time.UTC), expectedStatus: http.StatusForbidden},
+		{name: "within hours in configured zone", method: http.MethodPost, requestURI: "/v2/snaps", now: time.Date(2026, time.October, 12, 7, 0, 0, 0, time.UTC), location: time.FixedZone("UTC+3", 3*60*60), expectedStatus: http.StatusOK},
+		{name: "after hours in configured zone", method: http.MethodPost, requestURI: "/v2/snaps", now: time.Date(2026, time.October, 12, 15, 0, 0, 0, time.UTC), location: time.FixedZone("UTC+3", 3*60*60), expectedStatus: http.StatusForbidden},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var now time.Time = testCase.now
+			var router http.Handler = createAccessRulesRouter(accessRules, routingOptions{
+				timeWindowLocation: testCase.location,
+				now:                func() time.Time { return now },
+			}, relay)
+
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(testCase.method, testCase.requestURI, nil))
+			if recorder.Code != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d: %s", testCase.expectedStatus, recorder.Code, recorder.Body.String())
+			}
+
+			select {
+			case <-requestURIs:
+				if testCase.expectedStatus != http.StatusOK {
+					t.Error("expected the request to be refused, but it was relayed")
+				}
+			default:
+				if testCase.expectedStatus == http.StatusOK {
+					t.Error("expected the request to be relayed, but the target socket received nothing")
+				}
+			}
+		})
+	}
+}
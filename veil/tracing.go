@@ -0,0 +1,121 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName : Name of the instrumentation producing the veil's spans
+const tracerName string = "github.com/pdulapalli/unix-socket-http-veil/veil"
+
+// defaultTracingServiceName : Service name under which spans are exported,
+// unless OTEL_SERVICE_NAME or OTEL_RESOURCE_ATTRIBUTES names another
+const defaultTracingServiceName string = "veil"
+
+// traceContextPropagator : Carries trace context between services in the W3C
+// traceparent and tracestate headers
+var traceContextPropagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// newTracerProvider : Returns a tracer provider exporting spans over OTLP/HTTP,
+// configured through the standard OTEL_EXPORTER_OTLP_* and OTEL_TRACES_SAMPLER
+// environment variables. Spans are exported in batches, and those still
+// pending are flushed when the provider shuts down.
+func newTracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Attributes from the environment take precedence over the default
+	// service name
+	tracingResource, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", defaultTracingServiceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(tracingResource),
+	), nil
+}
+
+// withTracing : Wraps a request handler such that a span is recorded for every
+// request it serves, continuing any trace whose context the client sent
+func withTracing(tracer trace.Tracer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := traceContextPropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("veil.request_id", r.Header.Get(requestIDHeader)),
+			),
+		)
+		defer span.End()
+
+		var recordingWriter *statusRecordingResponseWriter = &statusRecordingResponseWriter{ResponseWriter: w}
+		r, outcome := withRequestOutcome(r.WithContext(ctx))
+		next.ServeHTTP(recordingWriter, r)
+
+		decision, upstreamError := outcome.snapshot()
+		if recordingWriter.statusCode == 0 {
+			recordingWriter.statusCode = http.StatusOK
+		}
+
+		span.SetAttributes(
+			attribute.Int("http.response.status_code", recordingWriter.statusCode),
+			attribute.String("veil.decision", decision),
+		)
+
+		if upstreamError != nil {
+			span.RecordError(upstreamError)
+		}
+
+		if recordingWriter.statusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recordingWriter.statusCode))
+		}
+	})
+}
+
+// injectTraceContext : Replaces any trace context in the headers of a request
+// being relayed with that of the span in the context, so that the target
+// socket's spans are recorded as its children. Headers are left untouched when
+// tracing is disabled.
+func injectTraceContext(ctx context.Context, header http.Header) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+
+	traceContextPropagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
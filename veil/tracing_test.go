@@ -0,0 +1,132 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// incomingTraceParent : Trace context sent by a client whose trace the veil
+// continues
+const incomingTraceParent string = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTracing(t *testing.T) {
+	var upstreamTraceParents chan string = make(chan string, 1)
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceParents <- r.Header.Get("Traceparent")
+		if r.URL.Path == "/v2/failing" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	testCases := []struct {
+		name               string
+		requestURI         string
+		traceParent        string
+		expectedStatus     int
+		expectedSpanStatus codes.Code
+		expectedTraceID    string
+		expectedParentSpan string
+	}{
+		{name: "new trace", requestURI: "/v2/snaps", expectedStatus: http.StatusOK, expectedSpanStatus: codes.Unset},
+		{name: "continued trace", requestURI: "/v2/snaps", traceParent: incomingTraceParent, expectedStatus: http.StatusOK, expectedSpanStatus: codes.Unset, expectedTraceID: "4bf92f3577b34da6a3ce929d0e0e4736", expectedParentSpan: "00f067aa0ba902b7"},
+		{name: "failed request", requestURI: "/v2/failing", expectedStatus: http.StatusServiceUnavailable, expectedSpanStatus: codes.Error},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var exporter *tracetest.InMemoryExporter = tracetest.NewInMemoryExporter()
+			var tracerProvider *sdktrace.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+			defer tracerProvider.Shutdown(context.Background())
+
+			var r *http.Request = httptest.NewRequest(http.MethodGet, testCase.requestURI, nil)
+			if len(testCase.traceParent) > 0 {
+				r.Header.Set("Traceparent", testCase.traceParent)
+			}
+
+			var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+			withTracing(tracerProvider.Tracer(tracerName), newTestRelay([]string{targetSocketPath}, relayOptions{})).ServeHTTP(recorder, r)
+			if recorder.Code != testCase.expectedStatus {
+				t.Fatalf("expected status %d, got %d", testCase.expectedStatus, recorder.Code)
+			}
+
+			var spans tracetest.SpanStubs = exporter.GetSpans()
+			if len(spans) != 1 {
+				t.Fatalf("expected 1 span, got %d", len(spans))
+			}
+
+			var span tracetest.SpanStub = spans[0]
+			if span.Name != http.MethodGet || span.SpanKind != trace.SpanKindServer {
+				t.Errorf("expected a server span named GET, got a %v span named %s", span.SpanKind, span.Name)
+			}
+
+			var attributes map[string]string = map[string]string{}
+			for _, attribute := range span.Attributes {
+				attributes[string(attribute.Key)] = attribute.Value.Emit()
+			}
+
+			if attributes["url.path"] != testCase.requestURI {
+				t.Errorf("expected the path %s to be recorded, got %q", testCase.requestURI, attributes["url.path"])
+			}
+
+			if attributes["http.response.status_code"] != strconv.Itoa(testCase.expectedStatus) {
+				t.Errorf("expected the status %d to be recorded, got %q", testCase.expectedStatus, attributes["http.response.status_code"])
+			}
+
+			if span.Status.Code != testCase.expectedSpanStatus {
+				t.Errorf("expected the span status %v, got %v", testCase.expectedSpanStatus, span.Status.Code)
+			}
+
+			if len(testCase.expectedTraceID) > 0 {
+				if traceID := span.SpanContext.TraceID().String(); traceID != testCase.expectedTraceID {
+					t.Errorf("expected the trace %s to be continued, got %s", testCase.expectedTraceID, traceID)
+				}
+
+				if parentSpanID := span.Parent.SpanID().String(); parentSpanID != testCase.expectedParentSpan {
+					t.Errorf("expected the parent span %s, got %s", testCase.expectedParentSpan, parentSpanID)
+				}
+			} else if span.Parent.IsValid() {
+				t.Errorf("expected a new trace, got the parent span %s", span.Parent.SpanID())
+			}
+
+			// The target socket's spans are recorded as children of the span
+			var expectedTraceParent string = "00-" + span.SpanContext.TraceID().String() + "-" + span.SpanContext.SpanID().String() + "-01"
+			if traceParent := <-upstreamTraceParents; traceParent != expectedTraceParent {
+				t.Errorf("expected the target socket to receive the trace context %s, got %s", expectedTraceParent, traceParent)
+			}
+		})
+	}
+}
+
+func TestInjectTraceContextWithoutSpan(t *testing.T) {
+	var header http.Header = http.Header{"Traceparent": {incomingTraceParent}}
+	injectTraceContext(context.Background(), header)
+	if traceParent := header.Get("Traceparent"); traceParent != incomingTraceParent {
+		t.Errorf("expected the trace context to be left untouched, got %s", traceParent)
+	}
+}
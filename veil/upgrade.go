@@ -0,0 +1,175 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// isUpgradeRequest : Reports whether a request asks to switch the connection
+// to another protocol, as is done to establish a WebSocket
+func isUpgradeRequest(r *http.Request) bool {
+	if len(r.Header.Get("Upgrade")) == 0 {
+		return false
+	}
+
+	for _, connectionValue := range r.Header["Connection"] {
+		for _, token := range strings.Split(connectionValue, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// relayUpgradeRequest : Relays a protocol upgrade request to the first of the
+// target sockets that can be dialed, over a dedicated connection. Should the
+// target socket agree to switch protocols, the client connection is taken over
+// from the HTTP server and bytes are copied in both directions until either
+// side closes its connection. Otherwise, the target socket's response is
+// relayed as usual.
+func relayUpgradeRequest(w http.ResponseWriter, r *http.Request, upstreams []*targetUpstream, requestURL *url.URL, timeout time.Duration, options relayOptions) {
+	hijacker, canHijack := w.(http.Hijacker)
+	if !canHijack {
+		writeErrorResponse(w, r, http.StatusInternalServerError, internalErrorString)
+		return
+	}
+
+	var dialTimeout time.Duration = timeout
+	if options.dialTimeout > 0 && options.dialTimeout < timeout {
+		dialTimeout = options.dialTimeout
+	}
+
+	var upstreamConnection net.Conn
+	var errDial error
+	for _, upstream := range upstreams {
+		if upstreamConnection, errDial = net.DialTimeout("unix", upstream.socketPath, dialTimeout); errDial == nil {
+			break
+		}
+
+		logWarn("Skipping target socket", upstream.socketPath, "for", r.Method, r.URL.Path, "after dial error:", errDial)
+	}
+
+	if errDial != nil {
+		statusCode, message, _ := relayFailureResponse(errDial, nil)
+		recordUpstreamError(r.Context(), errDial)
+		writeErrorResponse(w, r, statusCode, message)
+		return
+	}
+
+	defer upstreamConnection.Close()
+
+	httpRequest, errReqCreate := http.NewRequest(r.Method, requestURL.String(), nil)
+	if errReqCreate != nil {
+		writeErrorResponse(w, r, http.StatusInternalServerError, internalErrorString)
+		return
+	}
+
+	copyHeaders(httpRequest.Header, r.Header)
+	for _, strippedHeader := range options.strippedRequestHeaders {
+		httpRequest.Header.Del(strippedHeader)
+	}
+
+	httpRequest.Header.Set("Connection", "Upgrade")
+	httpRequest.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+	appendViaHeader(httpRequest.Header, r.ProtoMajor, r.ProtoMinor, options.viaPseudonym)
+	injectTraceContext(r.Context(), httpRequest.Header)
+
+	// The handshake is bounded by the request timeout, but the upgraded
+	// connection may then stay open indefinitely
+	upstreamConnection.SetDeadline(time.Now().Add(timeout))
+	var upstreamReader *bufio.Reader = bufio.NewReader(upstreamConnection)
+	if err := httpRequest.Write(upstreamConnection); err != nil {
+		statusCode, message, _ := relayFailureResponse(err, nil)
+		recordUpstreamError(r.Context(), err)
+		writeErrorResponse(w, r, statusCode, message)
+		return
+	}
+
+	response, errResponse := http.ReadResponse(upstreamReader, httpRequest)
+	if errResponse != nil {
+		statusCode, message, _ := relayFailureResponse(errResponse, nil)
+		recordUpstreamError(r.Context(), errResponse)
+		writeErrorResponse(w, r, statusCode, message)
+		return
+	}
+
+	defer response.Body.Close()
+	upstreamConnection.SetDeadline(time.Time{})
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		copyHeaders(w.Header(), response.Header)
+		applyResponseHeaders(w.Header(), options.responseHeaders)
+		appendViaHeader(w.Header(), response.ProtoMajor, response.ProtoMinor, options.viaPseudonym)
+		w.WriteHeader(response.StatusCode)
+		if _, errCopy := io.Copy(w, response.Body); errCopy != nil {
+			logError("Error relaying response for", r.Method, r.URL.Path, errCopy)
+			recordUpstreamError(r.Context(), errCopy)
+		}
+		return
+	}
+
+	clientConnection, clientBuffer, errHijack := hijacker.Hijack()
+	if errHijack != nil {
+		logError("Unable to take over connection for", r.Method, r.URL.Path, errHijack)
+		return
+	}
+
+	defer clientConnection.Close()
+
+	appendViaHeader(response.Header, response.ProtoMajor, response.ProtoMinor, options.viaPseudonym)
+
+	// Headers set by the veil itself, such as the request ID, accompany those
+	// of the target socket's response
+	for headerName, headerValues := range w.Header() {
+		if _, exists := response.Header[headerName]; !exists {
+			response.Header[headerName] = headerValues
+		}
+	}
+
+	fmt.Fprintf(clientBuffer, "HTTP/1.1 %d %s\r\n", response.StatusCode, http.StatusText(response.StatusCode))
+	response.Header.Write(clientBuffer)
+	clientBuffer.WriteString("\r\n")
+	if err := clientBuffer.Flush(); err != nil {
+		logError("Error relaying upgrade response for", r.Method, r.URL.Path, err)
+		return
+	}
+
+	var copyErrors chan error = make(chan error, 2)
+	go func() {
+		_, err := io.Copy(upstreamConnection, clientBuffer)
+		copyErrors <- err
+	}()
+	go func() {
+		_, err := io.Copy(clientConnection, upstreamReader)
+		copyErrors <- err
+	}()
+
+	// Once either side finishes, closing both connections ends the other copy
+	<-copyErrors
+}
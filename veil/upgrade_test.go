@@ -0,0 +1,187 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// webSocketGUID : Appended to the key of a WebSocket handshake to derive the
+// key accepting it
+const webSocketGUID string = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// webSocketAccept : Returns the Sec-WebSocket-Accept value answering the key
+func webSocketAccept(key string) string {
+	var digest [sha1.Size]byte = sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// writeWebSocketFrame : Writes a short, final text frame, masked as a client
+// must do
+func writeWebSocketFrame(w io.Writer, payload []byte, masked bool) error {
+	var frame []byte = []byte{0x81, byte(len(payload))}
+	if !masked {
+		frame = append(frame, payload...)
+		_, err := w.Write(frame)
+		return err
+	}
+
+	var mask []byte = []byte{0x12, 0x34, 0x56, 0x78}
+	frame[1] |= 0x80
+	frame = append(frame, mask...)
+	for i, payloadByte := range payload {
+		frame = append(frame, payloadByte^mask[i%len(mask)])
+	}
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// readWebSocketFrame : Reads a short frame, unmasking its payload if masked
+func readWebSocketFrame(r *bufio.Reader) ([]byte, error) {
+	var header []byte = make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	var length int = int(header[1] & 0x7f)
+	if length >= 126 {
+		return nil, errors.New("frame too long for the test")
+	}
+
+	var mask []byte
+	if header[1]&0x80 != 0 {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(r, mask); err != nil {
+			return nil, err
+		}
+	}
+
+	var payload []byte = make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	if mask != nil {
+		for i := range payload {
+			payload[i] ^= mask[i%len(mask)]
+		}
+	}
+
+	return payload, nil
+}
+
+// webSocketEchoHandler : Completes a WebSocket handshake, then echoes the
+// frames it receives until the connection closes
+func webSocketEchoHandler(w http.ResponseWriter, r *http.Request) {
+	connection, buffered, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer connection.Close()
+
+	io.WriteString(connection, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+webSocketAccept(r.Header.Get("Sec-WebSocket-Key"))+"\r\n\r\n")
+	for {
+		payload, err := readWebSocketFrame(buffered.Reader)
+		if err != nil {
+			return
+		}
+
+		if err := writeWebSocketFrame(connection, payload, false); err != nil {
+			return
+		}
+	}
+}
+
+func TestRelayWebSocket(t *testing.T) {
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(webSocketEchoHandler))
+	var relay http.HandlerFunc = newTestRelay([]string{targetSocketPath}, relayOptions{})
+	var router http.Handler = createAccessRulesRouter(loadTestAccessRules(t, "GET~/v2/ws/*\n!GET~/v2/ws/private\n"), routingOptions{}, relay)
+	var server *httptest.Server = httptest.NewServer(router)
+	defer server.Close()
+
+	testCases := []struct {
+		name           string
+		requestURI     string
+		expectedStatus int
+	}{
+		{name: "allowed path", requestURI: "/v2/ws/echo", expectedStatus: http.StatusSwitchingProtocols},
+		{name: "denied path", requestURI: "/v2/ws/private", expectedStatus: http.StatusUnauthorized},
+		{name: "unlisted path", requestURI: "/v2/snaps", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			connection, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer connection.Close()
+			connection.SetDeadline(time.Now().Add(5 * time.Second))
+
+			const key string = "dGhlIHNhbXBsZSBub25jZQ=="
+			io.WriteString(connection, "GET "+testCase.requestURI+" HTTP/1.1\r\nHost: veil\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+				"Sec-WebSocket-Key: "+key+"\r\nSec-WebSocket-Version: 13\r\n\r\n")
+
+			var reader *bufio.Reader = bufio.NewReader(connection)
+			response, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Fatalf("expected status %d, got %d", testCase.expectedStatus, response.StatusCode)
+			}
+
+			if testCase.expectedStatus != http.StatusSwitchingProtocols {
+				return
+			}
+
+			if accept := response.Header.Get("Sec-WebSocket-Accept"); accept != webSocketAccept(key) {
+				t.Fatalf("expected the handshake to be accepted with %q, got %q", webSocketAccept(key), accept)
+			}
+
+			for _, message := range []string{"hello", strings.Repeat("veil", 20)} {
+				if err := writeWebSocketFrame(connection, []byte(message), true); err != nil {
+					t.Fatal(err)
+				}
+
+				echoed, err := readWebSocketFrame(reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if string(echoed) != message {
+					t.Errorf("expected %q to be echoed, got %q", message, echoed)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// targetUpstream : One of the target sockets that requests are relayed to,
+// with the client holding its pool of connections and the outcome of its
+// latest health check
+type targetUpstream struct {
+	socketPath string
+	client     *http.Client
+
+	mutex     sync.Mutex
+	healthy   bool
+	checkedAt time.Time
+	changedAt time.Time
+	lastError error
+}
+
+// newTargetUpstreams : Creates an upstream for each of the target sockets,
+// each considered healthy until a health check finds otherwise
+func newTargetUpstreams(targetSocketPaths []string, options relayOptions) []*targetUpstream {
+	var upstreams []*targetUpstream = []*targetUpstream{}
+	for _, targetSocketPath := range targetSocketPaths {
+		upstreams = append(upstreams, &targetUpstream{
+			socketPath: targetSocketPath,
+			client:     createUnixSocketHTTPClient(targetSocketPath, options),
+			healthy:    true,
+			changedAt:  time.Now(),
+		})
+	}
+
+	return upstreams
+}
+
+// isHealthy : Reports whether the upstream passed its latest health check
+func (upstream *targetUpstream) isHealthy() bool {
+	upstream.mutex.Lock()
+	defer upstream.mutex.Unlock()
+
+	return upstream.healthy
+}
+
+// recordHealth : Notes the outcome of a health check of the upstream, logging
+// when it goes down or comes back up
+func (upstream *targetUpstream) recordHealth(err error) {
+	upstream.mutex.Lock()
+	defer upstream.mutex.Unlock()
+
+	var healthy bool = err == nil
+	if healthy != upstream.healthy {
+		if healthy {
+			logInfo("Target socket", upstream.socketPath, "passed its health check and is back in rotation")
+		} else {
+			logWarn("Target socket", upstream.socketPath, "failed its health check and is out of rotation:", err)
+		}
+
+		upstream.healthy = healthy
+		upstream.changedAt = time.Now()
+	}
+
+	upstream.checkedAt = time.Now()
+	upstream.lastError = err
+}
+
+// checkHealth : Checks whether the upstream can serve requests, by dialing its
+// socket or, given a health path, by requesting that path and expecting a 2xx
+// status. The check fails if it does not complete within the timeout.
+func (upstream *targetUpstream) checkHealth(healthPath string, timeout time.Duration) error {
+	if len(healthPath) == 0 {
+		targetConnection, err := net.DialTimeout("unix", upstream.socketPath, timeout)
+		if err != nil {
+			return err
+		}
+
+		return targetConnection.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://unix"+healthPath, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := upstream.client.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("health path %s answered with status %d", healthPath, response.StatusCode)
+	}
+
+	return nil
+}
+
+// rotateUpstreams : Orders the upstreams in which a request tries them,
+// starting from the one whose turn it is among those that are healthy. Should
+// none be healthy, every upstream is tried regardless, in case the health
+// checks are out of date.
+func rotateUpstreams(upstreams []*targetUpstream, turn uint64) []*targetUpstream {
+	var healthyUpstreams []*targetUpstream = []*targetUpstream{}
+	for _, upstream := range upstreams {
+		if upstream.isHealthy() {
+			healthyUpstreams = append(healthyUpstreams, upstream)
+		}
+	}
+
+	if len(healthyUpstreams) == 0 {
+		healthyUpstreams = upstreams
+	}
+
+	var first int = int(turn % uint64(len(healthyUpstreams)))
+	return append(append([]*targetUpstream{}, healthyUpstreams[first:]...), healthyUpstreams[:first]...)
+}
+
+// watchTargetHealth : Checks the health of the upstream once per interval
+// until the Veil is shut down, so that the upstream is taken out of rotation
+// while it fails its checks. Each check must complete within the interval.
+func (v *Veil) watchTargetHealth(upstream *targetUpstream) {
+	var interval time.Duration = v.options.TargetHealthInterval
+	var ticker *time.Ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		upstream.recordHealth(upstream.checkHealth(v.options.TargetHealthPath, interval))
+
+		select {
+		case <-v.stopWatching:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// namedTargetSocket : Serves a target socket that names itself in the
+// X-Target header of each response, returning the socket path
+func namedTargetSocket(t *testing.T, name string) string {
+	t.Helper()
+
+	return startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Target", name)
+	}))
+}
+
+func TestRotateUpstreams(t *testing.T) {
+	testCases := []struct {
+		name          string
+		healthy       []bool
+		turn          uint64
+		expectedOrder string
+	}{
+		{name: "first turn", healthy: []bool{true, true, true}, turn: 0, expectedOrder: "a,b,c"},
+		{name: "second turn", healthy: []bool{true, true, true}, turn: 1, expectedOrder: "b,c,a"},
+		{name: "turn past the end", healthy: []bool{true, true, true}, turn: 5, expectedOrder: "c,a,b"},
+		{name: "unhealthy upstream left out", healthy: []bool{true, false, true}, turn: 1, expectedOrder: "c,a"},
+		{name: "none healthy", healthy: []bool{false, false, false}, turn: 1, expectedOrder: "b,c,a"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var upstreams []*targetUpstream = newTargetUpstreams([]string{"a", "b", "c"}, relayOptions{})
+			for i, healthy := range testCase.healthy {
+				if !healthy {
+					upstreams[i].recordHealth(errors.New("unreachable"))
+				}
+			}
+
+			var order []string = []string{}
+			for _, upstream := range rotateUpstreams(upstreams, testCase.turn) {
+				order = append(order, upstream.socketPath)
+			}
+
+			if strings.Join(order, ",") != testCase.expectedOrder {
+				t.Errorf("expected the order %s, got %s", testCase.expectedOrder, strings.Join(order, ","))
+			}
+		})
+	}
+}
+
+func TestRelayRoundRobin(t *testing.T) {
+	var relay http.HandlerFunc = newTestRelay([]string{namedTargetSocket(t, "a"), namedTargetSocket(t, "b")}, relayOptions{})
+
+	var targets []string = []string{}
+	for i := 0; i < 4; i++ {
+		var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+		relay(recorder, httptest.NewRequest(http.MethodGet, "/v2/snaps", nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", recorder.Code)
+		}
+
+		targets = append(targets, recorder.Header().Get("X-Target"))
+	}
+
+	if expectedTargets := []string{"a", "b", "a", "b"}; !reflect.DeepEqual(targets, expectedTargets) {
+		t.Errorf("expected the requests to be spread as %v, got %v", expectedTargets, targets)
+	}
+}
+
+func TestRelaySkipsDeadUpstream(t *testing.T) {
+	var targetSocketPaths []string = []string{namedTargetSocket(t, "live"), filepath.Join(t.TempDir(), "dead.sock")}
+
+	testCases := []struct {
+		name             string
+		method           string
+		expectedStatuses []int
+	}{
+		{name: "idempotent requests", method: http.MethodGet, expectedStatuses: []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK}},
+		{name: "non-idempotent requests", method: http.MethodPost, expectedStatuses: []int{http.StatusOK, http.StatusBadGateway, http.StatusOK, http.StatusBadGateway}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var relay http.HandlerFunc = newTestRelay(targetSocketPaths, relayOptions{})
+
+			// Idempotent requests whose turn falls to the dead upstream are
+			// relayed to the live one instead, while others are not retried
+			// in case the target socket acted upon them
+			for i, expectedStatus := range testCase.expectedStatuses {
+				var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+				relay(recorder, httptest.NewRequest(testCase.method, "/v2/snaps", nil))
+				if recorder.Code != expectedStatus {
+					t.Errorf("expected request %d to get status %d, got %d", i+1, expectedStatus, recorder.Code)
+				}
+
+				if expectedStatus == http.StatusOK && recorder.Header().Get("X-Target") != "live" {
+					t.Errorf("expected request %d to be relayed to the live upstream, got %q", i+1, recorder.Header().Get("X-Target"))
+				}
+			}
+		})
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/failing":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/slow":
+			<-r.Context().Done()
+		}
+	}))
+	var deadSocketPath string = filepath.Join(t.TempDir(), "dead.sock")
+
+	testCases := []struct {
+		name          string
+		socketPath    string
+		healthPath    string
+		expectHealthy bool
+	}{
+		{name: "dialed", socketPath: targetSocketPath, expectHealthy: true},
+		{name: "dead socket dialed", socketPath: deadSocketPath, expectHealthy: false},
+		{name: "healthy path", socketPath: targetSocketPath, healthPath: "/healthz", expectHealthy: true},
+		{name: "failing path", socketPath: targetSocketPath, healthPath: "/failing", expectHealthy: false},
+		{name: "slow path", socketPath: targetSocketPath, healthPath: "/slow", expectHealthy: false},
+		{name: "dead socket requested", socketPath: deadSocketPath, healthPath: "/healthz", expectHealthy: false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var upstream *targetUpstream = newTargetUpstreams([]string{testCase.socketPath}, relayOptions{})[0]
+			if err := upstream.checkHealth(testCase.healthPath, 100*time.Millisecond); (err == nil) != testCase.expectHealthy {
+				t.Errorf("expected healthy to be %t, got error %v", testCase.expectHealthy, err)
+			}
+		})
+	}
+}
+
+func TestRecordHealth(t *testing.T) {
+	var upstream *targetUpstream = newTargetUpstreams([]string{"a"}, relayOptions{})[0]
+
+	testCases := []struct {
+		name            string
+		err             error
+		expectedHealthy bool
+		expectedChange  bool
+	}{
+		{name: "still healthy", err: nil, expectedHealthy: true, expectedChange: false},
+		{name: "goes down", err: errors.New("unreachable"), expectedHealthy: false, expectedChange: true},
+		{name: "still down", err: errors.New("unreachable"), expectedHealthy: false, expectedChange: false},
+		{name: "comes back", err: nil, expectedHealthy: true, expectedChange: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var changedAt time.Time = upstream.changedAt
+			upstream.recordHealth(testCase.err)
+			if upstream.isHealthy() != testCase.expectedHealthy {
+				t.Errorf("expected healthy to be %t", testCase.expectedHealthy)
+			}
+
+			if changed := upstream.changedAt != changedAt; changed != testCase.expectedChange {
+				t.Errorf("expected the health to have changed to be %t", testCase.expectedChange)
+			}
+
+			if upstream.checkedAt.IsZero() || upstream.lastError != testCase.err {
+				t.Errorf("expected the check to be recorded with error %v, got %v at %v", testCase.err, upstream.lastError, upstream.checkedAt)
+			}
+		})
+	}
+}
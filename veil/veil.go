@@ -0,0 +1,1004 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+// Package veil relays HTTP requests from an exposed socket to a target UNIX
+// Domain Socket, permitting only those requests allowed by an access rules list.
+package veil
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thoas/go-funk"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/time/rate"
+)
+
+// DefaultRequestTimeout : Maximum duration of a relayed request when none is
+// configured
+const DefaultRequestTimeout time.Duration = 5 * time.Second
+
+// DefaultHealthPath : Conventional path of the built-in health endpoint
+const DefaultHealthPath string = "/healthz"
+
+// DefaultViaPseudonym : Name by which the veil identifies itself in the Via
+// header when none is configured
+const DefaultViaPseudonym string = "unix-socket-http-veil"
+
+// DefaultAccessRuleDelimiter : Character separating the fields of a text access
+// rule when none is configured
+const DefaultAccessRuleDelimiter string = "~"
+
+// LogFormatText : Writes the access log as human-readable text
+const LogFormatText string = "text"
+
+// LogFormatJSON : Writes the access log as one JSON object per request
+const LogFormatJSON string = "json"
+
+// DefaultBreakerWindow : Period within which consecutive upstream failures
+// trip the circuit breaker when none is configured
+const DefaultBreakerWindow time.Duration = 10 * time.Second
+
+// DefaultBreakerCooldown : Period for which a tripped circuit breaker refuses
+// requests when none is configured
+const DefaultBreakerCooldown time.Duration = 5 * time.Second
+
+// DecisionAllowed : Access decision for requests relayed to the target socket
+const DecisionAllowed string = "allowed"
+
+// DecisionForbidden : Access decision for requests refused by the access rules
+const DecisionForbidden string = "forbidden"
+
+// DecisionNotFound : Access decision for requests whose path no access rule
+// covers
+const DecisionNotFound string = "not-found"
+
+// DecisionRateLimited : Access decision for requests refused for exceeding the
+// rate limit of the access rule they match
+const DecisionRateLimited string = "rate-limited"
+
+// DecisionInvalidBody : Access decision for requests refused because the
+// access rule they match does not accept their body's content type, or the
+// body does not conform to the rule's schema
+const DecisionInvalidBody string = "invalid-body"
+
+// DecisionPreflight : Access decision for CORS preflight requests, which are
+// answered by the veil itself
+const DecisionPreflight string = "preflight"
+
+// DecisionDryRunForbidden : Access decision for requests relayed in dry-run
+// mode that the access rules would otherwise have refused
+const DecisionDryRunForbidden string = "dry-run-forbidden"
+
+// DecisionDryRunNotFound : Access decision for requests relayed in dry-run
+// mode whose path no access rule covers
+const DecisionDryRunNotFound string = "dry-run-not-found"
+
+const singleSegmentWildcard string = "*"
+const multiSegmentWildcard string = "**"
+const regexpPathPrefix string = "re:"
+const prefixPathPrefix string = "prefix:"
+const denyMethodPrefix string = "!"
+const ruleCommentMarker string = "#"
+const ambiguousPathCharacters string = "?#"
+const ruleIncludeDirective string = "include"
+const tcpAddressScheme string = "tcp://"
+const unixAddressScheme string = "unix://"
+const unixAddressShortScheme string = "unix:"
+const ruleOptionTimeout string = "timeout"
+const ruleOptionUID string = "uid"
+const ruleOptionGID string = "gid"
+const ruleOptionCommonName string = "cn"
+const ruleOptionRewrite string = "rewrite"
+const ruleOptionRate string = "rate"
+const ruleOptionHeader string = "header"
+const ruleOptionQuery string = "query"
+const ruleOptionWindow string = "window"
+const ruleOptionSchema string = "schema"
+const ruleOptionContentType string = "content-type"
+
+// missingContentTypeToken : Entry of a rule's list of accepted media types
+// standing for requests without a Content-Type
+const missingContentTypeToken string = "none"
+const accessRulesFormatText string = "text"
+const accessRulesFormatJSON string = "json"
+const accessRulesFragmentPattern string = "*.conf"
+const accessRulesFormatYAML string = "yaml"
+const requestIDHeader string = "X-Request-Id"
+const adminSocketMode os.FileMode = 0600
+const clientClosedRequestStatus int = 499
+const healthCheckDialTimeout time.Duration = 1 * time.Second
+const targetSocketPollInterval time.Duration = 100 * time.Millisecond
+const expectContinueTimeout time.Duration = 1 * time.Second
+const rulesWatchPollInterval time.Duration = 250 * time.Millisecond
+const rulesWatchDebouncePeriod time.Duration = 500 * time.Millisecond
+const retryBackoffInterval time.Duration = 100 * time.Millisecond
+const unauthorizedMsgString string = "{\"type\":\"error\",\"status-code\":401,\"status\":\"Unauthorized\",\"result\":{\"message\":\"access denied\"}}"
+const methodNotAllowedString string = "{\"type\":\"error\",\"status-code\":405,\"status\":\"Method Not Allowed\",\"result\":{\"message\":\"method not allowed for this path\"}}"
+const unknownMsgString string = "{\"type\":\"error\",\"status-code\":404,\"status\":\"Not Found\",\"result\":{\"message\":\"not found\"}}"
+const badRequestString string = "{\"type\":\"error\",\"status-code\":400,\"status\":\"Invalid Request\",\"result\":{\"message\":\"bad request\"}}"
+const ambiguousPathString string = "{\"type\":\"error\",\"status-code\":400,\"status\":\"Invalid Request\",\"result\":{\"message\":\"request path contains an encoded ? or #\"}}"
+const requestTimeoutString string = "{\"type\":\"error\",\"status-code\":408,\"status\":\"Request Timeout\",\"result\":{\"message\":\"request timed out\"}}"
+const gatewayTimeoutString string = "{\"type\":\"error\",\"status-code\":504,\"status\":\"Gateway Timeout\",\"result\":{\"message\":\"target socket timed out\"}}"
+const badGatewayString string = "{\"type\":\"error\",\"status-code\":502,\"status\":\"Bad Gateway\",\"result\":{\"message\":\"request to target socket failed\"}}"
+const targetUnreachableString string = "{\"type\":\"error\",\"status-code\":502,\"status\":\"Bad Gateway\",\"result\":{\"message\":\"target socket unreachable\"}}"
+const serviceUnavailableString string = "{\"type\":\"error\",\"status-code\":503,\"status\":\"Service Unavailable\",\"result\":{\"message\":\"target socket unreachable\"}}"
+const tooManyRequestsInFlightString string = "{\"type\":\"error\",\"status-code\":503,\"status\":\"Service Unavailable\",\"result\":{\"message\":\"too many requests in flight\"}}"
+const tooManyRequestsString string = "{\"type\":\"error\",\"status-code\":429,\"status\":\"Too Many Requests\",\"result\":{\"message\":\"rate limit exceeded\"}}"
+const responseTooLargeString string = "{\"type\":\"error\",\"status-code\":502,\"status\":\"Bad Gateway\",\"result\":{\"message\":\"response from target socket too large\"}}"
+const unsupportedMediaTypeString string = "{\"type\":\"error\",\"status-code\":415,\"status\":\"Unsupported Media Type\",\"result\":{\"message\":\"content type not accepted for this path\"}}"
+const requestEntityTooLargeString string = "{\"type\":\"error\",\"status-code\":413,\"status\":\"Request Entity Too Large\",\"result\":{\"message\":\"request body too large\"}}"
+const healthyString string = "{\"type\":\"sync\",\"status-code\":200,\"status\":\"OK\",\"result\":{\"message\":\"healthy\"}}"
+const circuitOpenString string = "{\"type\":\"error\",\"status-code\":503,\"status\":\"Service Unavailable\",\"result\":{\"message\":\"target socket temporarily unavailable\"}}"
+const forbiddenAddressString string = "{\"type\":\"error\",\"status-code\":403,\"status\":\"Forbidden\",\"result\":{\"message\":\"client address not allowed\"}}"
+const internalErrorString string = "{\"type\":\"error\",\"status-code\":500,\"status\":\"Internal Server Error\",\"result\":{\"message\":\"internal server error\"}}"
+
+// supportedHTTPMethods : HTTP method types that may be relayed to the target
+// socket
+var supportedHTTPMethods []string = []string{
+	http.MethodDelete,
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPatch,
+	http.MethodPost,
+	http.MethodPut,
+}
+
+// idempotentHTTPMethods : HTTP method types whose requests may safely be
+// relayed to the target socket more than once
+var idempotentHTTPMethods []string = []string{
+	http.MethodDelete,
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPut,
+}
+
+// anyMethodTokens : Method tokens that grant a rule every supported HTTP
+// method type
+var anyMethodTokens []string = []string{"*", "ANY"}
+
+// builtInMethodAliases : Method tokens that grant a rule a group of HTTP
+// method types, unless redefined by a custom alias of the same name
+var builtInMethodAliases map[string][]string = map[string][]string{
+	"READ":  {http.MethodGet, http.MethodHead},
+	"WRITE": {http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+}
+
+// hopByHopHeaders : Headers that are meaningful only for a single transport
+// connection and so must not be relayed between the client and target socket
+var hopByHopHeaders []string = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Options : Configuration of a Veil. Only the socket addresses and the access
+// rules list are required; the zero value of every other field selects the
+// default behavior.
+type Options struct {
+	// TargetSocketPath is the UNIX Domain Socket that permitted requests are
+	// relayed to
+	TargetSocketPath string
+	// TargetSocketPaths lists several UNIX Domain Sockets, such as those of
+	// the worker processes of one backend, among which permitted requests are
+	// distributed in turn. It takes the place of TargetSocketPath when set.
+	TargetSocketPaths []string
+	// ExposedAddress is the path of the socket to expose, optionally prefixed
+	// with unix:// (or unix:), or a tcp://host:port address on which to listen
+	// instead
+	ExposedAddress string
+	// AccessRulesPath is the access rules list that requests are checked against
+	AccessRulesPath string
+	// AccessRulesFormat is "text", "json" or "yaml", and is inferred from the
+	// file extension of the access rules list if empty
+	AccessRulesFormat string
+	// LenientAccessRules skips malformed access rules instead of failing
+	LenientAccessRules bool
+	// AccessRuleDelimiter is the single character separating the fields of a
+	// text access rule, and defaults to DefaultAccessRuleDelimiter
+	AccessRuleDelimiter string
+	// MethodAliases defines method tokens that access rules may use in place
+	// of an HTTP method, each granting the HTTP methods it maps to, alongside
+	// the built-in READ (GET and HEAD) and WRITE (POST, PUT, PATCH and DELETE)
+	MethodAliases map[string][]string
+	// DefaultAllow relays requests that no access rule covers instead of
+	// refusing them, so that only deny rules refuse requests
+	DefaultAllow bool
+	// DryRun relays every request regardless of the access rules, recording
+	// in the access log the decision the access rules would have made
+	DryRun bool
+	// StrictTrailingSlash matches request paths only against rules whose paths
+	// agree on the presence of a trailing slash, instead of treating both forms
+	// of a path as equivalent
+	StrictTrailingSlash bool
+	// ImplicitHead permits HEAD requests wherever GET requests are permitted,
+	// and refuses them wherever GET requests are refused, for paths without
+	// rules of their own for HEAD
+	ImplicitHead bool
+	// HeadFromGet answers a HEAD request that the target socket does not
+	// support with the status and headers of the equivalent GET request,
+	// whose body is discarded
+	HeadFromGet bool
+	// TimeWindowZone is the name of the time zone, such as "Europe/Berlin" or
+	// "Local", in which the time windows of access rules are evaluated, and
+	// defaults to DefaultTimeWindowZone
+	TimeWindowZone string
+	// WatchAccessRules reloads the access rules list whenever it changes
+	WatchAccessRules bool
+
+	// WaitForTarget is how long New waits for the target socket to accept
+	// connections before giving up. New does not wait if it is zero.
+	WaitForTarget time.Duration
+	// TargetHealthInterval is how often each target socket is checked while
+	// serving, so that those failing their checks are left out of rotation
+	// until they pass again. Target sockets are not checked if it is zero.
+	TargetHealthInterval time.Duration
+	// TargetHealthPath is the path requested from each target socket to check
+	// its health, expecting a 2xx status. The target sockets are only dialed
+	// if it is empty.
+	TargetHealthPath string
+
+	// RequestTimeout bounds the duration of a relayed request, and defaults to
+	// DefaultRequestTimeout
+	RequestTimeout time.Duration
+	// DialTimeout bounds the time taken to connect to the target socket,
+	// separately from RequestTimeout, unless zero
+	DialTimeout time.Duration
+	// StrippedRequestHeaders are removed from requests before relaying them
+	StrippedRequestHeaders []string
+	// MaxConcurrentRequests limits the requests relayed at once, unless zero
+	MaxConcurrentRequests int
+	// Rate limits the requests served to this many per second, unless zero,
+	// while allowing bursts of up to Burst requests. Burst defaults to the
+	// rate, rounded up.
+	Rate  float64
+	Burst int
+	// UIDRate limits the requests served to each user connecting to the
+	// exposed socket, as identified by the credentials of its process, to
+	// this many per second, unless zero, while allowing bursts of up to
+	// UIDBurst requests. UIDBurst defaults to the rate, rounded up.
+	UIDRate  float64
+	UIDBurst int
+	// AllowedCIDRs, when not empty, restricts the clients served over TCP to
+	// those whose addresses lie within one of the listed CIDR blocks, refusing
+	// others before their requests are routed. Clients connecting to a UNIX
+	// Domain Socket are unaffected.
+	AllowedCIDRs []string
+	// MaxBodyBytes limits the size of relayed request bodies, unless zero
+	MaxBodyBytes int64
+	// CacheTTL enables an in-memory cache of the responses to GET requests
+	// permitted by the access rules, keyed by path and query, holding each
+	// successful response for this long. CacheMaxBytes bounds the total size
+	// of the bodies held, the least recently used being evicted beyond it, and
+	// defaults to DefaultCacheMaxBytes.
+	CacheTTL      time.Duration
+	CacheMaxBytes int64
+	// MaxResponseBytes limits the size of relayed response bodies, unless
+	// zero. Event streams are exempt.
+	MaxResponseBytes int64
+	// Retries is the number of times an idempotent request without a body is
+	// retried when the target socket cannot be reached
+	Retries int
+	// BreakerThreshold is the number of consecutive upstream failures within
+	// BreakerWindow that trips the circuit breaker, after which requests are
+	// refused for BreakerCooldown. The circuit breaker is disabled if zero.
+	BreakerThreshold int
+	BreakerWindow    time.Duration
+	BreakerCooldown  time.Duration
+
+	// MaxIdleConns and MaxIdleConnsPerHost bound the idle connections to the
+	// target socket that are kept open for reuse, and IdleConnTimeout is how
+	// long one may stay idle before it is closed. Since every connection is to
+	// the same socket, MaxIdleConnsPerHost is usually the effective bound. Zero
+	// values select the defaults of http.Transport.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+
+	// ViaPseudonym is the name by which the veil identifies itself in the Via
+	// header of relayed requests and responses, and defaults to
+	// DefaultViaPseudonym
+	ViaPseudonym string
+	// CompressResponses compresses relayed responses with gzip for clients
+	// that accept it, unless they are already encoded or compressed
+	CompressResponses bool
+	// DecompressRequests decompresses gzip-encoded request bodies before
+	// relaying them, for target sockets unable to decode them. MaxBodyBytes
+	// then limits the decompressed size.
+	DecompressRequests bool
+
+	// HealthPath is the path of the built-in health endpoint, which is disabled
+	// if empty
+	HealthPath string
+	// ErrorTemplatesPath is the path of a JSON file mapping status codes to
+	// templates for the bodies of the veil's error responses, which are
+	// built in if empty
+	ErrorTemplatesPath string
+	// CORSAllowedOrigins enables CORS for requests from these origins, or from
+	// every origin if it holds "*". Preflight requests are answered by the
+	// veil, permitting CORSAllowedMethods, which defaults to every supported
+	// method, and CORSAllowedHeaders. CORS is disabled if it is empty.
+	CORSAllowedOrigins []string
+	CORSAllowedMethods []string
+	CORSAllowedHeaders []string
+	// Tracing enables OpenTelemetry tracing, recording a span for every request
+	// and propagating its W3C trace context to the target socket. Spans are
+	// exported over OTLP/HTTP as configured by the standard OTEL_* environment
+	// variables.
+	Tracing bool
+	// ResponseHeadersPath is the path of a JSON file naming headers to add to
+	// relayed responses, such as X-Content-Type-Options, which none are if
+	// empty
+	ResponseHeadersPath string
+	// LogFormat is LogFormatText or LogFormatJSON, and defaults to text
+	LogFormat string
+	// LogLevel is LogLevelError, LogLevelWarn, LogLevelInfo or LogLevelDebug,
+	// and defaults to info. It applies to the veil's own log rather than the
+	// access log, and can be changed at runtime through the admin socket.
+	LogLevel string
+	// MetricsAddress is a host:port, optionally prefixed with tcp://, or an
+	// absolute socket path, optionally prefixed with unix:// (or unix:), on
+	// which to serve Prometheus metrics, which are disabled if empty
+	MetricsAddress string
+
+	// AdminSocketPath is the path of a UNIX Domain Socket, accessible only to
+	// the veil's user, on which to serve the admin API, which is disabled if
+	// empty
+	AdminSocketPath string
+	// AdminProfiling serves the runtime profiles of net/http/pprof on the
+	// admin socket, under /debug/pprof/
+	AdminProfiling bool
+
+	// TLSCertificatePath and TLSKeyPath serve a TCP listener over TLS
+	TLSCertificatePath string
+	TLSKeyPath         string
+	// ClientCAPath requires TLS clients to present a certificate issued by one
+	// of the certificate authorities it contains
+	ClientCAPath string
+
+	// SocketMode holds the permission bits of the exposed socket file, which
+	// are implied by the umask if zero
+	SocketMode os.FileMode
+	// SocketOwner and SocketGroup are the user and group, by name or ID, that
+	// the exposed socket file is assigned to
+	SocketOwner string
+	SocketGroup string
+	// User and Group are the user and group, by name or ID, that the process
+	// switches to once its sockets are bound, so that requests are not served
+	// with the privileges needed to bind them. Only supported on Linux.
+	User  string
+	Group string
+}
+
+// Veil : A relay between an exposed socket and a target socket, filtering the
+// requests that pass through it against an access rules list
+type Veil struct {
+	options Options
+
+	server   *http.Server
+	listener net.Listener
+	handler  *reloadableHandler
+	relay    http.HandlerFunc
+
+	upstreams []*targetUpstream
+
+	accessRulesMutex sync.RWMutex
+	accessRules      *AccessRules
+	dryRun           bool
+
+	timeWindowLocation *time.Location
+
+	metricsServer   *http.Server
+	metricsListener net.Listener
+
+	adminServer   *http.Server
+	adminListener net.Listener
+	stats         *relayStats
+	counters      *relayCounters
+
+	tracerProvider *sdktrace.TracerProvider
+
+	stopWatching chan struct{}
+	stopOnce     sync.Once
+}
+
+// validateOptions : Checks the options for values that cannot be used, filling
+// in the defaults for those left unset
+func validateOptions(options *Options) error {
+	if len(options.TargetSocketPaths) == 0 && len(options.TargetSocketPath) > 0 {
+		options.TargetSocketPaths = []string{options.TargetSocketPath}
+	}
+
+	for _, targetSocketPath := range options.TargetSocketPaths {
+		if len(targetSocketPath) == 0 {
+			return errors.New("target socket paths must not be empty")
+		}
+	}
+
+	if len(options.TargetSocketPaths) == 0 || len(options.ExposedAddress) == 0 || len(options.AccessRulesPath) == 0 {
+		return errors.New("the target socket, exposed address and access rules list are required")
+	}
+
+	if len(options.AccessRuleDelimiter) == 0 {
+		options.AccessRuleDelimiter = DefaultAccessRuleDelimiter
+	}
+
+	if err := validateAccessRuleDelimiter(options.AccessRuleDelimiter); err != nil {
+		return err
+	}
+
+	aliases, err := validateMethodAliases(options.MethodAliases, options.AccessRuleDelimiter)
+	if err != nil {
+		return err
+	}
+
+	options.MethodAliases = aliases
+
+	if options.RequestTimeout == 0 {
+		options.RequestTimeout = DefaultRequestTimeout
+	}
+
+	if options.RequestTimeout < 0 {
+		return fmt.Errorf("invalid timeout: %v (must be greater than zero)", options.RequestTimeout)
+	}
+
+	if options.WaitForTarget < 0 {
+		return fmt.Errorf("invalid wait for target: %v (must not be negative)", options.WaitForTarget)
+	}
+
+	if options.TargetHealthInterval < 0 {
+		return fmt.Errorf("invalid target health interval: %v (must not be negative)", options.TargetHealthInterval)
+	}
+
+	if len(options.TargetHealthPath) > 0 && !strings.HasPrefix(options.TargetHealthPath, "/") {
+		return fmt.Errorf("invalid target health path: %s (must begin with /)", options.TargetHealthPath)
+	}
+
+	if options.DialTimeout < 0 {
+		return fmt.Errorf("invalid dial timeout: %v (must not be negative)", options.DialTimeout)
+	}
+
+	if options.MaxConcurrentRequests < 0 {
+		return fmt.Errorf("invalid maximum concurrency: %d (must not be negative)", options.MaxConcurrentRequests)
+	}
+
+	if options.Rate < 0 || options.Burst < 0 {
+		return errors.New("the rate limit and burst must not be negative")
+	}
+
+	if options.UIDRate < 0 || options.UIDBurst < 0 {
+		return errors.New("the per-user rate limit and burst must not be negative")
+	}
+
+	if _, err := parseCIDRBlocks(options.AllowedCIDRs); err != nil {
+		return err
+	}
+
+	if options.MaxBodyBytes < 0 {
+		return fmt.Errorf("invalid maximum body size: %d (must not be negative)", options.MaxBodyBytes)
+	}
+
+	if options.CacheTTL < 0 || options.CacheMaxBytes < 0 {
+		return errors.New("the cache TTL and maximum size must not be negative")
+	}
+
+	if options.CacheTTL > 0 && options.CacheMaxBytes == 0 {
+		options.CacheMaxBytes = DefaultCacheMaxBytes
+	}
+
+	if options.MaxResponseBytes < 0 {
+		return fmt.Errorf("invalid maximum response size: %d (must not be negative)", options.MaxResponseBytes)
+	}
+
+	if options.Retries < 0 {
+		return fmt.Errorf("invalid retry count: %d (must not be negative)", options.Retries)
+	}
+
+	if options.BreakerThreshold < 0 {
+		return fmt.Errorf("invalid circuit breaker threshold: %d (must not be negative)", options.BreakerThreshold)
+	}
+
+	if options.MaxIdleConns < 0 || options.MaxIdleConnsPerHost < 0 || options.IdleConnTimeout < 0 {
+		return errors.New("the idle connection limits and timeout must not be negative")
+	}
+
+	if options.BreakerWindow == 0 {
+		options.BreakerWindow = DefaultBreakerWindow
+	}
+
+	if options.BreakerCooldown == 0 {
+		options.BreakerCooldown = DefaultBreakerCooldown
+	}
+
+	if options.BreakerWindow < 0 || options.BreakerCooldown < 0 {
+		return errors.New("the circuit breaker window and cooldown must be greater than zero")
+	}
+
+	if len(options.ViaPseudonym) == 0 {
+		options.ViaPseudonym = DefaultViaPseudonym
+	}
+
+	if len(options.LogFormat) == 0 {
+		options.LogFormat = LogFormatText
+	}
+
+	if options.LogFormat != LogFormatText && options.LogFormat != LogFormatJSON {
+		return fmt.Errorf("invalid log format: %s (must be %q or %q)", options.LogFormat, LogFormatText, LogFormatJSON)
+	}
+
+	if len(options.LogLevel) == 0 {
+		options.LogLevel = LogLevelInfo
+	}
+
+	if _, exists := logVerbosityOf(options.LogLevel); !exists {
+		return fmt.Errorf("invalid log level: %s (must be one of %s)", options.LogLevel, strings.Join(logLevels, ", "))
+	}
+
+	if len(options.TimeWindowZone) == 0 {
+		options.TimeWindowZone = DefaultTimeWindowZone
+	}
+
+	if _, err := time.LoadLocation(options.TimeWindowZone); err != nil {
+		return fmt.Errorf("invalid time window zone: %s", options.TimeWindowZone)
+	}
+
+	if len(options.CORSAllowedOrigins) == 0 && (len(options.CORSAllowedMethods) > 0 || len(options.CORSAllowedHeaders) > 0) {
+		return errors.New("the CORS methods and headers require allowed origins")
+	}
+
+	if len(options.CORSAllowedOrigins) > 0 && len(options.CORSAllowedMethods) == 0 {
+		options.CORSAllowedMethods = supportedHTTPMethods
+	}
+
+	var corsMethods []string = []string{}
+	for _, method := range options.CORSAllowedMethods {
+		if !funk.ContainsString(supportedHTTPMethods, normalizeMethod(method)) {
+			return fmt.Errorf("invalid CORS method: %s", method)
+		}
+
+		corsMethods = append(corsMethods, normalizeMethod(method))
+	}
+
+	options.CORSAllowedMethods = corsMethods
+
+	if options.SocketMode > 0777 {
+		return fmt.Errorf("invalid socket mode: %#o (must be permission bits such as 0660)", options.SocketMode)
+	}
+
+	if (len(options.TLSCertificatePath) > 0) != (len(options.TLSKeyPath) > 0) {
+		return errors.New("a TLS certificate and key must be provided together")
+	}
+
+	if len(options.TLSCertificatePath) > 0 {
+		if _, isUnixSocket := unixSocketPathOf(options.ExposedAddress); isUnixSocket {
+			return errors.New("TLS can only be used when the exposed address is a tcp:// address")
+		}
+	} else if len(options.ClientCAPath) > 0 {
+		return errors.New("client certificate authorities can only be used together with a TLS certificate and key")
+	}
+
+	if options.AdminProfiling && len(options.AdminSocketPath) == 0 {
+		return errors.New("profiling can only be enabled together with the admin socket")
+	}
+
+	return nil
+}
+
+// New : Creates a Veil from the options, loading its access rules list and
+// binding the exposed socket so that it is ready to serve requests
+func New(options Options) (*Veil, error) {
+	if err := validateOptions(&options); err != nil {
+		return nil, err
+	}
+
+	setLogLevel(options.LogLevel)
+
+	if options.WaitForTarget > 0 {
+		logInfo("Waiting up to", options.WaitForTarget, "for target socket", strings.Join(options.TargetSocketPaths, ", "))
+		if err := waitForTargetSocket(options.TargetSocketPaths, options.WaitForTarget); err != nil {
+			return nil, err
+		}
+	}
+
+	var serverTLSConfig *tls.Config
+	if len(options.TLSCertificatePath) > 0 {
+		var errTLS error
+		serverTLSConfig, errTLS = createServerTLSConfig(options.TLSCertificatePath, options.TLSKeyPath)
+		if errTLS != nil {
+			return nil, fmt.Errorf("unable to load TLS certificate: %v", errTLS)
+		}
+
+		if len(options.ClientCAPath) > 0 {
+			if err := requireClientCertificates(serverTLSConfig, options.ClientCAPath); err != nil {
+				return nil, fmt.Errorf("unable to load client certificate authorities: %v", err)
+			}
+		}
+	}
+
+	var responseHeaders []responseHeader
+	if len(options.ResponseHeadersPath) > 0 {
+		var errHeaders error
+		responseHeaders, errHeaders = loadResponseHeaders(options.ResponseHeadersPath)
+		if errHeaders != nil {
+			return nil, fmt.Errorf("unable to load response headers: %v", errHeaders)
+		}
+	}
+
+	timeWindowLocation, errLocation := time.LoadLocation(options.TimeWindowZone)
+	if errLocation != nil {
+		return nil, fmt.Errorf("unable to load time window zone: %v", errLocation)
+	}
+
+	var v *Veil = &Veil{
+		options:            options,
+		handler:            &reloadableHandler{},
+		dryRun:             options.DryRun,
+		timeWindowLocation: timeWindowLocation,
+		counters:           &relayCounters{},
+		stopWatching:       make(chan struct{}),
+	}
+
+	var relaySettings relayOptions = relayOptions{
+		requestTimeout:         options.RequestTimeout,
+		dialTimeout:            options.DialTimeout,
+		strippedRequestHeaders: options.StrippedRequestHeaders,
+		maxConcurrentRequests:  options.MaxConcurrentRequests,
+		maxBodyBytes:           options.MaxBodyBytes,
+		maxResponseBytes:       options.MaxResponseBytes,
+		retries:                options.Retries,
+		breakerThreshold:       options.BreakerThreshold,
+		breakerWindow:          options.BreakerWindow,
+		breakerCooldown:        options.BreakerCooldown,
+		maxIdleConns:           options.MaxIdleConns,
+		maxIdleConnsPerHost:    options.MaxIdleConnsPerHost,
+		idleConnTimeout:        options.IdleConnTimeout,
+		counters:               v.counters,
+		viaPseudonym:           options.ViaPseudonym,
+		compressResponses:      options.CompressResponses,
+		decompressRequests:     options.DecompressRequests,
+		headFromGet:            options.HeadFromGet,
+		responseHeaders:        responseHeaders,
+	}
+
+	v.upstreams = newTargetUpstreams(options.TargetSocketPaths, relaySettings)
+	v.relay = obtainSocketRequestHandler(v.upstreams, relaySettings)
+
+	if options.CacheTTL > 0 {
+		v.relay = withResponseCache(newResponseCache(options.CacheTTL, options.CacheMaxBytes), v.relay)
+	}
+
+	accessRules, errRules := v.loadAccessRules()
+	if errRules != nil {
+		return nil, fmt.Errorf("unable to load access rules: %v", errRules)
+	}
+
+	v.applyAccessRules(accessRules)
+
+	var templates errorTemplates
+	if len(options.ErrorTemplatesPath) > 0 {
+		var errTemplates error
+		templates, errTemplates = loadErrorTemplates(options.ErrorTemplatesPath)
+		if errTemplates != nil {
+			return nil, fmt.Errorf("unable to load error templates: %v", errTemplates)
+		}
+	}
+
+	var servedHandler http.Handler = v.handler
+	if options.Rate > 0 {
+		var burst int = options.Burst
+		if burst == 0 {
+			burst = int(math.Ceil(options.Rate))
+		}
+
+		servedHandler = withRateLimit(rate.NewLimiter(rate.Limit(options.Rate), burst), servedHandler)
+	}
+
+	if options.UIDRate > 0 {
+		var burst int = options.UIDBurst
+		if burst == 0 {
+			burst = int(math.Ceil(options.UIDRate))
+		}
+
+		servedHandler = withUIDRateLimit(newUIDRateLimiter(rate.Limit(options.UIDRate), burst), servedHandler)
+	}
+
+	allowedNetworks, err := parseCIDRBlocks(options.AllowedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	servedHandler = withPanicRecovery(servedHandler)
+	if len(options.MetricsAddress) > 0 {
+		metrics := newRelayMetrics()
+		metricsListener, err := listenOnAddress(options.MetricsAddress)
+		if err != nil {
+			return nil, fmt.Errorf("unable to listen on metrics address %s: %v", options.MetricsAddress, err)
+		}
+
+		v.metricsListener = metricsListener
+		v.metricsServer = &http.Server{Handler: metrics.handler()}
+		servedHandler = metrics.instrument(servedHandler)
+	}
+
+	if len(options.AdminSocketPath) > 0 {
+		adminListener, err := createUnixSocketListener(options.AdminSocketPath, unixSocketOptions{mode: adminSocketMode})
+		if err != nil {
+			if v.metricsListener != nil {
+				v.metricsListener.Close()
+			}
+
+			return nil, fmt.Errorf("unable to listen on admin socket %s: %v", options.AdminSocketPath, err)
+		}
+
+		v.adminListener = adminListener
+		v.adminServer = &http.Server{Handler: v.adminHandler()}
+		v.stats = newRelayStats()
+		servedHandler = v.stats.instrument(servedHandler)
+	}
+
+	if len(options.CORSAllowedOrigins) > 0 {
+		servedHandler = withCORS(corsPolicy{
+			allowedOrigins: options.CORSAllowedOrigins,
+			allowedMethods: options.CORSAllowedMethods,
+			allowedHeaders: options.CORSAllowedHeaders,
+		}, servedHandler)
+	}
+
+	if options.Tracing {
+		tracerProvider, err := newTracerProvider(context.Background())
+		if err != nil {
+			if v.metricsListener != nil {
+				v.metricsListener.Close()
+			}
+
+			if v.adminListener != nil {
+				v.adminListener.Close()
+			}
+
+			return nil, fmt.Errorf("unable to set up tracing: %v", err)
+		}
+
+		v.tracerProvider = tracerProvider
+		servedHandler = withTracing(tracerProvider.Tracer(tracerName), servedHandler)
+	}
+
+	servedHandler = withRequestID(withAccessLog(options.LogFormat, servedHandler))
+
+	var exposedHandler http.Handler = withErrorTemplates(templates, withHealthEndpoint(options.HealthPath, options.TargetSocketPaths, servedHandler))
+
+	// Client addresses are checked before anything else answers, so that the
+	// health endpoint and CORS preflights are also refused to other clients
+	if len(allowedNetworks) > 0 {
+		exposedHandler = withAllowedCIDRs(allowedNetworks, exposedHandler)
+	}
+
+	v.server = &http.Server{
+		Handler:     exposedHandler,
+		ConnContext: withPeerCredentials,
+	}
+
+	// A socket passed by systemd is served in place of the exposed address,
+	// with systemd managing its file and permissions
+	exposedListener, errListen := systemdListener()
+	if exposedListener != nil {
+		logInfo("Serving on the socket passed by systemd")
+	} else if errListen == nil {
+		exposedListener, errListen = createListener(options.ExposedAddress, unixSocketOptions{
+			mode:  options.SocketMode,
+			owner: options.SocketOwner,
+			group: options.SocketGroup,
+		})
+	}
+
+	if errListen != nil {
+		if v.metricsListener != nil {
+			v.metricsListener.Close()
+		}
+
+		if v.adminListener != nil {
+			v.adminListener.Close()
+		}
+
+		return nil, fmt.Errorf("unable to listen on exposed address %s: %v", options.ExposedAddress, errListen)
+	}
+
+	if serverTLSConfig != nil {
+		exposedListener = tls.NewListener(exposedListener, serverTLSConfig)
+	}
+
+	v.listener = exposedListener
+
+	if len(options.User) > 0 || len(options.Group) > 0 {
+		if err := dropPrivileges(options.User, options.Group); err != nil {
+			v.listener.Close()
+			if v.metricsListener != nil {
+				v.metricsListener.Close()
+			}
+
+			if v.adminListener != nil {
+				v.adminListener.Close()
+			}
+
+			return nil, fmt.Errorf("unable to drop privileges: %v", err)
+		}
+
+		logInfo("Running as user", os.Getuid(), "and group", os.Getgid())
+	}
+
+	return v, nil
+}
+
+// Serve : Serves requests arriving on the exposed socket, along with the
+// metrics and admin API if enabled, until the Veil is shut down. It returns nil once
+// Shutdown has been called.
+func (v *Veil) Serve() error {
+	if v.metricsServer != nil {
+		go func() {
+			if err := v.metricsServer.Serve(v.metricsListener); err != nil && err != http.ErrServerClosed {
+				logError("Metrics server stopped:", err)
+			}
+		}()
+	}
+
+	if v.adminServer != nil {
+		go func() {
+			if err := v.adminServer.Serve(v.adminListener); err != nil && err != http.ErrServerClosed {
+				logError("Admin server stopped:", err)
+			}
+		}()
+	}
+
+	if v.options.WatchAccessRules {
+		go v.watchAccessRulesFile()
+	}
+
+	if v.options.TargetHealthInterval > 0 {
+		for _, upstream := range v.upstreams {
+			go v.watchTargetHealth(upstream)
+		}
+	}
+
+	// The exposed socket is bound and the access rules loaded, so clients may
+	// already connect
+	if err := systemdNotify(systemdReadyState); err != nil {
+		logError("Unable to notify systemd of readiness:", err)
+	}
+
+	if err := v.server.Serve(v.listener); err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+// Shutdown : Stops accepting new connections, removing the exposed socket file
+// unless systemd created it, and waits for outstanding requests to complete
+// until the context is done
+func (v *Veil) Shutdown(ctx context.Context) error {
+	v.stopOnce.Do(func() {
+		close(v.stopWatching)
+	})
+
+	if err := systemdNotify(systemdStoppingState); err != nil {
+		logError("Unable to notify systemd of shutdown:", err)
+	}
+
+	var errShutdown error = v.server.Shutdown(ctx)
+	if v.metricsServer != nil {
+		v.metricsServer.Close()
+	}
+
+	if v.adminServer != nil {
+		v.adminServer.Close()
+	}
+
+	// Spans still awaiting export are flushed before the veil exits
+	if v.tracerProvider != nil {
+		if err := v.tracerProvider.Shutdown(ctx); err != nil {
+			logError("Unable to flush traces:", err)
+		}
+	}
+
+	// The exposed socket file is removed as its listener closes, which the
+	// server has already done unless the Veil was never served
+	v.listener.Close()
+
+	return errShutdown
+}
+
+// loadAccessRules : Loads the access rules list as governed by the options
+func (v *Veil) loadAccessRules() (*AccessRules, error) {
+	accessRules, readPaths, err := loadAccessRules(v.options.AccessRulesPath, v.options.AccessRulesFormat, v.options.LenientAccessRules, v.options.AccessRuleDelimiter, v.options.MethodAliases)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAccessRules(accessRules, readPaths, routingOptions{
+		strictTrailingSlash:   v.options.StrictTrailingSlash,
+		implicitHead:          v.options.ImplicitHead,
+		defaultAllow:          v.options.DefaultAllow,
+		timeWindowLocation:    v.timeWindowLocation,
+		maxValidatedBodyBytes: v.options.MaxBodyBytes,
+	}), nil
+}
+
+// applyAccessRules : Makes the access rules govern subsequent requests
+func (v *Veil) applyAccessRules(accessRules *AccessRules) {
+	v.accessRulesMutex.Lock()
+	defer v.accessRulesMutex.Unlock()
+
+	v.accessRules = accessRules
+	v.swapRouter()
+}
+
+// swapRouter : Routes subsequent requests according to the access rules and
+// dry-run mode currently in effect. The access rules mutex must be held.
+func (v *Veil) swapRouter() {
+	var router http.Handler = createAccessRulesRouter(v.accessRules.rules, v.accessRules.routing, v.relay)
+	if v.dryRun {
+		router = withDryRun(v.relay, router)
+	}
+
+	v.handler.swap(router)
+}
+
+// currentAccessRules : Returns the access rules currently in effect
+func (v *Veil) currentAccessRules() *AccessRules {
+	v.accessRulesMutex.RLock()
+	defer v.accessRulesMutex.RUnlock()
+
+	return v.accessRules
+}
+
+// isDryRun : Reports whether requests are currently relayed regardless of the
+// access rules
+func (v *Veil) isDryRun() bool {
+	v.accessRulesMutex.RLock()
+	defer v.accessRulesMutex.RUnlock()
+
+	return v.dryRun
+}
+
+// setDryRun : Switches dry-run mode on or off for subsequent requests
+func (v *Veil) setDryRun(enabled bool) {
+	v.accessRulesMutex.Lock()
+	defer v.accessRulesMutex.Unlock()
+
+	v.dryRun = enabled
+	v.swapRouter()
+}
+
+// MatchRequest : Returns the access decision that the access rules currently in
+// effect make for a request with the method and path, without relaying it
+func (v *Veil) MatchRequest(method string, path string) string {
+	return v.currentAccessRules().Match(method, path)
+}
@@ -0,0 +1,423 @@
+/*
+ * Copyright © 2020 Anurag Dulapalli
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ */
+
+package veil
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startTestVeil : Creates a Veil with the given options and serves it until
+// the test ends
+func startTestVeil(t *testing.T, options Options) *Veil {
+	t.Helper()
+
+	v, err := New(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var served chan error = make(chan error, 1)
+	go func() {
+		served <- v.Serve()
+	}()
+
+	t.Cleanup(func() {
+		v.Shutdown(context.Background())
+		if err := <-served; err != nil {
+			t.Error("Serve returned", err)
+		}
+	})
+
+	return v
+}
+
+// writeTestAccessRules : Writes an access rules list in the text format,
+// returning its path
+func writeTestAccessRules(t *testing.T, contents string) string {
+	t.Helper()
+
+	var accessRulesPath string = filepath.Join(t.TempDir(), "rules.txt")
+	if err := os.WriteFile(accessRulesPath, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return accessRulesPath
+}
+
+// newVeilClient : Returns a client whose every request is sent to the address
+// the Veil listens on, whichever transport it uses
+func newVeilClient(v *Veil) *http.Client {
+	var address net.Addr = v.listener.Addr()
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, address.Network(), address.String())
+			},
+		},
+	}
+}
+
+// requestStatus : Makes a request through the client, returning the status of
+// the response
+func requestStatus(t *testing.T, client *http.Client, method string, requestURI string) int {
+	t.Helper()
+
+	request, err := http.NewRequest(method, "http://veil"+requestURI, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	return response.StatusCode
+}
+
+// awaitStatus : Repeats a request through the client until it is answered with
+// the expected status, failing the test if that takes longer than the timeout
+func awaitStatus(t *testing.T, client *http.Client, method string, requestURI string, expectedStatus int, timeout time.Duration) {
+	t.Helper()
+
+	var deadline time.Time = time.Now().Add(timeout)
+	for {
+		var status int = requestStatus(t, client, method, requestURI)
+		if status == expectedStatus {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected status %d for %s within %v, got %d", expectedStatus, requestURI, timeout, status)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestExposedTransports(t *testing.T) {
+	targetSocketPath, requestURIs := recordingTargetSocket(t)
+	var accessRulesPath string = writeTestAccessRules(t, "GET~/v2/snaps\n")
+
+	testCases := []struct {
+		name           string
+		exposedAddress string
+	}{
+		{name: "tcp", exposedAddress: "tcp://127.0.0.1:0"},
+		{name: "unix", exposedAddress: "unix://" + filepath.Join(t.TempDir(), "veil.sock")},
+		{name: "unix without scheme", exposedAddress: filepath.Join(t.TempDir(), "veil.sock")},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var v *Veil = startTestVeil(t, Options{
+				TargetSocketPath: targetSocketPath,
+				ExposedAddress:   testCase.exposedAddress,
+				AccessRulesPath:  accessRulesPath,
+			})
+
+			var client *http.Client = newVeilClient(v)
+			for requestURI, expectedStatus := range map[string]int{"/v2/snaps": http.StatusOK, "/v2/secret": http.StatusNotFound} {
+				if status := requestStatus(t, client, http.MethodGet, requestURI); status != expectedStatus {
+					t.Errorf("expected status %d for %s, got %d", expectedStatus, requestURI, status)
+				}
+			}
+
+			if upstreamRequestURI := <-requestURIs; upstreamRequestURI != "/v2/snaps" {
+				t.Errorf("expected the target socket to receive /v2/snaps, got %q", upstreamRequestURI)
+			}
+		})
+	}
+}
+
+func TestNewRejectsInvalidOptions(t *testing.T) {
+	targetSocketPath, _ := recordingTargetSocket(t)
+	var accessRulesPath string = writeTestAccessRules(t, "GET~/v2/snaps\n")
+
+	testCases := []struct {
+		name    string
+		options func(options *Options)
+	}{
+		{name: "missing target socket", options: func(options *Options) { options.TargetSocketPath = "" }},
+		{name: "missing access rules", options: func(options *Options) { options.AccessRulesPath = "" }},
+		{name: "unreadable access rules", options: func(options *Options) { options.AccessRulesPath = filepath.Join(t.TempDir(), "missing.txt") }},
+		{name: "negative timeout", options: func(options *Options) { options.RequestTimeout = -1 }},
+		{name: "negative rate", options: func(options *Options) { options.Rate = -1 }},
+		{name: "negative retries", options: func(options *Options) { options.Retries = -1 }},
+		{name: "negative dial timeout", options: func(options *Options) { options.DialTimeout = -1 }},
+		{name: "negative maximum response size", options: func(options *Options) { options.MaxResponseBytes = -1 }},
+		{name: "relative target health path", options: func(options *Options) { options.TargetHealthPath = "healthz" }},
+		{name: "unknown log level", options: func(options *Options) { options.LogLevel = "verbose" }},
+		{name: "invalid CIDR block", options: func(options *Options) { options.AllowedCIDRs = []string{"10.0.0.0/33"} }},
+		{name: "socket mode beyond permission bits", options: func(options *Options) { options.SocketMode = 01777 }},
+		{name: "TLS certificate without key", options: func(options *Options) { options.TLSCertificatePath = "veil.crt" }},
+		{name: "TLS on a socket", options: func(options *Options) { options.TLSCertificatePath, options.TLSKeyPath = "veil.crt", "veil.key" }},
+		{name: "client CA without TLS", options: func(options *Options) { options.ClientCAPath = "ca.pem" }},
+		{name: "profiling without admin socket", options: func(options *Options) { options.AdminProfiling = true }},
+		{name: "CORS methods without origins", options: func(options *Options) { options.CORSAllowedMethods = []string{http.MethodGet} }},
+		{name: "invalid CORS method", options: func(options *Options) {
+			options.CORSAllowedOrigins, options.CORSAllowedMethods = []string{"*"}, []string{"FETCH"}
+		}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var options Options = Options{
+				TargetSocketPath: targetSocketPath,
+				ExposedAddress:   filepath.Join(t.TempDir(), "veil.sock"),
+				AccessRulesPath:  accessRulesPath,
+			}
+
+			testCase.options(&options)
+			if v, err := New(options); err == nil {
+				v.Shutdown(context.Background())
+				t.Fatal("expected the options to be rejected")
+			}
+		})
+	}
+}
+
+func TestWaitForTarget(t *testing.T) {
+	var accessRulesPath string = writeTestAccessRules(t, "GET~/v2/snaps\n")
+
+	testCases := []struct {
+		name          string
+		appears       bool
+		appearsAfter  time.Duration
+		waitForTarget time.Duration
+	}{
+		{name: "already listening", appears: true, waitForTarget: time.Second},
+		{name: "appears within the window", appears: true, appearsAfter: 300 * time.Millisecond, waitForTarget: 5 * time.Second},
+		{name: "never appears", appears: false, waitForTarget: 300 * time.Millisecond},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			// As for startTargetSocket, the directory is kept short
+			socketDirectory, err := os.MkdirTemp("", "veil")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(socketDirectory)
+
+			var targetSocketPath string = filepath.Join(socketDirectory, "target.sock")
+			var serveTarget func() = func() {
+				if listener, err := net.Listen("unix", targetSocketPath); err == nil {
+					var server *http.Server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+					go server.Serve(listener)
+					t.Cleanup(func() { server.Close() })
+				}
+			}
+
+			if testCase.appears && testCase.appearsAfter == 0 {
+				serveTarget()
+			} else if testCase.appears {
+				var appeared *time.Timer = time.AfterFunc(testCase.appearsAfter, serveTarget)
+				defer appeared.Stop()
+			}
+
+			var startTime time.Time = time.Now()
+			v, err := New(Options{
+				TargetSocketPath: targetSocketPath,
+				ExposedAddress:   "tcp://127.0.0.1:0",
+				AccessRulesPath:  accessRulesPath,
+				WaitForTarget:    testCase.waitForTarget,
+			})
+			if err == nil {
+				defer v.Shutdown(context.Background())
+			}
+
+			if !testCase.appears {
+				if err == nil {
+					t.Fatal("expected New to give up waiting for the target socket")
+				}
+
+				if elapsed := time.Since(startTime); elapsed < testCase.waitForTarget/2 {
+					t.Errorf("expected New to wait for the target socket, gave up after %v", elapsed)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if elapsed := time.Since(startTime); elapsed < testCase.appearsAfter {
+				t.Errorf("expected New to wait %v for the target socket, returned after %v", testCase.appearsAfter, elapsed)
+			}
+		})
+	}
+}
+
+func TestShutdownDrainsOutstandingRequests(t *testing.T) {
+	var started chan struct{} = make(chan struct{})
+	var release chan struct{} = make(chan struct{})
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	}))
+
+	var exposedSocketPath string = filepath.Join(t.TempDir(), "veil.sock")
+	var v *Veil = startTestVeil(t, Options{
+		TargetSocketPath: targetSocketPath,
+		ExposedAddress:   exposedSocketPath,
+		AccessRulesPath:  writeTestAccessRules(t, "POST~/v2/snaps\n"),
+	})
+
+	var client *http.Client = newVeilClient(v)
+	var slowStatus chan int = make(chan int, 1)
+	go func() {
+		response, err := client.Post("http://veil/v2/snaps", "application/json", nil)
+		if err != nil {
+			t.Error(err)
+			slowStatus <- 0
+			return
+		}
+
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if string(body) != "done" {
+			t.Errorf("expected the slow request to complete, got body %q", body)
+		}
+		slowStatus <- response.StatusCode
+	}()
+	<-started
+
+	var shutDown chan error = make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutDown <- v.Shutdown(ctx)
+	}()
+
+	// New connections are refused as soon as the exposed socket is closed,
+	// while the slow request is still outstanding
+	var deadline time.Time = time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("unix", exposedSocketPath)
+		if err != nil {
+			break
+		}
+		conn.Close()
+
+		if time.Now().After(deadline) {
+			t.Fatal("expected new connections to be refused once shutting down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := os.Stat(exposedSocketPath); !os.IsNotExist(err) {
+		t.Errorf("expected the exposed socket file to be removed, got %v", err)
+	}
+
+	select {
+	case err := <-shutDown:
+		t.Fatalf("expected shutdown to wait for the slow request, returned %v", err)
+	default:
+	}
+
+	close(release)
+	if status := <-slowStatus; status != http.StatusOK {
+		t.Errorf("expected the slow request to complete with status 200, got %d", status)
+	}
+
+	if err := <-shutDown; err != nil {
+		t.Errorf("expected shutdown to complete, got %v", err)
+	}
+}
+
+func TestEmbeddedVeil(t *testing.T) {
+	var targetSocketPath string = startTargetSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"path":"`+r.URL.Path+`"}`)
+	}))
+
+	v, err := New(Options{
+		TargetSocketPath: targetSocketPath,
+		ExposedAddress:   filepath.Join(t.TempDir(), "veil.sock"),
+		AccessRulesPath:  writeTestAccessRules(t, "GET~/v2/snaps/*\n!GET~/v2/snaps/core\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var served chan error = make(chan error, 1)
+	go func() {
+		served <- v.Serve()
+	}()
+
+	var client *http.Client = newVeilClient(v)
+	testCases := []struct {
+		requestURI     string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{requestURI: "/v2/snaps/hello", expectedStatus: http.StatusOK, expectedBody: `{"path":"/v2/snaps/hello"}`},
+		{requestURI: "/v2/snaps/core", expectedStatus: http.StatusUnauthorized},
+		{requestURI: "/v2/apps", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.requestURI, func(t *testing.T) {
+			response, err := client.Get("http://veil" + testCase.requestURI)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body, err := io.ReadAll(response.Body)
+			response.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.StatusCode != testCase.expectedStatus {
+				t.Errorf("expected status %d, got %d", testCase.expectedStatus, response.StatusCode)
+			}
+
+			if len(testCase.expectedBody) > 0 && string(body) != testCase.expectedBody {
+				t.Errorf("expected the body %q, got %q", testCase.expectedBody, body)
+			}
+		})
+	}
+
+	if err := v.Shutdown(context.Background()); err != nil {
+		t.Errorf("expected shutdown to succeed, got %v", err)
+	}
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("expected Serve to return nil once shut down, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Serve to return once shut down")
+	}
+}